@@ -95,6 +95,12 @@ type ProvisionController struct {
 	classSource      cache.ListerWatcher
 	classReflector   *cache.Reflector
 
+	// Claims are watched in these namespaces only, by a controller per
+	// namespace instead of claimController. Empty to watch claims of all
+	// namespaces.
+	namespaces      []string
+	namespaceClaims []cache.Controller
+
 	volumes cache.Store
 	claims  cache.Store
 	classes cache.Store
@@ -128,6 +134,14 @@ type ProvisionController struct {
 	leaderElectors      map[types.UID]*leaderelection.LeaderElector
 	leaderElectorsMutex *sync.Mutex
 
+	// Restricts provisioning to claims of some storage classes, nil to
+	// serve all classes
+	classFilter func(class metav1.Object) bool
+
+	// Bound the number of concurrent Provision and Delete calls separately,
+	// so that a backlog of slow deletes does not hold up provisioning
+	provisionWorkers, deleteWorkers *workerPool
+
 	hasRun     bool
 	hasRunLock *sync.Mutex
 }
@@ -265,6 +279,58 @@ func TermLimit(termLimit time.Duration) func(*ProvisionController) error {
 	}
 }
 
+// StorageClassFilter restricts provisioning to claims of storage classes for
+// which filter returns true, so that classes of one provisioner can be split
+// between several controllers. By default claims of all classes are served.
+func StorageClassFilter(filter func(class metav1.Object) bool) func(*ProvisionController) error {
+	return func(c *ProvisionController) error {
+		if c.HasRun() {
+			return errRuntime
+		}
+		c.classFilter = filter
+		return nil
+	}
+}
+
+// Namespaces restricts provisioning to claims in the given namespaces, and
+// deletion to volumes bound to claims in them, so that the controller needs
+// access to claims of those namespaces only. By default claims of all
+// namespaces are served.
+func Namespaces(namespaces []string) func(*ProvisionController) error {
+	return func(c *ProvisionController) error {
+		if c.HasRun() {
+			return errRuntime
+		}
+		c.namespaces = namespaces
+		return nil
+	}
+}
+
+// ProvisionWorkers limits the number of Provision calls running at once,
+// further claims wait for a free worker. 0 for no limit. Defaults to 0.
+func ProvisionWorkers(workers int) func(*ProvisionController) error {
+	return func(c *ProvisionController) error {
+		if c.HasRun() {
+			return errRuntime
+		}
+		c.provisionWorkers = newWorkerPool(workers)
+		return nil
+	}
+}
+
+// DeleteWorkers limits the number of Delete calls running at once, further
+// volumes wait for a free worker. Deletes never take provisioning workers.
+// 0 for no limit. Defaults to 0.
+func DeleteWorkers(workers int) func(*ProvisionController) error {
+	return func(c *ProvisionController) error {
+		if c.HasRun() {
+			return errRuntime
+		}
+		c.deleteWorkers = newWorkerPool(workers)
+		return nil
+	}
+}
+
 // NewProvisionController creates a new provision controller
 func NewProvisionController(
 	client kubernetes.Interface,
@@ -310,6 +376,8 @@ func NewProvisionController(
 		termLimit:                     defaultTermLimit,
 		leaderElectors:                make(map[types.UID]*leaderelection.LeaderElector),
 		leaderElectorsMutex:           &sync.Mutex{},
+		provisionWorkers:              newWorkerPool(0),
+		deleteWorkers:                 newWorkerPool(0),
 		hasRun:                        false,
 		hasRunLock:                    &sync.Mutex{},
 	}
@@ -318,24 +386,31 @@ func NewProvisionController(
 		option(controller)
 	}
 
-	controller.claimSource = &cache.ListWatch{
-		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
-			return client.Core().PersistentVolumeClaims(v1.NamespaceAll).List(options)
-		},
-		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
-			return client.Core().PersistentVolumeClaims(v1.NamespaceAll).Watch(options)
-		},
+	claimHandlers := cache.ResourceEventHandlerFuncs{
+		AddFunc:    controller.addClaim,
+		UpdateFunc: controller.updateClaim,
+		DeleteFunc: nil,
+	}
+	if len(controller.namespaces) == 0 {
+		controller.claimSource = claimListWatch(client, v1.NamespaceAll)
+		controller.claims, controller.claimController = cache.NewInformer(
+			controller.claimSource,
+			&v1.PersistentVolumeClaim{},
+			controller.resyncPeriod,
+			claimHandlers,
+		)
+	} else {
+		controller.claims = cache.NewStore(cache.DeletionHandlingMetaNamespaceKeyFunc)
+		for _, namespace := range controller.namespaces {
+			_, claimController := cache.NewInformer(
+				claimListWatch(client, namespace),
+				&v1.PersistentVolumeClaim{},
+				controller.resyncPeriod,
+				claimHandlers,
+			)
+			controller.namespaceClaims = append(controller.namespaceClaims, claimController)
+		}
 	}
-	controller.claims, controller.claimController = cache.NewInformer(
-		controller.claimSource,
-		&v1.PersistentVolumeClaim{},
-		controller.resyncPeriod,
-		cache.ResourceEventHandlerFuncs{
-			AddFunc:    controller.addClaim,
-			UpdateFunc: controller.updateClaim,
-			DeleteFunc: nil,
-		},
-	)
 
 	controller.volumeSource = &cache.ListWatch{
 		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
@@ -398,12 +473,43 @@ func (ctrl *ProvisionController) Run(stopCh <-chan struct{}) {
 	ctrl.hasRunLock.Lock()
 	ctrl.hasRun = true
 	ctrl.hasRunLock.Unlock()
-	go ctrl.claimController.Run(stopCh)
+	if ctrl.claimController != nil {
+		go ctrl.claimController.Run(stopCh)
+	}
+	for _, claimController := range ctrl.namespaceClaims {
+		go claimController.Run(stopCh)
+	}
 	go ctrl.volumeController.Run(stopCh)
 	go ctrl.classReflector.RunUntil(stopCh)
 	<-stopCh
 }
 
+// claimListWatch lists and watches claims of the namespace, of all
+// namespaces for v1.NamespaceAll
+func claimListWatch(client kubernetes.Interface, namespace string) *cache.ListWatch {
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return client.Core().PersistentVolumeClaims(namespace).List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return client.Core().PersistentVolumeClaims(namespace).Watch(options)
+		},
+	}
+}
+
+// namespaceAllowed checks the namespace of a claim against namespaces
+func (ctrl *ProvisionController) namespaceAllowed(namespace string) bool {
+	if len(ctrl.namespaces) == 0 {
+		return true
+	}
+	for _, n := range ctrl.namespaces {
+		if n == namespace {
+			return true
+		}
+	}
+	return false
+}
+
 // HasRun returns whether the controller has Run
 func (ctrl *ProvisionController) HasRun() bool {
 	ctrl.hasRunLock.Lock()
@@ -411,6 +517,22 @@ func (ctrl *ProvisionController) HasRun() bool {
 	return ctrl.hasRun
 }
 
+// QueueDepth is the number of operations of one kind waiting for a worker
+// and running at a given moment.
+type QueueDepth struct {
+	Waiting, Running int
+}
+
+// ProvisionQueue returns the depth of the provisioning queue
+func (ctrl *ProvisionController) ProvisionQueue() QueueDepth {
+	return ctrl.provisionWorkers.depth()
+}
+
+// DeleteQueue returns the depth of the deletion queue
+func (ctrl *ProvisionController) DeleteQueue() QueueDepth {
+	return ctrl.deleteWorkers.depth()
+}
+
 // SetFailedProvisionThreshold sets the value of failedProvisionThreshold
 func (ctrl *ProvisionController) SetFailedProvisionThreshold(threshold int) {
 	ctrl.failedProvisionStatsMutex.Lock()
@@ -441,9 +563,11 @@ func (ctrl *ProvisionController) addClaim(obj interface{}) {
 		if ok && le.IsLeader() {
 			opName := fmt.Sprintf("provision-%s[%s]", claimToClaimKey(claim), string(claim.UID))
 			ctrl.scheduleOperation(opName, func() error {
-				err := ctrl.provisionClaimOperation(claim)
-				ctrl.updateProvisionStats(claim, err)
-				return err
+				return ctrl.provisionWorkers.do(func() error {
+					err := ctrl.provisionClaimOperation(claim)
+					ctrl.updateProvisionStats(claim, err)
+					return err
+				})
 			})
 		} else {
 			opName := fmt.Sprintf("lock-provision-%s[%s]", claimToClaimKey(claim), string(claim.UID))
@@ -501,9 +625,11 @@ func (ctrl *ProvisionController) updateVolume(oldObj, newObj interface{}) {
 	if ctrl.shouldDelete(volume) {
 		opName := fmt.Sprintf("delete-%s[%s]", volume.Name, string(volume.UID))
 		ctrl.scheduleOperation(opName, func() error {
-			err := ctrl.deleteVolumeOperation(volume)
-			ctrl.updateDeleteStats(volume, err)
-			return err
+			return ctrl.deleteWorkers.do(func() error {
+				err := ctrl.deleteVolumeOperation(volume)
+				ctrl.updateDeleteStats(volume, err)
+				return err
+			})
 		})
 	}
 }
@@ -559,12 +685,16 @@ func (ctrl *ProvisionController) shouldProvision(claim *v1.PersistentVolumeClaim
 		return false
 	}
 
+	if !ctrl.namespaceAllowed(claim.Namespace) {
+		return false
+	}
+
 	// Kubernetes 1.5 provisioning with annStorageProvisioner
 	if provisioner, found := claim.Annotations[annStorageProvisioner]; found {
-		if provisioner == ctrl.provisionerName {
-			return true
+		if provisioner != ctrl.provisionerName {
+			return false
 		}
-		return false
+		return ctrl.classAllowed(claim)
 	}
 
 	// Kubernetes 1.4 provisioning, evaluating class.Provisioner
@@ -578,7 +708,24 @@ func (ctrl *ProvisionController) shouldProvision(claim *v1.PersistentVolumeClaim
 		return false
 	}
 
-	return true
+	return ctrl.classAllowed(claim)
+}
+
+// classAllowed checks the claim's storage class against classFilter
+func (ctrl *ProvisionController) classAllowed(claim *v1.PersistentVolumeClaim) bool {
+	if ctrl.classFilter == nil {
+		return true
+	}
+	claimClass := helper.GetPersistentVolumeClaimClass(claim)
+	classObj, found, err := ctrl.classes.GetByKey(claimClass)
+	if err != nil || !found {
+		return false
+	}
+	class, ok := classObj.(metav1.Object)
+	if !ok {
+		return false
+	}
+	return ctrl.classFilter(class)
 }
 
 func (ctrl *ProvisionController) shouldDelete(volume *v1.PersistentVolume) bool {
@@ -612,6 +759,10 @@ func (ctrl *ProvisionController) shouldDelete(volume *v1.PersistentVolume) bool
 		return false
 	}
 
+	if len(ctrl.namespaces) != 0 && (volume.Spec.ClaimRef == nil || !ctrl.namespaceAllowed(volume.Spec.ClaimRef.Namespace)) {
+		return false
+	}
+
 	if ann := volume.Annotations[annDynamicallyProvisioned]; ann != ctrl.provisionerName {
 		return false
 	}
@@ -644,9 +795,11 @@ func (ctrl *ProvisionController) lockProvisionClaimOperation(claim *v1.Persisten
 			OnStartedLeading: func(_ <-chan struct{}) {
 				opName := fmt.Sprintf("provision-%s[%s]", claimToClaimKey(claim), string(claim.UID))
 				ctrl.scheduleOperation(opName, func() error {
-					err := ctrl.provisionClaimOperation(claim)
-					ctrl.updateProvisionStats(claim, err)
-					return err
+					return ctrl.provisionWorkers.do(func() error {
+						err := ctrl.provisionClaimOperation(claim)
+						ctrl.updateProvisionStats(claim, err)
+						return err
+					})
 				})
 			},
 			OnStoppedLeading: func() {
@@ -921,7 +1074,11 @@ func (ctrl *ProvisionController) watchPVC(claim *v1.PersistentVolumeClaim, stopC
 		ResourceVersion: claim.ResourceVersion,
 	}
 
-	pvcWatch, err := ctrl.claimSource.Watch(options)
+	claimSource := ctrl.claimSource
+	if claimSource == nil {
+		claimSource = claimListWatch(ctrl.client, claim.Namespace)
+	}
+	pvcWatch, err := claimSource.Watch(options)
 	if err != nil {
 		return nil, err
 	}
@@ -1091,3 +1248,50 @@ func (ctrl *ProvisionController) getStorageClassFields(name string) (string, map
 func claimToClaimKey(claim *v1.PersistentVolumeClaim) string {
 	return fmt.Sprintf("%s/%s", claim.Namespace, claim.Name)
 }
+
+// workerPool runs operations with at most a fixed number of them at once,
+// the rest block until a worker is free. A pool without workers runs
+// everything immediately.
+type workerPool struct {
+	slots chan struct{}
+
+	mutex            sync.Mutex
+	waiting, running int
+}
+
+func newWorkerPool(workers int) *workerPool {
+	p := &workerPool{}
+	if workers > 0 {
+		p.slots = make(chan struct{}, workers)
+	}
+	return p
+}
+
+func (p *workerPool) do(operation func() error) error {
+	p.mutex.Lock()
+	p.waiting++
+	p.mutex.Unlock()
+
+	if p.slots != nil {
+		p.slots <- struct{}{}
+		defer func() { <-p.slots }()
+	}
+
+	p.mutex.Lock()
+	p.waiting--
+	p.running++
+	p.mutex.Unlock()
+
+	defer func() {
+		p.mutex.Lock()
+		p.running--
+		p.mutex.Unlock()
+	}()
+	return operation()
+}
+
+func (p *workerPool) depth() QueueDepth {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return QueueDepth{Waiting: p.waiting, Running: p.running}
+}
@@ -453,6 +453,144 @@ func TestIsOnlyRecordUpdate(t *testing.T) {
 	}
 }
 
+func TestStorageClassFilter(t *testing.T) {
+	filter := func(class metav1.Object) bool {
+		return class.GetLabels()["shard"] == "a"
+	}
+	tests := []struct {
+		name           string
+		labels         map[string]string
+		expectedShould bool
+	}{
+		{
+			name:           "class of this controller",
+			labels:         map[string]string{"shard": "a"},
+			expectedShould: true,
+		},
+		{
+			name:           "class of another controller",
+			labels:         map[string]string{"shard": "b"},
+			expectedShould: false,
+		},
+		{
+			name:           "unlabeled class",
+			expectedShould: false,
+		},
+	}
+	for _, test := range tests {
+		claim := newClaim("claim-1", "1-1", "class-1", "", nil)
+		client := fake.NewSimpleClientset(claim)
+		ctrl := newTestProvisionController(client, "foo.bar/baz", newTestProvisioner(), "v1.5.0")
+		StorageClassFilter(filter)(ctrl)
+
+		class := newStorageClass("class-1", "foo.bar/baz")
+		class.Labels = test.labels
+		if err := ctrl.classes.Add(class); err != nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("error adding class %v to cache: %v", class, err)
+		}
+
+		should := ctrl.shouldProvision(claim)
+		if test.expectedShould != should {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected should provision %v but got %v\n", test.expectedShould, should)
+		}
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	tests := []struct {
+		name           string
+		namespace      string
+		expectedShould bool
+	}{
+		{
+			name:           "namespace of this controller",
+			namespace:      v1.NamespaceDefault,
+			expectedShould: true,
+		},
+		{
+			name:           "another namespace",
+			namespace:      "secure",
+			expectedShould: false,
+		},
+	}
+	for _, test := range tests {
+		claim := newClaim("claim-1", "1-1", "class-1", "", nil)
+		claim.Namespace = test.namespace
+		client := fake.NewSimpleClientset(claim)
+		ctrl := newTestProvisionController(client, "foo.bar/baz", newTestProvisioner(), "v1.5.0")
+		Namespaces([]string{v1.NamespaceDefault, "kube-system"})(ctrl)
+		ctrl.classes.Add(newStorageClass("class-1", "foo.bar/baz"))
+
+		should := ctrl.shouldProvision(claim)
+		if test.expectedShould != should {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected should provision %v but got %v\n", test.expectedShould, should)
+		}
+
+		volume := newVolume("volume-1", v1.VolumeReleased, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "foo.bar/baz"})
+		volume.Spec.ClaimRef = &v1.ObjectReference{Namespace: test.namespace, Name: claim.Name}
+		should = ctrl.shouldDelete(volume)
+		if test.expectedShould != should {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected should delete %v but got %v\n", test.expectedShould, should)
+		}
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	ctrl := newTestProvisionController(client, "foo.bar/baz", newTestProvisioner(), "v1.5.0")
+	ProvisionWorkers(1)(ctrl)
+	DeleteWorkers(1)(ctrl)
+
+	release := make(chan struct{})
+	started := make(chan struct{}, 3)
+	block := func() error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}
+	done := make(chan struct{}, 3)
+	for i := 0; i < 2; i++ {
+		go func() {
+			ctrl.deleteWorkers.do(block)
+			done <- struct{}{}
+		}()
+	}
+	<-started
+
+	// A stuck delete must not hold up provisioning
+	go func() {
+		ctrl.provisionWorkers.do(block)
+		done <- struct{}{}
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("provisioning waited for the delete workers")
+	}
+
+	for i := 0; i < 50 && ctrl.DeleteQueue().Waiting != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if depth := ctrl.DeleteQueue(); depth != (QueueDepth{Waiting: 1, Running: 1}) {
+		t.Errorf("expected delete queue %+v but got %+v", QueueDepth{Waiting: 1, Running: 1}, depth)
+	}
+	if depth := ctrl.ProvisionQueue(); depth != (QueueDepth{Running: 1}) {
+		t.Errorf("expected provision queue %+v but got %+v", QueueDepth{Running: 1}, depth)
+	}
+
+	close(release)
+	for i := 0; i < 3; i++ {
+		<-done
+	}
+	if depth := ctrl.DeleteQueue(); depth != (QueueDepth{}) {
+		t.Errorf("expected empty delete queue but got %+v", depth)
+	}
+}
+
 func newTestProvisionController(
 	client kubernetes.Interface,
 	provisionerName string,
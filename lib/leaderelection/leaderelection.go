@@ -128,10 +128,12 @@ func (le *LeaderElector) Run(task <-chan bool) {
 	stop := make(chan struct{})
 	go le.config.Callbacks.OnStartedLeading(stop)
 	timeout := make(chan bool, 1)
-	go func() {
-		time.Sleep(le.config.TermLimit)
-		timeout <- true
-	}()
+	if le.config.TermLimit > 0 {
+		go func() {
+			time.Sleep(le.config.TermLimit)
+			timeout <- true
+		}()
+	}
 	le.renew(task, timeout)
 	close(stop)
 	le.config.Callbacks.OnStoppedLeading()
@@ -148,6 +150,26 @@ func (le *LeaderElector) IsLeader() bool {
 	return le.observedRecord.HolderIdentity == le.config.Lock.Identity()
 }
 
+// Release gives up the lease if this client holds it, so that other
+// candidates can acquire it without waiting for it to expire. It is meant
+// to be called after Run returns.
+func (le *LeaderElector) Release() error {
+	record, err := le.config.Lock.Get()
+	if err != nil {
+		return err
+	}
+	if record.HolderIdentity != le.config.Lock.Identity() {
+		return nil
+	}
+	record.HolderIdentity = ""
+	record.RenewTime = metav1.Now()
+	if err := le.config.Lock.Update(*record); err != nil {
+		return err
+	}
+	le.config.Lock.RecordEvent("released lease")
+	return nil
+}
+
 // acquire loops calling tryAcquireOrRenew and returns immediately when tryAcquireOrRenew succeeds
 // or the task has successfully finished in which case there is no longer a need to acquire
 func (le *LeaderElector) acquire(task <-chan bool) bool {
@@ -254,7 +276,9 @@ func (le *LeaderElector) tryAcquireOrRenew() bool {
 		le.observedRecord = *oldLeaderElectionRecord
 		le.observedTime = time.Now()
 	}
+	// a released lock is free right away
 	if le.observedTime.Add(le.config.LeaseDuration).After(now.Time) &&
+		oldLeaderElectionRecord.HolderIdentity != "" &&
 		oldLeaderElectionRecord.HolderIdentity != le.config.Lock.Identity() {
 		glog.V(4).Infof("lock is held by %v and has not yet expired", oldLeaderElectionRecord.HolderIdentity)
 		return false
@@ -0,0 +1,177 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzvolume"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// How volumes provisioned by older versions, which lack annotations and
+// options Delete relies on, are handled at startup
+const (
+	legacyIgnore = "ignore"
+	legacyWarn   = "warn"
+	legacyAdopt  = "adopt"
+)
+
+// legacyVolume is a volume to be upgraded to the current scheme
+type legacyVolume struct {
+	volume  *v1.PersistentVolume
+	secret  *v1.Secret
+	changes []string
+}
+
+// adoptLegacyVolumes finds volumes of the provisioner provisioned by older
+// versions and, in adopt mode, upgrades them in place: ownership and share
+// annotations are added, the cluster and the secret finalizer are recorded
+// in their options and the finalizer is added to the secret. Every volume
+// and its changes are logged, followed by a summary.
+func (p *vzFSProvisioner) adoptLegacyVolumes(mode string) {
+	if mode == legacyIgnore {
+		return
+	}
+	volumes, err := p.client.Core().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		glog.Errorf("Unable to list persistent volumes to find legacy ones: %v", err)
+		return
+	}
+
+	found, adopted, failed := 0, 0, 0
+	for i := range volumes.Items {
+		l, err := p.legacyVolume(&volumes.Items[i])
+		if err != nil {
+			glog.Errorf("Unable to check whether %s is a legacy volume: %v", volumes.Items[i].Name, err)
+			failed++
+			continue
+		}
+		if l == nil {
+			continue
+		}
+		found++
+		if mode != legacyAdopt {
+			glog.Warningf("Legacy volume %s needs: %s", l.volume.Name, strings.Join(l.changes, ", "))
+			continue
+		}
+		if err := p.adopt(l); err != nil {
+			glog.Errorf("Unable to adopt legacy volume %s (%s): %v", l.volume.Name, strings.Join(l.changes, ", "), err)
+			failed++
+			continue
+		}
+		glog.Infof("Adopted legacy volume %s: %s", l.volume.Name, strings.Join(l.changes, ", "))
+		adopted++
+	}
+	if found != 0 || failed != 0 {
+		glog.Warningf("Legacy volumes: %d found, %d adopted, %d failed", found, adopted, failed)
+	}
+}
+
+// legacyVolume returns the changes volume needs, nil if it isn't ours or
+// is up to date. The changes are made to volume.
+func (p *vzFSProvisioner) legacyVolume(volume *v1.PersistentVolume) (*legacyVolume, error) {
+	if volume.Spec.FlexVolume == nil || volume.Spec.FlexVolume.Driver != vzvolume.Driver {
+		return nil, nil
+	}
+	owner, ok := volume.Annotations[parentProvisionerAnn]
+	if ok && owner != *provisionerID {
+		return nil, nil
+	}
+	// volumes of versions which didn't annotate their owner are taken by
+	// the provisioner of the name they were provisioned by
+	if !ok && volume.Annotations[provisionedByAnn] != *provisionerName {
+		return nil, nil
+	}
+
+	v := volume
+	options := v.Spec.FlexVolume.Options
+	if options == nil || options["volumeID"] == "" {
+		return nil, fmt.Errorf("no volumeID in flexvolume options")
+	}
+	if v.Annotations == nil {
+		v.Annotations = map[string]string{}
+	}
+	l := &legacyVolume{volume: v}
+
+	if !ok {
+		v.Annotations[parentProvisionerAnn] = *provisionerID
+		l.changes = append(l.changes, "owner annotation")
+	}
+	if v.Annotations[vzShareAnn] == "" {
+		v.Annotations[vzShareAnn] = options["volumeID"]
+		l.changes = append(l.changes, "share annotation")
+	}
+
+	secretNamespace, secretName := volumeSecret(v)
+	var err error
+	if l.secret, err = tenantSecrets.get(secretNamespace, secretName); err != nil {
+		return nil, err
+	}
+	if options["clusterName"] == "" {
+		cluster, err := clusterFromSecret(l.secret)
+		if err != nil {
+			return nil, err
+		}
+		options["clusterName"] = cluster.name
+		l.changes = append(l.changes, "clusterName option")
+	}
+	if v.Annotations[clusterAnn] == "" {
+		v.Annotations[clusterAnn] = options["clusterName"]
+		l.changes = append(l.changes, "cluster annotation")
+	}
+	finalizer := options["finalizer"]
+	if finalizer == "" {
+		options["finalizer"] = fmt.Sprintf("virtuozzo.com/%s-pv", uuid.NewUUID())
+		l.changes = append(l.changes, "finalizer option")
+	} else if !hasFinalizer(l.secret, finalizer) {
+		l.changes = append(l.changes, "finalizer on secret "+secretName)
+	}
+
+	if len(l.changes) == 0 {
+		return nil, nil
+	}
+	return l, nil
+}
+
+// adopt stores the upgraded volume and adds its finalizer to the secret.
+// The PV goes first: a finalizer missing on the secret is found and added
+// by the next scan, while a finalizer of a volume which failed to be
+// stored would keep the secret forever.
+func (p *vzFSProvisioner) adopt(l *legacyVolume) error {
+	if _, err := p.client.Core().PersistentVolumes().Update(l.volume); err != nil {
+		return err
+	}
+	finalizer := l.volume.Spec.FlexVolume.Options["finalizer"]
+	if hasFinalizer(l.secret, finalizer) {
+		return nil
+	}
+	return p.finalizers.add(l.secret.Namespace, l.secret.Name, finalizer)
+}
+
+func hasFinalizer(secret *v1.Secret, finalizer string) bool {
+	for _, f := range secret.Finalizers {
+		if f == finalizer {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzvolume"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// legacyTestVolume returns a PV of the provisioner as older versions
+// created it, with neither its owner nor its cluster recorded
+func legacyTestVolume(name string) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Annotations: map[string]string{provisionedByAnn: *provisionerName},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			ClaimRef: &v1.ObjectReference{Namespace: "team-a", Name: name},
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				FlexVolume: &v1.FlexVolumeSource{
+					Driver:    vzvolume.Driver,
+					SecretRef: &v1.LocalObjectReference{Name: "vz-secret"},
+					Options:   map[string]string{"volumeID": name},
+				},
+			},
+		},
+	}
+}
+
+func TestAdoptLegacyVolumes(t *testing.T) {
+	*provisionerID = "vz"
+	legacy := legacyTestVolume("pv-legacy")
+	foreign := legacyTestVolume("pv-foreign")
+	foreign.Annotations[provisionedByAnn] = "other.com/storage"
+	other := legacyTestVolume("pv-other")
+	other.Annotations[parentProvisionerAnn] = "other"
+	current := legacyTestVolume("pv-current")
+	current.Annotations[parentProvisionerAnn] = "vz"
+	current.Annotations[vzShareAnn] = "pv-current"
+	current.Annotations[clusterAnn] = "cl1"
+	current.Spec.FlexVolume.Options["clusterName"] = "cl1"
+	current.Spec.FlexVolume.Options["finalizer"] = "virtuozzo.com/current-pv"
+
+	client := fake.NewSimpleClientset(legacy, foreign, other, current, &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       "vz-secret",
+			Namespace:  "team-a",
+			Finalizers: []string{"virtuozzo.com/current-pv"},
+		},
+		Data: map[string][]byte{"clusterName": []byte("cl1")},
+	})
+	tenantSecrets = newSecretAccess(client, nil, *namespace, "")
+	p := &vzFSProvisioner{client: client, finalizers: newSecretFinalizers()}
+
+	for _, pv := range []*v1.PersistentVolume{foreign, other, current} {
+		if l, err := p.legacyVolume(pv); l != nil || err != nil {
+			t.Errorf("%s: expected not to be legacy, got %+v, %v", pv.Name, l, err)
+		}
+	}
+
+	// warn mode leaves volumes alone
+	p.adoptLegacyVolumes(legacyWarn)
+	pv, err := client.Core().PersistentVolumes().Get("pv-legacy", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pv.Annotations[parentProvisionerAnn]; ok {
+		t.Errorf("Expected warn mode not to change the PV, got %v", pv.Annotations)
+	}
+
+	p.adoptLegacyVolumes(legacyAdopt)
+	pv, err = client.Core().PersistentVolumes().Get("pv-legacy", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ann, value := range map[string]string{parentProvisionerAnn: "vz", vzShareAnn: "pv-legacy", clusterAnn: "cl1"} {
+		if pv.Annotations[ann] != value {
+			t.Errorf("Expected %s=%s on the adopted PV, got %v", ann, value, pv.Annotations)
+		}
+	}
+	options := pv.Spec.FlexVolume.Options
+	finalizer := options["finalizer"]
+	if options["clusterName"] != "cl1" || !strings.HasPrefix(finalizer, "virtuozzo.com/") {
+		t.Errorf("Expected the cluster and the finalizer in options of the adopted PV, got %v", options)
+	}
+	secret, err := client.Core().Secrets("team-a").Get("vz-secret", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasFinalizer(secret, finalizer) || !hasFinalizer(secret, "virtuozzo.com/current-pv") {
+		t.Errorf("Expected the finalizer of the adopted PV added to the secret, got %v", secret.Finalizers)
+	}
+
+	// adopted volumes are up to date
+	if l, err := p.legacyVolume(pv); l != nil || err != nil {
+		t.Errorf("Expected the adopted volume to be up to date, got %+v, %v", l, err)
+	}
+	for _, name := range []string{"pv-foreign", "pv-other"} {
+		pv, err := client.Core().PersistentVolumes().Get(name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pv.Spec.FlexVolume.Options["finalizer"] != "" {
+			t.Errorf("%s: expected a volume of another provisioner to be left alone", name)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/metrics"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzvolume"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// adviceLabel marks the config map with volumes most in need of
+// maintenance, which kubectl-vz looks for
+const adviceLabel = "virtuozzo.com/maintenance-advice"
+
+var (
+	volumeReclaimableBytes = metrics.NewGauge("vzstorage_volume_reclaimable_bytes",
+		"Space taken by images of the volumes most in need of maintenance which their filesystems don't use.", "pv", "claim")
+	volumeDeltas = metrics.NewGauge("vzstorage_volume_deltas",
+		"Number of deltas of images of the volumes most in need of maintenance.", "pv", "claim")
+)
+
+// volumeAdvice is the usage of the image of a volume which would benefit
+// from maintenance
+type volumeAdvice struct {
+	Volume      string `json:"volume"`
+	Claim       string `json:"claim"`
+	Allocated   uint64 `json:"allocatedBytes"`
+	Used        uint64 `json:"usedBytes"`
+	Reclaimable uint64 `json:"reclaimableBytes"`
+	Deltas      int    `json:"deltas"`
+}
+
+// byReclaimable orders advices by the space compaction would return,
+// then by the number of deltas
+type byReclaimable []volumeAdvice
+
+func (b byReclaimable) Len() int      { return len(b) }
+func (b byReclaimable) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byReclaimable) Less(i, j int) bool {
+	if b[i].Reclaimable != b[j].Reclaimable {
+		return b[i].Reclaimable > b[j].Reclaimable
+	}
+	return b[i].Deltas > b[j].Deltas
+}
+
+// runMaintenanceAdvisor periodically measures images of all volumes and
+// publishes the top of them which would benefit from compaction most
+func (p *vzFSProvisioner) runMaintenanceAdvisor(period time.Duration, top int) {
+	store := &configMapStore{
+		client:    p.client,
+		namespace: *namespace,
+		name:      *provisionerID + "-maintenance-advice",
+		labels:    map[string]string{adviceLabel: ""},
+	}
+	wait.Forever(func() { p.adviseMaintenance(store, top) }, period)
+}
+
+func (p *vzFSProvisioner) adviseMaintenance(store *configMapStore, top int) {
+	volumes, err := p.client.Core().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		glog.Errorf("Unable to list persistent volumes: %v", err)
+		return
+	}
+
+	var advices []volumeAdvice
+	for i := range volumes.Items {
+		volume := &volumes.Items[i]
+		if volume.Annotations[parentProvisionerAnn] != *provisionerID ||
+			volume.Spec.FlexVolume == nil || volume.Spec.ClaimRef == nil {
+			continue
+		}
+		u, err := p.imageUsage(volume)
+		if err != nil {
+			glog.Warningf("Unable to measure the image of %s: %v", volume.Name, err)
+			continue
+		}
+		if u.Reclaimable() == 0 && u.Deltas <= 1 {
+			continue
+		}
+		advices = append(advices, volumeAdvice{
+			Volume:      volume.Name,
+			Claim:       volume.Spec.ClaimRef.Namespace + "/" + volume.Spec.ClaimRef.Name,
+			Allocated:   u.Allocated,
+			Used:        u.Used,
+			Reclaimable: u.Reclaimable(),
+			Deltas:      u.Deltas,
+		})
+	}
+	sort.Sort(byReclaimable(advices))
+	if len(advices) > top {
+		advices = advices[:top]
+	}
+
+	volumeReclaimableBytes.Reset()
+	volumeDeltas.Reset()
+	for _, a := range advices {
+		volumeReclaimableBytes.Set(float64(a.Reclaimable), a.Volume, a.Claim)
+		volumeDeltas.Set(float64(a.Deltas), a.Volume, a.Claim)
+	}
+
+	data, err := json.Marshal(advices)
+	if err != nil {
+		glog.Errorf("Unable to marshal maintenance advice: %v", err)
+		return
+	}
+	if _, err := store.modify(func(d map[string]string) {
+		d["advice"] = string(data)
+		d["time"] = time.Now().UTC().Format(time.RFC3339)
+	}); err != nil {
+		glog.Errorf("Unable to publish maintenance advice: %v", err)
+	}
+}
+
+// imageUsage measures the image of the volume
+func (p *vzFSProvisioner) imageUsage(volume *v1.PersistentVolume) (*vzvolume.ImageUsage, error) {
+	secretNamespace, secretName := volumeSecret(volume)
+	secret, err := tenantSecrets.get(secretNamespace, secretName)
+	if err != nil {
+		return nil, err
+	}
+	cluster, err := clusterFromSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+	options := volume.Spec.FlexVolume.Options
+	if err := p.prepareVstorage(options, cluster, secret); err != nil {
+		return nil, err
+	}
+	return vzvolume.Usage(mountDir+cluster.name, options)
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzvolume"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// allocationParam is the StorageClass parameter with the default
+	// allocation mode of images, also recorded in PV options
+	allocationParam = vzvolume.AllocationOption
+	// allocationAnn on a claim overrides the mode of its StorageClass, on
+	// a PV it records the mode its image was created with
+	allocationAnn = "virtuozzo.com/allocation"
+)
+
+const (
+	allocationThin         = "thin"
+	allocationPreallocated = vzvolume.Preallocated
+)
+
+// allocationOf returns the allocation mode of the claim's image. Thin
+// images grow as they are written, preallocated ones take their whole
+// size on creation and don't pay for allocation on writes.
+func allocationOf(claim *v1.PersistentVolumeClaim, parameters map[string]string) (string, error) {
+	mode, source := allocationThin, ""
+	if v, ok := parameters[allocationParam]; ok {
+		mode, source = v, "parameter "+allocationParam
+	}
+	if v, ok := claim.Annotations[allocationAnn]; ok {
+		mode, source = v, "annotation "+allocationAnn
+	}
+	switch mode {
+	case allocationThin, allocationPreallocated:
+		return mode, nil
+	}
+	return "", fmt.Errorf("Invalid %s %q, expected %s or %s", source, mode, allocationThin, allocationPreallocated)
+}
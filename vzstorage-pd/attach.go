@@ -0,0 +1,230 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// maxVolumesAnn on a node overrides -max-volumes-per-node for it
+const maxVolumesAnn = "virtuozzo.com/max-ploop-volumes"
+
+// nodeVolumes is the number of ploop volumes a node can attach and the
+// PVs attached to it
+type nodeVolumes struct {
+	Limit    int      `json:"limit"`
+	Attached []string `json:"attached"`
+}
+
+// attachLimits tracks ploop volumes attached to nodes, i.e. used by their
+// pods, and publishes them in a config map. Nodes which reached their limit
+// aren't preferred for new volumes, and a scheduler extender filters them
+// out for pods with volumes not attached yet.
+type attachLimits struct {
+	configMapStore
+	defaultLimit int
+
+	mu sync.RWMutex
+	// nodes by name
+	nodes map[string]nodeVolumes
+	// ploop PVs by claim namespace/name
+	claims map[string]string
+}
+
+func newAttachLimits(client kubernetes.Interface, namespace, name string, defaultLimit int) *attachLimits {
+	return &attachLimits{
+		configMapStore: configMapStore{
+			client:    client,
+			namespace: namespace,
+			name:      name,
+		},
+		defaultLimit: defaultLimit,
+		nodes:        map[string]nodeVolumes{},
+		claims:       map[string]string{},
+	}
+}
+
+func (a *attachLimits) run(period time.Duration) {
+	wait.Forever(a.update, period)
+}
+
+func (a *attachLimits) update() {
+	volumes, err := a.client.Core().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		glog.Errorf("Unable to list persistent volumes: %v", err)
+		return
+	}
+	claims := map[string]string{}
+	for _, volume := range volumes.Items {
+		flex := volume.Spec.FlexVolume
+		if flex == nil || flex.Driver != "virtuozzo/ploop" || volume.Spec.ClaimRef == nil {
+			continue
+		}
+		claims[volume.Spec.ClaimRef.Namespace+"/"+volume.Spec.ClaimRef.Name] = volume.Name
+	}
+
+	list, err := a.client.Core().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		glog.Errorf("Unable to list nodes: %v", err)
+		return
+	}
+	attached := map[string]map[string]bool{}
+	limits := map[string]int{}
+	for _, node := range list.Items {
+		attached[node.Name] = map[string]bool{}
+		limits[node.Name] = a.defaultLimit
+		if s, ok := node.Annotations[maxVolumesAnn]; ok {
+			if n, err := strconv.Atoi(s); err == nil {
+				limits[node.Name] = n
+			} else {
+				glog.Warningf("Invalid %s annotation of node %s: %q", maxVolumesAnn, node.Name, s)
+			}
+		}
+	}
+
+	pods, err := a.client.Core().Pods(v1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		glog.Errorf("Unable to list pods: %v", err)
+		return
+	}
+	for _, pod := range pods.Items {
+		if pod.Spec.NodeName == "" || pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		for _, pv := range podVolumes(&pod, claims) {
+			if attached[pod.Spec.NodeName] != nil {
+				attached[pod.Spec.NodeName][pv] = true
+			}
+		}
+	}
+
+	nodes := map[string]nodeVolumes{}
+	data := map[string]string{}
+	for name, pvs := range attached {
+		n := nodeVolumes{Limit: limits[name], Attached: []string{}}
+		for pv := range pvs {
+			n.Attached = append(n.Attached, pv)
+		}
+		sort.Strings(n.Attached)
+		nodes[name] = n
+		if d, err := json.Marshal(&n); err == nil {
+			data[name] = string(d)
+		}
+	}
+
+	a.mu.Lock()
+	a.nodes, a.claims = nodes, claims
+	a.mu.Unlock()
+
+	if _, err := a.modify(func(m map[string]string) {
+		for k := range m {
+			delete(m, k)
+		}
+		for k, v := range data {
+			m[k] = v
+		}
+	}); err != nil {
+		glog.Errorf("Unable to publish attached volumes: %v", err)
+	}
+}
+
+// podVolumes returns ploop PVs used by the pod
+func podVolumes(pod *v1.Pod, claims map[string]string) []string {
+	var pvs []string
+	for _, vol := range pod.Spec.Volumes {
+		if c := vol.PersistentVolumeClaim; c != nil {
+			if pv, ok := claims[pod.Namespace+"/"+c.ClaimName]; ok {
+				pvs = append(pvs, pv)
+			}
+		}
+	}
+	return pvs
+}
+
+// saturated returns true if the node can't attach more ploop volumes
+func (a *attachLimits) saturated(node string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	n, ok := a.nodes[node]
+	return ok && len(n.Attached) >= n.Limit
+}
+
+// fits checks if the node can attach volumes of the pod which it doesn't
+// have attached yet
+func (a *attachLimits) fits(pod *v1.Pod, node string) (bool, string) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	n, ok := a.nodes[node]
+	if !ok {
+		return true, ""
+	}
+	attached := len(n.Attached)
+	for _, pv := range podVolumes(pod, a.claims) {
+		if i := sort.SearchStrings(n.Attached, pv); i == len(n.Attached) || n.Attached[i] != pv {
+			attached++
+		}
+	}
+	if attached > n.Limit && attached > len(n.Attached) {
+		return false, fmt.Sprintf("node would have %d ploop volumes attached, the limit is %d", attached, n.Limit)
+	}
+	return true, ""
+}
+
+// extenderArgs and extenderFilterResult are the scheduler extender API
+type extenderArgs struct {
+	Pod   v1.Pod      `json:"pod"`
+	Nodes v1.NodeList `json:"nodes"`
+}
+
+type extenderFilterResult struct {
+	Nodes       v1.NodeList       `json:"nodes,omitempty"`
+	FailedNodes map[string]string `json:"failedNodes,omitempty"`
+	Error       string            `json:"error,omitempty"`
+}
+
+// serveFilter is the filter verb of a scheduler extender, it drops nodes
+// which can't attach ploop volumes of the pod
+func (a *attachLimits) serveFilter(w http.ResponseWriter, req *http.Request) {
+	var args extenderArgs
+	var result extenderFilterResult
+	if err := json.NewDecoder(req.Body).Decode(&args); err != nil {
+		result.Error = err.Error()
+	} else {
+		result.FailedNodes = map[string]string{}
+		for _, node := range args.Nodes.Items {
+			if ok, reason := a.fits(&args.Pod, node.Name); ok {
+				result.Nodes.Items = append(result.Nodes.Items, node)
+			} else {
+				result.FailedNodes[node.Name] = reason
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&result)
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// auditRecord is a single line of the audit log
+type auditRecord struct {
+	Time      string `json:"time"`
+	Node      string `json:"node"`
+	Operation string `json:"operation"`
+	PV        string `json:"pv"`
+	Claim     string `json:"claim,omitempty"`
+	Share     string `json:"share,omitempty"`
+	Result    string `json:"result"`
+	Error     string `json:"error,omitempty"`
+}
+
+// auditLog is an append-only log of volume operations, one JSON object
+// per line. A nil *auditLog records nothing.
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+	node string
+}
+
+func newAuditLog(path string) *auditLog {
+	if path == "" {
+		return nil
+	}
+	node, _ := os.Hostname()
+	return &auditLog{path: path, node: node}
+}
+
+func (a *auditLog) record(operation, pv, claim, share string, err error) {
+	if a == nil {
+		return
+	}
+
+	r := auditRecord{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		Node:      a.node,
+		Operation: operation,
+		PV:        pv,
+		Claim:     claim,
+		Share:     share,
+		Result:    "success",
+	}
+	if err != nil {
+		r.Result = "failure"
+		r.Error = err.Error()
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		glog.Errorf("Unable to marshal audit record: %v", err)
+		return
+	}
+	data = append(data, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		glog.Errorf("Unable to open audit log %s: %v", a.path, err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		glog.Errorf("Unable to write audit log %s: %v", a.path, err)
+		return
+	}
+	if err := f.Sync(); err != nil {
+		glog.Errorf("Unable to sync audit log %s: %v", a.path, err)
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// authCache remembers clusters the node was authenticated in, so that
+// retries of failed mounts during churn don't run vstorage auth-node
+// again and again. Entries expire after ttl, are keyed by the password so
+// that a changed one is used right away, and are invalidated when a mount
+// fails on authentication.
+type authCache struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	entries map[string]authEntry
+}
+
+type authEntry struct {
+	password [sha256.Size]byte
+	expires  time.Time
+}
+
+// clusterAuth caches authentication in clusters, nil if disabled
+var clusterAuth *authCache
+
+func newAuthCache(ttl time.Duration) *authCache {
+	return &authCache{ttl: ttl, entries: map[string]authEntry{}}
+}
+
+// authenticated returns whether the node is known to be authenticated in
+// the cluster with its password
+func (c *authCache) authenticated(cluster *vstorageCluster) bool {
+	if c == nil {
+		return false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e, ok := c.entries[cluster.name]
+	return ok && e.password == sha256.Sum256([]byte(cluster.password)) && time.Now().Before(e.expires)
+}
+
+// add records a successful authentication in the cluster
+func (c *authCache) add(cluster *vstorageCluster) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries[cluster.name] = authEntry{
+		password: sha256.Sum256([]byte(cluster.password)),
+		expires:  time.Now().Add(c.ttl),
+	}
+}
+
+// invalidate forgets the authentication in the cluster if err looks like
+// the node isn't authenticated
+func (c *authCache) invalidate(name string, err error) {
+	if c == nil || err == nil || !isAuthError(err) {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.entries[name]; ok {
+		glog.Warningf("Authentication in %s is no longer valid: %v", name, err)
+		delete(c.entries, name)
+	}
+}
+
+// isAuthError returns whether a vstorage error is about authentication
+func isAuthError(err error) bool {
+	s := strings.ToLower(err.Error())
+	for _, m := range []string{"auth", "permission denied", "access denied", "password"} {
+		if strings.Contains(s, m) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,389 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/lib/controller"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/backup"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzvolume"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/pkg/api/v1"
+	storage "k8s.io/client-go/pkg/apis/storage/v1"
+)
+
+const (
+	// backupLabel marks config maps requesting a backup of a claim
+	backupLabel = "virtuozzo.com/backup"
+	// restoreLabel marks config maps requesting a restore of a backup
+	restoreLabel = "virtuozzo.com/restore"
+	backupPeriod = 30 * time.Second
+
+	backupCompleted = "Completed"
+	backupFailed    = "Failed"
+)
+
+// runBackups periodically processes backup, restore, import and group
+// snapshot requests. A request is a config map with the data described in
+// README, its progress is reported in the "phase" and "message" keys of
+// the same config map.
+func (p *vzFSProvisioner) runBackups(period time.Duration) {
+	wait.Forever(func() {
+		p.processRequests(backupLabel, p.backup)
+		p.processRequests(restoreLabel, p.restore)
+		p.processRequests(importLabel, p.importImage)
+		p.processRequests(groupSnapshotLabel, p.groupSnapshot)
+		p.removeGroupSnapshots()
+	}, period)
+}
+
+// processRequests runs fn for unfinished requests labeled with label. fn
+// returns false for requests which belong to another provisioner. A request
+// failing with volumeInUseError stays pending and is retried later.
+func (p *vzFSProvisioner) processRequests(label string, fn func(*v1.ConfigMap) (bool, error)) {
+	requests, err := p.client.Core().ConfigMaps(v1.NamespaceAll).List(metav1.ListOptions{LabelSelector: label})
+	if err != nil {
+		glog.Errorf("Unable to list %s requests: %v", label, err)
+		return
+	}
+	for i := range requests.Items {
+		cm := &requests.Items[i]
+		if phase := cm.Data["phase"]; phase == backupCompleted || phase == backupFailed {
+			continue
+		}
+
+		ours, err := fn(cm)
+		if !ours {
+			continue
+		}
+		if e, ok := err.(*volumeInUseError); ok {
+			p.postponeRequest(cm, label, e)
+			continue
+		}
+		phase, message := backupCompleted, ""
+		if err != nil {
+			glog.Errorf("Request %s/%s failed: %v", cm.Namespace, cm.Name, err)
+			phase, message = backupFailed, err.Error()
+			p.recorder.Eventf(cm, v1.EventTypeWarning, "RequestFailed", "%s failed: %v", label, err)
+		} else {
+			glog.Infof("Request %s/%s completed", cm.Namespace, cm.Name)
+			p.recorder.Eventf(cm, v1.EventTypeNormal, "RequestCompleted", "%s completed", label)
+		}
+		store := configMapStore{client: p.client, namespace: cm.Namespace, name: cm.Name}
+		if _, err := store.modify(func(d map[string]string) {
+			d["phase"] = phase
+			d["message"] = message
+		}); err != nil {
+			glog.Errorf("Unable to update request %s/%s: %v", cm.Namespace, cm.Name, err)
+		}
+	}
+}
+
+// postponeRequest tells on the request that it waits for the volume to be
+// released
+func (p *vzFSProvisioner) postponeRequest(cm *v1.ConfigMap, label string, e *volumeInUseError) {
+	message, changed := p.postponeInUse(cm, "RequestPostponed", label, cm.Namespace+"/"+cm.Name, cm.Data["message"], e)
+	if !changed {
+		return
+	}
+	store := configMapStore{client: p.client, namespace: cm.Namespace, name: cm.Name}
+	if _, err := store.modify(func(d map[string]string) {
+		d["message"] = message
+	}); err != nil {
+		glog.Errorf("Unable to update request %s/%s: %v", cm.Namespace, cm.Name, err)
+	}
+}
+
+// backupTarget returns the bucket and the key of the backup named in a
+// request. A backup is kept under <prefix>/<namespace>/<name> of the
+// request which created it.
+func (p *vzFSProvisioner) backupTarget(cm *v1.ConfigMap, name string) (backup.Target, string, error) {
+	secret, err := tenantSecrets.get(cm.Namespace, cm.Data["target"])
+	if err != nil {
+		return nil, "", err
+	}
+	target := &backup.S3{
+		Endpoint:  string(secret.Data["endpoint"]),
+		Region:    string(secret.Data["region"]),
+		Bucket:    string(secret.Data["bucket"]),
+		AccessKey: string(secret.Data["accessKey"]),
+		SecretKey: string(secret.Data["secretKey"]),
+	}
+	if target.Endpoint == "" || target.Bucket == "" {
+		return nil, "", fmt.Errorf("secret %s/%s has no endpoint or bucket", cm.Namespace, secret.Name)
+	}
+	if target.Region == "" {
+		target.Region = "us-east-1"
+	}
+	if !strings.Contains(name, "/") {
+		name = cm.Namespace + "/" + name
+	}
+	return target, path.Join(string(secret.Data["prefix"]), name), nil
+}
+
+// backup uploads a snapshot of the volume bound to the claim of the request
+func (p *vzFSProvisioner) backup(cm *v1.ConfigMap) (bool, error) {
+	claim, err := p.client.Core().PersistentVolumeClaims(cm.Namespace).Get(cm.Data["claim"], metav1.GetOptions{})
+	if err != nil {
+		return true, err
+	}
+	if claim.Spec.VolumeName == "" {
+		return true, fmt.Errorf("claim %s is not bound", claim.Name)
+	}
+	volume, err := p.client.Core().PersistentVolumes().Get(claim.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return true, err
+	}
+	if volume.Annotations[parentProvisionerAnn] != *provisionerID {
+		return false, nil
+	}
+
+	target, key, err := p.backupTarget(cm, cm.Name)
+	if err != nil {
+		return true, err
+	}
+	secretNamespace, secretName := volumeSecret(volume)
+	secret, err := tenantSecrets.get(secretNamespace, secretName)
+	if err != nil {
+		return true, err
+	}
+	cluster, err := clusterFromSecret(secret)
+	if err != nil {
+		return true, err
+	}
+	options := volume.Spec.FlexVolume.Options
+	if err := p.prepareVstorage(options, cluster, secret); err != nil {
+		return true, err
+	}
+
+	// the snapshot is taken offline, see checkNotInUse
+	if err := p.checkNotInUse(volume); err != nil {
+		return true, err
+	}
+	mount := mountDir + cluster.name
+	dir := vzvolume.SnapshotsDir(mount, options)
+	// snapshots left by interrupted backups are already stale
+	if err := p.merges.queueLeftovers(volume.Name, dir, options["volumeID"]+"-backup"); err != nil {
+		return true, err
+	}
+	snapshotPath, err := vzvolume.Snapshot(mount, options, tempSnapshotName(options, "-backup-"))
+	if err != nil {
+		return true, err
+	}
+	defer func() {
+		if err := p.merges.queue(volume.Name, snapshotPath); err != nil {
+			glog.Errorf("Unable to queue deletion of snapshot %s, the next backup queues it: %v", snapshotPath, err)
+		}
+	}()
+
+	capacity := volume.Spec.Capacity[v1.ResourceName(v1.ResourceStorage)]
+	m := &backup.Manifest{
+		Volume:   volume.Name,
+		Capacity: capacity.String(),
+		Options:  options,
+		Created:  time.Now(),
+	}
+	return true, backup.Backup(target, key, snapshotPath, m)
+}
+
+// restore provisions a volume of the storage class of the request, fills
+// it with the backup and creates the claim of the request bound to it. The
+// PV is recorded in the request as soon as it is created, so that a restore
+// interrupted by a restart continues with the same volume.
+func (p *vzFSProvisioner) restore(cm *v1.ConfigMap) (bool, error) {
+	volume, ours, err := p.requestVolume(cm)
+	if !ours || err != nil {
+		return ours, err
+	}
+	if volume == nil {
+		class, err := p.client.Storage().StorageClasses().Get(cm.Data["storageClass"], metav1.GetOptions{})
+		if err != nil {
+			return true, err
+		}
+		if !servesClass(class) {
+			return false, nil
+		}
+		target, key, err := p.backupTarget(cm, cm.Data["backup"])
+		if err != nil {
+			return true, err
+		}
+		m, err := backup.GetManifest(target, key)
+		if err != nil {
+			return true, err
+		}
+		capacity, err := resource.ParseQuantity(m.Capacity)
+		if err != nil {
+			return true, fmt.Errorf("invalid capacity in the manifest: %v", err)
+		}
+		if volume, err = p.provisionForRequest(cm, class, capacity); err != nil {
+			return true, err
+		}
+	}
+
+	if err := p.restoreImage(cm, volume); err != nil {
+		p.discardVolume(volume)
+		return true, err
+	}
+	return true, p.createBoundClaim(volume)
+}
+
+// requestVolume returns the PV recorded in the request, nil if there is
+// none yet, and false if the PV belongs to another provisioner
+func (p *vzFSProvisioner) requestVolume(cm *v1.ConfigMap) (*v1.PersistentVolume, bool, error) {
+	name := cm.Data["volume"]
+	if name == "" {
+		return nil, true, nil
+	}
+	volume, err := p.client.Core().PersistentVolumes().Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, true, err
+	}
+	if volume.Annotations[parentProvisionerAnn] != *provisionerID {
+		return nil, false, nil
+	}
+	return volume, true, nil
+}
+
+// servesClass returns true if volumes of the class are provisioned by this
+// provisioner
+func servesClass(class *storage.StorageClass) bool {
+	owner, ok := class.Annotations[shardAnn]
+	return class.Provisioner == *provisionerName && (!ok || owner == *provisionerID)
+}
+
+// provisionForRequest provisions a volume of the class and creates its PV
+// pre-bound to the claim named in the request, recording it in the request
+func (p *vzFSProvisioner) provisionForRequest(cm *v1.ConfigMap, class *storage.StorageClass, capacity resource.Quantity) (*v1.PersistentVolume, error) {
+	claim := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cm.Data["claim"],
+			Namespace: cm.Namespace,
+			UID:       cm.UID,
+		},
+		Spec: v1.PersistentVolumeClaimSpec{
+			AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{v1.ResourceName(v1.ResourceStorage): capacity},
+			},
+			StorageClassName: &class.Name,
+		},
+	}
+	volume, err := p.Provision(controller.VolumeOptions{
+		PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+		PVName:                        "pvc-" + string(cm.UID),
+		PVC:                           claim,
+		Parameters:                    class.Parameters,
+	})
+	if err != nil {
+		return nil, err
+	}
+	volume.Annotations[provisionedByAnn] = *provisionerName
+	volume.Spec.StorageClassName = class.Name
+	volume.Spec.ClaimRef = &v1.ObjectReference{
+		Kind:      "PersistentVolumeClaim",
+		Namespace: claim.Namespace,
+		Name:      claim.Name,
+	}
+	if volume, err = p.client.Core().PersistentVolumes().Create(volume); err != nil {
+		return nil, err
+	}
+	store := configMapStore{client: p.client, namespace: cm.Namespace, name: cm.Name}
+	if _, err := store.modify(func(d map[string]string) { d["volume"] = volume.Name }); err != nil {
+		return nil, err
+	}
+	return volume, nil
+}
+
+// discardVolume removes a volume whose filling failed, as it is of no use
+func (p *vzFSProvisioner) discardVolume(volume *v1.PersistentVolume) {
+	p.client.Core().PersistentVolumes().Delete(volume.Name, &metav1.DeleteOptions{})
+	if err := p.delete(context.Background(), volume); err != nil {
+		glog.Errorf("Unable to remove volume %s of a failed request: %v", volume.Name, err)
+	}
+}
+
+// createBoundClaim creates the claim the volume is pre-bound to
+func (p *vzFSProvisioner) createBoundClaim(volume *v1.PersistentVolume) error {
+	capacity := volume.Spec.Capacity[v1.ResourceName(v1.ResourceStorage)]
+	claim := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      volume.Spec.ClaimRef.Name,
+			Namespace: volume.Spec.ClaimRef.Namespace,
+		},
+		Spec: v1.PersistentVolumeClaimSpec{
+			AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{v1.ResourceName(v1.ResourceStorage): capacity},
+			},
+			VolumeName:       volume.Name,
+			StorageClassName: &volume.Spec.StorageClassName,
+		},
+	}
+	if _, err := p.client.Core().PersistentVolumeClaims(claim.Namespace).Create(claim); err != nil && !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
+
+// restoreImage replaces the empty image of a freshly provisioned volume
+// with the backup
+func (p *vzFSProvisioner) restoreImage(cm *v1.ConfigMap, volume *v1.PersistentVolume) error {
+	target, key, err := p.backupTarget(cm, cm.Data["backup"])
+	if err != nil {
+		return err
+	}
+	m, err := backup.GetManifest(target, key)
+	if err != nil {
+		return err
+	}
+
+	secretNamespace, secretName := volumeSecret(volume)
+	secret, err := tenantSecrets.get(secretNamespace, secretName)
+	if err != nil {
+		return err
+	}
+	cluster, err := clusterFromSecret(secret)
+	if err != nil {
+		return err
+	}
+	options := volume.Spec.FlexVolume.Options
+	if err := p.prepareVstorage(options, cluster, secret); err != nil {
+		return err
+	}
+
+	ploopPath, imageDir := vzvolume.Paths(mountDir+cluster.name, options)
+	for _, f := range []string{path.Join(ploopPath, "DiskDescriptor.xml"), path.Join(imageDir, "root.hds")} {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := backup.Restore(target, key, m, ploopPath, imageDir); err != nil {
+		return err
+	}
+	glog.Infof("Restored %s from %s", volume.Name, key)
+	return nil
+}
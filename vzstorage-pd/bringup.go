@@ -0,0 +1,114 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// bringUpClusters mounts clusters of existing volumes and of storage
+// classes with credentials in kube-system at startup, so that the first
+// claims don't wait for them. Clusters are mounted in parallel by a
+// limited number of workers at a limited rate. A cluster which can't be
+// reached is marked unavailable, which fails its operations right away
+// and retries the mount in background, while other clusters are served.
+// Other failures are left to mounts on demand.
+func (p *vzFSProvisioner) bringUpClusters(workers int, qps float32) {
+	p.recoverMounts()
+
+	secrets := map[string]bool{}
+	if volumes, err := p.client.Core().PersistentVolumes().List(metav1.ListOptions{}); err == nil {
+		for _, volume := range volumes.Items {
+			if volume.Annotations[parentProvisionerAnn] != *provisionerID ||
+				volume.Spec.FlexVolume == nil || volume.Spec.ClaimRef == nil {
+				continue
+			}
+			ns, name := volumeSecret(&volume)
+			secrets[ns+"/"+name] = true
+		}
+	} else {
+		glog.Errorf("Unable to list persistent volumes: %v", err)
+	}
+	if classes, err := p.client.Storage().StorageClasses().List(metav1.ListOptions{}); err == nil {
+		for _, class := range classes.Items {
+			if class.Provisioner == *provisionerName && class.Parameters["optionsFromSystem"] == "true" {
+				secrets["kube-system/"+class.Parameters["secretName"]] = true
+			}
+		}
+	} else {
+		glog.Errorf("Unable to list storage classes: %v", err)
+	}
+
+	// several secrets may point to the same cluster
+	type clusterSecret struct {
+		cluster *vstorageCluster
+		secret  *v1.Secret
+	}
+	clusters := map[string]clusterSecret{}
+	for key := range secrets {
+		parts := strings.SplitN(key, "/", 2)
+		secret, err := tenantSecrets.get(parts[0], parts[1])
+		if err != nil {
+			glog.Errorf("Unable to get secret %s: %v", key, err)
+			continue
+		}
+		cluster, err := clusterFromSecret(secret)
+		if err != nil {
+			glog.Errorf("%v", err)
+			continue
+		}
+		clusters[cluster.name] = clusterSecret{cluster, secret}
+	}
+
+	queue := make(chan clusterSecret, len(clusters))
+	for _, c := range clusters {
+		queue <- c
+	}
+	close(queue)
+
+	limiter := flowcontrol.NewTokenBucketRateLimiter(qps, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range queue {
+				limiter.Accept()
+				err := p.prepareVstorage(nil, c.cluster, c.secret)
+				if err == nil {
+					glog.Infof("Cluster %s is ready", c.cluster.name)
+					continue
+				}
+				// prepareVstorage marks clusters which look unreachable as
+				// unavailable. Other failures, like wrong credentials, are
+				// no outage to probe or fail over from, and the mount is
+				// retried on demand.
+				if !isClusterUnavailable(err) {
+					glog.Errorf("Unable to bring up cluster %s, it is mounted on demand: %v", c.cluster.name, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	glog.Infof("Brought up %d clusters", len(clusters))
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzvolume"
+	"github.com/virtuozzo/ploop-flexvol/vstorage"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/api/v1/helper"
+)
+
+const (
+	// bundleMetadataFile describes a volume next to its disk descriptor,
+	// for tools which only see the cluster
+	bundleMetadataFile = "virtuozzo-volume.json"
+	// how often files describing volumes are brought up to date
+	bundleRefreshPeriod = 10 * time.Minute
+)
+
+// bundleMetadata is the content of bundleMetadataFile. Fields are only
+// ever added to it.
+type bundleMetadata struct {
+	PV                 string `json:"pv"`
+	PVUID              string `json:"pvUID,omitempty"`
+	ClaimNamespace     string `json:"claimNamespace,omitempty"`
+	ClaimName          string `json:"claimName,omitempty"`
+	ClaimUID           string `json:"claimUID,omitempty"`
+	StorageClass       string `json:"storageClass,omitempty"`
+	Cluster            string `json:"cluster"`
+	Capacity           string `json:"capacity"`
+	Created            string `json:"created"`
+	Provisioner        string `json:"provisioner"`
+	ProvisionerVersion string `json:"provisionerVersion"`
+}
+
+// boundVolume returns the PV of a volume being provisioned for the claim as
+// the controller stores it: with the claim reference and the class
+func boundVolume(pv *v1.PersistentVolume, claim *v1.PersistentVolumeClaim) *v1.PersistentVolume {
+	bound := *pv
+	bound.Annotations = map[string]string{provisionedByAnn: *provisionerName}
+	for k, v := range pv.Annotations {
+		bound.Annotations[k] = v
+	}
+	bound.Spec.ClaimRef = &v1.ObjectReference{
+		Kind:       "PersistentVolumeClaim",
+		APIVersion: "v1",
+		Namespace:  claim.Namespace,
+		Name:       claim.Name,
+		UID:        claim.UID,
+	}
+	bound.Spec.StorageClassName = helper.GetPersistentVolumeClaimClass(claim)
+	return &bound
+}
+
+// writeBundle writes the recovery marker and the metadata of the volume
+// next to its disk descriptor. Files are only rewritten if they changed.
+func writeBundle(mount string, pv *v1.PersistentVolume) error {
+	ploopPath, _ := vzvolume.Paths(mount, pv.Spec.FlexVolume.Options)
+
+	marker := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        pv.Name,
+			Labels:      pv.Labels,
+			Annotations: pv.Annotations,
+		},
+		Spec: pv.Spec,
+	}
+	if err := writeBundleFile(ploopPath, recoveryMarker, marker); err != nil {
+		return err
+	}
+
+	capacity := pv.Spec.Capacity[v1.ResourceName(v1.ResourceStorage)]
+	m := &bundleMetadata{
+		PV:                 pv.Name,
+		PVUID:              string(pv.UID),
+		StorageClass:       pv.Spec.StorageClassName,
+		Cluster:            pv.Spec.FlexVolume.Options["clusterName"],
+		Capacity:           capacity.String(),
+		Created:            time.Now().UTC().Format(time.RFC3339),
+		Provisioner:        *provisionerID,
+		ProvisionerVersion: version,
+	}
+	if ref := pv.Spec.ClaimRef; ref != nil {
+		m.ClaimNamespace, m.ClaimName, m.ClaimUID = ref.Namespace, ref.Name, string(ref.UID)
+	}
+	// the time the volume was created at is kept
+	old := &bundleMetadata{}
+	if data, err := ioutil.ReadFile(path.Join(ploopPath, bundleMetadataFile)); err == nil && json.Unmarshal(data, old) == nil && old.Created != "" {
+		m.Created = old.Created
+	} else if !pv.CreationTimestamp.IsZero() {
+		m.Created = pv.CreationTimestamp.UTC().Format(time.RFC3339)
+	}
+	return writeBundleFile(ploopPath, bundleMetadataFile, m)
+}
+
+func writeBundleFile(dir, name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	file := path.Join(dir, name)
+	if old, err := ioutil.ReadFile(file); err == nil && bytes.Equal(old, data) {
+		return nil
+	}
+	tmp := path.Join(dir, "."+name+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+func (p *vzFSProvisioner) runBundleRefresh(period time.Duration) {
+	wait.Forever(p.refreshBundles, period)
+}
+
+// refreshBundles brings files describing volumes up to date with their
+// PVs, which gain their UID once stored and may be resized or relabeled.
+// Only volumes on mounted clusters are refreshed, clusters aren't mounted
+// for that.
+func (p *vzFSProvisioner) refreshBundles() {
+	volumes, err := p.client.Core().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		glog.Errorf("Unable to list volumes: %v", err)
+		return
+	}
+	for i := range volumes.Items {
+		volume := &volumes.Items[i]
+		if volume.Annotations[parentProvisionerAnn] != *provisionerID || volume.Spec.FlexVolume == nil {
+			continue
+		}
+		mount := mountDir + volume.Spec.FlexVolume.Options["clusterName"]
+		if mounted, _ := vstorage.IsVstorage(mount); !mounted {
+			continue
+		}
+		ploopPath, _ := vzvolume.Paths(mount, volume.Spec.FlexVolume.Options)
+		if !pathExists(path.Join(ploopPath, "DiskDescriptor.xml")) {
+			continue
+		}
+		if err := writeBundle(mount, volume); err != nil {
+			glog.Warningf("Unable to update files describing %s: %v", volume.Name, err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/metrics"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzstorage"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+var (
+	tierTotalBytes = metrics.NewGauge("vzstorage_tier_total_bytes",
+		"Total space of chunk servers in the tier.", "cluster", "tier")
+	tierFreeBytes = metrics.NewGauge("vzstorage_tier_free_bytes",
+		"Free space of chunk servers in the tier.", "cluster", "tier")
+	tierUsedBytes = metrics.NewGauge("vzstorage_tier_used_bytes",
+		"Used space of chunk servers in the tier.", "cluster", "tier")
+	licensedCapacityBytes = metrics.NewGauge("vzstorage_licensed_capacity_bytes",
+		"Capacity allowed by the cluster license, 0 if unlimited.", "cluster")
+)
+
+// clusterStats shares vstorage stat of a cluster between everything polling
+// it: capacity metrics and publishing, the over-commit limit, maintenance
+// latency and replica locality
+var clusterStats = vzstorage.NewStatCache(10 * time.Second)
+
+// updateCapacity refreshes capacity metrics of all mounted clusters. New
+// values replace old ones in place and only series of clusters which are
+// no longer mounted, or tiers which are gone, are removed, so scrapes
+// during a poll see every series. A cluster whose stat fails keeps its
+// last values.
+func updateCapacity() {
+	clusters := map[string]bool{}
+	failed := map[string]bool{}
+	tiers := map[string]bool{}
+	for _, cluster := range mountedClusters() {
+		clusters[cluster] = true
+		st, err := clusterStats.Stat(context.Background(), cluster)
+		if err != nil {
+			glog.Warningf("Unable to update capacity of cluster %s: %v", cluster, err)
+			failed[cluster] = true
+			continue
+		}
+		for _, t := range st.Tiers {
+			tierTotalBytes.Set(float64(t.Total), cluster, t.Tier)
+			tierFreeBytes.Set(float64(t.Free), cluster, t.Tier)
+			tierUsedBytes.Set(float64(t.Used()), cluster, t.Tier)
+			tiers[cluster+"/"+t.Tier] = true
+		}
+		licensedCapacityBytes.Set(float64(st.LicensedCapacity), cluster)
+	}
+
+	keepTier := func(labelValues []string) bool {
+		return failed[labelValues[0]] || tiers[labelValues[0]+"/"+labelValues[1]]
+	}
+	tierTotalBytes.Retain(keepTier)
+	tierFreeBytes.Retain(keepTier)
+	tierUsedBytes.Retain(keepTier)
+	licensedCapacityBytes.Retain(func(labelValues []string) bool { return clusters[labelValues[0]] })
+}
+
+// runCapacityPoller periodically updates capacity metrics
+func runCapacityPoller(period time.Duration) {
+	go wait.Forever(updateCapacity, period)
+}
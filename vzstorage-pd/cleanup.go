@@ -0,0 +1,193 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/journal"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/metrics"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzvolume"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	cleanupPeriod     = 30 * time.Second
+	cleanupMinBackoff = 30 * time.Second
+	cleanupMaxBackoff = time.Hour
+)
+
+var pendingCleanups = metrics.NewGauge("vzstorage_pending_cleanups",
+	"Number of leftovers of failed provisioning waiting to be removed.")
+
+// cleanupEntry describes a ploop volume left over by a failed Provision
+type cleanupEntry struct {
+	SecretNamespace string            `json:"secretNamespace"`
+	SecretName      string            `json:"secretName"`
+	Options         map[string]string `json:"options"`
+	Attempts        int               `json:"attempts"`
+	NextRetry       time.Time         `json:"nextRetry"`
+	LastError       string            `json:"lastError,omitempty"`
+}
+
+// cleanupQueue keeps leftovers of failed provisioning in a config map
+// and retries their removal with backoff until it succeeds
+type cleanupQueue struct {
+	configMapStore
+}
+
+func newCleanupQueue(client kubernetes.Interface, namespace, name string) *cleanupQueue {
+	return &cleanupQueue{configMapStore{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+	}}
+}
+
+// update modifies the queue and refreshes the gauge of pending cleanups
+func (q *cleanupQueue) update(fn func(data map[string]string)) error {
+	data, err := q.modify(fn)
+	if err == nil {
+		pendingCleanups.Set(float64(len(data)))
+	}
+	return err
+}
+
+// add queues a volume for removal
+func (q *cleanupQueue) add(share string, e cleanupEntry) {
+	e.NextRetry = time.Now().Add(cleanupMinBackoff)
+	data, err := json.Marshal(e)
+	if err != nil {
+		glog.Errorf("Unable to marshal cleanup entry for %s: %v", share, err)
+		return
+	}
+	err = q.update(func(d map[string]string) {
+		d[share] = string(data)
+	})
+	if err != nil {
+		glog.Errorf("Unable to queue %s for cleanup, it has to be removed manually: %v", share, err)
+		return
+	}
+	glog.Infof("Queued %s for cleanup", share)
+}
+
+// run processes the queue every period
+func (q *cleanupQueue) run(period time.Duration) {
+	wait.Forever(q.process, period)
+}
+
+func (q *cleanupQueue) process() {
+	cm, err := q.client.Core().ConfigMaps(q.namespace).Get(q.name, metav1.GetOptions{})
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			glog.Errorf("Unable to get cleanup queue %s/%s: %v", q.namespace, q.name, err)
+		}
+		pendingCleanups.Set(0)
+		return
+	}
+	pendingCleanups.Set(float64(len(cm.Data)))
+
+	// the controller retries a claim with the same share and paths, so a
+	// leftover may have become a live volume since it was queued
+	volumes, err := q.client.Core().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		glog.Errorf("Unable to list PVs to process cleanup queue: %v", err)
+		return
+	}
+	live := map[string]string{}
+	for _, volume := range volumes.Items {
+		if share, ok := volume.Annotations[vzShareAnn]; ok {
+			live[share] = volume.Name
+		}
+	}
+
+	now := time.Now()
+	for share, data := range cm.Data {
+		var e cleanupEntry
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			glog.Errorf("Dropping malformed cleanup entry %s: %v", share, err)
+			q.update(func(d map[string]string) { delete(d, share) })
+			continue
+		}
+		if pv, ok := live[share]; ok {
+			glog.Warningf("Dropping cleanup of %s, it is the volume of %s", share, pv)
+			q.update(func(d map[string]string) { delete(d, share) })
+			continue
+		}
+		if now.Before(e.NextRetry) {
+			continue
+		}
+
+		if err := q.cleanup(share, &e); err != nil {
+			e.Attempts++
+			e.LastError = err.Error()
+			backoff := cleanupMinBackoff << uint(e.Attempts)
+			if backoff > cleanupMaxBackoff || backoff <= 0 {
+				backoff = cleanupMaxBackoff
+			}
+			e.NextRetry = now.Add(backoff)
+			glog.Warningf("Cleanup of %s failed (attempt %d), next retry in %v: %v", share, e.Attempts, backoff, err)
+			if data, err := json.Marshal(e); err == nil {
+				q.update(func(d map[string]string) { d[share] = string(data) })
+			}
+			continue
+		}
+
+		glog.Infof("Leftover volume %s removed", share)
+		q.update(func(d map[string]string) { delete(d, share) })
+	}
+}
+
+// cleanup removes the volume of share described by e, succeeding if it is
+// gone. It waits while the share is journaled, i.e. provisioned again.
+func (q *cleanupQueue) cleanup(share string, e *cleanupEntry) error {
+	secret, err := tenantSecrets.get(e.SecretNamespace, e.SecretName)
+	if err != nil {
+		return err
+	}
+	cluster, err := clusterFromSecret(secret)
+	if err != nil {
+		return err
+	}
+	if err := prepareVstorage(context.Background(), nil, e.Options, cluster); err != nil {
+		return err
+	}
+
+	// a volume whose descriptor is gone can only have its image left
+	mount := mountDir + cluster.name
+	if _, err := journal.Read(journalPath(mount), share); err == nil {
+		return fmt.Errorf("%s is being provisioned again", share)
+	}
+	ploopPath, imageDir := vzvolume.Paths(mount, e.Options)
+	if !pathExists(ploopPath) && !pathExists(ploopPath+".deleted") {
+		return os.RemoveAll(imageDir)
+	}
+	return removePloop(context.Background(), mount, e.Options)
+}
+
+func pathExists(p string) bool {
+	_, err := os.Stat(p)
+	return !os.IsNotExist(err)
+}
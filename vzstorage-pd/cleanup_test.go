@@ -0,0 +1,69 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestCleanupSkipsLiveVolumes(t *testing.T) {
+	*provisionerID = "vz"
+	client := fake.NewSimpleClientset(&v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "pvc-1",
+			Annotations: map[string]string{vzShareAnn: "share-1"},
+		},
+	})
+	// the secret is missing, so a cleanup which gets to run fails
+	tenantSecrets = newSecretAccess(client, nil, *namespace, "")
+	q := newCleanupQueue(client, *namespace, "vz-cleanup")
+	for _, share := range []string{"share-1", "share-2"} {
+		data, err := json.Marshal(&cleanupEntry{
+			SecretNamespace: "team-a",
+			SecretName:      "vz-secret",
+			Options:         map[string]string{"volumePath": "v", "volumeID": share},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := q.update(func(d map[string]string) { d[share] = string(data) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q.process()
+	queue, err := q.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := queue["share-1"]; ok {
+		t.Errorf("Expected the cleanup of a share with a PV to be dropped")
+	}
+	var e cleanupEntry
+	if err := json.Unmarshal([]byte(queue["share-2"]), &e); err != nil {
+		t.Fatalf("Expected the leftover without PV to stay queued: %v", err)
+	}
+	if e.Attempts != 1 || !e.NextRetry.After(time.Now()) {
+		t.Errorf("Expected the failed cleanup to be retried later, got %+v", e)
+	}
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzstorage"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// vstorageCluster holds parameters to access a cluster, taken from a secret
+type vstorageCluster struct {
+	name     string
+	password string
+	// MDS addresses to use instead of auto-discovery, if not empty
+	mdsAddresses []string
+	// network interface MDS servers are reached through, if not empty
+	mdsInterface string
+	// proxy through which MDS servers are reached, if not nil
+	mdsProxy *vzstorage.Proxy
+	// extra arguments of vstorage-mount
+	mountOptions []string
+	// limit of capacity of volumes relative to the total space of the
+	// cluster, 0 if not limited
+	overcommit float64
+	// bytes per second all compactions on the cluster may reclaim
+	// together, 0 if unlimited
+	compactRate int64
+}
+
+func clusterFromSecret(secret *v1.Secret) (*vstorageCluster, error) {
+	c := &vstorageCluster{
+		name:         string(secret.Data["clusterName"]),
+		password:     string(secret.Data["clusterPassword"]),
+		mountOptions: strings.Fields(*mountOptions),
+		overcommit:   *overcommitLimit,
+		compactRate:  compactClusterLimit,
+	}
+	if c.name == "" {
+		return nil, fmt.Errorf("clusterName isn't specified in secret %s", secret.Name)
+	}
+	// the name makes paths of the cluster configuration and mount point
+	if err := vzstorage.ValidateClusterName(c.name); err != nil {
+		return nil, fmt.Errorf("Invalid clusterName in secret %s: %v", secret.Name, err)
+	}
+
+	if mds := string(secret.Data["mdsAddresses"]); mds != "" {
+		c.mdsInterface = string(secret.Data["mdsInterface"])
+		addrs, err := vzstorage.ParseMDSAddresses(mds, c.mdsInterface)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid mdsAddresses in secret %s: %v", secret.Name, err)
+		}
+		c.mdsAddresses = addrs
+	}
+	proxy := *mdsProxy
+	if p, ok := secret.Data["mdsProxy"]; ok {
+		if len(c.mdsAddresses) == 0 && len(p) != 0 {
+			return nil, fmt.Errorf("mdsProxy in secret %s needs mdsAddresses, clusters can't be discovered through a proxy", secret.Name)
+		}
+		proxy = string(p)
+	}
+	if proxy != "" && len(c.mdsAddresses) != 0 {
+		p, err := vzstorage.ParseProxy(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid mdsProxy of secret %s: %v", secret.Name, err)
+		}
+		c.mdsProxy = p
+	}
+	if opts, ok := secret.Data["mountOptions"]; ok {
+		c.mountOptions = strings.Fields(string(opts))
+	}
+	if rate, ok := secret.Data["compactClusterRate"]; ok {
+		r, err := parseRate(string(rate))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid compactClusterRate %q in secret %s: %v", rate, secret.Name, err)
+		}
+		c.compactRate = r
+	}
+	if ratio, ok := secret.Data["overcommitRatio"]; ok {
+		r, err := strconv.ParseFloat(string(ratio), 64)
+		if err != nil || r < 0 {
+			return nil, fmt.Errorf("Invalid overcommitRatio %q in secret %s", ratio, secret.Name)
+		}
+		c.overcommit = r
+	}
+	return c, nil
+}
@@ -0,0 +1,403 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// kubectl-vz is a kubectl plugin showing Virtuozzo volumes and requesting
+// operations on them from the provisioner
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	driver = "virtuozzo/ploop"
+	// annotations handled by the provisioner
+	imageSizeAnn = "virtuozzo.com/image-size"
+	compactAnn   = "virtuozzo.com/compact"
+	verifyAnn    = "virtuozzo.com/verify"
+	verifyResult = "virtuozzo.com/verify-result"
+	// label of config maps handled by the provisioner
+	importLabel = "virtuozzo.com/import"
+	// label of volume histories kept by the provisioner
+	historyLabel = "virtuozzo.com/volume-history"
+	// label of volumes most in need of maintenance published by the
+	// provisioner
+	adviceLabel = "virtuozzo.com/maintenance-advice"
+)
+
+var (
+	kubeconfig = flag.String("kubeconfig", "", "Path to the kubeconfig file. The default loading rules of kubectl are used if not set.")
+	namespace  = flag.String("n", "", "Namespace of claims. The namespace of the current context is used if not set.")
+)
+
+const usage = `Usage: kubectl-vz [flags] <command> [args]
+
+Commands:
+  list                  list Virtuozzo volumes with their image size, tier and replicas
+  node <claim>          show nodes where the volume of the claim is used
+  compact <claim>       ask the provisioner to compact the image of the claim
+  verify <claim> [-repair]
+                        ask the provisioner to check the image of the claim,
+                        -repair fixes problems found
+  events <claim> [-f]   show events of the claim, -f follows new events
+  history <claim>       show operations on volumes of the claim, including
+                        deleted ones
+  advice                list volumes which would benefit from compaction most,
+                        as measured by the provisioner
+  import <source> <storage class> <claim>
+                        ask the provisioner to convert a raw or qcow2 image on
+                        the cluster of the storage class into a new claim
+
+Flags:
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = *kubeconfig
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{})
+	config, err := clientConfig.ClientConfig()
+	if err != nil {
+		fatalf("Unable to load kubeconfig: %v", err)
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		fatalf("Failed to create client: %v", err)
+	}
+	if *namespace == "" {
+		if *namespace, _, err = clientConfig.Namespace(); err != nil {
+			fatalf("Unable to get namespace: %v", err)
+		}
+	}
+
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		err = list(client)
+	case args[0] == "node" && len(args) == 2:
+		err = node(client, args[1])
+	case args[0] == "compact" && len(args) == 2:
+		err = compact(client, args[1])
+	case args[0] == "verify" && len(args) == 2:
+		err = verify(client, args[1], "check")
+	case args[0] == "verify" && len(args) == 3 && args[2] == "-repair":
+		err = verify(client, args[1], "repair")
+	case args[0] == "import" && len(args) == 4:
+		err = importImage(client, args[1], args[2], args[3])
+	case args[0] == "events" && len(args) == 2:
+		err = events(client, args[1], false)
+	case args[0] == "events" && len(args) == 3 && args[2] == "-f":
+		err = events(client, args[1], true)
+	case args[0] == "history" && len(args) == 2:
+		err = history(client, args[1])
+	case args[0] == "advice" && len(args) == 1:
+		err = advice(client)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fatalf("%v", err)
+	}
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "error: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+func list(client kubernetes.Interface) error {
+	volumes, err := client.Core().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tCLAIM\tSTATUS\tCAPACITY\tIMAGE SIZE\tTIER\tREPLICAS")
+	for _, v := range volumes.Items {
+		flex := v.Spec.FlexVolume
+		if flex == nil || flex.Driver != driver {
+			continue
+		}
+		claim := ""
+		if ref := v.Spec.ClaimRef; ref != nil {
+			claim = ref.Namespace + "/" + ref.Name
+		}
+		capacity := v.Spec.Capacity[v1.ResourceStorage]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", v.Name, claim, v.Status.Phase,
+			capacity.String(), orNone(v.Annotations[imageSizeAnn]),
+			orNone(flex.Options["vzsTier"]), orNone(flex.Options["vzsReplicas"]))
+	}
+	return w.Flush()
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "<none>"
+	}
+	return s
+}
+
+// node lists pods using the claim. The image of a volume is mounted on the
+// node of each such pod, which is running.
+func node(client kubernetes.Interface, claim string) error {
+	if _, err := client.Core().PersistentVolumeClaims(*namespace).Get(claim, metav1.GetOptions{}); err != nil {
+		return err
+	}
+	pods, err := client.Core().Pods(*namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "POD\tNODE\tSTATUS")
+	for _, pod := range pods.Items {
+		for _, vol := range pod.Spec.Volumes {
+			if c := vol.PersistentVolumeClaim; c != nil && c.ClaimName == claim {
+				fmt.Fprintf(w, "%s\t%s\t%s\n", pod.Name, orNone(pod.Spec.NodeName), pod.Status.Phase)
+				break
+			}
+		}
+	}
+	return w.Flush()
+}
+
+// compact annotates the claim, the provisioner compacts the image and
+// reports the result by an event on the claim
+func compact(client kubernetes.Interface, name string) error {
+	claim, err := client.Core().PersistentVolumeClaims(*namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if claim.Spec.VolumeName == "" {
+		return fmt.Errorf("claim %s is not bound", name)
+	}
+	if claim.Annotations == nil {
+		claim.Annotations = map[string]string{}
+	}
+	claim.Annotations[compactAnn] = "true"
+	if _, err := client.Core().PersistentVolumeClaims(*namespace).Update(claim); err != nil {
+		return err
+	}
+	fmt.Printf("Compaction of %s requested, see kubectl-vz events %s\n", name, name)
+	return nil
+}
+
+// verify annotates the claim, the provisioner reports the result by an
+// event and in another annotation of the claim
+func verify(client kubernetes.Interface, name, mode string) error {
+	claim, err := client.Core().PersistentVolumeClaims(*namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if claim.Spec.VolumeName == "" {
+		return fmt.Errorf("claim %s is not bound", name)
+	}
+	if claim.Annotations == nil {
+		claim.Annotations = map[string]string{}
+	}
+	claim.Annotations[verifyAnn] = mode
+	if _, err := client.Core().PersistentVolumeClaims(*namespace).Update(claim); err != nil {
+		return err
+	}
+	if last := claim.Annotations[verifyResult]; last != "" {
+		fmt.Printf("Last verification: %s\n", last)
+	}
+	fmt.Printf("Verification of %s requested, see kubectl-vz events %s\n", name, name)
+	return nil
+}
+
+// importImage creates an import request, the provisioner reports progress
+// in the request and by events on it
+func importImage(client kubernetes.Interface, source, class, claim string) error {
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "import-" + claim,
+			Labels: map[string]string{importLabel: ""},
+		},
+		Data: map[string]string{
+			"source":       source,
+			"storageClass": class,
+			"claim":        claim,
+		},
+	}
+	if _, err := client.Core().ConfigMaps(*namespace).Create(cm); err != nil {
+		return err
+	}
+	fmt.Printf("Import of %s requested, see kubectl get configmap %s -o yaml\n", source, cm.Name)
+	return nil
+}
+
+func events(client kubernetes.Interface, claim string, follow bool) error {
+	opts := metav1.ListOptions{
+		FieldSelector: fields.Set{
+			"involvedObject.kind": "PersistentVolumeClaim",
+			"involvedObject.name": claim,
+		}.String(),
+	}
+	list, err := client.Core().Events(*namespace).List(opts)
+	if err != nil {
+		return err
+	}
+	for i := range list.Items {
+		printEvent(&list.Items[i])
+	}
+	if !follow {
+		return nil
+	}
+
+	opts.ResourceVersion = list.ResourceVersion
+	watcher, err := client.Core().Events(*namespace).Watch(opts)
+	if err != nil {
+		return err
+	}
+	defer watcher.Stop()
+	for e := range watcher.ResultChan() {
+		if event, ok := e.Object.(*v1.Event); ok {
+			printEvent(event)
+		}
+	}
+	return nil
+}
+
+func printEvent(e *v1.Event) {
+	fmt.Printf("%s\t%s\t%s\t%s\n", e.LastTimestamp.Format("2006-01-02 15:04:05"), e.Type, e.Reason, e.Message)
+}
+
+// historyEntry is an operation in a volume history
+type historyEntry struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	Result    string    `json:"result"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// history prints histories of volumes the claim had, which outlive the
+// claim and its volumes for a while
+func history(client kubernetes.Interface, claim string) error {
+	list, err := client.Core().ConfigMaps(*namespace).List(metav1.ListOptions{LabelSelector: historyLabel})
+	if err != nil {
+		return err
+	}
+	var histories []v1.ConfigMap
+	for _, cm := range list.Items {
+		if cm.Data["claim"] == claim {
+			histories = append(histories, cm)
+		}
+	}
+	if len(histories) == 0 {
+		return fmt.Errorf("no history of claim %s", claim)
+	}
+	sort.Sort(byCreation(histories))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tVOLUME\tOPERATION\tRESULT\tERROR")
+	for _, cm := range histories {
+		var entries []historyEntry
+		if err := json.Unmarshal([]byte(cm.Data["history"]), &entries); err != nil {
+			return fmt.Errorf("malformed history %s: %v", cm.Name, err)
+		}
+		for _, e := range entries {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", e.Time.Local().Format("2006-01-02 15:04:05"),
+				cm.Data["pv"], e.Operation, e.Result, e.Error)
+		}
+	}
+	return w.Flush()
+}
+
+type byCreation []v1.ConfigMap
+
+func (b byCreation) Len() int      { return len(b) }
+func (b byCreation) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byCreation) Less(i, j int) bool {
+	return b[i].CreationTimestamp.Before(b[j].CreationTimestamp)
+}
+
+// volumeAdvice is a volume which would benefit from maintenance
+type volumeAdvice struct {
+	Volume      string `json:"volume"`
+	Claim       string `json:"claim"`
+	Allocated   int64  `json:"allocatedBytes"`
+	Used        int64  `json:"usedBytes"`
+	Reclaimable int64  `json:"reclaimableBytes"`
+	Deltas      int    `json:"deltas"`
+}
+
+// advice prints volumes published by provisioners as most in need of
+// maintenance, those whose compaction would return most space first
+func advice(client kubernetes.Interface) error {
+	list, err := client.Core().ConfigMaps(v1.NamespaceAll).List(metav1.ListOptions{LabelSelector: adviceLabel})
+	if err != nil {
+		return err
+	}
+	if len(list.Items) == 0 {
+		return fmt.Errorf("no maintenance advice, is -maintenance-advice-interval of the provisioner set?")
+	}
+	var advices []volumeAdvice
+	for _, cm := range list.Items {
+		var a []volumeAdvice
+		if err := json.Unmarshal([]byte(cm.Data["advice"]), &a); err != nil {
+			return fmt.Errorf("malformed advice %s/%s: %v", cm.Namespace, cm.Name, err)
+		}
+		advices = append(advices, a...)
+	}
+	sort.Sort(byReclaimable(advices))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tCLAIM\tALLOCATED\tUSED\tRECLAIMABLE\tDELTAS")
+	for _, a := range advices {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\n", a.Volume, a.Claim, quantity(a.Allocated),
+			quantity(a.Used), quantity(a.Reclaimable), a.Deltas)
+	}
+	return w.Flush()
+}
+
+func quantity(bytes int64) string {
+	return resource.NewQuantity(bytes, resource.BinarySI).String()
+}
+
+type byReclaimable []volumeAdvice
+
+func (b byReclaimable) Len() int      { return len(b) }
+func (b byReclaimable) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byReclaimable) Less(i, j int) bool {
+	if b[i].Reclaimable != b[j].Reclaimable {
+		return b[i].Reclaimable > b[j].Reclaimable
+	}
+	return b[i].Deltas > b[j].Deltas
+}
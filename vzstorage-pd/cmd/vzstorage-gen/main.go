@@ -0,0 +1,105 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// vzstorage-gen renders deployment manifests of the provisioner and the
+// schema of volume options
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/manifests"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzvolume"
+)
+
+const usage = `Usage: vzstorage-gen manifests [flags]
+       vzstorage-gen options-schema
+
+manifests renders RBAC, the provisioner deployment, the driver installer
+daemon set, example secrets and storage classes from a config file, see
+deploy/gen.yaml.
+
+options-schema prints the JSON schema of flexvolume options of volumes.
+
+Flags of manifests:
+`
+
+func main() {
+	fs := flag.NewFlagSet("manifests", flag.ExitOnError)
+	config := fs.String("config", "gen.yaml", "Path to the config file")
+	out := fs.String("out", "", "Directory to write manifests to. They are printed if empty")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		fs.PrintDefaults()
+	}
+	if len(os.Args) == 2 && os.Args[1] == "options-schema" {
+		schema, err := vzvolume.Schema()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s\n", schema)
+		return
+	}
+	if len(os.Args) < 2 || os.Args[1] != "manifests" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	fs.Parse(os.Args[2:])
+
+	if err := generate(*config, *out); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func generate(config, out string) error {
+	data, err := ioutil.ReadFile(config)
+	if err != nil {
+		return err
+	}
+	c, err := manifests.Load(data)
+	if err != nil {
+		return fmt.Errorf("invalid config %s: %v", config, err)
+	}
+	ms, err := manifests.Render(c)
+	if err != nil {
+		return err
+	}
+
+	if out == "" {
+		for i, m := range ms {
+			if i != 0 {
+				fmt.Println("---")
+			}
+			fmt.Printf("# %s\n%s", m.Name, m.Data)
+		}
+		return nil
+	}
+	if err := os.MkdirAll(out, 0755); err != nil {
+		return err
+	}
+	for _, m := range ms {
+		if err := ioutil.WriteFile(path.Join(out, m.Name), m.Data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
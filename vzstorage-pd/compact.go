@@ -0,0 +1,146 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzvolume"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// compactAnn set to "true" or "now" on a claim requests compaction of
+	// the image of its volume. It's set on claims, so that users who can't
+	// edit PVs can request it; operators may set it on the PV as well.
+	compactAnn = "virtuozzo.com/compact"
+	// compactResultAnn on the annotated claim or PV is the time and
+	// outcome of its last compaction
+	compactResultAnn = "virtuozzo.com/compact-result"
+	compactPeriod    = 30 * time.Second
+)
+
+// runCompactor periodically looks for claims and PVs annotated for
+// compaction
+func (p *vzFSProvisioner) runCompactor(period time.Duration) {
+	wait.Forever(p.processCompactions, period)
+}
+
+func (p *vzFSProvisioner) processCompactions() {
+	var nodes map[string]string
+	for _, r := range p.maintenanceRequests(compactAnn) {
+		if r.value != "true" && r.value != maintenanceNow {
+			continue
+		}
+		if nodes == nil {
+			nodes = p.maintenance.claimNodes()
+		}
+		// the image is mounted on the provisioner node for compaction,
+		// which vstorage doesn't allow while a pod has it leased
+		if node := nodes[r.claim.Namespace+"/"+r.claim.Name]; node != "" {
+			p.postponeMaintenance(r, "compaction", node)
+			continue
+		}
+		r := r
+		p.maintenance.start("compaction", r.claim, r.volume, nodes, func() { p.compactClaim(r) })
+	}
+}
+
+func (p *vzFSProvisioner) compactClaim(r *maintenanceRequest) {
+	volume := r.volume
+	err := p.compact(volume)
+	p.history.add(volume.Spec.ClaimRef, volume.Name, "Compact", err, false)
+	result := "OK"
+	if err != nil {
+		glog.Errorf("Unable to compact %s: %v", volume.Name, err)
+		p.recorder.Eventf(r.object(), v1.EventTypeWarning, "CompactionFailed", "Unable to compact the image: %v", err)
+		result = "Failed: " + err.Error()
+	} else {
+		glog.Infof("Compacted %s", volume.Name)
+		p.recorder.Event(r.object(), v1.EventTypeNormal, "Compacted", "The image is compacted")
+	}
+
+	// a failed compaction is not retried, it has to be requested again
+	p.updateAnnotations(r, func(ann map[string]string) {
+		delete(ann, compactAnn)
+		delete(ann, maintenancePendingAnn)
+		ann[compactResultAnn] = time.Now().UTC().Format(time.RFC3339) + " " + result
+	})
+}
+
+// updateClaimAnnotations applies fn to annotations of the current version
+// of the claim, which may have changed while a job was running
+func (p *vzFSProvisioner) updateClaimAnnotations(claim *v1.PersistentVolumeClaim, fn func(map[string]string)) {
+	claim, err := p.client.Core().PersistentVolumeClaims(claim.Namespace).Get(claim.Name, metav1.GetOptions{})
+	if err == nil {
+		if claim.Annotations == nil {
+			claim.Annotations = map[string]string{}
+		}
+		fn(claim.Annotations)
+		_, err = p.client.Core().PersistentVolumeClaims(claim.Namespace).Update(claim)
+	}
+	if err != nil {
+		glog.Errorf("Unable to update claim %s/%s: %v", claim.Namespace, claim.Name, err)
+	}
+}
+
+// updateVolumeAnnotations applies fn to annotations of the current version
+// of the PV
+func (p *vzFSProvisioner) updateVolumeAnnotations(volume *v1.PersistentVolume, fn func(map[string]string)) {
+	volume, err := p.client.Core().PersistentVolumes().Get(volume.Name, metav1.GetOptions{})
+	if err == nil {
+		if volume.Annotations == nil {
+			volume.Annotations = map[string]string{}
+		}
+		fn(volume.Annotations)
+		_, err = p.client.Core().PersistentVolumes().Update(volume)
+	}
+	if err != nil {
+		glog.Errorf("Unable to update volume %s: %v", volume.Name, err)
+	}
+}
+
+// compact returns unused blocks of the image to the cluster. The image is
+// mounted for that on this node, so a volume used by a pod can't be
+// compacted, vstorage doesn't let a leased image be mounted elsewhere.
+func (p *vzFSProvisioner) compact(volume *v1.PersistentVolume) error {
+	if volume.Spec.FlexVolume == nil {
+		return fmt.Errorf("volume is not a flexvolume")
+	}
+	secretNamespace, secretName := volumeSecret(volume)
+	secret, err := tenantSecrets.get(secretNamespace, secretName)
+	if err != nil {
+		return err
+	}
+	cluster, err := clusterFromSecret(secret)
+	if err != nil {
+		return err
+	}
+	options := volume.Spec.FlexVolume.Options
+	if err := p.prepareVstorage(options, cluster, secret); err != nil {
+		return err
+	}
+
+	mount := mountDir + cluster.name
+	ploopPath, _ := vzvolume.Paths(mount, options)
+	return p.compactBudgets.compact(mount, path.Join(ploopPath, "DiskDescriptor.xml"), cluster, options)
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/juju/ratelimit"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzvolume"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// compactChunkPeriod is how long a chunk of a rate limited compaction
+// takes at the rate, the image is compacted in steps of that much space
+const compactChunkPeriod = 10 * time.Second
+
+// minCompactChunk is the smallest step of a rate limited compaction
+const minCompactChunk = 1024 * 1024
+
+// compactClusterLimit is -compact-cluster-rate in bytes per second
+var compactClusterLimit int64
+
+// compactBudgets limits how fast images are compacted, per volume and in
+// total per cluster, so that compaction doesn't compete with IO of tenants.
+// Images are compacted in chunks of space, each taking its size from the
+// budgets before it runs. A nil *compactBudgets doesn't limit anything.
+type compactBudgets struct {
+	// bytes per second of a single compaction, 0 if unlimited
+	volumeRate int64
+	mutex      sync.Mutex
+	clusters   map[string]*clusterBudget
+}
+
+// clusterBudget is the bucket shared by compactions on a cluster, along
+// with the rate it was made for
+type clusterBudget struct {
+	rate   int64
+	bucket *ratelimit.Bucket
+}
+
+func newCompactBudgets(volumeRate int64) *compactBudgets {
+	return &compactBudgets{volumeRate: volumeRate, clusters: map[string]*clusterBudget{}}
+}
+
+// parseRate parses a rate in bytes per second given as a quantity like
+// 50Mi, an empty one is unlimited
+func parseRate(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	q, err := resource.ParseQuantity(s)
+	if err != nil {
+		return 0, err
+	}
+	if q.Sign() < 0 {
+		return 0, fmt.Errorf("rate %s is negative", s)
+	}
+	return q.Value(), nil
+}
+
+func chunkOf(rate int64) int64 {
+	chunk := rate * int64(compactChunkPeriod/time.Second)
+	if chunk < minCompactChunk {
+		chunk = minCompactChunk
+	}
+	return chunk
+}
+
+// clusterBucket returns the shared budget of compactions on the cluster,
+// nil if it is unlimited. The bucket is replaced when the rate changes.
+func (b *compactBudgets) clusterBucket(cluster *vstorageCluster) *ratelimit.Bucket {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if cluster.compactRate == 0 {
+		delete(b.clusters, cluster.name)
+		return nil
+	}
+	budget, ok := b.clusters[cluster.name]
+	if !ok || budget.rate != cluster.compactRate {
+		budget = &clusterBudget{
+			rate:   cluster.compactRate,
+			bucket: ratelimit.NewBucketWithRate(float64(cluster.compactRate), chunkOf(cluster.compactRate)),
+		}
+		b.clusters[cluster.name] = budget
+	}
+	return budget.bucket
+}
+
+// reserve waits until the budget of the cluster allows bytes of IO, for
+// jobs like snapshot merges which can't be split into chunks. A single job
+// runs at full speed, the rate holds over the jobs of the cluster.
+func (b *compactBudgets) reserve(cluster *vstorageCluster, bytes int64) {
+	if b == nil || bytes <= 0 {
+		return
+	}
+	if bucket := b.clusterBucket(cluster); bucket != nil {
+		bucket.Wait(bytes)
+	}
+}
+
+// compact runs ploop balloon discard on the image, in chunks paced by the
+// budgets if any applies
+func (b *compactBudgets) compact(mount, dd string, cluster *vstorageCluster, options map[string]string) error {
+	var buckets []*ratelimit.Bucket
+	var chunk int64
+	if b != nil && b.volumeRate != 0 {
+		buckets = append(buckets, ratelimit.NewBucketWithRate(float64(b.volumeRate), chunkOf(b.volumeRate)))
+		chunk = chunkOf(b.volumeRate)
+	}
+	if b != nil {
+		if bucket := b.clusterBucket(cluster); bucket != nil {
+			buckets = append(buckets, bucket)
+			if c := chunkOf(cluster.compactRate); chunk == 0 || c < chunk {
+				chunk = c
+			}
+		}
+	}
+	if len(buckets) == 0 {
+		return discard(dd)
+	}
+
+	// ploop takes sizes in megabytes
+	chunk = (chunk + minCompactChunk - 1) / minCompactChunk * minCompactChunk
+	for {
+		for _, bucket := range buckets {
+			bucket.Wait(chunk)
+		}
+		before, err := vzvolume.Allocated(mount, options)
+		if err != nil {
+			return err
+		}
+		if err := discard(dd, "--to-free", fmt.Sprintf("%dM", chunk/minCompactChunk)); err != nil {
+			return err
+		}
+		after, err := vzvolume.Allocated(mount, options)
+		if err != nil {
+			return err
+		}
+		freed := int64(before) - int64(after)
+		glog.V(4).Infof("Compaction of %s freed %d bytes", dd, freed)
+		// a chunk which frees much less than asked means that there is
+		// nothing left worth reclaiming
+		if freed < chunk/2 {
+			return nil
+		}
+	}
+}
+
+func discard(dd string, args ...string) error {
+	args = append([]string{"balloon", "discard", "--automount"}, args...)
+	out, err := exec.Command("ploop", append(args, dd)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
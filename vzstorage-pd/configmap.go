@@ -0,0 +1,87 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// how many times to retry an update of a config map on conflicts
+const configMapUpdateRetries = 5
+
+// configMapStore keeps provisioner state in the data of a config map
+type configMapStore struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	// labels of the config map when it is created
+	labels map[string]string
+}
+
+// get returns the data of the config map, which is empty if the config
+// map doesn't exist yet
+func (s *configMapStore) get() (map[string]string, error) {
+	cm, err := s.client.Core().ConfigMaps(s.namespace).Get(s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cm.Data == nil {
+		return map[string]string{}, nil
+	}
+	return cm.Data, nil
+}
+
+// modify applies fn to the data of the config map and stores the result,
+// retrying on update conflicts. The config map is created if needed.
+func (s *configMapStore) modify(fn func(data map[string]string)) (map[string]string, error) {
+	var err error
+	for i := 0; i < configMapUpdateRetries; i++ {
+		var cm *v1.ConfigMap
+		cm, err = s.client.Core().ConfigMaps(s.namespace).Get(s.name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			cm = &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      s.name,
+					Namespace: s.namespace,
+					Labels:    s.labels,
+				},
+				Data: map[string]string{},
+			}
+			fn(cm.Data)
+			_, err = s.client.Core().ConfigMaps(s.namespace).Create(cm)
+		} else if err == nil {
+			if cm.Data == nil {
+				cm.Data = map[string]string{}
+			}
+			fn(cm.Data)
+			_, err = s.client.Core().ConfigMaps(s.namespace).Update(cm)
+		}
+		if err == nil {
+			return cm.Data, nil
+		}
+		if !(apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)) {
+			break
+		}
+	}
+	return nil, err
+}
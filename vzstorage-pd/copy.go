@@ -0,0 +1,225 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzvolume"
+	"github.com/virtuozzo/goploop-cli"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// copyVolume copies the image of the PV to the cluster of the secret
+// target, given as namespace/name, and writes a manifest of a PV of the
+// copy to w. The image is copied from a snapshot, which is taken offline,
+// so the volume must not be in use. The copy is verified by comparing
+// checksums of both devices.
+func (p *vzFSProvisioner) copyVolume(name, target string, w io.Writer) error {
+	volume, err := p.client.Core().PersistentVolumes().Get(name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if _, ok := volume.Annotations[vzShareAnn]; !ok || volume.Spec.FlexVolume == nil {
+		return fmt.Errorf("%s is not a Virtuozzo Storage volume", name)
+	}
+	options := volume.Spec.FlexVolume.Options
+
+	secretNamespace, secretName := volumeSecret(volume)
+	secret, err := tenantSecrets.get(secretNamespace, secretName)
+	if err != nil {
+		return err
+	}
+	cluster, err := clusterFromSecret(secret)
+	if err != nil {
+		return err
+	}
+	if err := p.prepareVstorage(options, cluster, secret); err != nil {
+		return err
+	}
+
+	parts := strings.SplitN(target, "/", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("the target secret %q has to be namespace/name", target)
+	}
+	targetSecret, err := tenantSecrets.get(parts[0], parts[1])
+	if err != nil {
+		return err
+	}
+	targetCluster, err := clusterFromSecret(targetSecret)
+	if err != nil {
+		return err
+	}
+	if targetCluster.name == cluster.name {
+		return fmt.Errorf("%s is already on cluster %s", name, cluster.name)
+	}
+	if err := p.prepareVstorage(options, targetCluster, targetSecret); err != nil {
+		return err
+	}
+
+	mount, targetMount := mountDir+cluster.name, mountDir+targetCluster.name
+	size, err := vzvolume.ImageSize(mount, options)
+	if err != nil {
+		return err
+	}
+	copyOptions := map[string]string{}
+	for k, v := range options {
+		copyOptions[k] = v
+	}
+	copyOptions["clusterName"] = targetCluster.name
+	copyOptions[vzvolume.SizeOption] = strconv.FormatInt(size, 10)
+	delete(copyOptions, "finalizer")
+	if options["optionsFromSystem"] == "true" {
+		copyOptions["secretName"] = parts[1]
+	}
+
+	if err := p.checkNotInUse(volume); err != nil {
+		return fmt.Errorf("%s can't be copied, scale its workload down first: %v", name, err)
+	}
+	// snapshots left by interrupted copies are already stale
+	if err := p.merges.queueLeftovers(volume.Name, vzvolume.SnapshotsDir(mount, options), options["volumeID"]+"-copy"); err != nil {
+		return err
+	}
+	snapshotPath, err := vzvolume.Snapshot(mount, options, tempSnapshotName(options, "-copy-"))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := p.merges.queue(volume.Name, snapshotPath); err != nil {
+			glog.Errorf("Unable to queue deletion of snapshot %s, the next copy queues it: %v", snapshotPath, err)
+		}
+	}()
+
+	if err := vzvolume.CreateVolume(context.Background(), targetMount, copyOptions, p.attrs.get(targetCluster.name)); err != nil {
+		return err
+	}
+	targetPath, _ := vzvolume.Paths(targetMount, copyOptions)
+	if err := copyImage(path.Join(snapshotPath, "DiskDescriptor.xml"), path.Join(targetPath, "DiskDescriptor.xml")); err != nil {
+		if e := vzvolume.DeleteVolume(context.Background(), targetMount, copyOptions); e != nil {
+			glog.Errorf("Unable to remove the copy of %s: %v", name, e)
+		}
+		return err
+	}
+	glog.Infof("Copied %s to cluster %s", name, targetCluster.name)
+
+	pv := &v1.PersistentVolume{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolume"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   volume.Name,
+			Labels: volume.Labels,
+			Annotations: map[string]string{
+				parentProvisionerAnn: *provisionerID,
+				vzShareAnn:           volume.Annotations[vzShareAnn],
+				clusterAnn:           targetCluster.name,
+			},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			Capacity:                      volume.Spec.Capacity,
+			AccessModes:                   volume.Spec.AccessModes,
+			PersistentVolumeReclaimPolicy: volume.Spec.PersistentVolumeReclaimPolicy,
+			StorageClassName:              volume.Spec.StorageClassName,
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				FlexVolume: &v1.FlexVolumeSource{
+					Driver:  vzvolume.Driver,
+					Options: copyOptions,
+				},
+			},
+		},
+	}
+	if volume.Spec.FlexVolume.SecretRef != nil {
+		pv.Spec.FlexVolume.SecretRef = &v1.LocalObjectReference{Name: parts[1]}
+	}
+	data, err := yaml.Marshal(pv)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// copyImage copies the content of the image of descriptor src to the
+// image of descriptor dst block by block, and verifies the copy by
+// reading it back
+func copyImage(src, dst string) error {
+	s, err := ploop.Open(src)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	srcDevice, err := s.Mount(&ploop.MountParam{Readonly: true})
+	if err != nil {
+		return err
+	}
+	defer s.Umount()
+
+	d, err := ploop.Open(dst)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	dstDevice, err := d.Mount(&ploop.MountParam{})
+	if err != nil {
+		return err
+	}
+	defer d.Umount()
+
+	in, err := os.Open(srcDevice)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dstDevice, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(out, h), in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to copy %s to %s: %v", srcDevice, dstDevice, err)
+	}
+
+	check, err := os.Open(dstDevice)
+	if err != nil {
+		return err
+	}
+	defer check.Close()
+	hc := sha256.New()
+	if _, err := io.CopyN(hc, check, n); err != nil {
+		return fmt.Errorf("Unable to read back %s: %v", dstDevice, err)
+	}
+	if !bytes.Equal(h.Sum(nil), hc.Sum(nil)) {
+		return fmt.Errorf("checksum of the copy in %s doesn't match the original", dst)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/deferred"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const deferredDeletePeriod = time.Minute
+
+// deferredDeletesName is the name of the index config map of deferred
+// deletes, config maps of volumes are named after it
+func deferredDeletesName() string {
+	return *provisionerID + "-deferred-deletes"
+}
+
+// deferredDeletes keeps released volumes for the grace period before their
+// images are removed. A volume can be restored until then by listing its
+// PV in the undelete annotation of the index config map.
+type deferredDeletes struct {
+	*deferred.Deletes
+	grace time.Duration
+}
+
+func newDeferredDeletes(p *vzFSProvisioner, client kubernetes.Interface, namespace, name string, grace time.Duration) *deferredDeletes {
+	d := deferred.New(client, namespace, name, grace)
+	d.Delete = func(volume *v1.PersistentVolume) error {
+		err := p.operations.run("Delete "+volume.Name, func(ctx context.Context) error {
+			return p.delete(ctx, volume)
+		})
+		p.recordDelete("Delete", volume, err)
+		return err
+	}
+	d.Restored = func(volume *v1.PersistentVolume) {
+		glog.Infof("Undeleted %s", volume.Name)
+		p.recordDelete("Undelete", volume, nil)
+	}
+	return &deferredDeletes{Deletes: d, grace: grace}
+}
+
+// add defers deletion of the volume. The PV itself is removed by the
+// controller as usual.
+func (d *deferredDeletes) add(volume *v1.PersistentVolume) error {
+	if err := d.Add(volume); err != nil {
+		return err
+	}
+	glog.Infof("Deletion of %s is deferred for %v", volume.Name, d.grace)
+	return nil
+}
+
+// pendingDeletes returns the names of PVs whose deletion is deferred. It
+// works without -delete-grace-period too, deletes deferred before it was
+// turned off are still pending.
+func (p *vzFSProvisioner) pendingDeletes() (map[string]bool, error) {
+	return deferred.New(p.client, *namespace, deferredDeletesName(), 0).Pending()
+}
+
+func (d *deferredDeletes) run(period time.Duration) {
+	wait.Forever(func() {
+		if err := d.Process(); err != nil {
+			glog.Errorf("%v", err)
+		}
+	}, period)
+}
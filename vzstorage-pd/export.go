@@ -0,0 +1,136 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/ghodss/yaml"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzstorage"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzvolume"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+
+	"github.com/virtuozzo/goploop-cli"
+)
+
+// volumeRecipe is everything needed to recreate a volume identical to an
+// existing one, possibly on another cluster
+type volumeRecipe struct {
+	PersistentVolume string                           `json:"persistentVolume"`
+	StorageClass     string                           `json:"storageClass,omitempty"`
+	Capacity         string                           `json:"capacity"`
+	AccessModes      []v1.PersistentVolumeAccessMode  `json:"accessModes"`
+	ReclaimPolicy    v1.PersistentVolumeReclaimPolicy `json:"reclaimPolicy"`
+	Parameters       map[string]string                `json:"parameters"`
+	Secret           secretRecipe                     `json:"secret"`
+	Cluster          string                           `json:"cluster"`
+	Attributes       map[string]string                `json:"attributes"`
+	Image            imageRecipe                      `json:"image"`
+}
+
+type secretRecipe struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+type imageRecipe struct {
+	// Size and BlockSize are in bytes
+	Size      uint64 `json:"size"`
+	BlockSize uint64 `json:"blockSize"`
+	Version   int    `json:"version"`
+}
+
+// exportRecipe writes the recipe of the volume as YAML to w. Attributes
+// and the image format are read from the cluster rather than taken from
+// the StorageClass, as they may have been changed since provisioning.
+func (p *vzFSProvisioner) exportRecipe(name string, w io.Writer) error {
+	volume, err := p.client.Core().PersistentVolumes().Get(name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if _, ok := volume.Annotations[vzShareAnn]; !ok || volume.Spec.FlexVolume == nil {
+		return fmt.Errorf("%s is not a Virtuozzo Storage volume", name)
+	}
+	options := volume.Spec.FlexVolume.Options
+
+	secretNamespace, secretName := volumeSecret(volume)
+	secret, err := tenantSecrets.get(secretNamespace, secretName)
+	if err != nil {
+		return err
+	}
+	cluster, err := clusterFromSecret(secret)
+	if err != nil {
+		return err
+	}
+	if err := p.prepareVstorage(options, cluster, secret); err != nil {
+		return err
+	}
+
+	ploopPath, imageDir := vzvolume.Paths(mountDir+cluster.name, options)
+	attrs, err := vzstorage.GetAttr(context.Background(), imageDir)
+	if err != nil {
+		return err
+	}
+	d, err := ploop.Open(path.Join(ploopPath, "DiskDescriptor.xml"))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	info, err := d.ImageInfo()
+	if err != nil {
+		return err
+	}
+
+	parameters := map[string]string{"secretName": secretName}
+	for k, v := range options {
+		if knownParameters[k] {
+			parameters[k] = v
+		}
+	}
+	capacity := volume.Spec.Capacity[v1.ResourceName(v1.ResourceStorage)]
+	storageClass := volume.Spec.StorageClassName
+	if storageClass == "" {
+		storageClass = volume.Annotations[v1.BetaStorageClassAnnotation]
+	}
+
+	recipe := volumeRecipe{
+		PersistentVolume: volume.Name,
+		StorageClass:     storageClass,
+		Capacity:         capacity.String(),
+		AccessModes:      volume.Spec.AccessModes,
+		ReclaimPolicy:    volume.Spec.PersistentVolumeReclaimPolicy,
+		Parameters:       parameters,
+		Secret:           secretRecipe{Namespace: secretNamespace, Name: secretName},
+		Cluster:          cluster.name,
+		Attributes:       attrs,
+		Image: imageRecipe{
+			Size:      info.Blocks * 512,
+			BlockSize: uint64(info.BlockSize) * 512,
+			Version:   info.Version,
+		},
+	}
+	data, err := yaml.Marshal(&recipe)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
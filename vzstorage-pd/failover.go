@@ -0,0 +1,54 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/trace"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// secondarySecretParam is the StorageClass parameter with the secret
+	// of the cluster volumes are provisioned on while the cluster of
+	// secretName is unavailable
+	secondarySecretParam = "secondarySecretName"
+	// clusterAnn records the cluster the volume of a PV lives on
+	clusterAnn = "virtuozzo.com/cluster"
+	// failedOverAnn records the secret of the unavailable cluster a PV
+	// was to be provisioned on
+	failedOverAnn = "virtuozzo.com/failed-over-from"
+)
+
+// connectCluster reads the secret and mounts its cluster
+func (p *vzFSProvisioner) connectCluster(ctx context.Context, span *trace.Span, options map[string]string, secretNamespace, secretName string) (*v1.Secret, *vstorageCluster, error) {
+	s := span.Child("api.get-secret")
+	secret, err := tenantSecrets.get(secretNamespace, secretName)
+	s.End(err)
+	if err != nil {
+		return nil, nil, err
+	}
+	cluster, err := clusterFromSecret(secret)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := p.prepareVstorageTraced(ctx, span, options, cluster, secret); err != nil {
+		return nil, nil, err
+	}
+	return secret, cluster, nil
+}
@@ -0,0 +1,212 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/metrics"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// how long to collect finalizer changes of a secret before updating it
+	finalizerBatchDelay = 100 * time.Millisecond
+	// how often to retry removals of finalizers that failed during Delete
+	finalizerRetryPeriod = 30 * time.Second
+)
+
+var pendingFinalizerRemovals = metrics.NewGauge("vzstorage_pending_finalizer_removals",
+	"Number of finalizers of deleted volumes waiting to be removed from secrets.")
+
+// backoff of secret updates retried on conflicts
+var finalizerBackoff = wait.Backoff{
+	Duration: 50 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.5,
+	Steps:    8,
+}
+
+// finalizerBatch is a set of finalizer changes of a single secret
+type finalizerBatch struct {
+	add    map[string]bool
+	remove map[string]bool
+	done   []chan error
+}
+
+// secretFinalizers adds and removes volume finalizers on secrets. Changes
+// of one secret made at about the same time, e.g. during bulk provisioning,
+// are applied with a single update, which is retried on conflicts.
+type secretFinalizers struct {
+	mu      sync.Mutex
+	pending map[string]*finalizerBatch
+	// removals that failed, e.g. while the API server was unavailable
+	retries map[finalizerRemoval]bool
+}
+
+// finalizerRemoval is a finalizer to remove from a secret
+type finalizerRemoval struct {
+	namespace, name, finalizer string
+}
+
+func newSecretFinalizers() *secretFinalizers {
+	return &secretFinalizers{
+		pending: make(map[string]*finalizerBatch),
+		retries: make(map[finalizerRemoval]bool),
+	}
+}
+
+// add adds finalizer to the secret unless it is already there
+func (s *secretFinalizers) add(namespace, name, finalizer string) error {
+	return s.change(namespace, name, finalizer, true)
+}
+
+// remove removes finalizer from the secret if it is there
+func (s *secretFinalizers) remove(namespace, name, finalizer string) error {
+	return s.change(namespace, name, finalizer, false)
+}
+
+func (s *secretFinalizers) change(namespace, name, finalizer string, add bool) error {
+	key := namespace + "/" + name
+	done := make(chan error, 1)
+
+	s.mu.Lock()
+	b, ok := s.pending[key]
+	if !ok {
+		b = &finalizerBatch{add: map[string]bool{}, remove: map[string]bool{}}
+		s.pending[key] = b
+		go s.flush(namespace, name, key)
+	}
+	if add {
+		b.add[finalizer] = true
+		delete(b.remove, finalizer)
+	} else {
+		b.remove[finalizer] = true
+		delete(b.add, finalizer)
+	}
+	b.done = append(b.done, done)
+	s.mu.Unlock()
+
+	return <-done
+}
+
+// flush applies the batch of the secret after finalizerBatchDelay
+func (s *secretFinalizers) flush(namespace, name, key string) {
+	time.Sleep(finalizerBatchDelay)
+
+	s.mu.Lock()
+	b := s.pending[key]
+	delete(s.pending, key)
+	s.mu.Unlock()
+
+	err := s.update(namespace, name, b)
+	if err != nil {
+		glog.Errorf("Failed to update finalizers in secret %s: %v", key, err)
+	}
+	for _, done := range b.done {
+		done <- err
+	}
+}
+
+// update applies b to the secret, re-reading it on conflicts
+func (s *secretFinalizers) update(namespace, name string, b *finalizerBatch) error {
+	var lastErr error
+	err := wait.ExponentialBackoff(finalizerBackoff, func() (bool, error) {
+		secret, err := tenantSecrets.get(namespace, name)
+		if err != nil {
+			return false, err
+		}
+
+		var finalizers []string
+		changed := false
+		present := map[string]bool{}
+		for _, f := range secret.Finalizers {
+			if b.remove[f] {
+				changed = true
+				continue
+			}
+			present[f] = true
+			finalizers = append(finalizers, f)
+		}
+		var added []string
+		for f := range b.add {
+			if !present[f] {
+				added = append(added, f)
+			}
+		}
+		if len(added) != 0 {
+			sort.Strings(added)
+			finalizers = append(finalizers, added...)
+			changed = true
+		}
+		if !changed {
+			return true, nil
+		}
+
+		secret.Finalizers = finalizers
+		_, lastErr = tenantSecrets.update(secret)
+		if apierrors.IsConflict(lastErr) {
+			return false, nil
+		}
+		return lastErr == nil, lastErr
+	})
+	if err == wait.ErrWaitTimeout {
+		return lastErr
+	}
+	return err
+}
+
+// removeLater retries removal of finalizer from the secret in background
+// until it succeeds. The retries are kept in memory, a finalizer still
+// pending on restart has to be removed manually.
+func (s *secretFinalizers) removeLater(namespace, name, finalizer string) {
+	s.mu.Lock()
+	s.retries[finalizerRemoval{namespace, name, finalizer}] = true
+	pendingFinalizerRemovals.Set(float64(len(s.retries)))
+	s.mu.Unlock()
+}
+
+// runRetries retries the failed removals every period
+func (s *secretFinalizers) runRetries(period time.Duration) {
+	wait.Forever(s.retryRemovals, period)
+}
+
+func (s *secretFinalizers) retryRemovals() {
+	s.mu.Lock()
+	var removals []finalizerRemoval
+	for r := range s.retries {
+		removals = append(removals, r)
+	}
+	s.mu.Unlock()
+
+	for _, r := range removals {
+		err := s.remove(r.namespace, r.name, r.finalizer)
+		if err != nil && !apierrors.IsNotFound(err) {
+			glog.V(4).Infof("Finalizer %s is still in secret %s/%s: %v", r.finalizer, r.namespace, r.name, err)
+			continue
+		}
+		glog.Infof("Removed finalizer %s from secret %s/%s", r.finalizer, r.namespace, r.name)
+		s.mu.Lock()
+		delete(s.retries, r)
+		pendingFinalizerRemovals.Set(float64(len(s.retries)))
+		s.mu.Unlock()
+	}
+}
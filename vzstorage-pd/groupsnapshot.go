@@ -0,0 +1,215 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzvolume"
+	"github.com/virtuozzo/goploop-cli"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// groupSnapshotLabel marks config maps requesting snapshots of a set of
+// claims taken at the same moment
+const groupSnapshotLabel = "virtuozzo.com/group-snapshot"
+
+// groupMember is a volume of a group snapshot
+type groupMember struct {
+	Claim    string `json:"claim"`
+	Volume   string `json:"volume"`
+	Snapshot string `json:"snapshot"`
+}
+
+// groupSnapshots returns the store of snapshots taken for group snapshot
+// requests, keyed by <namespace>.<name> of the request, so that they are
+// removed along with their requests
+func (p *vzFSProvisioner) groupSnapshots() *configMapStore {
+	return &configMapStore{
+		client:    p.client,
+		namespace: *namespace,
+		name:      *provisionerID + "-group-snapshots",
+	}
+}
+
+// groupSnapshot snapshots images of all claims selected by the request.
+// Clusters of the volumes are prepared first and the snapshots are then
+// taken one right after another; if any of them fails, those already
+// taken are removed, so a group snapshot is either complete or absent.
+// Snapshots are taken offline, so the request waits while any of the
+// volumes is used by a pod.
+func (p *vzFSProvisioner) groupSnapshot(cm *v1.ConfigMap) (bool, error) {
+	claims, err := p.client.Core().PersistentVolumeClaims(cm.Namespace).List(metav1.ListOptions{LabelSelector: cm.Data["selector"]})
+	if err != nil {
+		return true, err
+	}
+	if len(claims.Items) == 0 {
+		return true, fmt.Errorf("no claims match selector %q", cm.Data["selector"])
+	}
+
+	var members []groupMember
+	var volumes []*v1.PersistentVolume
+	var mounts []string
+	var options []map[string]string
+	for _, claim := range claims.Items {
+		if claim.Spec.VolumeName == "" {
+			return true, fmt.Errorf("claim %s is not bound", claim.Name)
+		}
+		volume, err := p.client.Core().PersistentVolumes().Get(claim.Spec.VolumeName, metav1.GetOptions{})
+		if err != nil {
+			return true, err
+		}
+		if volume.Annotations[parentProvisionerAnn] != *provisionerID {
+			if len(members) == 0 {
+				// requests for volumes of another provisioner are its own
+				return false, nil
+			}
+			return true, fmt.Errorf("volume %s of claim %s belongs to another provisioner", volume.Name, claim.Name)
+		}
+		secretNamespace, secretName := volumeSecret(volume)
+		secret, err := tenantSecrets.get(secretNamespace, secretName)
+		if err != nil {
+			return true, err
+		}
+		cluster, err := clusterFromSecret(secret)
+		if err != nil {
+			return true, err
+		}
+		opts := volume.Spec.FlexVolume.Options
+		if err := p.prepareVstorage(opts, cluster, secret); err != nil {
+			return true, err
+		}
+		mount := mountDir + cluster.name
+		members = append(members, groupMember{
+			Claim:    claim.Name,
+			Volume:   volume.Name,
+			Snapshot: path.Join(vzvolume.SnapshotsDir(mount, opts), tempSnapshotName(opts, "-group-"+cm.Name+"-")),
+		})
+		volumes = append(volumes, volume)
+		mounts = append(mounts, mount)
+		options = append(options, opts)
+	}
+	for _, volume := range volumes {
+		if err := p.checkNotInUse(volume); err != nil {
+			return true, err
+		}
+	}
+
+	// snapshots are recorded before they are taken, so that those of an
+	// interrupted request are still removed with it. Snapshots of an
+	// interrupted attempt are already stale.
+	key := cm.Namespace + "." + cm.Name
+	store := p.groupSnapshots()
+	data, err := store.get()
+	if err != nil {
+		return true, err
+	}
+	if recorded, ok := data[key]; ok {
+		if err := p.removeGroupMembers(recorded); err != nil {
+			return true, err
+		}
+	}
+	recorded, err := json.Marshal(members)
+	if err != nil {
+		return true, err
+	}
+	if _, err := store.modify(func(d map[string]string) { d[key] = string(recorded) }); err != nil {
+		return true, err
+	}
+
+	for i, m := range members {
+		if _, err := vzvolume.Snapshot(mounts[i], options[i], path.Base(m.Snapshot)); err != nil {
+			for _, taken := range members[:i] {
+				if e := p.merges.queue(taken.Volume, taken.Snapshot); e != nil {
+					glog.Errorf("Unable to remove snapshot %s of a failed group snapshot: %v", taken.Snapshot, e)
+				}
+			}
+			return true, fmt.Errorf("claim %s: %v", m.Claim, err)
+		}
+	}
+
+	request := configMapStore{client: p.client, namespace: cm.Namespace, name: cm.Name}
+	if _, err := request.modify(func(d map[string]string) { d["snapshots"] = string(recorded) }); err != nil {
+		return true, err
+	}
+	glog.Infof("Took group snapshot %s/%s of %d volumes", cm.Namespace, cm.Name, len(members))
+	return true, nil
+}
+
+// removeGroupSnapshots queues deletion of snapshots of group snapshot
+// requests which were deleted
+func (p *vzFSProvisioner) removeGroupSnapshots() {
+	store := p.groupSnapshots()
+	data, err := store.get()
+	if err != nil {
+		glog.Errorf("Unable to get group snapshots: %v", err)
+		return
+	}
+	for key, recorded := range data {
+		parts := strings.SplitN(key, ".", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		_, err := p.client.Core().ConfigMaps(parts[0]).Get(parts[1], metav1.GetOptions{})
+		if !apierrors.IsNotFound(err) {
+			continue
+		}
+		if err := p.removeGroupMembers(recorded); err != nil {
+			glog.Warningf("Unable to remove snapshots of group snapshot %s: %v", key, err)
+			continue
+		}
+		if _, err := store.modify(func(d map[string]string) { delete(d, key) }); err != nil {
+			glog.Errorf("Unable to forget group snapshot %s: %v", key, err)
+			continue
+		}
+		glog.Infof("Removed group snapshot %s", key)
+	}
+}
+
+// removeGroupMembers queues deletion of the recorded snapshots of a group
+// snapshot
+func (p *vzFSProvisioner) removeGroupMembers(recorded string) error {
+	var members []groupMember
+	if err := json.Unmarshal([]byte(recorded), &members); err != nil {
+		glog.Errorf("Dropping malformed group snapshot %q: %v", recorded, err)
+		return nil
+	}
+	for _, m := range members {
+		if err := p.merges.queue(m.Volume, m.Snapshot); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteSnapshot removes a ploop snapshot if it exists
+func deleteSnapshot(snapshotPath string) error {
+	if !pathExists(snapshotPath) {
+		return nil
+	}
+	snap, err := ploop.PloopVolumeSnapshotOpen(snapshotPath)
+	if err != nil {
+		return err
+	}
+	return snap.Delete()
+}
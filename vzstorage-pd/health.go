@@ -0,0 +1,109 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const clusterProbeInterval = 30 * time.Second
+
+// errors meaning the whole cluster can't be reached, rather than
+// something is wrong with a particular volume
+var reClusterUnavailable = regexp.MustCompile(`Unable to mount .* in |is unavailable since |(?i)transport endpoint is not connected|connection refused|no route to host|timed out`)
+
+func isClusterUnavailable(err error) bool {
+	return err != nil && reClusterUnavailable.MatchString(err.Error())
+}
+
+type clusterOutage struct {
+	since  time.Time
+	paused int
+}
+
+// clusterHealth tracks clusters which can't be reached. Operations on
+// such clusters fail right away until a background probe succeeds, so
+// retries of pending claims don't hammer a cluster which is down.
+type clusterHealth struct {
+	mu       sync.Mutex
+	recorder record.EventRecorder
+	down     map[string]*clusterOutage
+}
+
+func newClusterHealth(recorder record.EventRecorder) *clusterHealth {
+	return &clusterHealth{
+		recorder: recorder,
+		down:     map[string]*clusterOutage{},
+	}
+}
+
+// check returns an error if the cluster is known to be unavailable
+func (h *clusterHealth) check(name string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	o, ok := h.down[name]
+	if !ok {
+		return nil
+	}
+	o.paused++
+	return fmt.Errorf("cluster %s is unavailable since %s, operations are paused until it is back", name, o.since.Format(time.RFC3339))
+}
+
+// markUnavailable records the outage of the cluster, emits a single event
+// for it on the secret and starts probing the cluster
+func (h *clusterHealth) markUnavailable(cluster *vstorageCluster, secret *v1.Secret, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.down[cluster.name]; ok {
+		return
+	}
+	h.down[cluster.name] = &clusterOutage{since: time.Now()}
+
+	glog.Errorf("Cluster %s is unavailable, pausing operations: %v", cluster.name, err)
+	h.recorder.Eventf(secret, v1.EventTypeWarning, "ClusterUnavailable",
+		"Cluster %s is unavailable, operations are paused until it is back: %v", cluster.name, err)
+	go h.probe(cluster, secret)
+}
+
+func (h *clusterHealth) probe(cluster *vstorageCluster, secret *v1.Secret) {
+	wait.PollInfinite(clusterProbeInterval, func() (bool, error) {
+		err := prepareVstorage(context.Background(), nil, nil, cluster)
+		if err != nil {
+			glog.V(4).Infof("Cluster %s is still unavailable: %v", cluster.name, err)
+		}
+		return err == nil, nil
+	})
+
+	h.mu.Lock()
+	o := h.down[cluster.name]
+	delete(h.down, cluster.name)
+	h.mu.Unlock()
+
+	glog.Infof("Cluster %s is available again, resuming operations", cluster.name)
+	h.recorder.Eventf(secret, v1.EventTypeNormal, "ClusterAvailable",
+		"Cluster %s is available again after %v, %d operations were paused",
+		cluster.name, time.Since(o.since), o.paused)
+}
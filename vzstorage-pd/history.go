@@ -0,0 +1,138 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/golang/glog"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// volumeHistoryLabel marks volume histories, its value is the PV name
+	volumeHistoryLabel  = "virtuozzo.com/volume-history"
+	volumeHistoryPrefix = "vz-history-"
+	volumeHistoryPeriod = time.Hour
+)
+
+// historyEntry is an operation on a volume
+type historyEntry struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	Result    string    `json:"result"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// volumeHistories keeps the last operations on every volume in a config
+// map in the namespace of its claim, where its users can read it long
+// after the events have expired. A history outlives its volume for the
+// retention period. A nil *volumeHistories records nothing.
+type volumeHistories struct {
+	client    kubernetes.Interface
+	size      int
+	retention time.Duration
+}
+
+func newVolumeHistories(client kubernetes.Interface, size int, retention time.Duration) *volumeHistories {
+	return &volumeHistories{client: client, size: size, retention: retention}
+}
+
+func (h *volumeHistories) store(namespace, pv string) *configMapStore {
+	return &configMapStore{
+		client:    h.client,
+		namespace: namespace,
+		name:      volumeHistoryPrefix + pv,
+		labels:    map[string]string{volumeHistoryLabel: pv},
+	}
+}
+
+// add appends an operation to the history of the volume of the claim,
+// dropping the oldest entries beyond the size of histories. deleted marks
+// the volume as gone, which starts the retention period. Failures are only
+// logged, histories never hold up operations.
+func (h *volumeHistories) add(claim *v1.ObjectReference, pv, operation string, err error, deleted bool) {
+	if h == nil || claim == nil {
+		return
+	}
+	e := historyEntry{
+		Time:      time.Now().UTC(),
+		Operation: operation,
+		Result:    "success",
+	}
+	if err != nil {
+		e.Result = "failure"
+		e.Error = err.Error()
+	}
+
+	_, storeErr := h.store(claim.Namespace, pv).modify(func(d map[string]string) {
+		var entries []historyEntry
+		if data, ok := d["history"]; ok {
+			if err := json.Unmarshal([]byte(data), &entries); err != nil {
+				glog.Warningf("Dropping malformed history of %s: %v", pv, err)
+				entries = nil
+			}
+		}
+		entries = append(entries, e)
+		if len(entries) > h.size {
+			entries = entries[len(entries)-h.size:]
+		}
+		data, _ := json.Marshal(entries)
+		d["history"] = string(data)
+		d["pv"] = pv
+		d["claim"] = claim.Name
+		if deleted {
+			d["deleted"] = e.Time.Format(time.RFC3339)
+		} else {
+			delete(d, "deleted")
+		}
+	})
+	if storeErr != nil {
+		glog.Warningf("Unable to record %s of %s in its history: %v", operation, pv, storeErr)
+	}
+}
+
+// run removes histories of volumes deleted longer than the retention
+// period ago every period
+func (h *volumeHistories) run(period time.Duration) {
+	wait.Forever(h.prune, period)
+}
+
+func (h *volumeHistories) prune() {
+	list, err := h.client.Core().ConfigMaps(v1.NamespaceAll).List(metav1.ListOptions{LabelSelector: volumeHistoryLabel})
+	if err != nil {
+		glog.Errorf("Unable to list volume histories: %v", err)
+		return
+	}
+	for _, cm := range list.Items {
+		deleted, err := time.Parse(time.RFC3339, cm.Data["deleted"])
+		if err != nil || time.Since(deleted) < h.retention {
+			continue
+		}
+		err = h.client.Core().ConfigMaps(cm.Namespace).Delete(cm.Name, nil)
+		if err != nil && !apierrors.IsNotFound(err) {
+			glog.Warningf("Unable to remove history %s/%s: %v", cm.Namespace, cm.Name, err)
+			continue
+		}
+		glog.V(4).Infof("Removed history %s/%s", cm.Namespace, cm.Name)
+	}
+}
@@ -0,0 +1,231 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzvolume"
+	"github.com/virtuozzo/goploop-cli"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	storage "k8s.io/client-go/pkg/apis/storage/v1"
+)
+
+// importLabel marks config maps requesting conversion of a raw or qcow2
+// disk image on the cluster into a volume
+const importLabel = "virtuozzo.com/import"
+
+// qcow2Magic starts qcow2 images, anything else is imported as raw
+var qcow2Magic = []byte{'Q', 'F', 'I', 0xfb}
+
+// importImage provisions a volume of the storage class of the request as
+// large as the disk image, writes the image onto its ploop device and
+// creates the claim of the request bound to it. Like restores, an import
+// interrupted by a restart continues with the recorded PV.
+func (p *vzFSProvisioner) importImage(cm *v1.ConfigMap) (bool, error) {
+	volume, ours, err := p.requestVolume(cm)
+	if !ours || err != nil {
+		return ours, err
+	}
+	if volume == nil {
+		class, err := p.client.Storage().StorageClasses().Get(cm.Data["storageClass"], metav1.GetOptions{})
+		if err != nil {
+			return true, err
+		}
+		if !servesClass(class) {
+			return false, nil
+		}
+		mount, err := p.classMount(class, cm.Namespace)
+		if err != nil {
+			return true, err
+		}
+		source, err := importSource(mount, cm.Data["source"])
+		if err != nil {
+			return true, err
+		}
+		size, err := diskSize(source)
+		if err != nil {
+			return true, err
+		}
+		// ploop images are sized in megabytes
+		const mb = 1024 * 1024
+		capacity := resource.NewQuantity((size+mb-1)/mb*mb, resource.BinarySI)
+		if volume, err = p.provisionForRequest(cm, class, *capacity); err != nil {
+			return true, err
+		}
+	}
+
+	if err := p.convertImage(cm, volume); err != nil {
+		p.discardVolume(volume)
+		return true, err
+	}
+	return true, p.createBoundClaim(volume)
+}
+
+// classMount mounts the cluster of the storage class for claims of the
+// namespace and returns its mount point
+func (p *vzFSProvisioner) classMount(class *storage.StorageClass, namespace string) (string, error) {
+	if class.Parameters["optionsFromSystem"] == "true" {
+		namespace = "kube-system"
+	}
+	secret, err := tenantSecrets.get(namespace, class.Parameters["secretName"])
+	if err != nil {
+		return "", err
+	}
+	cluster, err := clusterFromSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	if err := p.prepareVstorage(class.Parameters, cluster, secret); err != nil {
+		return "", err
+	}
+	return mountDir + cluster.name, nil
+}
+
+// importSource returns the path of the image given relative to the
+// cluster root, which it may not leave
+func importSource(mount, source string) (string, error) {
+	clean := path.Clean("/" + source)
+	if rel := path.Clean(source); source == "" || clean == "/" || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("invalid source %q, it has to be a path relative to the cluster root", source)
+	}
+	return path.Join(mount, clean), nil
+}
+
+func isQcow2(file string) (bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	magic := make([]byte, len(qcow2Magic))
+	if _, err := io.ReadFull(f, magic); err != nil && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	return bytes.Equal(magic, qcow2Magic), nil
+}
+
+// diskSize returns the size of the disk in the image, in bytes
+func diskSize(file string) (int64, error) {
+	qcow2, err := isQcow2(file)
+	if err != nil {
+		return 0, err
+	}
+	if !qcow2 {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return 0, err
+		}
+		return fi.Size(), nil
+	}
+	out, err := exec.Command("qemu-img", "info", "--output=json", "-f", "qcow2", file).Output()
+	if err != nil {
+		return 0, fmt.Errorf("Unable to get info of %s: %v", file, err)
+	}
+	var info struct {
+		VirtualSize int64 `json:"virtual-size"`
+	}
+	if err := json.Unmarshal(out, &info); err != nil {
+		return 0, fmt.Errorf("Unable to parse info of %s: %v", file, err)
+	}
+	return info.VirtualSize, nil
+}
+
+// convertImage writes the disk image of the request onto the ploop device
+// of the freshly provisioned volume, replacing its empty partition table
+// and filesystem
+func (p *vzFSProvisioner) convertImage(cm *v1.ConfigMap, volume *v1.PersistentVolume) error {
+	secretNamespace, secretName := volumeSecret(volume)
+	secret, err := tenantSecrets.get(secretNamespace, secretName)
+	if err != nil {
+		return err
+	}
+	cluster, err := clusterFromSecret(secret)
+	if err != nil {
+		return err
+	}
+	options := volume.Spec.FlexVolume.Options
+	if err := p.prepareVstorage(options, cluster, secret); err != nil {
+		return err
+	}
+	mount := mountDir + cluster.name
+	source, err := importSource(mount, cm.Data["source"])
+	if err != nil {
+		return err
+	}
+	qcow2, err := isQcow2(source)
+	if err != nil {
+		return err
+	}
+
+	ploopPath, _ := vzvolume.Paths(mount, options)
+	d, err := ploop.Open(path.Join(ploopPath, "DiskDescriptor.xml"))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	// only the device is needed, its filesystem is overwritten
+	device, err := d.Mount(&ploop.MountParam{})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := d.Umount(); err != nil {
+			glog.Errorf("Unable to unmount %s: %v", ploopPath, err)
+		}
+	}()
+
+	if qcow2 {
+		if out, err := exec.Command("qemu-img", "convert", "-n", "-f", "qcow2", "-O", "raw", source, device).CombinedOutput(); err != nil {
+			return fmt.Errorf("Unable to convert %s: %v: %s", source, err, strings.TrimSpace(string(out)))
+		}
+	} else if err := copyToDevice(source, device); err != nil {
+		return fmt.Errorf("Unable to copy %s: %v", source, err)
+	}
+	glog.Infof("Imported %s into %s", source, volume.Name)
+	return nil
+}
+
+func copyToDevice(src, device string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(device, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	return err
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sort"
+
+	"github.com/golang/glog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// inventoryOf returns what identifies the image of the volume on its
+// cluster. It is kept in PV annotations and flexvolume options, which other
+// controllers are free to mutate, so volume records keep a copy written
+// once when the volume is provisioned and trusted by Delete.
+func inventoryOf(volume *v1.PersistentVolume) map[string]string {
+	inventory := map[string]string{
+		"provisioner": volume.Annotations[parentProvisionerAnn],
+		"share":       volume.Annotations[vzShareAnn],
+	}
+	if flex := volume.Spec.FlexVolume; flex != nil {
+		inventory["finalizer"] = flex.Options["finalizer"]
+		inventory["cluster"] = flex.Options["clusterName"]
+	}
+	return inventory
+}
+
+// recordInventory adds the inventory of the volume to its record data,
+// keeping whatever was recorded before
+func recordInventory(data map[string]string, volume *v1.PersistentVolume) {
+	for k, v := range inventoryOf(volume) {
+		if data[k] == "" {
+			data[k] = v
+		}
+	}
+}
+
+// restore returns the volume with its inventory as recorded, along with the
+// keys which differed on the PV. The volume is returned as is if it has no
+// record, or the record is of another claim.
+func (r *volumeRecords) restore(volume *v1.PersistentVolume) (*v1.PersistentVolume, []string) {
+	if r == nil || volume.Spec.FlexVolume == nil {
+		return volume, nil
+	}
+	data, err := r.store(volume.Name).get()
+	if err != nil {
+		glog.Warningf("Unable to get the record of %s, trusting the PV: %v", volume.Name, err)
+		return volume, nil
+	}
+	if data["provisioner"] == "" {
+		return volume, nil
+	}
+	if ref := volume.Spec.ClaimRef; ref != nil && data["claim"] != "" && data["claim"] != ref.Namespace+"/"+ref.Name {
+		glog.Warningf("Record of %s is of claim %s, trusting the PV", volume.Name, data["claim"])
+		return volume, nil
+	}
+
+	var changed []string
+	for k, v := range inventoryOf(volume) {
+		if data[k] != "" && data[k] != v {
+			changed = append(changed, k)
+		}
+	}
+	if len(changed) == 0 {
+		return volume, nil
+	}
+	sort.Strings(changed)
+
+	restored := *volume
+	restored.Annotations = map[string]string{}
+	for k, v := range volume.Annotations {
+		restored.Annotations[k] = v
+	}
+	flex := *volume.Spec.FlexVolume
+	flex.Options = map[string]string{}
+	for k, v := range volume.Spec.FlexVolume.Options {
+		flex.Options[k] = v
+	}
+	restored.Spec.FlexVolume = &flex
+
+	set := func(m map[string]string, key, value string) {
+		if value != "" {
+			m[key] = value
+		}
+	}
+	set(restored.Annotations, parentProvisionerAnn, data["provisioner"])
+	set(restored.Annotations, vzShareAnn, data["share"])
+	set(flex.Options, "finalizer", data["finalizer"])
+	set(flex.Options, "clusterName", data["cluster"])
+	return &restored, changed
+}
+
+// migrate records the inventory of volumes provisioned before it was kept,
+// taking it from their PVs as they are now.
+func (r *volumeRecords) migrate() {
+	if r == nil {
+		return
+	}
+	volumes, err := r.client.Core().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		glog.Warningf("Unable to list volumes to migrate their inventory: %v", err)
+		return
+	}
+	migrated := 0
+	for i := range volumes.Items {
+		volume := &volumes.Items[i]
+		if volume.Annotations[parentProvisionerAnn] != *provisionerID || volume.Spec.FlexVolume == nil {
+			continue
+		}
+		data, err := r.store(volume.Name).get()
+		if err != nil {
+			glog.Warningf("Unable to get the record of %s: %v", volume.Name, err)
+			continue
+		}
+		if data["provisioner"] != "" {
+			continue
+		}
+		if len(data) == 0 {
+			r.update(volume, volumeProvisioned, nil)
+		} else if _, err := r.store(volume.Name).modify(func(d map[string]string) { recordInventory(d, volume) }); err != nil {
+			glog.Warningf("Unable to record the inventory of %s: %v", volume.Name, err)
+			continue
+		}
+		migrated++
+	}
+	if migrated != 0 {
+		glog.Infof("Recorded the inventory of %d volumes", migrated)
+	}
+}
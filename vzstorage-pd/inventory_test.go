@@ -0,0 +1,124 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func inventoryTestVolume(name string) *v1.PersistentVolume {
+	pv := testVolume(name)
+	pv.Spec.FlexVolume.Options["clusterName"] = "cl1"
+	pv.Spec.FlexVolume.Options["finalizer"] = "virtuozzo.com/" + name
+	return pv
+}
+
+func TestRestoreInventory(t *testing.T) {
+	*provisionerID = "vz"
+	r := newVolumeRecords(fake.NewSimpleClientset(), *namespace)
+	recorded := inventoryTestVolume("pv-1")
+	r.update(recorded, volumeProvisioned, nil)
+
+	// a PV without changes is trusted
+	if pv, changed := r.restore(recorded); pv != recorded || changed != nil {
+		t.Errorf("Expected an unchanged PV as is, got changes %v", changed)
+	}
+
+	mutated := inventoryTestVolume("pv-1")
+	mutated.Annotations[vzShareAnn] = "pv-2"
+	mutated.Spec.FlexVolume.Options["clusterName"] = "cl2"
+	mutated.Spec.FlexVolume.Options["volumePath"] = "moved"
+	pv, changed := r.restore(mutated)
+	if !reflect.DeepEqual(changed, []string{"cluster", "share"}) {
+		t.Errorf("Expected changed cluster and share, got %v", changed)
+	}
+	if pv.Annotations[vzShareAnn] != "pv-1" || pv.Spec.FlexVolume.Options["clusterName"] != "cl1" {
+		t.Errorf("Expected the recorded inventory, got %v, %v", pv.Annotations, pv.Spec.FlexVolume.Options)
+	}
+	if pv.Spec.FlexVolume.Options["volumePath"] != "moved" {
+		t.Errorf("Expected options outside of the inventory kept, got %v", pv.Spec.FlexVolume.Options)
+	}
+	if mutated.Annotations[vzShareAnn] != "pv-2" || mutated.Spec.FlexVolume.Options["clusterName"] != "cl2" {
+		t.Errorf("Expected the PV passed to be left as is")
+	}
+
+	// the record of a volume of another claim, e.g. a recreated PV of the
+	// same name, isn't trusted
+	reclaimed := inventoryTestVolume("pv-1")
+	reclaimed.Spec.ClaimRef.Name = "other"
+	reclaimed.Annotations[vzShareAnn] = "pv-2"
+	if pv, changed := r.restore(reclaimed); pv != reclaimed || changed != nil {
+		t.Errorf("Expected a PV of another claim as is, got changes %v", changed)
+	}
+
+	unrecorded := inventoryTestVolume("pv-3")
+	if pv, changed := r.restore(unrecorded); pv != unrecorded || changed != nil {
+		t.Errorf("Expected a PV without record as is, got changes %v", changed)
+	}
+	var none *volumeRecords
+	if pv, _ := none.restore(mutated); pv != mutated {
+		t.Errorf("Expected PVs as is without records")
+	}
+}
+
+func TestMigrateInventory(t *testing.T) {
+	*provisionerID = "vz"
+	unrecorded := inventoryTestVolume("pv-unrecorded")
+	old := inventoryTestVolume("pv-old")
+	current := inventoryTestVolume("pv-current")
+	foreign := inventoryTestVolume("pv-foreign")
+	foreign.Annotations[parentProvisionerAnn] = "other"
+	client := fake.NewSimpleClientset(unrecorded, old, current, foreign)
+	r := newVolumeRecords(client, *namespace)
+
+	// records of versions which didn't keep the inventory
+	if _, err := r.store("pv-old").modify(func(d map[string]string) { d["state"] = volumeProvisioned }); err != nil {
+		t.Fatal(err)
+	}
+	r.update(current, volumeProvisioned, nil)
+	current.Annotations[vzShareAnn] = "mutated"
+	if _, err := client.Core().PersistentVolumes().Update(current); err != nil {
+		t.Fatal(err)
+	}
+
+	r.migrate()
+
+	for name, share := range map[string]string{
+		"pv-unrecorded": "pv-unrecorded",
+		"pv-old":        "pv-old",
+		"pv-current":    "pv-current",
+	} {
+		data, err := r.store(name).get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data["provisioner"] != "vz" || data["share"] != share || data["cluster"] != "cl1" || data["state"] != volumeProvisioned {
+			t.Errorf("%s: unexpected record %v", name, data)
+		}
+	}
+	data, err := r.store("pv-foreign").get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 0 {
+		t.Errorf("Expected no record of a volume of another provisioner, got %v", data)
+	}
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/journal"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzvolume"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// directory in the cluster root keeping journals of provisioners
+	journalDir    = ".vzstorage-pd-journal"
+	journalPeriod = time.Minute
+)
+
+// journalPath returns the directory with journal entries of this
+// provisioner in the cluster mounted at mount
+func journalPath(mount string) string {
+	return path.Join(mount, journalDir, *provisionerID)
+}
+
+// runJournal replays journals of mounted clusters every period. It runs
+// once this replica leads, so entries written before are left over by
+// provisioning of a previous leader or process.
+func (p *vzFSProvisioner) runJournal(period time.Duration) {
+	wait.Forever(func() { p.replayJournals(p.journalSince) }, period)
+}
+
+// startJournal writes the journal entry of share in the cluster mounted at
+// mount before its volume is created. The controller retries a claim with the same share, so an entry
+// may already be there. One left over by a crash is rolled back, others
+// belong to attempts of this provisioner or volumes with PVs, and they are
+// never overwritten: the attempt fails and is retried.
+func (p *vzFSProvisioner) startJournal(mount, share string, e *journal.Entry) error {
+	dir := journalPath(mount)
+	old, err := journal.Read(dir, share)
+	if err == nil {
+		hasPV := false
+		if old.PV != "" {
+			_, err := p.client.Core().PersistentVolumes().Get(old.PV, metav1.GetOptions{})
+			if err != nil && !apierrors.IsNotFound(err) {
+				return err
+			}
+			hasPV = err == nil
+		}
+		ploopPath, _ := vzvolume.Paths(mount, old.Options)
+		st := journal.State{HasPV: hasPV, ImageExists: pathExists(ploopPath)}
+		if journal.Retry(old, st, p.journalSince) == journal.Rollback {
+			if err := p.rollback(dir, share, old); err != nil {
+				return fmt.Errorf("Unable to roll back interrupted provisioning of %s: %v", share, err)
+			}
+			return fmt.Errorf("interrupted provisioning of %s is being rolled back, will retry", share)
+		}
+		return fmt.Errorf("provisioning of %s is journaled by another attempt, will retry", share)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := journal.Write(dir, share, e); err != nil {
+		return fmt.Errorf("Unable to write provisioning journal: %v", err)
+	}
+	return nil
+}
+
+func (p *vzFSProvisioner) replayJournals(since time.Time) {
+	committed := map[string]bool{}
+	volumes, err := p.client.Core().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		glog.Errorf("Unable to list PVs to replay provisioning journal: %v", err)
+		return
+	}
+	for _, volume := range volumes.Items {
+		if share, ok := volume.Annotations[vzShareAnn]; ok {
+			committed[share] = true
+		}
+	}
+
+	for _, cluster := range mountedClusters() {
+		p.replayJournal(mountDir+cluster, committed, since)
+	}
+}
+
+// replayJournal replays the provisioning journal of the cluster mounted
+// at mount. committed holds shares of volumes which have PVs.
+func (p *vzFSProvisioner) replayJournal(mount string, committed map[string]bool, since time.Time) {
+	dir := journalPath(mount)
+	shares, err := journal.List(dir)
+	if err != nil {
+		glog.Errorf("Unable to read provisioning journal of %s: %v", path.Base(mount), err)
+		return
+	}
+	for _, share := range shares {
+		e, err := journal.Read(dir, share)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				glog.Errorf("Dropping unreadable journal entry %s: %v", share, err)
+				journal.Remove(dir, share)
+			}
+			continue
+		}
+		ploopPath, _ := vzvolume.Paths(mount, e.Options)
+		st := journal.State{
+			HasPV:       committed[share],
+			Running:     e.PV != "" && p.operations.isRunning("Provision "+e.PV),
+			ImageExists: pathExists(ploopPath),
+		}
+		switch journal.Replay(e, st, since) {
+		case journal.Forget:
+			journal.Remove(dir, share)
+		case journal.Rollback:
+			if err := p.rollback(dir, share, e); err != nil {
+				glog.Errorf("Unable to roll back provisioning of %s: %v", share, err)
+			}
+		}
+	}
+}
+
+// rollback undoes provisioning of a journaled volume which was interrupted
+func (p *vzFSProvisioner) rollback(dir, share string, e *journal.Entry) error {
+	glog.Infof("Rolling back interrupted provisioning of %s", share)
+	err := p.finalizers.remove(e.SecretNamespace, e.SecretName, e.Options["finalizer"])
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	// the image is removed in background, as the cluster may be busy
+	p.cleanup.add(share, cleanupEntry{
+		SecretNamespace: e.SecretNamespace,
+		SecretName:      e.SecretName,
+		Options:         e.Options,
+	})
+	return journal.Remove(dir, share)
+}
@@ -0,0 +1,203 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/journal"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzvolume"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// newJournalProvisioner returns a provisioner with a fake client, which
+// holds the secret of volumes with the finalizer of a crashed attempt
+func newJournalProvisioner(objects ...runtime.Object) (*vzFSProvisioner, *fake.Clientset) {
+	*provisionerID = "vz"
+	objects = append(objects, &v1.Secret{ObjectMeta: metav1.ObjectMeta{
+		Name:       "vz-secret",
+		Namespace:  "team-a",
+		Finalizers: []string{"virtuozzo.com/crashed-pv"},
+	}})
+	client := fake.NewSimpleClientset(objects...)
+	tenantSecrets = newSecretAccess(client, nil, *namespace, "")
+	p := &vzFSProvisioner{
+		client:     client,
+		operations: newOperations(0),
+		finalizers: newSecretFinalizers(),
+		cleanup:    newCleanupQueue(client, *namespace, "vz-cleanup"),
+	}
+	return p, client
+}
+
+func journalEntry(t time.Time) *journal.Entry {
+	return &journal.Entry{
+		PV:              "pvc-1",
+		SecretNamespace: "team-a",
+		SecretName:      "vz-secret",
+		Options: map[string]string{
+			"volumePath": "v",
+			"volumeID":   "share-1",
+			"finalizer":  "virtuozzo.com/crashed-pv",
+		},
+		Time: t,
+	}
+}
+
+func TestStartJournalAfterCrash(t *testing.T) {
+	mount, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mount)
+	p, client := newJournalProvisioner()
+	p.journalSince = time.Now()
+	dir := journalPath(mount)
+
+	// a previous leader crashed after creating the image
+	crashed := journalEntry(p.journalSince.Add(-time.Hour))
+	if err := journal.Write(dir, "share-1", crashed); err != nil {
+		t.Fatal(err)
+	}
+	ploopPath, _ := vzvolume.Paths(mount, crashed.Options)
+	if err := os.MkdirAll(ploopPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// the retry of the claim rolls the leftover back and fails
+	retry := journalEntry(time.Now())
+	err = p.startJournal(mount, "share-1", retry)
+	if err == nil || !strings.Contains(err.Error(), "rolled back") {
+		t.Fatalf("Expected the attempt to fail while the leftover is rolled back, got %v", err)
+	}
+	if _, err := journal.Read(dir, "share-1"); !os.IsNotExist(err) {
+		t.Errorf("Expected the leftover entry to be removed, got %v", err)
+	}
+	queue, err := p.cleanup.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := queue["share-1"]; !ok {
+		t.Errorf("Expected the leftover image to be queued for cleanup, got %v", queue)
+	}
+	secret, err := client.Core().Secrets("team-a").Get("vz-secret", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secret.Finalizers) != 0 {
+		t.Errorf("Expected the finalizer of the crashed attempt to be removed, got %v", secret.Finalizers)
+	}
+
+	// the next retry journals itself
+	if err := p.startJournal(mount, "share-1", retry); err != nil {
+		t.Fatal(err)
+	}
+	e, err := journal.Read(dir, "share-1")
+	if err != nil || !e.Time.Equal(retry.Time) {
+		t.Fatalf("Expected the entry of the retry, got %+v, %v", e, err)
+	}
+
+	// an entry of an attempt since the takeover is never overwritten
+	if err := p.startJournal(mount, "share-1", journalEntry(time.Now().Add(time.Minute))); err == nil {
+		t.Errorf("Expected a concurrent attempt to fail")
+	}
+	if e, err = journal.Read(dir, "share-1"); err != nil || !e.Time.Equal(retry.Time) {
+		t.Errorf("Expected the entry to be kept, got %+v, %v", e, err)
+	}
+}
+
+func TestStartJournalCommitted(t *testing.T) {
+	mount, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mount)
+	p, _ := newJournalProvisioner(&v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pvc-1"}})
+	p.journalSince = time.Now()
+	dir := journalPath(mount)
+
+	if err := journal.Write(dir, "share-1", journalEntry(p.journalSince.Add(-time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.startJournal(mount, "share-1", journalEntry(time.Now())); err == nil {
+		t.Errorf("Expected the attempt to fail while the volume has a PV")
+	}
+	if _, err := journal.Read(dir, "share-1"); err != nil {
+		t.Errorf("Expected the entry to be left to the replay, got %v", err)
+	}
+}
+
+func TestReplayJournal(t *testing.T) {
+	mount, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mount)
+	p, client := newJournalProvisioner()
+	since := time.Now()
+	dir := journalPath(mount)
+
+	entries := map[string]*journal.Entry{
+		// left over by a crash before the takeover
+		"share-crashed": journalEntry(since.Add(-time.Hour)),
+		// its PV exists
+		"share-committed": journalEntry(since.Add(-time.Hour)),
+		// provisioning since the takeover is running
+		"share-running": journalEntry(since.Add(time.Second)),
+	}
+	for share, e := range entries {
+		e.Options["volumeID"] = share
+		if err := journal.Write(dir, share, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ploopPath, _ := vzvolume.Paths(mount, entries["share-crashed"].Options)
+	if err := os.MkdirAll(ploopPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	p.replayJournal(mount, map[string]bool{"share-committed": true}, since)
+
+	shares, err := journal.List(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shares) != 1 || shares[0] != "share-running" {
+		t.Errorf("Expected only the running entry to be kept, got %v", shares)
+	}
+	queue, err := p.cleanup.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := queue["share-crashed"]; !ok || len(queue) != 1 {
+		t.Errorf("Expected only the crashed image to be queued for cleanup, got %v", queue)
+	}
+	secret, err := client.Core().Secrets("team-a").Get("vz-secret", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secret.Finalizers) != 0 {
+		t.Errorf("Expected the finalizer of the crashed attempt to be removed, got %v", secret.Finalizers)
+	}
+}
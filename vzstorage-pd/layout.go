@@ -0,0 +1,79 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"path"
+
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzstorage"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzvolume"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/api/v1/helper"
+)
+
+// StorageClass parameters overriding templates of vzstorage.DefaultLayout
+const (
+	descriptorTemplateParam = "descriptorDirTemplate"
+	imageTemplateParam      = "imageDirTemplate"
+	snapshotsTemplateParam  = "snapshotsDirTemplate"
+)
+
+// PV options recording the rendered layout. The descriptor directory is
+// recorded as volumePath, where ploop-flexvol looks for it.
+const (
+	imagePathOption     = vzvolume.ImagePathOption
+	snapshotsPathOption = vzvolume.SnapshotsPathOption
+)
+
+// applyLayout renders the directory layout of a new volume and records it
+// in its options in place of the templates
+func applyLayout(options map[string]string, claim *v1.PersistentVolumeClaim) error {
+	layout := vzstorage.DefaultLayout
+	for _, t := range []struct {
+		param    string
+		template *string
+	}{
+		{descriptorTemplateParam, &layout.Descriptor},
+		{imageTemplateParam, &layout.Image},
+		{snapshotsTemplateParam, &layout.Snapshots},
+	} {
+		if v, ok := options[t.param]; ok {
+			*t.template = v
+			delete(options, t.param)
+		}
+	}
+
+	deltasPath := options["deltasPath"]
+	if deltasPath == "" {
+		deltasPath = options["volumePath"]
+	}
+	paths, err := layout.Render(map[string]string{
+		"volumePath":   options["volumePath"],
+		"deltasPath":   deltasPath,
+		"volumeID":     options["volumeID"],
+		"namespace":    claim.Namespace,
+		"claim":        claim.Name,
+		"storageClass": helper.GetPersistentVolumeClaimClass(claim),
+	})
+	if err != nil {
+		return err
+	}
+	options["volumePath"] = path.Dir(paths.Descriptor)
+	options[imagePathOption] = paths.Image
+	options[snapshotsPathOption] = paths.Snapshots
+	return nil
+}
@@ -0,0 +1,188 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzstorage"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzvolume"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// localityAnn holds the replica locality of a PV for the prioritize verb
+// of the scheduler extender. PV node affinity can't carry it: the scheduler
+// only checks required terms of volumes, so preferences there are ignored.
+const localityAnn = "virtuozzo.com/locality"
+
+// volumeLocality tells weights in 1..100 of nodes by the value of their
+// label, nodes holding more replicas of the image have higher weights
+type volumeLocality struct {
+	Label   string           `json:"label"`
+	Weights map[string]int32 `json:"weights"`
+}
+
+// hostPriority is the scheduler extender API
+type hostPriority struct {
+	Host  string `json:"host"`
+	Score int    `json:"score"`
+}
+
+// maxExtenderPriority is the highest score the scheduler accepts from an
+// extender
+const maxExtenderPriority = 10
+
+// locality returns weights of nodes which host replicas of the volume
+// image, or nil if none of them is a known node. Nodes are matched by their
+// addresses and selected by the label.
+func (p *vzFSProvisioner) locality(ctx context.Context, cluster, mount string, options map[string]string, label string) (*volumeLocality, error) {
+	st, err := clusterStats.Stat(ctx, cluster)
+	if err != nil {
+		return nil, err
+	}
+	_, imageDir := vzvolume.Paths(mount, options)
+	servers, err := vzstorage.ReplicaServers(ctx, path.Join(imageDir, "root.hds"))
+	if err != nil {
+		return nil, err
+	}
+	replicas := vzstorage.ReplicaHosts(servers, st.Hosts)
+	if len(replicas) == 0 {
+		return nil, nil
+	}
+
+	nodes, err := p.client.Core().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	byValue := map[string]int{}
+	max := 0
+	for _, node := range nodes.Items {
+		value, ok := node.Labels[label]
+		if !ok || p.attach != nil && p.attach.saturated(node.Name) {
+			continue
+		}
+		for _, addr := range node.Status.Addresses {
+			if n, ok := replicas[addr.Address]; ok {
+				byValue[value] += n
+				if byValue[value] > max {
+					max = byValue[value]
+				}
+				break
+			}
+		}
+	}
+	if len(byValue) == 0 {
+		return nil, nil
+	}
+
+	l := &volumeLocality{Label: label, Weights: map[string]int32{}}
+	for v, n := range byValue {
+		weight := int32(n * 100 / max)
+		if weight == 0 {
+			weight = 1
+		}
+		l.Weights[v] = weight
+	}
+	return l, nil
+}
+
+// setLocality stores locality in the annotation of the volume
+func setLocality(volume *v1.PersistentVolume, l *volumeLocality) error {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	if volume.Annotations == nil {
+		volume.Annotations = map[string]string{}
+	}
+	volume.Annotations[localityAnn] = string(data)
+	return nil
+}
+
+// podLocalities returns localities of volumes of the pod. Claims which
+// aren't bound or volumes without locality are skipped.
+func (p *vzFSProvisioner) podLocalities(pod *v1.Pod) ([]*volumeLocality, error) {
+	var localities []*volumeLocality
+	for _, vol := range pod.Spec.Volumes {
+		if vol.PersistentVolumeClaim == nil {
+			continue
+		}
+		claim, err := p.client.Core().PersistentVolumeClaims(pod.Namespace).Get(vol.PersistentVolumeClaim.ClaimName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if claim.Spec.VolumeName == "" {
+			continue
+		}
+		volume, err := p.client.Core().PersistentVolumes().Get(claim.Spec.VolumeName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		data, ok := volume.Annotations[localityAnn]
+		if !ok {
+			continue
+		}
+		l := &volumeLocality{}
+		if err := json.Unmarshal([]byte(data), l); err != nil {
+			glog.Warningf("Invalid %s annotation of %s: %v", localityAnn, volume.Name, err)
+			continue
+		}
+		localities = append(localities, l)
+	}
+	return localities, nil
+}
+
+// serveLocality is the prioritize verb of a scheduler extender, it scores
+// nodes by the replicas of volumes of the pod they hold
+func (p *vzFSProvisioner) serveLocality(w http.ResponseWriter, req *http.Request) {
+	var args extenderArgs
+	if err := json.NewDecoder(req.Body).Decode(&args); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	localities, err := p.podLocalities(&args.Pod)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	result := make([]hostPriority, 0, len(args.Nodes.Items))
+	for _, node := range args.Nodes.Items {
+		score := 0
+		if len(localities) != 0 {
+			var sum int32
+			for _, l := range localities {
+				if value, ok := node.Labels[l.Label]; ok {
+					sum += l.Weights[value]
+				}
+			}
+			score = int(sum) * maxExtenderPriority / (100 * len(localities))
+		}
+		result = append(result, hostPriority{Host: node.Name, Score: score})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
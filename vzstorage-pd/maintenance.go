@@ -0,0 +1,332 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// how long IO latency of cluster clients is trusted
+	latencyTTL = time.Minute
+	// maintenanceNow as the value of a request annotation runs the job as
+	// soon as limits allow, like "true" for compaction and "check" for
+	// verification
+	maintenanceNow = "now"
+	// maintenancePendingAnn on the annotated claim or PV tells why its job
+	// waits
+	maintenancePendingAnn = "virtuozzo.com/maintenance-pending"
+)
+
+// maintenance runs maintenance jobs like compaction and verification of
+// volumes in the background, at most perCluster at a time on a cluster
+// and perNode on volumes used by pods on the same node. Jobs of volumes on
+// nodes whose cluster client IO latency exceeds maxLatency are postponed,
+// as are jobs over the limits; they are retried by the next pass.
+type maintenance struct {
+	client     kubernetes.Interface
+	perCluster int
+	perNode    int
+	// 0 disables the latency check
+	maxLatency time.Duration
+
+	mu       sync.Mutex
+	running  map[types.UID]bool
+	clusters map[string]int
+	nodes    map[string]int
+	latency  map[string]clusterLatency
+}
+
+type clusterLatency struct {
+	at time.Time
+	// client latency by host address, in milliseconds
+	hosts map[string]float64
+}
+
+func newMaintenance(client kubernetes.Interface, perCluster, perNode int, maxLatency time.Duration) *maintenance {
+	return &maintenance{
+		client:     client,
+		perCluster: perCluster,
+		perNode:    perNode,
+		maxLatency: maxLatency,
+		running:    map[types.UID]bool{},
+		clusters:   map[string]int{},
+		nodes:      map[string]int{},
+		latency:    map[string]clusterLatency{},
+	}
+}
+
+// claimNodes returns nodes of running pods by the namespace/name of claims
+// they use
+func (m *maintenance) claimNodes() map[string]string {
+	nodes, err := m.usedClaims()
+	if err != nil {
+		glog.Errorf("Unable to list pods: %v", err)
+	}
+	return nodes
+}
+
+// usedClaims is claimNodes failing when pods can't be listed, for callers
+// which must not take an unknown state for an unused volume
+func (m *maintenance) usedClaims() (map[string]string, error) {
+	nodes := map[string]string{}
+	pods, err := m.client.Core().Pods(v1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		return nodes, err
+	}
+	for _, pod := range pods.Items {
+		if pod.Spec.NodeName == "" || pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		for _, vol := range pod.Spec.Volumes {
+			if c := vol.PersistentVolumeClaim; c != nil {
+				nodes[pod.Namespace+"/"+c.ClaimName] = pod.Spec.NodeName
+			}
+		}
+	}
+	return nodes, nil
+}
+
+// volumeInUseError is returned by jobs which change the image of a volume
+// offline while a pod on node uses it
+type volumeInUseError struct {
+	node string
+}
+
+func (e *volumeInUseError) Error() string {
+	return fmt.Sprintf("the volume is used by a pod on node %s", e.node)
+}
+
+// checkNotInUse fails with volumeInUseError if a pod uses the volume.
+// ploop-volume snapshot and delete rewrite DiskDescriptor.xml offline, so
+// doing that under a ploop device running on a node leaves the device
+// writing to a delta which is no longer the top one, and the writes are
+// lost on the next mount.
+func (p *vzFSProvisioner) checkNotInUse(volume *v1.PersistentVolume) error {
+	ref := volume.Spec.ClaimRef
+	if ref == nil {
+		return nil
+	}
+	nodes, err := p.maintenance.usedClaims()
+	if err != nil {
+		return fmt.Errorf("Unable to tell whether the volume is in use: %v", err)
+	}
+	if node := nodes[ref.Namespace+"/"+ref.Name]; node != "" {
+		return &volumeInUseError{node: node}
+	}
+	return nil
+}
+
+// start runs the job of the claim in the background unless a job of the
+// claim is running already or limits don't allow it now. It returns true
+// if the job was started.
+func (m *maintenance) start(kind string, claim *v1.PersistentVolumeClaim, volume *v1.PersistentVolume, nodes map[string]string, job func()) bool {
+	cluster := volume.Spec.FlexVolume.Options["clusterName"]
+	node := nodes[claim.Namespace+"/"+claim.Name]
+
+	if m.maxLatency != 0 && node != "" {
+		if latency, ok := m.nodeLatency(cluster, node); ok && latency > m.maxLatency {
+			glog.Infof("Postponing %s of %s: IO latency of node %s is %v", kind, volume.Name, node, latency)
+			return false
+		}
+	}
+
+	m.mu.Lock()
+	if m.running[claim.UID] || m.clusters[cluster] >= m.perCluster || node != "" && m.nodes[node] >= m.perNode {
+		m.mu.Unlock()
+		return false
+	}
+	m.running[claim.UID] = true
+	m.clusters[cluster]++
+	if node != "" {
+		m.nodes[node]++
+	}
+	m.mu.Unlock()
+
+	go func() {
+		defer func() {
+			m.mu.Lock()
+			delete(m.running, claim.UID)
+			m.clusters[cluster]--
+			if node != "" {
+				m.nodes[node]--
+			}
+			m.mu.Unlock()
+		}()
+		job()
+	}()
+	return true
+}
+
+// nodeLatency returns IO latency of cluster clients on the node, false if
+// it isn't known
+func (m *maintenance) nodeLatency(cluster, node string) (time.Duration, bool) {
+	m.mu.Lock()
+	l, ok := m.latency[cluster]
+	m.mu.Unlock()
+	if !ok || time.Since(l.at) > latencyTTL {
+		st, err := clusterStats.Stat(context.Background(), cluster)
+		if err != nil {
+			glog.Warningf("Unable to get IO latency of %s: %v", cluster, err)
+			return 0, false
+		}
+		l = clusterLatency{at: time.Now(), hosts: st.ClientLatency}
+		m.mu.Lock()
+		m.latency[cluster] = l
+		m.mu.Unlock()
+	}
+
+	n, err := m.client.Core().Nodes().Get(node, metav1.GetOptions{})
+	if err != nil {
+		glog.Warningf("Unable to get node %s: %v", node, err)
+		return 0, false
+	}
+	var max float64
+	found := false
+	for _, addr := range n.Status.Addresses {
+		if ms, ok := l.hosts[addr.Address]; ok {
+			found = true
+			if ms > max {
+				max = ms
+			}
+		}
+	}
+	return time.Duration(max * float64(time.Millisecond)), found
+}
+
+// maintenanceRequest is a maintenance job requested by an annotation on a
+// claim or, by operators who don't edit claims, on its PV. Results are
+// reported on the annotated object.
+type maintenanceRequest struct {
+	claim  *v1.PersistentVolumeClaim
+	volume *v1.PersistentVolume
+	// value of the request annotation
+	value string
+	// onVolume is true if the PV is annotated rather than the claim
+	onVolume bool
+}
+
+// object returns the annotated object
+func (r *maintenanceRequest) object() runtime.Object {
+	if r.onVolume {
+		return r.volume
+	}
+	return r.claim
+}
+
+func (r *maintenanceRequest) annotations() map[string]string {
+	if r.onVolume {
+		return r.volume.Annotations
+	}
+	return r.claim.Annotations
+}
+
+// maintenanceRequests returns jobs requested by ann on bound claims of
+// volumes of this provisioner and on the volumes themselves. A request on
+// a claim wins over one on its PV.
+func (p *vzFSProvisioner) maintenanceRequests(ann string) []*maintenanceRequest {
+	claims, err := listClaims(p.client)
+	if err != nil {
+		glog.Errorf("Unable to list persistent volume claims: %v", err)
+		return nil
+	}
+	volumes, err := p.client.Core().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		glog.Errorf("Unable to list persistent volumes: %v", err)
+		return nil
+	}
+	ours := map[string]*v1.PersistentVolume{}
+	for i := range volumes.Items {
+		volume := &volumes.Items[i]
+		if volume.Annotations[parentProvisionerAnn] == *provisionerID {
+			ours[volume.Name] = volume
+		}
+	}
+
+	var requests []*maintenanceRequest
+	bound := map[string]*v1.PersistentVolumeClaim{}
+	for i := range claims {
+		claim := &claims[i]
+		volume := ours[claim.Spec.VolumeName]
+		if claim.Spec.VolumeName == "" || volume == nil {
+			continue
+		}
+		bound[volume.Name] = claim
+		if value, ok := claim.Annotations[ann]; ok {
+			requests = append(requests, &maintenanceRequest{claim: claim, volume: volume, value: value})
+		}
+	}
+	for name, volume := range ours {
+		value, ok := volume.Annotations[ann]
+		claim := bound[name]
+		if !ok || claim == nil {
+			continue
+		}
+		if _, onClaim := claim.Annotations[ann]; onClaim {
+			continue
+		}
+		requests = append(requests, &maintenanceRequest{claim: claim, volume: volume, value: value, onVolume: true})
+	}
+	return requests
+}
+
+// updateAnnotations applies fn to annotations of the current version of
+// the annotated object
+func (p *vzFSProvisioner) updateAnnotations(r *maintenanceRequest, fn func(map[string]string)) {
+	if r.onVolume {
+		p.updateVolumeAnnotations(r.volume, fn)
+	} else {
+		p.updateClaimAnnotations(r.claim, fn)
+	}
+}
+
+// postponeInUse reports on obj, by an event with reason, that kind of the
+// volume waits for the pod using it to release it, unless shown, what obj
+// tells already, is the same. It returns what obj should tell and whether
+// that changed.
+func (p *vzFSProvisioner) postponeInUse(obj runtime.Object, reason, kind, volume, shown string, e *volumeInUseError) (string, bool) {
+	message := fmt.Sprintf("%s waits for the pod on node %s to release the volume", kind, e.node)
+	if shown == message {
+		return message, false
+	}
+	glog.Infof("Postponing %s of %s: %v", kind, volume, e)
+	p.recorder.Event(obj, v1.EventTypeNormal, reason, message)
+	return message, true
+}
+
+// postponeMaintenance keeps a job which can't run while the volume is
+// used by a pod on node until the pod releases it, and tells so on the
+// annotated object
+func (p *vzFSProvisioner) postponeMaintenance(r *maintenanceRequest, kind, node string) {
+	message, changed := p.postponeInUse(r.object(), "MaintenancePostponed", kind, r.volume.Name, r.annotations()[maintenancePendingAnn], &volumeInUseError{node: node})
+	if !changed {
+		return
+	}
+	p.updateAnnotations(r, func(ann map[string]string) {
+		ann[maintenancePendingAnn] = message
+	})
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzstorage"
+)
+
+// mdsForwarder forwards local ports to MDS servers of a cluster through
+// its proxy
+type mdsForwarder struct {
+	// proxy and MDS addresses the forwarder was started for
+	config    string
+	forwarder *vzstorage.Forwarder
+}
+
+// mdsForwarders are kept for as long as the provisioner runs, as mounts
+// keep using the local addresses they were given
+var mdsForwarders = struct {
+	sync.Mutex
+	clusters map[string]*mdsForwarder
+}{clusters: map[string]*mdsForwarder{}}
+
+// mdsAddresses returns MDS addresses to give vstorage tools for the cluster,
+// only those on networks of its MDS interface if it has one, or local
+// addresses of forwarders if its MDS servers are reached through a proxy.
+// Forwarders are restarted when the proxy or the addresses change.
+func mdsAddresses(cluster *vstorageCluster) ([]string, error) {
+	if cluster.mdsProxy == nil {
+		if cluster.mdsInterface == "" {
+			return cluster.mdsAddresses, nil
+		}
+		return vzstorage.SelectInterface(cluster.mdsAddresses, cluster.mdsInterface)
+	}
+	config := fmt.Sprintf("%+v %s", *cluster.mdsProxy, strings.Join(cluster.mdsAddresses, ","))
+
+	mdsForwarders.Lock()
+	defer mdsForwarders.Unlock()
+	if f, ok := mdsForwarders.clusters[cluster.name]; ok {
+		if f.config == config {
+			return f.forwarder.Addresses(), nil
+		}
+		f.forwarder.Close()
+		delete(mdsForwarders.clusters, cluster.name)
+	}
+	name := cluster.name
+	f, err := vzstorage.NewForwarder(cluster.mdsProxy, cluster.mdsAddresses, func(err error) {
+		glog.Warningf("Unable to reach an MDS server of %s: %v", name, err)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to forward MDS addresses of %s through %s: %v", cluster.name, cluster.mdsProxy, err)
+	}
+	glog.Infof("Reaching MDS servers of %s through %s at %v", cluster.name, cluster.mdsProxy, f.Addresses())
+	mdsForwarders.clusters[cluster.name] = &mdsForwarder{config: config, forwarder: f}
+	return f.Addresses(), nil
+}
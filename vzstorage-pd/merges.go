@@ -0,0 +1,259 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/cron"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzvolume"
+	"github.com/virtuozzo/ploop-flexvol/vstorage"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const mergePeriod = time.Minute
+
+// snapshotMerge is a snapshot which is no longer needed and waits to be
+// deleted
+type snapshotMerge struct {
+	Snapshot string    `json:"snapshot"`
+	Volume   string    `json:"volume"`
+	Queued   time.Time `json:"queued"`
+}
+
+// merger deletes snapshots of volumes in a maintenance window. Deleting a
+// ploop snapshot merges its delta into the one above it, which reads and
+// rewrites the whole delta, so snapshots aren't deleted by the jobs which
+// are done with them but queued here. Queued snapshots are deleted one at
+// a time per volume through maintenance slots, paced by the compaction
+// budget of their cluster, and only while their volume isn't used by a pod,
+// as the delete rewrites the descriptor offline. The queue is kept in a
+// config map keyed by the snapshot name, so it survives restarts.
+type merger struct {
+	p     *vzFSProvisioner
+	store configMapStore
+	// merges start only within window, any time if it is nil
+	window *cron.Window
+}
+
+func newMerger(p *vzFSProvisioner, client kubernetes.Interface, namespace, name string, window *cron.Window) *merger {
+	return &merger{
+		p: p,
+		store: configMapStore{
+			client:    client,
+			namespace: namespace,
+			name:      name,
+		},
+		window: window,
+	}
+}
+
+// queue records that the snapshot of the PV named volume is to be deleted
+func (m *merger) queue(volume, snapshot string) error {
+	key := path.Base(snapshot)
+	data, err := m.store.get()
+	if err != nil {
+		return err
+	}
+	if _, ok := data[key]; ok {
+		return nil
+	}
+	value, err := json.Marshal(&snapshotMerge{Snapshot: snapshot, Volume: volume, Queued: time.Now()})
+	if err != nil {
+		return err
+	}
+	if _, err := m.store.modify(func(d map[string]string) { d[key] = string(value) }); err != nil {
+		return err
+	}
+	glog.Infof("Queued deletion of snapshot %s of %s", snapshot, volume)
+	return nil
+}
+
+// queued returns whether the snapshot waits to be deleted
+func (m *merger) queued(snapshot string) (bool, error) {
+	data, err := m.store.get()
+	if err != nil {
+		return false, err
+	}
+	_, ok := data[path.Base(snapshot)]
+	return ok, nil
+}
+
+// queueLeftovers queues snapshots of the volume in dir whose names start
+// with prefix, left there by interrupted jobs
+func (m *merger) queueLeftovers(volume, dir, prefix string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, f := range files {
+		name := f.Name()
+		if strings.HasPrefix(name, prefix) && strings.HasSuffix(name, ".snap") {
+			if err := m.queue(volume, path.Join(dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// forget drops the snapshot from the queue
+func (m *merger) forget(key string) {
+	if _, err := m.store.modify(func(d map[string]string) { delete(d, key) }); err != nil {
+		glog.Errorf("Unable to forget merged snapshot %s: %v", key, err)
+	}
+}
+
+func (m *merger) run(period time.Duration) {
+	wait.Forever(m.process, period)
+}
+
+// process starts deletions of queued snapshots which the window, the
+// maintenance limits and the pods of their volumes allow
+func (m *merger) process() {
+	if m.window != nil && !m.window.Contains(time.Now()) {
+		return
+	}
+	data, err := m.store.get()
+	if err != nil {
+		glog.Errorf("Unable to get queued snapshot merges: %v", err)
+		return
+	}
+	if len(data) == 0 {
+		return
+	}
+	nodes, err := m.p.maintenance.usedClaims()
+	if err != nil {
+		glog.Errorf("Unable to list pods: %v", err)
+		return
+	}
+	for key, value := range data {
+		var merge snapshotMerge
+		if err := json.Unmarshal([]byte(value), &merge); err != nil {
+			glog.Errorf("Dropping malformed snapshot merge %s: %v", key, err)
+			m.forget(key)
+			continue
+		}
+		volume, err := m.p.client.Core().PersistentVolumes().Get(merge.Volume, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			m.deleteOrphan(key, &merge)
+			continue
+		}
+		if err != nil {
+			glog.Errorf("Unable to get volume %s: %v", merge.Volume, err)
+			continue
+		}
+
+		claim := &v1.PersistentVolumeClaim{}
+		claim.UID = volume.UID
+		if ref := volume.Spec.ClaimRef; ref != nil {
+			claim.Namespace, claim.Name, claim.UID = ref.Namespace, ref.Name, ref.UID
+			if node := nodes[ref.Namespace+"/"+ref.Name]; node != "" {
+				glog.V(4).Infof("Not merging snapshot %s: %s is used on node %s", merge.Snapshot, volume.Name, node)
+				continue
+			}
+		}
+		key, merge := key, merge
+		m.p.maintenance.start("snapshot merge", claim, volume, nodes, func() { m.merge(key, &merge, volume) })
+	}
+}
+
+// merge deletes the snapshot once the budget of its cluster allows as
+// much IO as the merge takes
+func (m *merger) merge(key string, merge *snapshotMerge, volume *v1.PersistentVolume) {
+	options := volume.Spec.FlexVolume.Options
+	secretNamespace, secretName := volumeSecret(volume)
+	secret, err := tenantSecrets.get(secretNamespace, secretName)
+	if err != nil {
+		glog.Errorf("Unable to merge snapshot %s: %v", merge.Snapshot, err)
+		return
+	}
+	cluster, err := clusterFromSecret(secret)
+	if err != nil {
+		glog.Errorf("Unable to merge snapshot %s: %v", merge.Snapshot, err)
+		return
+	}
+	if err := m.p.prepareVstorage(options, cluster, secret); err != nil {
+		glog.Errorf("Unable to merge snapshot %s: %v", merge.Snapshot, err)
+		return
+	}
+	if !pathExists(merge.Snapshot) {
+		m.forget(key)
+		return
+	}
+
+	size, err := vzvolume.MergeSize(merge.Snapshot)
+	if err != nil {
+		glog.Warningf("Unable to tell the size of snapshot %s, merging it unpaced: %v", merge.Snapshot, err)
+	}
+	m.p.compactBudgets.reserve(cluster, int64(size))
+	// waiting for the budget takes time, the pod may have started and the
+	// window may have passed meanwhile
+	if m.window != nil && !m.window.Contains(time.Now()) {
+		return
+	}
+	if err := m.p.checkNotInUse(volume); err != nil {
+		glog.V(4).Infof("Not merging snapshot %s: %v", merge.Snapshot, err)
+		return
+	}
+
+	start := time.Now()
+	if err := deleteSnapshot(merge.Snapshot); err != nil {
+		glog.Errorf("Unable to delete snapshot %s of %s: %v", merge.Snapshot, volume.Name, err)
+		m.p.recorder.Eventf(volume, v1.EventTypeWarning, "SnapshotMergeFailed", "Unable to delete snapshot %s: %v", path.Base(merge.Snapshot), err)
+		return
+	}
+	m.forget(key)
+	glog.Infof("Deleted snapshot %s of %s, merging %d bytes took %v", merge.Snapshot, volume.Name, size, time.Since(start))
+}
+
+// deleteOrphan deletes a queued snapshot of a volume which is gone, so
+// nothing uses it. Snapshots on clusters which aren't mounted are kept
+// until they are.
+func (m *merger) deleteOrphan(key string, merge *snapshotMerge) {
+	cluster := strings.SplitN(strings.TrimPrefix(merge.Snapshot, mountDir), "/", 2)[0]
+	if mounted, _ := vstorage.IsVstorage(mountDir + cluster); !mounted {
+		return
+	}
+	if err := deleteSnapshot(merge.Snapshot); err != nil {
+		glog.Warningf("Unable to delete snapshot %s of removed volume %s: %v", merge.Snapshot, merge.Volume, err)
+		return
+	}
+	m.forget(key)
+	glog.Infof("Deleted snapshot %s of removed volume %s", merge.Snapshot, merge.Volume)
+}
+
+// tempSnapshotName returns a new name of a snapshot of the volume taken by
+// a job named by infix, like "-backup-". Every run takes a snapshot of its
+// own, as the one of the previous run may still wait to be merged.
+func tempSnapshotName(options map[string]string, infix string) string {
+	return fmt.Sprintf("%s%s%s.snap", options["volumeID"], infix, time.Now().UTC().Format(scheduledSnapshotTimeForm))
+}
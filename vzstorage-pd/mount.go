@@ -0,0 +1,130 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzstorage"
+	"github.com/virtuozzo/ploop-flexvol/vstorage"
+)
+
+// hostMounts caches mount points of clusters mounted on the host, which
+// are bind mounted instead of mounting clusters again
+var hostMounts = vzstorage.NewMountCache()
+
+// isStaleMount returns true if path is a mount point whose backing
+// filesystem has gone away, e.g. a bind mount of a vstorage cluster
+// which was remounted or lost after a node reboot.
+func isStaleMount(path string) bool {
+	var buf syscall.Statfs_t
+	err := syscall.Statfs(path, &buf)
+	return err == syscall.ENOTCONN || err == syscall.ESTALE || err == syscall.EIO
+}
+
+// cleanupStaleMount lazily detaches a torn mount, so it can be rebuilt
+func cleanupStaleMount(path string) error {
+	if !isStaleMount(path) {
+		return nil
+	}
+	glog.Warningf("Detaching stale vstorage mount %s", path)
+	if err := syscall.Unmount(path, syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("Unable to detach stale mount %s: %v", path, err)
+	}
+	return nil
+}
+
+// recoverMounts rebuilds cluster mounts under mountDir which were torn
+// while the provisioner was not running. Only mounts of the provisioner
+// are repaired; cluster mounts of ploop-flexvol on nodes are up to the
+// driver. Clusters which are mounted on the host are bind-mounted back
+// right away, all others are mounted on demand by prepareVstorage, as
+// credentials are not known until then. Every entry is repaired under the
+// mount lock of its cluster, as provisioning may run already.
+func (p *vzFSProvisioner) recoverMounts() {
+	entries, err := ioutil.ReadDir(mountDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			glog.Warningf("Unable to read %s: %v", mountDir, err)
+		}
+		return
+	}
+
+	for _, e := range entries {
+		lock := p.mountLock(e.Name())
+		lock.Lock()
+		recoverMount(e.Name())
+		lock.Unlock()
+	}
+}
+
+func recoverMount(cluster string) {
+	mount := path.Join(mountDir, cluster)
+	if err := cleanupStaleMount(mount); err != nil {
+		glog.Errorf("%v", err)
+		return
+	}
+	if mounted, _ := vstorage.IsVstorage(mount); mounted {
+		return
+	}
+
+	p, _ := hostMounts.Mountpoint(cluster)
+	if p == "" {
+		glog.Infof("Cluster %s is not mounted on the host, it will be mounted on demand", cluster)
+		return
+	}
+	if err := syscall.Mount(p, mount, "", syscall.MS_BIND, ""); err != nil {
+		glog.Errorf("Unable to bind mount %s to %s: %v", p, mount, err)
+		return
+	}
+	glog.Infof("Recovered mount of cluster %s in %s", cluster, mount)
+}
+
+// mountCluster mounts the cluster with its mount options. The client of
+// a cluster is shared by all its volumes, so options can't differ between
+// storage classes, and they are only applied when the cluster is mounted.
+func mountCluster(ctx context.Context, cluster *vstorageCluster, where string) error {
+	args := append([]string{"-c", cluster.name}, cluster.mountOptions...)
+	args = append(args, where)
+	if out, err := exec.CommandContext(ctx, "vstorage-mount", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("Unable to mount %s in %s: %v: %s", cluster.name, where, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// mountedClusters returns names of clusters mounted under mountDir
+func mountedClusters() []string {
+	entries, err := ioutil.ReadDir(mountDir)
+	if err != nil {
+		return nil
+	}
+	var clusters []string
+	for _, e := range entries {
+		if mounted, _ := vstorage.IsVstorage(path.Join(mountDir, e.Name())); mounted {
+			clusters = append(clusters, e.Name())
+		}
+	}
+	return clusters
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// watchedNamespaces are the namespaces whose claims the provisioner serves,
+// set by -watch-namespaces. Claims of all namespaces are served if empty.
+var watchedNamespaces []string
+
+// parseNamespaces parses a comma separated list of namespaces
+func parseNamespaces(s string) ([]string, error) {
+	var namespaces []string
+	seen := map[string]bool{}
+	for _, n := range strings.Split(s, ",") {
+		n = strings.TrimSpace(n)
+		if n == "" || seen[n] {
+			continue
+		}
+		if errs := validation.IsDNS1123Label(n); len(errs) != 0 {
+			return nil, fmt.Errorf("invalid namespace %q: %s", n, strings.Join(errs, ", "))
+		}
+		seen[n] = true
+		namespaces = append(namespaces, n)
+	}
+	return namespaces, nil
+}
+
+// listClaims lists claims of the watched namespaces. The provisioner may
+// not be allowed to list claims of other namespaces.
+func listClaims(client kubernetes.Interface) ([]v1.PersistentVolumeClaim, error) {
+	if len(watchedNamespaces) == 0 {
+		claims, err := client.Core().PersistentVolumeClaims(v1.NamespaceAll).List(metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return claims.Items, nil
+	}
+	var items []v1.PersistentVolumeClaim
+	for _, namespace := range watchedNamespaces {
+		claims, err := client.Core().PersistentVolumeClaims(namespace).List(metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, claims.Items...)
+	}
+	return items, nil
+}
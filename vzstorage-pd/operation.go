@@ -0,0 +1,104 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// operationGracePeriod is how long a timed out operation has to stop after
+// its context is cancelled before it is abandoned
+const operationGracePeriod = 5 * time.Second
+
+// operations bounds provisioning and deletion of volumes by a timeout.
+// When it expires the context of the operation is cancelled, which kills
+// its subprocesses and stops it between steps. Calls which don't take a
+// context, like those of goploop and ploop-flexvol, can't be interrupted;
+// the operation is abandoned to them then, so that the controller worker
+// is released, and another attempt of the same operation fails until the
+// abandoned one ends.
+type operations struct {
+	timeout time.Duration
+
+	mu      sync.Mutex
+	running map[string]bool
+}
+
+func newOperations(timeout time.Duration) *operations {
+	return &operations{timeout: timeout, running: map[string]bool{}}
+}
+
+// run runs fn as the operation named key, e.g. "Delete pvc-1"
+func (o *operations) run(key string, fn func(ctx context.Context) error) error {
+	if o.timeout == 0 {
+		return fn(context.Background())
+	}
+
+	o.mu.Lock()
+	if o.running[key] {
+		o.mu.Unlock()
+		return fmt.Errorf("%s is still running after its timeout, will retry", key)
+	}
+	o.running[key] = true
+	o.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), o.timeout)
+	done := make(chan error, 1)
+	go func() {
+		err := fn(ctx)
+		cancel()
+		o.mu.Lock()
+		delete(o.running, key)
+		o.mu.Unlock()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		// fn may have just returned as well
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(operationGracePeriod):
+		}
+		glog.Errorf("%s timed out after %v and is left to finish in background", key, o.timeout)
+		return fmt.Errorf("%s timed out after %v", key, o.timeout)
+	}
+}
+
+// isRunning returns true if the operation named key is running, including
+// after its timeout
+func (o *operations) isRunning(key string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.running[key]
+}
+
+// idle returns true if no operation is running, including those abandoned
+// after their timeout
+func (o *operations) idle() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.running) == 0
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/metrics"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// how long capacity of a provisioned volume is reserved, until its PV is
+// created and counted
+const overcommitReservationTTL = time.Minute
+
+var overcommitRatio = metrics.NewGauge("vzstorage_overcommit_ratio",
+	"Capacity of volumes on the cluster divided by its total space.", "cluster")
+
+// overcommitGuard keeps capacity of volumes provisioned on a cluster below
+// a multiple of its total space, so that thin images can't promise more
+// than the cluster is meant to hold. Capacity of volumes being provisioned
+// is reserved, so that concurrent Provision calls can't overrun the limit
+// together.
+type overcommitGuard struct {
+	client kubernetes.Interface
+
+	mu sync.Mutex
+	// reservations by cluster and PV name
+	reserved map[string]map[string]reservation
+}
+
+type reservation struct {
+	bytes int64
+	// zero while the volume is being provisioned
+	until time.Time
+}
+
+func newOvercommitGuard(client kubernetes.Interface) *overcommitGuard {
+	return &overcommitGuard{client: client, reserved: map[string]map[string]reservation{}}
+}
+
+// reserve reserves bytes for the volume pvName on the cluster, failing if
+// that would exceed the over-commit limit of the cluster. release has to
+// be called once provisioning ends; a successful reservation is kept a
+// while longer, until the PV is created.
+func (g *overcommitGuard) reserve(ctx context.Context, cluster *vstorageCluster, pvName string, bytes int64) (func(provisioned bool), error) {
+	if cluster.overcommit == 0 {
+		return func(bool) {}, nil
+	}
+	total, provisioned, err := g.usage(ctx, cluster.name)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to check over-commit of cluster %s: %v", cluster.name, err)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	reserved := g.reservedLocked(cluster.name)
+	limit := cluster.overcommit * float64(total)
+	if float64(provisioned+reserved+bytes) > limit {
+		return nil, fmt.Errorf("provisioning %d bytes would over-commit cluster %s: %d bytes of volumes on %d bytes of space exceed the ratio %g",
+			bytes, cluster.name, provisioned+reserved+bytes, total, cluster.overcommit)
+	}
+	if g.reserved[cluster.name] == nil {
+		g.reserved[cluster.name] = map[string]reservation{}
+	}
+	g.reserved[cluster.name][pvName] = reservation{bytes: bytes}
+	if total != 0 {
+		overcommitRatio.Set(float64(provisioned+reserved+bytes)/float64(total), cluster.name)
+	}
+
+	return func(ok bool) {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if ok {
+			g.reserved[cluster.name][pvName] = reservation{bytes: bytes, until: time.Now().Add(overcommitReservationTTL)}
+		} else {
+			delete(g.reserved[cluster.name], pvName)
+		}
+	}, nil
+}
+
+// reservedLocked sums reservations of the cluster, dropping expired ones
+func (g *overcommitGuard) reservedLocked(cluster string) int64 {
+	var sum int64
+	now := time.Now()
+	for name, r := range g.reserved[cluster] {
+		if !r.until.IsZero() && now.After(r.until) {
+			delete(g.reserved[cluster], name)
+			continue
+		}
+		sum += r.bytes
+	}
+	return sum
+}
+
+// usage returns the total space of the cluster and the capacity of PVs of
+// this provisioner on it
+func (g *overcommitGuard) usage(ctx context.Context, cluster string) (int64, int64, error) {
+	st, err := clusterStats.Stat(ctx, cluster)
+	if err != nil {
+		return 0, 0, err
+	}
+	var total int64
+	for _, t := range st.Tiers {
+		total += int64(t.Total)
+	}
+	provisioned, err := g.provisioned()
+	if err != nil {
+		return 0, 0, err
+	}
+	return total, provisioned[cluster], nil
+}
+
+// provisioned returns capacity of PVs of this provisioner by cluster
+func (g *overcommitGuard) provisioned() (map[string]int64, error) {
+	volumes, err := g.client.Core().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	capacity := map[string]int64{}
+	for _, volume := range volumes.Items {
+		if volume.Annotations[parentProvisionerAnn] != *provisionerID || volume.Spec.FlexVolume == nil {
+			continue
+		}
+		q := volume.Spec.Capacity[v1.ResourceName(v1.ResourceStorage)]
+		capacity[volume.Spec.FlexVolume.Options["clusterName"]] += q.Value()
+	}
+	return capacity, nil
+}
+
+// run refreshes over-commit ratios of mounted clusters every period
+func (g *overcommitGuard) run(period time.Duration) {
+	wait.Forever(g.updateRatios, period)
+}
+
+func (g *overcommitGuard) updateRatios() {
+	provisioned, err := g.provisioned()
+	if err != nil {
+		glog.Errorf("Unable to list persistent volumes: %v", err)
+		return
+	}
+	overcommitRatio.Reset()
+	for _, cluster := range mountedClusters() {
+		st, err := clusterStats.Stat(context.Background(), cluster)
+		if err != nil {
+			glog.Warningf("Unable to get capacity of cluster %s: %v", cluster, err)
+			continue
+		}
+		var total uint64
+		for _, t := range st.Tiers {
+			total += t.Total
+		}
+		if total != 0 {
+			overcommitRatio.Set(float64(provisioned[cluster])/float64(total), cluster)
+		}
+	}
+}
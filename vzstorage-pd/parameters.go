@@ -0,0 +1,73 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/golang/glog"
+)
+
+// knownParameters are StorageClass parameters understood by the
+// provisioner or passed through to ploop-flexvol
+var knownParameters = map[string]bool{
+	"volumePath":            true,
+	"deltasPath":            true,
+	"secretName":            true,
+	secondarySecretParam:    true,
+	"optionsFromSystem":     true,
+	"ploopBlockSize":        true,
+	allocationParam:         true,
+	pvLabelsParam:           true,
+	pvAnnotationsParam:      true,
+	secureDeleteParam:       true,
+	"vzsReplicas":           true,
+	"vzsFailureDomain":      true,
+	"vzsEncoding":           true,
+	"vzsTier":               true,
+	"kubernetes.io/fsType":  true,
+	descriptorTemplateParam: true,
+	imageTemplateParam:      true,
+	snapshotsTemplateParam:  true,
+	profileParam:            true,
+	sizeProfilesParam:       true,
+	snapshotScheduleParam:   true,
+	snapshotRetentionParam:  true,
+}
+
+// checkParameters reports StorageClass parameters the provisioner doesn't
+// know, which are most likely typos. In strict mode they are an error,
+// otherwise they are only logged.
+func checkParameters(parameters map[string]string, strict bool) error {
+	var unknown []string
+	for k := range parameters {
+		if !knownParameters[k] {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+
+	if strict {
+		return fmt.Errorf("unknown StorageClass parameter %q", unknown[0])
+	}
+	glog.Warningf("Ignoring unknown StorageClass parameters %q", unknown)
+	return nil
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package backup keeps ploop snapshots in object storage
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// Target is an object storage backups are kept in
+type Target interface {
+	// Put stores the object under the key, replacing an existing one
+	Put(key string, r io.Reader) error
+	// Get returns the content of the object, which has to be closed
+	Get(key string) (io.ReadCloser, error)
+}
+
+// Manifest describes a backup. It is stored after all deltas, so a backup
+// without a manifest is incomplete.
+type Manifest struct {
+	Volume   string            `json:"volume"`
+	Capacity string            `json:"capacity"`
+	Options  map[string]string `json:"options"`
+	Created  time.Time         `json:"created"`
+	// DiskDescriptor of the snapshot with deltas referred by their names
+	DiskDescriptor string  `json:"diskDescriptor"`
+	Deltas         []Delta `json:"deltas"`
+}
+
+// Delta is a delta file of the backed up snapshot
+type Delta struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+const manifestName = "manifest.json"
+
+var reDeltaFile = regexp.MustCompile(`<File>([^<]+)</File>`)
+
+// Backup uploads deltas of the snapshot in snapshotPath under prefix, and
+// the manifest m completed with the deltas and the disk descriptor
+func Backup(t Target, prefix, snapshotPath string, m *Manifest) error {
+	dd, err := ioutil.ReadFile(path.Join(snapshotPath, "DiskDescriptor.xml"))
+	if err != nil {
+		return err
+	}
+
+	m.Deltas = nil
+	var uploadErr error
+	m.DiskDescriptor = reDeltaFile.ReplaceAllStringFunc(string(dd), func(s string) string {
+		if uploadErr != nil {
+			return s
+		}
+		file := reDeltaFile.FindStringSubmatch(s)[1]
+		if !path.IsAbs(file) {
+			file = path.Join(snapshotPath, file)
+		}
+		name := fmt.Sprintf("%d-%s", len(m.Deltas), path.Base(file))
+		delta, err := uploadDelta(t, prefix, name, file)
+		if err != nil {
+			uploadErr = err
+			return s
+		}
+		m.Deltas = append(m.Deltas, *delta)
+		return "<File>" + name + "</File>"
+	})
+	if uploadErr != nil {
+		return uploadErr
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return t.Put(path.Join(prefix, manifestName), bytes.NewReader(data))
+}
+
+// countingHash sums up and counts what is read through it
+type countingHash struct {
+	hash.Hash
+	n int64
+}
+
+func (c *countingHash) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return c.Hash.Write(p)
+}
+
+func uploadDelta(t Target, prefix, name, file string) (*Delta, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := &countingHash{Hash: sha256.New()}
+	if err := t.Put(path.Join(prefix, "deltas", name), io.TeeReader(f, h)); err != nil {
+		return nil, fmt.Errorf("Unable to upload %s: %v", file, err)
+	}
+	return &Delta{Name: name, Size: h.n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// GetManifest returns the manifest of the backup under prefix
+func GetManifest(t Target, prefix string) (*Manifest, error) {
+	r, err := t.Get(path.Join(prefix, manifestName))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var m Manifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("Unable to parse manifest of %s: %v", prefix, err)
+	}
+	return &m, nil
+}
+
+// Restore downloads deltas of the backup to deltaDir, verifying their
+// checksums, and writes the disk descriptor referring them to ddDir
+func Restore(t Target, prefix string, m *Manifest, ddDir, deltaDir string) error {
+	for _, d := range m.Deltas {
+		if err := downloadDelta(t, prefix, d, path.Join(deltaDir, d.Name)); err != nil {
+			return err
+		}
+	}
+
+	rel, err := filepath.Rel(ddDir, deltaDir)
+	if err != nil {
+		return err
+	}
+	dd := reDeltaFile.ReplaceAllStringFunc(m.DiskDescriptor, func(s string) string {
+		return "<File>" + path.Join(rel, reDeltaFile.FindStringSubmatch(s)[1]) + "</File>"
+	})
+	tmp := path.Join(ddDir, ".DiskDescriptor.xml")
+	if err := ioutil.WriteFile(tmp, []byte(dd), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path.Join(ddDir, "DiskDescriptor.xml"))
+}
+
+func downloadDelta(t Target, prefix string, d Delta, file string) error {
+	r, err := t.Get(path.Join(prefix, "deltas", d.Name))
+	if err != nil {
+		return fmt.Errorf("Unable to download %s: %v", d.Name, err)
+	}
+	defer r.Close()
+
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	h := &countingHash{Hash: sha256.New()}
+	_, err = io.Copy(io.MultiWriter(f, h), r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to download %s: %v", d.Name, err)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); h.n != d.Size || sum != d.SHA256 {
+		return fmt.Errorf("Delta %s is corrupted: got %d bytes with sha256 %s, expected %d bytes with sha256 %s",
+			d.Name, h.n, sum, d.Size, d.SHA256)
+	}
+	return nil
+}
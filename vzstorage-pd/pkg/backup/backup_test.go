@@ -0,0 +1,141 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// memTarget keeps objects in memory
+type memTarget map[string][]byte
+
+func (m memTarget) Put(key string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m[key] = data
+	return nil
+}
+
+func (m memTarget) Get(key string) (io.ReadCloser, error) {
+	data, ok := m[key]
+	if !ok {
+		return nil, fmt.Errorf("%s not found", key)
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+const snapshotDD = `<?xml version="1.0"?>
+<Parallels_disk_image>
+  <StorageData>
+    <Storage>
+      <Image>
+        <GUID>{5fbaabe3-6958-40ff-92a7-860e329aab41}</GUID>
+        <File>../../images/vol.image/root.hds</File>
+      </Image>
+      <Image>
+        <GUID>{4b4b1c1e-a4ed-4e1c-8e48-1d2ee6e53d72}</GUID>
+        <File>%s</File>
+      </Image>
+    </Storage>
+  </StorageData>
+</Parallels_disk_image>
+`
+
+func TestBackupRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	snapshot := path.Join(dir, "volumes", "vol.snap")
+	images := path.Join(dir, "images", "vol.image")
+	for _, d := range []string{snapshot, images} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	top := path.Join(images, "root.hds.{4b4b1c1e}")
+	files := map[string]string{
+		path.Join(images, "root.hds"): "base delta",
+		top:                           "top delta",
+		path.Join(snapshot, "DiskDescriptor.xml"): fmt.Sprintf(snapshotDD, top),
+	}
+	for file, data := range files {
+		if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	target := memTarget{}
+	m := &Manifest{Volume: "pvc-1", Capacity: "1Gi"}
+	if err := Backup(target, "ns/backup1", snapshot, m); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	if len(m.Deltas) != 2 || m.Deltas[0].Name != "0-root.hds" || m.Deltas[1].Name != "1-root.hds.{4b4b1c1e}" ||
+		m.Deltas[1].Size != int64(len("top delta")) {
+		t.Errorf("unexpected deltas %+v", m.Deltas)
+	}
+	if string(target["ns/backup1/deltas/0-root.hds"]) != "base delta" {
+		t.Errorf("unexpected objects %v", target)
+	}
+
+	got, err := GetManifest(target, "ns/backup1")
+	if err != nil {
+		t.Fatalf("GetManifest failed: %v", err)
+	}
+	if got.Volume != "pvc-1" || len(got.Deltas) != 2 {
+		t.Errorf("unexpected manifest %+v", got)
+	}
+
+	ddDir := path.Join(dir, "volumes", "restored")
+	deltaDir := path.Join(dir, "images", "restored.image")
+	for _, d := range []string{ddDir, deltaDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Restore(target, "ns/backup1", got, ddDir, deltaDir); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	data, err := ioutil.ReadFile(path.Join(deltaDir, "1-root.hds.{4b4b1c1e}"))
+	if err != nil || string(data) != "top delta" {
+		t.Errorf("unexpected restored delta %q: %v", data, err)
+	}
+	dd, err := ioutil.ReadFile(path.Join(ddDir, "DiskDescriptor.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(dd), "<File>../../images/restored.image/0-root.hds</File>") ||
+		!strings.Contains(string(dd), "<File>../../images/restored.image/1-root.hds.{4b4b1c1e}</File>") {
+		t.Errorf("unexpected restored disk descriptor %s", dd)
+	}
+
+	target["ns/backup1/deltas/1-root.hds.{4b4b1c1e}"] = []byte("top delte")
+	if err := Restore(target, "ns/backup1", got, ddDir, deltaDir); err == nil || !strings.Contains(err.Error(), "corrupted") {
+		t.Errorf("expected a checksum error, got %v", err)
+	}
+}
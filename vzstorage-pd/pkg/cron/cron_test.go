@@ -0,0 +1,77 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"@often",
+	} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	// a Wednesday
+	from := time.Date(2017, 3, 15, 10, 20, 30, 0, time.UTC)
+	tests := []struct {
+		spec string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2017, 3, 15, 10, 21, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2017, 3, 15, 11, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2017, 3, 16, 0, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2017, 3, 15, 10, 30, 0, 0, time.UTC)},
+		{"30 2 * * *", time.Date(2017, 3, 16, 2, 30, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2017, 3, 15, 13, 0, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2017, 3, 19, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2017, 3, 19, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 1-5", time.Date(2017, 3, 16, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2017, 4, 1, 0, 0, 0, 0, time.UTC)},
+		// restricted days of month and week match either
+		{"0 0 1 * 5", time.Date(2017, 3, 17, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1,15 1 *", time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, test := range tests {
+		s, err := Parse(test.spec)
+		if err != nil {
+			t.Errorf("%q: %v", test.spec, err)
+			continue
+		}
+		if next := s.Next(from); !next.Equal(test.next) {
+			t.Errorf("%q: expected %v, got %v", test.spec, test.next, next)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cron
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Window is a daily time window in UTC, like 01:00-05:00. A window whose
+// end is before its start spans midnight.
+type Window struct {
+	start, end time.Duration
+}
+
+// ParseWindow parses a window given as HH:MM-HH:MM
+func ParseWindow(spec string) (*Window, error) {
+	parts := strings.Split(spec, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("window %q is not HH:MM-HH:MM", spec)
+	}
+	w := &Window{}
+	var err error
+	if w.start, err = parseClock(parts[0]); err != nil {
+		return nil, fmt.Errorf("start of %q: %v", spec, err)
+	}
+	if w.end, err = parseClock(parts[1]); err != nil {
+		return nil, fmt.Errorf("end of %q: %v", spec, err)
+	}
+	if w.start == w.end {
+		return nil, fmt.Errorf("window %q is empty", spec)
+	}
+	return w, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Contains returns whether t is within the window
+func (w *Window) Contains(t time.Time) bool {
+	t = t.UTC()
+	clock := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if w.start < w.end {
+		return clock >= w.start && clock < w.end
+	}
+	return clock >= w.start || clock < w.end
+}
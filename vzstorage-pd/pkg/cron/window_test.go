@@ -0,0 +1,75 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseWindowErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"01:00",
+		"01:00-",
+		"1-5",
+		"25:00-05:00",
+		"01:00-05:60",
+		"01:00-05:00-06:00",
+		"03:00-03:00",
+	} {
+		if _, err := ParseWindow(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	at := func(hour, min int) time.Time {
+		return time.Date(2017, 3, 15, hour, min, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		spec string
+		t    time.Time
+		in   bool
+	}{
+		{"01:00-05:00", at(0, 59), false},
+		{"01:00-05:00", at(1, 0), true},
+		{"01:00-05:00", at(4, 59), true},
+		{"01:00-05:00", at(5, 0), false},
+		{"22:30-02:00", at(22, 29), false},
+		{"22:30-02:00", at(23, 0), true},
+		{"22:30-02:00", at(0, 0), true},
+		{"22:30-02:00", at(1, 59), true},
+		{"22:30-02:00", at(2, 0), false},
+		{"22:30-02:00", at(12, 0), false},
+	}
+	for _, test := range tests {
+		w, err := ParseWindow(test.spec)
+		if err != nil {
+			t.Fatalf("%q: %v", test.spec, err)
+		}
+		if in := w.Contains(test.t); in != test.in {
+			t.Errorf("%q contains %v: got %v, expected %v", test.spec, test.t, in, test.in)
+		}
+	}
+	// times are compared in UTC
+	w, _ := ParseWindow("01:00-05:00")
+	if !w.Contains(at(2, 0).In(time.FixedZone("UTC+3", 3*3600))) {
+		t.Errorf("a time in another zone is not compared in UTC")
+	}
+}
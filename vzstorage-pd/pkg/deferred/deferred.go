@@ -0,0 +1,264 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package deferred keeps released volumes for a grace period before their
+// images are removed, so that they can be restored until then
+package deferred
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// Label marks config maps of deferred deletes, its value is the name
+	// of the PV
+	Label = "virtuozzo.com/deferred-delete"
+	// UndeleteAnnotation on the index config map is a comma separated list
+	// of PVs to restore
+	UndeleteAnnotation = "virtuozzo.com/undelete"
+)
+
+// Entry is a released volume waiting for its grace period to end
+type Entry struct {
+	Volume   *v1.PersistentVolume `json:"volume"`
+	DeleteAt time.Time            `json:"deleteAt"`
+}
+
+// Deletes keeps a config map <name>-<pv> per released volume, so that the
+// number of deferred volumes isn't limited by the size of a single object.
+// The index config map <name> only carries UndeleteAnnotation; entries
+// stored in its data by older versions are moved to their own config maps.
+type Deletes struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	grace     time.Duration
+	// Delete removes the image of a volume whose grace period ended
+	Delete func(volume *v1.PersistentVolume) error
+	// Restored is called for every volume restored by undelete
+	Restored func(volume *v1.PersistentVolume)
+}
+
+// New returns deferred deletes kept in config maps in namespace
+func New(client kubernetes.Interface, namespace, name string, grace time.Duration) *Deletes {
+	return &Deletes{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+		grace:     grace,
+		Delete:    func(*v1.PersistentVolume) error { return nil },
+		Restored:  func(*v1.PersistentVolume) {},
+	}
+}
+
+// Add defers deletion of the volume by the grace period. Only what is
+// needed to restore the PV is kept.
+func (d *Deletes) Add(volume *v1.PersistentVolume) error {
+	// the index is where undeletes are requested, so it has to exist
+	index := &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: d.name, Namespace: d.namespace}}
+	if _, err := d.client.Core().ConfigMaps(d.namespace).Create(index); err != nil && !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+	return d.store(&Entry{Volume: stripVolume(volume), DeleteAt: time.Now().Add(d.grace)})
+}
+
+func (d *Deletes) store(e *Entry) error {
+	data, err := json.Marshal(e.Volume)
+	if err != nil {
+		return err
+	}
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      d.name + "-" + e.Volume.Name,
+			Namespace: d.namespace,
+			Labels:    map[string]string{Label: e.Volume.Name},
+		},
+		Data: map[string]string{
+			"volume":   string(data),
+			"deleteAt": e.DeleteAt.UTC().Format(time.RFC3339),
+		},
+	}
+	cms := d.client.Core().ConfigMaps(d.namespace)
+	if _, err := cms.Create(cm); apierrors.IsAlreadyExists(err) {
+		_, err = cms.Update(cm)
+		return err
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// stripVolume returns the name, labels, annotations and spec of volume
+func stripVolume(volume *v1.PersistentVolume) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        volume.Name,
+			Labels:      volume.Labels,
+			Annotations: volume.Annotations,
+		},
+		Spec: volume.Spec,
+	}
+}
+
+func decode(cm *v1.ConfigMap) (*Entry, error) {
+	e := &Entry{Volume: &v1.PersistentVolume{}}
+	if err := json.Unmarshal([]byte(cm.Data["volume"]), e.Volume); err != nil {
+		return nil, err
+	}
+	t, err := time.Parse(time.RFC3339, cm.Data["deleteAt"])
+	if err != nil {
+		return nil, err
+	}
+	e.DeleteAt = t
+	return e, nil
+}
+
+// Pending returns the names of PVs whose deletion is deferred, including
+// those still kept in the data of the index by older versions
+func (d *Deletes) Pending() (map[string]bool, error) {
+	cms := d.client.Core().ConfigMaps(d.namespace)
+	pending := map[string]bool{}
+	index, err := cms.Get(d.name, metav1.GetOptions{})
+	if err == nil {
+		for name := range index.Data {
+			pending[name] = true
+		}
+	} else if !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+	list, err := cms.List(metav1.ListOptions{LabelSelector: Label})
+	if err != nil {
+		return nil, err
+	}
+	for _, cm := range list.Items {
+		if strings.HasPrefix(cm.Name, d.name+"-") {
+			pending[cm.Labels[Label]] = true
+		}
+	}
+	return pending, nil
+}
+
+// Process deletes volumes whose grace period ended and restores those
+// listed in UndeleteAnnotation of the index config map. Volumes which
+// fail are retried by the next call.
+func (d *Deletes) Process() error {
+	cms := d.client.Core().ConfigMaps(d.namespace)
+	var errs []error
+	undelete := map[string]bool{}
+	index, err := cms.Get(d.name, metav1.GetOptions{})
+	if err == nil {
+		for _, name := range strings.Split(index.Annotations[UndeleteAnnotation], ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				undelete[name] = true
+			}
+		}
+		if err := d.migrate(index); err != nil {
+			errs = append(errs, err)
+		}
+	} else if !apierrors.IsNotFound(err) {
+		return fmt.Errorf("Unable to get deferred deletes %s/%s: %v", d.namespace, d.name, err)
+	}
+
+	list, err := cms.List(metav1.ListOptions{LabelSelector: Label})
+	if err != nil {
+		return fmt.Errorf("Unable to list deferred deletes: %v", err)
+	}
+	now := time.Now()
+	for i := range list.Items {
+		cm := &list.Items[i]
+		// config maps of other provisioners
+		if !strings.HasPrefix(cm.Name, d.name+"-") {
+			continue
+		}
+		name := cm.Labels[Label]
+		e, err := decode(cm)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Dropping malformed deferred delete %s: %v", name, err))
+		} else if undelete[name] {
+			if err := d.restore(e.Volume); err != nil {
+				errs = append(errs, fmt.Errorf("Unable to undelete %s: %v", name, err))
+				continue
+			}
+			d.Restored(e.Volume)
+		} else if now.Before(e.DeleteAt) {
+			continue
+		} else if err := d.Delete(e.Volume); err != nil {
+			errs = append(errs, fmt.Errorf("Deferred deletion of %s failed, will retry: %v", name, err))
+			continue
+		}
+		if err := cms.Delete(cm.Name, nil); err != nil && !apierrors.IsNotFound(err) {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(undelete) != 0 {
+		// the annotation is cleared on a best effort basis, undeleted
+		// volumes are gone anyway
+		if index, err := cms.Get(d.name, metav1.GetOptions{}); err == nil {
+			delete(index.Annotations, UndeleteAnnotation)
+			cms.Update(index)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// migrate moves entries kept in the data of the index config map to their
+// own config maps
+func (d *Deletes) migrate(index *v1.ConfigMap) error {
+	if len(index.Data) == 0 {
+		return nil
+	}
+	for name, data := range index.Data {
+		var e Entry
+		if err := json.Unmarshal([]byte(data), &e); err != nil || e.Volume == nil {
+			// malformed entries are dropped along with the data
+			continue
+		}
+		if err := d.store(&e); err != nil {
+			return fmt.Errorf("Unable to move deferred delete %s: %v", name, err)
+		}
+	}
+	index.Data = nil
+	_, err := d.client.Core().ConfigMaps(d.namespace).Update(index)
+	return err
+}
+
+// restore recreates the PV of a volume whose deletion was deferred. The
+// PV keeps its claim reference without the UID, so a claim recreated with
+// the same name binds to it again.
+func (d *Deletes) restore(volume *v1.PersistentVolume) error {
+	pv := stripVolume(volume)
+	if ref := pv.Spec.ClaimRef; ref != nil {
+		pv.Spec.ClaimRef = &v1.ObjectReference{
+			Kind:      ref.Kind,
+			Namespace: ref.Namespace,
+			Name:      ref.Name,
+		}
+	}
+	if _, err := d.client.Core().PersistentVolumes().Create(pv); err != nil && !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
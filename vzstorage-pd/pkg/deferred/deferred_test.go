@@ -0,0 +1,208 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deferred
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func newVolume(name string) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Annotations:     map[string]string{"vzShare": name},
+			ResourceVersion: "42",
+		},
+		Spec: v1.PersistentVolumeSpec{
+			ClaimRef: &v1.ObjectReference{Kind: "PersistentVolumeClaim", Namespace: "team-a", Name: "db", UID: "1234"},
+		},
+		Status: v1.PersistentVolumeStatus{Phase: v1.VolumeReleased},
+	}
+}
+
+// newDeletes returns deferred deletes which record what they deleted and
+// restored
+func newDeletes(client *fake.Clientset, grace time.Duration) (*Deletes, map[string]bool, map[string]bool) {
+	deleted, restored := map[string]bool{}, map[string]bool{}
+	d := New(client, "kube-system", "vz-deferred-deletes", grace)
+	d.Delete = func(volume *v1.PersistentVolume) error {
+		if volume.Name == "pv-fail" {
+			return errors.New("cluster is down")
+		}
+		deleted[volume.Name] = true
+		return nil
+	}
+	d.Restored = func(volume *v1.PersistentVolume) { restored[volume.Name] = true }
+	return d, deleted, restored
+}
+
+func entries(t *testing.T, client *fake.Clientset) map[string]bool {
+	list, err := client.Core().ConfigMaps("kube-system").List(metav1.ListOptions{LabelSelector: Label})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{}
+	for _, cm := range list.Items {
+		names[cm.Labels[Label]] = true
+	}
+	return names
+}
+
+func TestProcess(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	d, deleted, restored := newDeletes(client, time.Hour)
+	for _, name := range []string{"pv-1", "pv-2"} {
+		if err := d.Add(newVolume(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Process(); err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 0 || len(restored) != 0 {
+		t.Errorf("Expected nothing to happen during the grace period, deleted %v, restored %v", deleted, restored)
+	}
+	if e := entries(t, client); len(e) != 2 {
+		t.Errorf("Expected 2 entries, got %v", e)
+	}
+
+	d, deleted, _ = newDeletes(client, 0)
+	for _, name := range []string{"pv-1", "pv-fail"} {
+		if err := d.Add(newVolume(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Process(); err == nil {
+		t.Errorf("Expected the failed deletion to be reported")
+	}
+	if !deleted["pv-1"] || deleted["pv-2"] {
+		t.Errorf("Expected only pv-1 to be deleted, got %v", deleted)
+	}
+	if e := entries(t, client); len(e) != 2 || !e["pv-2"] || !e["pv-fail"] {
+		t.Errorf("Expected pv-2 and pv-fail to be kept, got %v", e)
+	}
+}
+
+func TestUndelete(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	d, deleted, restored := newDeletes(client, 0)
+	if err := d.Add(newVolume("pv-1")); err != nil {
+		t.Fatal(err)
+	}
+	cms := client.Core().ConfigMaps("kube-system")
+	index, err := cms.Get("vz-deferred-deletes", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected the index to be created: %v", err)
+	}
+	index.Annotations = map[string]string{UndeleteAnnotation: " pv-1, pv-unknown"}
+	if _, err := cms.Update(index); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Process(); err != nil {
+		t.Fatal(err)
+	}
+	if !restored["pv-1"] || len(deleted) != 0 {
+		t.Errorf("Expected pv-1 to be restored rather than deleted, restored %v, deleted %v", restored, deleted)
+	}
+	if e := entries(t, client); len(e) != 0 {
+		t.Errorf("Expected the entry to be removed, got %v", e)
+	}
+	if index, err = cms.Get("vz-deferred-deletes", metav1.GetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := index.Annotations[UndeleteAnnotation]; ok {
+		t.Errorf("Expected the undelete annotation to be cleared")
+	}
+
+	pv, err := client.Core().PersistentVolumes().Get("pv-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected the PV to be recreated: %v", err)
+	}
+	ref := pv.Spec.ClaimRef
+	if ref == nil || ref.Namespace != "team-a" || ref.Name != "db" || ref.UID != "" {
+		t.Errorf("Expected the claim reference without UID, got %+v", ref)
+	}
+	if pv.Annotations["vzShare"] != "pv-1" || pv.ResourceVersion != "" || pv.Status.Phase != "" {
+		t.Errorf("Expected annotations and spec only, got %+v", pv)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	data, err := json.Marshal(&Entry{Volume: newVolume("pv-old"), DeleteAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := fake.NewSimpleClientset(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "vz-deferred-deletes", Namespace: "kube-system"},
+		Data:       map[string]string{"pv-old": string(data), "pv-bad": "{"},
+	})
+	d, deleted, _ := newDeletes(client, time.Hour)
+	if err := d.Process(); err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 0 {
+		t.Errorf("Expected the grace period of moved entries to be kept, deleted %v", deleted)
+	}
+	if e := entries(t, client); len(e) != 1 || !e["pv-old"] {
+		t.Errorf("Expected pv-old to be moved to its own config map, got %v", e)
+	}
+	index, err := client.Core().ConfigMaps("kube-system").Get("vz-deferred-deletes", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Data) != 0 {
+		t.Errorf("Expected the index data to be cleared, got %v", index.Data)
+	}
+}
+
+func TestPending(t *testing.T) {
+	data, err := json.Marshal(&Entry{Volume: newVolume("pv-old"), DeleteAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := fake.NewSimpleClientset(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "vz-deferred-deletes", Namespace: "kube-system"},
+		Data:       map[string]string{"pv-old": string(data)},
+	}, &v1.ConfigMap{
+		// a deferred delete of another provisioner
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "other-deferred-deletes-pv-2",
+			Namespace: "kube-system",
+			Labels:    map[string]string{Label: "pv-2"},
+		},
+	})
+	d, _, _ := newDeletes(client, time.Hour)
+	if err := d.Add(newVolume("pv-1")); err != nil {
+		t.Fatal(err)
+	}
+	pending, err := d.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]bool{"pv-old": true, "pv-1": true}; !reflect.DeepEqual(pending, expected) {
+		t.Errorf("Expected %v, got %v", expected, pending)
+	}
+}
@@ -0,0 +1,44 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+func init() {
+	Register(ext4{})
+}
+
+type ext4 struct{}
+
+func (ext4) Type() string {
+	return "ext4"
+}
+
+func (ext4) Mkfs(device string) error {
+	return runOK([]int{0}, "mkfs.ext4", "-F", "-q", device)
+}
+
+// Resize works both online and offline
+func (ext4) Resize(device, mountpoint string) error {
+	return runOK([]int{0}, "resize2fs", device)
+}
+
+// Check treats 1 as success, e2fsck returns it when errors were corrected
+func (ext4) Check(device string, repair bool) error {
+	if repair {
+		return runOK([]int{0, 1}, "e2fsck", "-f", "-p", device)
+	}
+	return runOK([]int{0}, "e2fsck", "-f", "-n", device)
+}
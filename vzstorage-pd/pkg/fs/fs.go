@@ -0,0 +1,104 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fs creates, grows and checks filesystems of ploop devices, so
+// that the provisioner and the node driver handle fsType the same way.
+package fs
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// DefaultType is used when no fsType is given, it is what ploop creates
+const DefaultType = "ext4"
+
+// Filesystem is a filesystem type which can be put on a block device
+type Filesystem interface {
+	// Type is the name of the filesystem as used in fsType
+	Type() string
+	// Mkfs creates the filesystem on the device
+	Mkfs(device string) error
+	// Resize grows the filesystem to the size of the device. Some
+	// filesystems can only be grown online, so mountpoint is where the
+	// device is mounted, or empty if it is not.
+	Resize(device, mountpoint string) error
+	// Check checks the filesystem on the unmounted device, fixing errors
+	// if repair is set
+	Check(device string, repair bool) error
+}
+
+var filesystems = map[string]Filesystem{}
+
+// Register makes the filesystem available by its type
+func Register(f Filesystem) {
+	filesystems[f.Type()] = f
+}
+
+// Get returns the filesystem of the given type, or of DefaultType if
+// fsType is empty
+func Get(fsType string) (Filesystem, error) {
+	if fsType == "" {
+		fsType = DefaultType
+	}
+	f, ok := filesystems[fsType]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported filesystem type %q, supported are %s", fsType, strings.Join(Types(), ", "))
+	}
+	return f, nil
+}
+
+// Types returns sorted names of registered filesystems
+func Types() []string {
+	var types []string
+	for t := range filesystems {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// run executes a filesystem tool and returns its exit code. An error is
+// returned only if the tool couldn't be run or was killed.
+var run = func(name string, args ...string) (int, string, error) {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err == nil {
+		return 0, string(out), nil
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Exited() {
+			return status.ExitStatus(), string(out), nil
+		}
+	}
+	return -1, string(out), fmt.Errorf("Unable to run %s: %v", name, err)
+}
+
+// runOK runs a tool which succeeds with any of the given exit codes
+func runOK(codes []int, name string, args ...string) error {
+	code, out, err := run(name, args...)
+	if err != nil {
+		return err
+	}
+	for _, c := range codes {
+		if code == c {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s %s failed with code %d: %s", name, strings.Join(args, " "), code, strings.TrimSpace(out))
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// stubRun replaces run with a function recording commands and returning
+// code. The returned function restores run.
+func stubRun(code int) (*[]string, func()) {
+	var cmds []string
+	orig := run
+	run = func(name string, args ...string) (int, string, error) {
+		cmds = append(cmds, strings.Join(append([]string{name}, args...), " "))
+		return code, "", nil
+	}
+	return &cmds, func() { run = orig }
+}
+
+func TestGet(t *testing.T) {
+	f, err := Get("")
+	if err != nil || f.Type() != DefaultType {
+		t.Errorf("Expected default filesystem %s, got %v, %v", DefaultType, f, err)
+	}
+	if _, err := Get("xfs"); err != nil {
+		t.Errorf("Expected xfs to be supported: %v", err)
+	}
+	if _, err := Get("btrfs"); err == nil {
+		t.Errorf("Expected btrfs to be unsupported")
+	}
+	if types := Types(); !reflect.DeepEqual(types, []string{"ext4", "xfs"}) {
+		t.Errorf("Unexpected filesystem types %v", types)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	cmds, restore := stubRun(0)
+	defer restore()
+	e, _ := Get("ext4")
+	x, _ := Get("xfs")
+
+	e.Mkfs("/dev/ploop1")
+	e.Resize("/dev/ploop1", "")
+	e.Check("/dev/ploop1", true)
+	x.Mkfs("/dev/ploop2")
+	x.Resize("/dev/ploop2", "/mnt")
+	x.Check("/dev/ploop2", false)
+
+	expected := []string{
+		"mkfs.ext4 -F -q /dev/ploop1",
+		"resize2fs /dev/ploop1",
+		"e2fsck -f -p /dev/ploop1",
+		"mkfs.xfs -f -q /dev/ploop2",
+		"xfs_growfs /mnt",
+		"xfs_repair -n /dev/ploop2",
+	}
+	if !reflect.DeepEqual(*cmds, expected) {
+		t.Errorf("Expected commands %q, got %q", expected, *cmds)
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	_, restore := stubRun(1)
+	defer restore()
+	e, _ := Get("ext4")
+	if err := e.Check("/dev/ploop1", true); err != nil {
+		t.Errorf("Expected corrected errors to be a success: %v", err)
+	}
+	if err := e.Check("/dev/ploop1", false); err == nil {
+		t.Errorf("Expected errors found by a read-only check to fail")
+	}
+
+	x, _ := Get("xfs")
+	if err := x.Resize("/dev/ploop2", ""); err == nil {
+		t.Errorf("Expected offline xfs resize to fail")
+	}
+}
+
+// TestLoopDevice runs the real tools against a loop device, it is skipped
+// unless loop devices can be set up
+func TestLoopDevice(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("needs root to set up a loop device")
+	}
+	img, err := ioutil.TempFile("", "fs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(img.Name())
+	if err := img.Truncate(64 << 20); err != nil {
+		t.Fatal(err)
+	}
+	img.Close()
+
+	out, err := exec.Command("losetup", "-f", "--show", img.Name()).Output()
+	if err != nil {
+		t.Skipf("unable to set up a loop device: %v", err)
+	}
+	device := strings.TrimSpace(string(out))
+	defer exec.Command("losetup", "-d", device).Run()
+
+	for _, fsType := range Types() {
+		f, _ := Get(fsType)
+		if err := f.Mkfs(device); err != nil {
+			if strings.Contains(err.Error(), "Unable to run") {
+				t.Logf("skipping %s: %v", fsType, err)
+				continue
+			}
+			t.Fatalf("Mkfs of %s failed: %v", fsType, err)
+		}
+		if err := f.Check(device, false); err != nil {
+			t.Errorf("Check of fresh %s failed: %v", fsType, err)
+		}
+	}
+}
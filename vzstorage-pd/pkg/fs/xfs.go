@@ -0,0 +1,48 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import "fmt"
+
+func init() {
+	Register(xfs{})
+}
+
+type xfs struct{}
+
+func (xfs) Type() string {
+	return "xfs"
+}
+
+func (xfs) Mkfs(device string) error {
+	return runOK([]int{0}, "mkfs.xfs", "-f", "-q", device)
+}
+
+// Resize needs the filesystem to be mounted, xfs can't be grown offline
+func (xfs) Resize(device, mountpoint string) error {
+	if mountpoint == "" {
+		return fmt.Errorf("xfs on %s can only be resized while mounted", device)
+	}
+	return runOK([]int{0}, "xfs_growfs", mountpoint)
+}
+
+func (xfs) Check(device string, repair bool) error {
+	if repair {
+		return runOK([]int{0}, "xfs_repair", device)
+	}
+	return runOK([]int{0}, "xfs_repair", "-n", device)
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package hostlock serializes processes sharing a directory of the host,
+// like replicas of the provisioner on the same node
+package hostlock
+
+import (
+	"os"
+	"path"
+	"sync"
+	"syscall"
+)
+
+// Lock is an exclusive flock of a file. Locks of the same file exclude
+// each other within a process as well, and the lock of a process is
+// released when it exits.
+type Lock struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// New returns the lock of the file at path, which is created if needed
+func New(path string) *Lock {
+	return &Lock{path: path}
+}
+
+// TryLock takes the lock unless another holder has it and returns
+// whether it is held
+func (l *Lock) TryLock() (bool, error) {
+	return l.lock(false)
+}
+
+// Acquire waits for the lock, calling waiting first if another holder has
+// it
+func (l *Lock) Acquire(waiting func()) error {
+	held, err := l.lock(false)
+	if held || err != nil {
+		return err
+	}
+	waiting()
+	_, err = l.lock(true)
+	return err
+}
+
+func (l *Lock) lock(wait bool) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		return true, nil
+	}
+	if err := os.MkdirAll(path.Dir(l.path), 0755); err != nil {
+		return false, err
+	}
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return false, err
+	}
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return false, nil
+		}
+		return false, err
+	}
+	l.f = f
+	return true, nil
+}
+
+// Unlock releases the lock if it is held
+func (l *Lock) Unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
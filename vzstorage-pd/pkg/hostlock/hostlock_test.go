@@ -0,0 +1,106 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hostlock
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestTryLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostlock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "sub", "mnt.lock")
+
+	a, b := New(file), New(file)
+	if held, err := a.TryLock(); !held || err != nil {
+		t.Fatalf("expected a free lock to be taken, got %v, %v", held, err)
+	}
+	if held, err := a.TryLock(); !held || err != nil {
+		t.Errorf("expected a held lock to stay held, got %v, %v", held, err)
+	}
+	if held, err := b.TryLock(); held || err != nil {
+		t.Errorf("expected a lock held elsewhere not to be taken, got %v, %v", held, err)
+	}
+	if err := a.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if held, err := b.TryLock(); !held || err != nil {
+		t.Errorf("expected a released lock to be taken, got %v, %v", held, err)
+	}
+	b.Unlock()
+}
+
+// TestHandoff runs the protocol of replicas sharing a node: a replica
+// campaigns for leadership only once it holds the lock, and the one
+// waiting takes over when the holder exits
+func TestHandoff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostlock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "mnt.lock")
+
+	first, second := New(file), New(file)
+	waited := false
+	if err := first.Acquire(func() { waited = true }); err != nil {
+		t.Fatal(err)
+	}
+	if waited {
+		t.Errorf("expected a free lock to be acquired without waiting")
+	}
+
+	waiting := make(chan struct{})
+	campaigning := make(chan error, 1)
+	go func() {
+		campaigning <- second.Acquire(func() { close(waiting) })
+	}()
+	select {
+	case <-waiting:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the second replica to wait for the lock")
+	}
+	select {
+	case <-campaigning:
+		t.Fatalf("expected the second replica not to campaign while the first holds the lock")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// the first replica exits
+	if err := first.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-campaigning:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the second replica to take over the released lock")
+	}
+	if held, _ := first.TryLock(); held {
+		t.Errorf("expected the lock to be held by the second replica")
+	}
+	second.Unlock()
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package journal keeps intents to provision volumes on the cluster, so
+// that provisioning interrupted by a crash can be rolled back
+package journal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Entry records an intent to provision a volume. It is written before the
+// image is created, marked Provisioned once the volume is complete and
+// removed once its PV exists.
+type Entry struct {
+	// PV is the name of the PV the volume is provisioned for
+	PV              string            `json:"pv,omitempty"`
+	SecretNamespace string            `json:"secretNamespace"`
+	SecretName      string            `json:"secretName"`
+	Options         map[string]string `json:"options"`
+	Time            time.Time         `json:"time"`
+	// Provisioned is set once the volume is handed over to the controller
+	// to create its PV
+	Provisioned bool `json:"provisioned,omitempty"`
+}
+
+// Write durably stores e in dir as the entry of share
+func Write(dir, share string, e *Entry) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+share)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path.Join(dir, share+".json"))
+}
+
+// Read returns the entry of share in dir
+func Read(dir, share string) (*Entry, error) {
+	data, err := ioutil.ReadFile(path.Join(dir, share+".json"))
+	if err != nil {
+		return nil, err
+	}
+	var e Entry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// Remove removes the entry of share in dir, if any
+func Remove(dir, share string) error {
+	err := os.Remove(path.Join(dir, share+".json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// List returns shares with entries in dir
+func List(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var shares []string
+	for _, f := range files {
+		if name := f.Name(); strings.HasSuffix(name, ".json") && !strings.HasPrefix(name, ".") {
+			shares = append(shares, strings.TrimSuffix(name, ".json"))
+		}
+	}
+	return shares, nil
+}
+
+// Action is what replaying an entry does
+type Action int
+
+const (
+	// Keep leaves the entry for a later replay
+	Keep Action = iota
+	// Forget removes the entry, the volume is committed or gone
+	Forget
+	// Rollback removes the volume and then the entry
+	Rollback
+)
+
+// State is what is known about the volume of an entry when it's replayed
+type State struct {
+	// HasPV is set if a PV of the volume exists
+	HasPV bool
+	// Running is set if the provisioning still runs in this process,
+	// e.g. left running in background after its timeout
+	Running bool
+	// ImageExists is set if the image of the volume exists
+	ImageExists bool
+}
+
+// Replay returns what to do with an entry. since is when the replaying
+// provisioner took over: later entries belong to provisioning it runs
+// itself, which removes them on errors, so only earlier ones are left
+// over by a crash. Provisioned volumes are never rolled back, their PVs
+// may still be on the way.
+func Replay(e *Entry, st State, since time.Time) Action {
+	switch {
+	case st.HasPV:
+		return Forget
+	case st.Running:
+		return Keep
+	case e.Provisioned:
+		// the controller deletes volumes whose PV it couldn't create
+		if !st.ImageExists {
+			return Forget
+		}
+		return Keep
+	case !e.Time.Before(since):
+		return Keep
+	}
+	return Rollback
+}
+
+// Retry returns what a new attempt to provision a volume does with the
+// entry it finds for the same share, which the controller keeps for all
+// attempts of a claim. Entries written since the takeover belong to
+// attempts of this provisioner, which remove them themselves, and an
+// entry of a volume with a PV is forgotten by Replay, so both are kept
+// and the attempt fails. Earlier entries are left over by a crash: the
+// controller asks for the volume again, so its PV isn't on the way even if
+// it was provisioned, and the leftover is rolled back.
+func Retry(e *Entry, st State, since time.Time) Action {
+	if st.HasPV || st.Running || !e.Time.Before(since) {
+		return Keep
+	}
+	return Rollback
+}
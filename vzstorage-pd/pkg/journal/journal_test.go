@@ -0,0 +1,139 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package journal
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWriteReadRemove(t *testing.T) {
+	root, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	dir := path.Join(root, "vz-provisioner")
+
+	shares, err := List(dir)
+	if err != nil || len(shares) != 0 {
+		t.Fatalf("expected no entries in a missing directory, got %v, %v", shares, err)
+	}
+
+	e := &Entry{
+		PV:              "pvc-1",
+		SecretNamespace: "default",
+		SecretName:      "vz-secret",
+		Options:         map[string]string{"volumeID": "share-1"},
+		Time:            time.Date(2017, 3, 15, 10, 0, 0, 0, time.UTC),
+	}
+	if err := Write(dir, "share-1", e); err != nil {
+		t.Fatal(err)
+	}
+	e.Provisioned = true
+	if err := Write(dir, "share-1", e); err != nil {
+		t.Fatal(err)
+	}
+	// a temporary file of an interrupted write is not an entry
+	if err := ioutil.WriteFile(path.Join(dir, ".share-2123.json"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	shares, err = List(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(shares, []string{"share-1"}) {
+		t.Errorf("expected entry of share-1, got %v", shares)
+	}
+	read, err := Read(dir, "share-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, e) {
+		t.Errorf("expected %+v, got %+v", e, read)
+	}
+
+	if err := Remove(dir, "share-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Remove(dir, "share-1"); err != nil {
+		t.Errorf("removing a missing entry: %v", err)
+	}
+	if _, err := Read(dir, "share-1"); !os.IsNotExist(err) {
+		t.Errorf("expected the entry to be gone, got %v", err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	since := time.Date(2017, 3, 15, 10, 0, 0, 0, time.UTC)
+	before := &Entry{Time: since.Add(-time.Hour)}
+	after := &Entry{Time: since.Add(time.Second)}
+	provisioned := &Entry{Time: since.Add(-time.Hour), Provisioned: true}
+
+	tests := []struct {
+		name     string
+		entry    *Entry
+		state    State
+		expected Action
+	}{
+		{"committed", before, State{HasPV: true, ImageExists: true}, Forget},
+		{"committed while running", after, State{HasPV: true, Running: true}, Forget},
+		{"interrupted before takeover", before, State{ImageExists: true}, Rollback},
+		{"interrupted before the image", before, State{}, Rollback},
+		{"still running", before, State{Running: true, ImageExists: true}, Keep},
+		{"started after takeover", after, State{ImageExists: true}, Keep},
+		{"abandoned after its timeout", after, State{Running: true, ImageExists: true}, Keep},
+		{"PV on the way", provisioned, State{ImageExists: true}, Keep},
+		{"deleted by the controller", provisioned, State{}, Forget},
+	}
+	for _, test := range tests {
+		if action := Replay(test.entry, test.state, since); action != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, action)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	since := time.Date(2017, 3, 15, 10, 0, 0, 0, time.UTC)
+	before := &Entry{Time: since.Add(-time.Hour)}
+	after := &Entry{Time: since.Add(time.Second)}
+	provisioned := &Entry{Time: since.Add(-time.Hour), Provisioned: true}
+
+	tests := []struct {
+		name     string
+		entry    *Entry
+		state    State
+		expected Action
+	}{
+		{"crashed before takeover", before, State{ImageExists: true}, Rollback},
+		{"crashed before the image", before, State{}, Rollback},
+		{"crashed before the PV", provisioned, State{ImageExists: true}, Rollback},
+		{"committed", before, State{HasPV: true, ImageExists: true}, Keep},
+		{"earlier attempt after takeover", after, State{ImageExists: true}, Keep},
+		{"abandoned after its timeout", before, State{Running: true, ImageExists: true}, Keep},
+	}
+	for _, test := range tests {
+		if action := Retry(test.entry, test.state, since); action != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, action)
+		}
+	}
+}
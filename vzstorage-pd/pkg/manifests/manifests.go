@@ -0,0 +1,486 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package manifests renders deployment manifests of the provisioner
+package manifests
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzstorage"
+)
+
+// Config describes a deployment
+type Config struct {
+	// Version is the tag of the provisioner and driver images
+	Version         string   `json:"version"`
+	Image           string   `json:"image"`
+	DriverImage     string   `json:"driverImage"`
+	Namespace       string   `json:"namespace"`
+	ProvisionerName string   `json:"provisionerName"`
+	ProvisionerID   string   `json:"provisionerID"`
+	PluginDir       string   `json:"pluginDir"`
+	Args            []string `json:"args"`
+	// SecretReader is the service account impersonated to access secrets
+	// of other namespaces, which are accessed directly if empty
+	SecretReader string `json:"secretReader"`
+	// WatchNamespaces are the only namespaces whose claims the provisioner
+	// serves and may access, claims of all namespaces if empty
+	WatchNamespaces []string  `json:"watchNamespaces"`
+	Clusters        []Cluster `json:"clusters"`
+}
+
+// Cluster is a Virtuozzo Storage cluster and its storage classes
+type Cluster struct {
+	Name           string         `json:"name"`
+	SecretName     string         `json:"secretName"`
+	StorageClasses []StorageClass `json:"storageClasses"`
+	// MDSAddresses are used instead of cluster auto-discovery if not empty
+	MDSAddresses []string `json:"mdsAddresses"`
+	// MDSProxy is a socks5:// or http:// proxy URL through which MDS
+	// servers are reached, it needs MDSAddresses
+	MDSProxy string `json:"mdsProxy"`
+}
+
+// StorageClass is a class of volumes of a cluster
+type StorageClass struct {
+	Name       string            `json:"name"`
+	Default    bool              `json:"default"`
+	Parameters map[string]string `json:"parameters"`
+}
+
+// Manifest is a rendered file
+type Manifest struct {
+	Name string
+	Data []byte
+}
+
+// Load parses a YAML config and fills in defaults
+func Load(data []byte) (*Config, error) {
+	c := &Config{}
+	if err := yaml.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	if c.Version == "" {
+		return nil, fmt.Errorf("version is required")
+	}
+	defaults := []struct {
+		value *string
+		def   string
+	}{
+		{&c.Image, "virtuozzo/virtuozzo-provisioner"},
+		{&c.DriverImage, "virtuozzo/ploop-flexvol"},
+		{&c.Namespace, "kube-system"},
+		{&c.ProvisionerName, "virtuozzo.com/virtuozzo-storage"},
+		{&c.ProvisionerID, "vz-provisioner"},
+		{&c.PluginDir, "/usr/libexec/kubernetes/kubelet-plugins/volume/exec"},
+	}
+	for _, d := range defaults {
+		if *d.value == "" {
+			*d.value = d.def
+		}
+	}
+
+	for _, n := range c.WatchNamespaces {
+		if n == "" || strings.Contains(n, ",") {
+			return nil, fmt.Errorf("invalid watched namespace %q", n)
+		}
+	}
+
+	secrets := map[string]bool{}
+	classes := map[string]bool{}
+	for i := range c.Clusters {
+		cl := &c.Clusters[i]
+		if cl.Name == "" {
+			return nil, fmt.Errorf("cluster %d has no name", i)
+		}
+		if cl.SecretName == "" {
+			cl.SecretName = cl.Name + "-secret"
+		}
+		if secrets[cl.SecretName] {
+			return nil, fmt.Errorf("secret %s is used by several clusters", cl.SecretName)
+		}
+		secrets[cl.SecretName] = true
+		if len(cl.MDSAddresses) != 0 {
+			if _, err := vzstorage.ParseMDSAddresses(strings.Join(cl.MDSAddresses, ","), ""); err != nil {
+				return nil, fmt.Errorf("cluster %s: %v", cl.Name, err)
+			}
+		}
+		if cl.MDSProxy != "" {
+			if len(cl.MDSAddresses) == 0 {
+				return nil, fmt.Errorf("cluster %s: mdsProxy needs mdsAddresses", cl.Name)
+			}
+			if _, err := vzstorage.ParseProxy(cl.MDSProxy); err != nil {
+				return nil, fmt.Errorf("cluster %s: %v", cl.Name, err)
+			}
+		}
+		for _, sc := range cl.StorageClasses {
+			if sc.Name == "" || classes[sc.Name] {
+				return nil, fmt.Errorf("storage classes of cluster %s need unique names", cl.Name)
+			}
+			classes[sc.Name] = true
+		}
+	}
+	return c, nil
+}
+
+type object map[string]interface{}
+
+// Render returns manifests of the deployment, in the order they are to
+// be created in
+func Render(c *Config) ([]Manifest, error) {
+	var manifests []Manifest
+	add := func(name string, objects ...object) error {
+		var data []byte
+		for i, o := range objects {
+			y, err := yaml.Marshal(o)
+			if err != nil {
+				return err
+			}
+			if i != 0 {
+				data = append(data, "---\n"...)
+			}
+			data = append(data, y...)
+		}
+		manifests = append(manifests, Manifest{Name: name, Data: data})
+		return nil
+	}
+
+	rbac := []object{serviceAccount(c), clusterRole(c), clusterRoleBinding(c)}
+	if c.SecretReader != "" {
+		rbac = append(rbac, ownSecretsRole(c), ownSecretsRoleBinding(c))
+	}
+	for _, n := range c.WatchNamespaces {
+		rbac = append(rbac, claimsRole(c, n), claimsRoleBinding(c, n))
+	}
+	if err := add("rbac.yaml", rbac...); err != nil {
+		return nil, err
+	}
+	if err := add("deployment.yaml", deployment(c)); err != nil {
+		return nil, err
+	}
+	if err := add("driver-installer.yaml", driverInstaller(c)); err != nil {
+		return nil, err
+	}
+	var classes, secrets []object
+	for _, cl := range c.Clusters {
+		secrets = append(secrets, secret(cl))
+		for _, sc := range cl.StorageClasses {
+			classes = append(classes, storageClass(c, cl, sc))
+		}
+	}
+	if len(secrets) != 0 {
+		if err := add("secrets.example.yaml", secrets...); err != nil {
+			return nil, err
+		}
+		if c.SecretReader != "" {
+			if err := add("secret-reader.example.yaml", secretReader(c)...); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(classes) != 0 {
+		if err := add("storageclasses.yaml", classes...); err != nil {
+			return nil, err
+		}
+	}
+	return manifests, nil
+}
+
+func metadata(name, namespace string) object {
+	m := object{"name": name}
+	if namespace != "" {
+		m["namespace"] = namespace
+	}
+	return m
+}
+
+func serviceAccount(c *Config) object {
+	return object{
+		"apiVersion": "v1",
+		"kind":       "ServiceAccount",
+		"metadata":   metadata(c.ProvisionerID, c.Namespace),
+	}
+}
+
+func rule(group, resource string, verbs ...string) object {
+	return object{
+		"apiGroups": []string{group},
+		"resources": []string{resource},
+		"verbs":     verbs,
+	}
+}
+
+// clusterRole has to be kept in sync with deploy/auth/clusterrole.yaml
+func clusterRole(c *Config) object {
+	secrets := rule("", "secrets", "get", "watch", "list", "update", "patch")
+	if c.SecretReader != "" {
+		secrets = rule("", "serviceaccounts", "impersonate")
+		secrets["resourceNames"] = []string{c.SecretReader}
+	}
+	rules := []object{
+		rule("", "persistentvolumes", "get", "list", "watch", "create", "update", "delete"),
+		rule("", "persistentvolumeclaims", "get", "list", "watch", "create", "update"),
+		rule("storage.k8s.io", "storageclasses", "get", "list", "watch", "update"),
+		rule("", "events", "list", "watch", "create", "update", "patch"),
+		secrets,
+		rule("", "configmaps", "get", "list", "create", "update", "delete"),
+		rule("", "nodes", "list"),
+		rule("", "pods", "list"),
+	}
+	if len(c.WatchNamespaces) != 0 {
+		// claims are accessed by claimsRole
+		rules = append(rules[:1], rules[2:]...)
+	}
+	return object{
+		"apiVersion": "rbac.authorization.k8s.io/v1alpha1",
+		"kind":       "ClusterRole",
+		"metadata":   metadata(c.ProvisionerID+"-runner", ""),
+		"rules":      rules,
+	}
+}
+
+// claimsRole grants access to claims of a watched namespace instead of the
+// cluster role
+func claimsRole(c *Config, namespace string) object {
+	return object{
+		"apiVersion": "rbac.authorization.k8s.io/v1alpha1",
+		"kind":       "Role",
+		"metadata":   metadata(c.ProvisionerID+"-claims", namespace),
+		"rules":      []object{rule("", "persistentvolumeclaims", "get", "list", "watch", "create", "update")},
+	}
+}
+
+func claimsRoleBinding(c *Config, namespace string) object {
+	return object{
+		"apiVersion": "rbac.authorization.k8s.io/v1alpha1",
+		"kind":       "RoleBinding",
+		"metadata":   metadata(c.ProvisionerID+"-claims", namespace),
+		"subjects": []object{{
+			"kind":      "ServiceAccount",
+			"name":      c.ProvisionerID,
+			"namespace": c.Namespace,
+		}},
+		"roleRef": object{
+			"kind":     "Role",
+			"name":     c.ProvisionerID + "-claims",
+			"apiGroup": "rbac.authorization.k8s.io",
+		},
+	}
+}
+
+// ownSecretsRole grants access to secrets of the provisioner's namespace,
+// such as DR peers, which are never read by impersonation
+func ownSecretsRole(c *Config) object {
+	return object{
+		"apiVersion": "rbac.authorization.k8s.io/v1alpha1",
+		"kind":       "Role",
+		"metadata":   metadata(c.ProvisionerID+"-secrets", c.Namespace),
+		"rules":      []object{rule("", "secrets", "get", "update", "patch")},
+	}
+}
+
+func ownSecretsRoleBinding(c *Config) object {
+	return object{
+		"apiVersion": "rbac.authorization.k8s.io/v1alpha1",
+		"kind":       "RoleBinding",
+		"metadata":   metadata(c.ProvisionerID+"-secrets", c.Namespace),
+		"subjects": []object{{
+			"kind":      "ServiceAccount",
+			"name":      c.ProvisionerID,
+			"namespace": c.Namespace,
+		}},
+		"roleRef": object{
+			"kind":     "Role",
+			"name":     c.ProvisionerID + "-secrets",
+			"apiGroup": "rbac.authorization.k8s.io",
+		},
+	}
+}
+
+// secretReader is the service account, to be created in every namespace
+// with cluster secrets, which the provisioner impersonates to read them.
+// It may only access the secrets of the clusters.
+func secretReader(c *Config) []object {
+	var names []string
+	for _, cl := range c.Clusters {
+		names = append(names, cl.SecretName)
+	}
+	access := rule("", "secrets", "get", "update", "patch")
+	access["resourceNames"] = names
+	return []object{
+		{
+			"apiVersion": "v1",
+			"kind":       "ServiceAccount",
+			"metadata":   metadata(c.SecretReader, ""),
+		},
+		{
+			"apiVersion": "rbac.authorization.k8s.io/v1alpha1",
+			"kind":       "Role",
+			"metadata":   metadata(c.SecretReader, ""),
+			"rules":      []object{access},
+		},
+		{
+			"apiVersion": "rbac.authorization.k8s.io/v1alpha1",
+			"kind":       "RoleBinding",
+			"metadata":   metadata(c.SecretReader, ""),
+			"subjects": []object{{
+				"kind": "ServiceAccount",
+				"name": c.SecretReader,
+			}},
+			"roleRef": object{
+				"kind":     "Role",
+				"name":     c.SecretReader,
+				"apiGroup": "rbac.authorization.k8s.io",
+			},
+		},
+	}
+}
+
+func clusterRoleBinding(c *Config) object {
+	return object{
+		"apiVersion": "rbac.authorization.k8s.io/v1alpha1",
+		"kind":       "ClusterRoleBinding",
+		"metadata":   metadata("run-"+c.ProvisionerID, ""),
+		"subjects": []object{{
+			"kind":      "ServiceAccount",
+			"name":      c.ProvisionerID,
+			"namespace": c.Namespace,
+		}},
+		"roleRef": object{
+			"kind":     "ClusterRole",
+			"name":     c.ProvisionerID + "-runner",
+			"apiGroup": "rbac.authorization.k8s.io",
+		},
+	}
+}
+
+func deployment(c *Config) object {
+	args := []string{
+		"-name=" + c.ProvisionerName,
+		"-id=" + c.ProvisionerID,
+		"-namespace=" + c.Namespace,
+	}
+	if c.SecretReader != "" {
+		args = append(args, "-secret-access=impersonate", "-secret-reader="+c.SecretReader)
+	}
+	if len(c.WatchNamespaces) != 0 {
+		args = append(args, "-watch-namespaces="+strings.Join(c.WatchNamespaces, ","))
+	}
+	args = append(args, c.Args...)
+	return object{
+		"apiVersion": "extensions/v1beta1",
+		"kind":       "Deployment",
+		"metadata":   metadata(c.ProvisionerID, c.Namespace),
+		"spec": object{
+			"replicas": 1,
+			"strategy": object{"type": "Recreate"},
+			"template": object{
+				"metadata": object{"labels": object{"app": c.ProvisionerID}},
+				"spec": object{
+					"serviceAccountName": c.ProvisionerID,
+					"hostNetwork":        true,
+					"restartPolicy":      "Always",
+					"containers": []object{{
+						"name":            c.ProvisionerID,
+						"image":           c.Image + ":" + c.Version,
+						"args":            args,
+						"securityContext": object{"privileged": true},
+					}},
+				},
+			},
+		},
+	}
+}
+
+// driverInstaller copies the driver from its image to the flexvolume
+// plugin directory of every node
+func driverInstaller(c *Config) object {
+	name := c.ProvisionerID + "-driver-installer"
+	return object{
+		"apiVersion": "extensions/v1beta1",
+		"kind":       "DaemonSet",
+		"metadata":   metadata(name, c.Namespace),
+		"spec": object{
+			"template": object{
+				"metadata": object{"labels": object{"app": name}},
+				"spec": object{
+					"containers": []object{{
+						"name":  "installer",
+						"image": c.DriverImage + ":" + c.Version,
+						"command": []string{"/bin/sh", "-c",
+							"mkdir -p /flexmnt/virtuozzo~ploop && " +
+								"cp /usr/bin/ploop-flexvol /flexmnt/virtuozzo~ploop/.ploop && " +
+								"mv -f /flexmnt/virtuozzo~ploop/.ploop /flexmnt/virtuozzo~ploop/ploop && " +
+								"while true; do sleep 3600; done"},
+						"volumeMounts": []object{{"name": "flexmnt", "mountPath": "/flexmnt"}},
+					}},
+					"volumes": []object{{
+						"name":     "flexmnt",
+						"hostPath": object{"path": c.PluginDir},
+					}},
+				},
+			},
+		},
+	}
+}
+
+// secret is an example secret of the cluster with a placeholder password
+func secret(cl Cluster) object {
+	data := object{
+		"clusterName":     base64.StdEncoding.EncodeToString([]byte(cl.Name)),
+		"clusterPassword": base64.StdEncoding.EncodeToString([]byte("CHANGE-ME")),
+	}
+	if len(cl.MDSAddresses) != 0 {
+		data["mdsAddresses"] = base64.StdEncoding.EncodeToString([]byte(strings.Join(cl.MDSAddresses, ", ")))
+	}
+	if cl.MDSProxy != "" {
+		data["mdsProxy"] = base64.StdEncoding.EncodeToString([]byte(cl.MDSProxy))
+	}
+	return object{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"type":       "virtuozzo/ploop",
+		"metadata":   metadata(cl.SecretName, ""),
+		"data":       data,
+	}
+}
+
+func storageClass(c *Config, cl Cluster, sc StorageClass) object {
+	parameters := map[string]string{}
+	for k, v := range sc.Parameters {
+		parameters[k] = v
+	}
+	if _, ok := parameters["volumePath"]; !ok {
+		parameters["volumePath"] = "k8s-volumes"
+	}
+	parameters["secretName"] = cl.SecretName
+
+	meta := metadata(sc.Name, "")
+	if sc.Default {
+		meta["annotations"] = object{"storageclass.beta.kubernetes.io/is-default-class": "true"}
+	}
+	return object{
+		"apiVersion":  "storage.k8s.io/v1beta1",
+		"kind":        "StorageClass",
+		"metadata":    meta,
+		"provisioner": c.ProvisionerName,
+		"parameters":  parameters,
+	}
+}
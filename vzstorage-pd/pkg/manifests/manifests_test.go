@@ -0,0 +1,172 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manifests
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ghodss/yaml"
+)
+
+const config = `
+version: "0.2.0"
+namespace: storage
+args: ["-metrics-address=:9100"]
+clusters:
+  - name: stor1
+    storageClasses:
+      - name: fast
+        default: true
+        parameters:
+          vzsTier: "1"
+`
+
+func TestRender(t *testing.T) {
+	c, err := Load([]byte(config))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	manifests, err := Render(c)
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+
+	var names []string
+	objects := map[string]map[string]interface{}{}
+	for _, m := range manifests {
+		names = append(names, m.Name)
+		for _, doc := range strings.Split(string(m.Data), "---\n") {
+			var o map[string]interface{}
+			if err := yaml.Unmarshal([]byte(doc), &o); err != nil {
+				t.Fatalf("%s is not valid YAML: %v", m.Name, err)
+			}
+			objects[o["kind"].(string)] = o
+		}
+	}
+	expected := []string{"rbac.yaml", "deployment.yaml", "driver-installer.yaml", "secrets.example.yaml", "storageclasses.yaml"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+
+	container := objects["Deployment"]["spec"].(map[string]interface{})["template"].(map[string]interface{})["spec"].(map[string]interface{})["containers"].([]interface{})[0].(map[string]interface{})
+	if container["image"] != "virtuozzo/virtuozzo-provisioner:0.2.0" {
+		t.Errorf("unexpected image %v", container["image"])
+	}
+	args := []interface{}{"-name=virtuozzo.com/virtuozzo-storage", "-id=vz-provisioner", "-namespace=storage", "-metrics-address=:9100"}
+	if !reflect.DeepEqual(container["args"], args) {
+		t.Errorf("unexpected args %v", container["args"])
+	}
+
+	class := objects["StorageClass"]
+	parameters := map[string]interface{}{"vzsTier": "1", "volumePath": "k8s-volumes", "secretName": "stor1-secret"}
+	if !reflect.DeepEqual(class["parameters"], parameters) {
+		t.Errorf("unexpected parameters %v", class["parameters"])
+	}
+	if objects["Secret"]["data"].(map[string]interface{})["clusterName"] != "c3RvcjE=" {
+		t.Errorf("unexpected secret %v", objects["Secret"])
+	}
+}
+
+func TestRenderSecretReader(t *testing.T) {
+	c, err := Load([]byte(config + "secretReader: vz-secret-reader\n"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	manifests, err := Render(c)
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+
+	rendered := map[string]string{}
+	for _, m := range manifests {
+		rendered[m.Name] = string(m.Data)
+	}
+	for _, s := range []string{"impersonate", "kind: Role\n", "namespace: storage"} {
+		if !strings.Contains(rendered["rbac.yaml"], s) {
+			t.Errorf("rbac.yaml lacks %q:\n%s", s, rendered["rbac.yaml"])
+		}
+	}
+	if strings.Contains(rendered["rbac.yaml"], "- list\n  - update") {
+		t.Errorf("rbac.yaml grants access to secrets of all namespaces:\n%s", rendered["rbac.yaml"])
+	}
+	if !strings.Contains(rendered["deployment.yaml"], "-secret-access=impersonate") {
+		t.Errorf("deployment.yaml doesn't impersonate:\n%s", rendered["deployment.yaml"])
+	}
+	if !strings.Contains(rendered["secret-reader.example.yaml"], "- stor1-secret") {
+		t.Errorf("unexpected secret reader:\n%s", rendered["secret-reader.example.yaml"])
+	}
+}
+
+func TestRenderWatchNamespaces(t *testing.T) {
+	c, err := Load([]byte(config + "watchNamespaces: [secure, payments]\n"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	manifests, err := Render(c)
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+
+	rendered := map[string]string{}
+	for _, m := range manifests {
+		rendered[m.Name] = string(m.Data)
+	}
+	if n := strings.Count(rendered["rbac.yaml"], "persistentvolumeclaims"); n != 2 {
+		t.Errorf("expected access to claims of 2 namespaces, got %d:\n%s", n, rendered["rbac.yaml"])
+	}
+	for _, s := range []string{"name: vz-provisioner-claims\n  namespace: secure", "name: vz-provisioner-claims\n  namespace: payments"} {
+		if !strings.Contains(rendered["rbac.yaml"], s) {
+			t.Errorf("rbac.yaml lacks %q:\n%s", s, rendered["rbac.yaml"])
+		}
+	}
+	if !strings.Contains(rendered["deployment.yaml"], "-watch-namespaces=secure,payments") {
+		t.Errorf("deployment.yaml doesn't watch namespaces:\n%s", rendered["deployment.yaml"])
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for _, config := range []string{
+		`clusters: []`,
+		`{version: "1", clusters: [{secretName: s}]}`,
+		`{version: "1", clusters: [{name: a, secretName: s}, {name: b, secretName: s}]}`,
+		`{version: "1", clusters: [{name: a, storageClasses: [{name: c}]}, {name: b, storageClasses: [{name: c}]}]}`,
+		`{version: "1", clusters: [{name: a, mdsProxy: "socks5://10.0.0.1:1080"}]}`,
+		`{version: "1", clusters: [{name: a, mdsAddresses: ["10.0.0.2"], mdsProxy: "ftp://10.0.0.1:21"}]}`,
+		`{version: "1", clusters: [{name: a, mdsAddresses: ["10.0.0.2:0"]}]}`,
+		`{version: "1", watchNamespaces: ["a,b"]}`,
+	} {
+		if _, err := Load([]byte(config)); err == nil {
+			t.Errorf("expected an error for %s", config)
+		}
+	}
+}
+
+func TestRenderMDSProxy(t *testing.T) {
+	c, err := Load([]byte(`{version: "1", clusters: [{name: a, mdsAddresses: ["10.0.0.2", "10.0.0.3:2511"], mdsProxy: "socks5://10.0.0.1:1080"}]}`))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	data := secret(c.Clusters[0])["data"].(object)
+	if data["mdsAddresses"] != "MTAuMC4wLjIsIDEwLjAuMC4zOjI1MTE=" {
+		t.Errorf("unexpected mdsAddresses %v", data["mdsAddresses"])
+	}
+	if data["mdsProxy"] != "c29ja3M1Oi8vMTAuMC4wLjE6MTA4MA==" {
+		t.Errorf("unexpected mdsProxy %v", data["mdsProxy"])
+	}
+}
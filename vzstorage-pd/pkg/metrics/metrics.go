@@ -0,0 +1,232 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics is a minimal implementation of gauges and counters
+// exported in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Kind is a type of a metric
+type Kind string
+
+// Supported metric kinds
+const (
+	Gauge   Kind = "gauge"
+	Counter Kind = "counter"
+)
+
+// Metric is a family of samples sharing a name and a set of label names
+type Metric struct {
+	name   string
+	help   string
+	kind   Kind
+	labels []string
+
+	mu      sync.Mutex
+	samples map[string]*sample
+}
+
+type sample struct {
+	labelValues []string
+	value       float64
+}
+
+// NewGauge creates a gauge with the given label names and registers it
+// in the default registry
+func NewGauge(name, help string, labels ...string) *Metric {
+	return DefaultRegistry.register(newMetric(name, help, Gauge, labels))
+}
+
+// NewCounter creates a counter with the given label names and registers it
+// in the default registry
+func NewCounter(name, help string, labels ...string) *Metric {
+	return DefaultRegistry.register(newMetric(name, help, Counter, labels))
+}
+
+func newMetric(name, help string, kind Kind, labels []string) *Metric {
+	return &Metric{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		samples: make(map[string]*sample),
+	}
+}
+
+func (m *Metric) get(labelValues []string) *sample {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", m.name, len(m.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.samples[key]
+	if !ok {
+		s = &sample{labelValues: append([]string(nil), labelValues...)}
+		m.samples[key] = s
+	}
+	return s
+}
+
+// Set sets the value of the sample with the given label values
+func (m *Metric) Set(value float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labelValues).value = value
+}
+
+// Add adds delta to the value of the sample with the given label values
+func (m *Metric) Add(delta float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labelValues).value += delta
+}
+
+// Inc increments the value of the sample with the given label values
+func (m *Metric) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+// Dec decrements the value of the sample with the given label values
+func (m *Metric) Dec(labelValues ...string) {
+	m.Add(-1, labelValues...)
+}
+
+// Value returns the current value of the sample with the given label values
+func (m *Metric) Value(labelValues ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.get(labelValues).value
+}
+
+// Delete removes the sample with the given label values
+func (m *Metric) Delete(labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.samples, strings.Join(labelValues, "\xff"))
+}
+
+// Reset removes all samples
+func (m *Metric) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.samples = make(map[string]*sample)
+}
+
+// Retain removes samples whose label values keep returns false for. Unlike
+// Reset followed by setting new values, readers never see the metric
+// without the samples that stay.
+func (m *Metric) Retain(keep func(labelValues []string) bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, s := range m.samples {
+		if !keep(s.labelValues) {
+			delete(m.samples, key)
+		}
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func (m *Metric) write(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(&b, "# TYPE %s %s\n", m.name, m.kind)
+
+	keys := make([]string, 0, len(m.samples))
+	for k := range m.samples {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := m.samples[k]
+		b.WriteString(m.name)
+		if len(m.labels) != 0 {
+			pairs := make([]string, len(m.labels))
+			for i, l := range m.labels {
+				pairs[i] = fmt.Sprintf(`%s="%s"`, l, labelEscaper.Replace(s.labelValues[i]))
+			}
+			fmt.Fprintf(&b, "{%s}", strings.Join(pairs, ","))
+		}
+		fmt.Fprintf(&b, " %s\n", strconv.FormatFloat(s.value, 'g', -1, 64))
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// Registry is a set of metrics exported together
+type Registry struct {
+	mu      sync.Mutex
+	metrics []*Metric
+}
+
+// DefaultRegistry is the registry used by NewGauge and NewCounter
+var DefaultRegistry = &Registry{}
+
+func (r *Registry) register(m *Metric) *Metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, o := range r.metrics {
+		if o.name == m.name {
+			panic(fmt.Sprintf("metric %s is already registered", m.name))
+		}
+	}
+	r.metrics = append(r.metrics, m)
+	return m
+}
+
+// WriteText writes all metrics of the registry in the text exposition format
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	metrics := append([]*Metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	sort.Sort(byName(metrics))
+	for _, m := range metrics {
+		if err := m.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServeHTTP implements http.Handler
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteText(w)
+}
+
+// Handler returns an http.Handler serving the default registry
+func Handler() http.Handler {
+	return DefaultRegistry
+}
+
+type byName []*Metric
+
+func (m byName) Len() int           { return len(m) }
+func (m byName) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m byName) Less(i, j int) bool { return m[i].name < m[j].name }
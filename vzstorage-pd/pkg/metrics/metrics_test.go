@@ -0,0 +1,87 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := &Registry{}
+	g := r.register(newMetric("vz_free_bytes", "Free space", Gauge, []string{"cluster", "tier"}))
+	c := r.register(newMetric("vz_ops_total", "Operations", Counter, nil))
+
+	g.Set(10, "stor1", "1")
+	g.Set(2.5, "stor1", "0")
+	g.Set(7, "st\"or2", "0")
+	c.Inc()
+	c.Add(2)
+
+	var b bytes.Buffer
+	if err := r.WriteText(&b); err != nil {
+		t.Fatalf("WriteText failed: %v", err)
+	}
+
+	expected := `# HELP vz_free_bytes Free space
+# TYPE vz_free_bytes gauge
+vz_free_bytes{cluster="st\"or2",tier="0"} 7
+vz_free_bytes{cluster="stor1",tier="0"} 2.5
+vz_free_bytes{cluster="stor1",tier="1"} 10
+# HELP vz_ops_total Operations
+# TYPE vz_ops_total counter
+vz_ops_total 3
+`
+	if b.String() != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, b.String())
+	}
+}
+
+func TestDeleteReset(t *testing.T) {
+	m := newMetric("m", "help", Gauge, []string{"l"})
+	m.Set(1, "a")
+	m.Set(2, "b")
+	m.Delete("a")
+	if len(m.samples) != 1 {
+		t.Errorf("Expected 1 sample after Delete, got %d", len(m.samples))
+	}
+	m.Reset()
+	if len(m.samples) != 0 {
+		t.Errorf("Expected no samples after Reset, got %d", len(m.samples))
+	}
+}
+
+func TestRetain(t *testing.T) {
+	m := newMetric("m", "help", Gauge, []string{"cluster", "tier"})
+	m.Set(1, "c1", "0")
+	m.Set(2, "c1", "1")
+	m.Set(3, "c2", "0")
+	m.Retain(func(labelValues []string) bool { return labelValues[0] == "c1" })
+	if len(m.samples) != 2 || m.Value("c1", "1") != 2 {
+		t.Errorf("Expected samples of c1 to stay, got %v", m.samples)
+	}
+}
+
+func TestLabelCountMismatch(t *testing.T) {
+	m := newMetric("m", "help", Gauge, []string{"l"})
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected panic on label count mismatch")
+		}
+	}()
+	m.Set(1)
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package policy restricts StorageClasses and their parameters which
+// namespaces may provision volumes of
+package policy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+// Default is the key of the rule of namespaces without their own rule
+const Default = "*"
+
+// Rule restricts volumes of a namespace. A nil list allows anything.
+type Rule struct {
+	StorageClasses []string `json:"storageClasses,omitempty"`
+	// Tiers are values of vzsTier, classes without it use tier 0
+	Tiers []string `json:"tiers,omitempty"`
+	// MaxReplicas limits the normal number of replicas of vzsReplicas,
+	// classes without it use the cluster default and aren't limited
+	MaxReplicas int `json:"maxReplicas,omitempty"`
+}
+
+// Policy is rules by namespace
+type Policy map[string]Rule
+
+// Parse parses the data of a policy config map, where keys are namespaces
+// or Default and values are YAML rules
+func Parse(data map[string]string) (Policy, error) {
+	p := Policy{}
+	for namespace, s := range data {
+		var r Rule
+		if err := yaml.Unmarshal([]byte(s), &r); err != nil {
+			return nil, fmt.Errorf("invalid rule of %s: %v", namespace, err)
+		}
+		p[namespace] = r
+	}
+	return p, nil
+}
+
+// Check returns an error explaining why the namespace may not provision a
+// volume of the class with the parameters. Namespaces without a rule, when
+// there is no Default rule either, aren't restricted.
+func (p Policy) Check(namespace, class string, parameters map[string]string) error {
+	r, ok := p[namespace]
+	if !ok {
+		if r, ok = p[Default]; !ok {
+			return nil
+		}
+	}
+	if r.StorageClasses != nil && !contains(r.StorageClasses, class) {
+		return fmt.Errorf("namespace %s may not use storage class %q, allowed classes: %s",
+			namespace, class, list(r.StorageClasses))
+	}
+	tier := parameters["vzsTier"]
+	if tier == "" {
+		tier = "0"
+	}
+	if r.Tiers != nil && !contains(r.Tiers, tier) {
+		return fmt.Errorf("namespace %s may not use tier %s of storage class %q, allowed tiers: %s",
+			namespace, tier, class, list(r.Tiers))
+	}
+	if s := parameters["vzsReplicas"]; r.MaxReplicas != 0 && s != "" {
+		// the format is norm[:min][/max]
+		n := s
+		if i := strings.IndexAny(n, ":/"); i >= 0 {
+			n = n[:i]
+		}
+		norm, err := strconv.Atoi(n)
+		if err != nil {
+			return fmt.Errorf("invalid vzsReplicas %q of storage class %q", s, class)
+		}
+		if norm > r.MaxReplicas {
+			return fmt.Errorf("namespace %s may use at most %d replicas, storage class %q has %d",
+				namespace, r.MaxReplicas, class, norm)
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func list(l []string) string {
+	if len(l) == 0 {
+		return "none"
+	}
+	return strings.Join(l, ", ")
+}
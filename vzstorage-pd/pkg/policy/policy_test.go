@@ -0,0 +1,68 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	p, err := Parse(map[string]string{
+		"team-a": "storageClasses: [fast, slow]\ntiers: [\"0\", \"1\"]\nmaxReplicas: 2\n",
+		"team-b": "{}",
+		"*":      "storageClasses: []\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		namespace  string
+		class      string
+		parameters map[string]string
+		err        string
+	}{
+		{"team-a", "fast", nil, ""},
+		{"team-a", "fast", map[string]string{"vzsTier": "1", "vzsReplicas": "2:1"}, ""},
+		{"team-a", "gold", nil, "may not use storage class"},
+		{"team-a", "fast", map[string]string{"vzsTier": "3"}, "may not use tier 3"},
+		{"team-a", "fast", map[string]string{"vzsReplicas": "3:2/5"}, "at most 2 replicas"},
+		{"team-a", "fast", map[string]string{"vzsReplicas": ":"}, "invalid vzsReplicas"},
+		{"team-b", "gold", map[string]string{"vzsTier": "3"}, ""},
+		{"other", "fast", nil, "allowed classes: none"},
+	}
+	for _, test := range tests {
+		err := p.Check(test.namespace, test.class, test.parameters)
+		if test.err == "" && err != nil {
+			t.Errorf("%s/%s: unexpected error %v", test.namespace, test.class, err)
+		}
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s/%s: expected error with %q, got %v", test.namespace, test.class, test.err, err)
+		}
+	}
+
+	if err := (Policy{}).Check("any", "gold", nil); err != nil {
+		t.Errorf("Expected an empty policy to allow anything, got %v", err)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	if _, err := Parse(map[string]string{"team-a": "maxReplicas: many"}); err == nil {
+		t.Errorf("Expected an error for an invalid rule")
+	}
+}
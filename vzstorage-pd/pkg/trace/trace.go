@@ -0,0 +1,288 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package trace is a minimal implementation of tracing spans exported to
+// an OpenTelemetry collector by OTLP over HTTP with JSON encoding.
+package trace
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxQueued spans are kept for export, newer ones are dropped while
+	// the collector is unavailable
+	maxQueued = 2048
+	batchSize = 256
+)
+
+// Tracer creates spans and exports finished ones in batches. A nil Tracer
+// is valid and creates nil spans, which do nothing.
+type Tracer struct {
+	endpoint string
+	service  string
+	client   *http.Client
+	period   time.Duration
+
+	mu     sync.Mutex
+	queue  []*Span
+	notify chan struct{}
+	// dropped counts spans which didn't fit into the queue
+	dropped int
+}
+
+// Span is a timed operation, possibly a part of another one. Methods of a
+// nil Span do nothing.
+type Span struct {
+	tracer  *Tracer
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte
+	name    string
+	start   time.Time
+	end     time.Time
+
+	mu         sync.Mutex
+	attributes map[string]string
+	err        string
+}
+
+// NewTracer returns a tracer exporting spans of the service to the OTLP
+// HTTP endpoint of a collector, e.g. http://collector:4318, every period
+func NewTracer(endpoint, service string, period time.Duration) *Tracer {
+	return &Tracer{
+		endpoint: strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		service:  service,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		period:   period,
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+// Start begins a new trace
+func (t *Tracer) Start(name string) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{tracer: t, name: name, start: time.Now()}
+	rand.Read(s.traceID[:])
+	rand.Read(s.spanID[:])
+	return s
+}
+
+// Child begins a span of an operation which is a part of s
+func (s *Span) Child(name string) *Span {
+	if s == nil {
+		return nil
+	}
+	c := &Span{tracer: s.tracer, traceID: s.traceID, parent: s.spanID, name: name, start: time.Now()}
+	rand.Read(c.spanID[:])
+	return c
+}
+
+// SetAttribute annotates the span
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attributes == nil {
+		s.attributes = map[string]string{}
+	}
+	s.attributes[key] = value
+}
+
+// End finishes the span, which failed if err isn't nil, and queues it for
+// export
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.end = time.Now()
+	if err != nil {
+		s.err = err.Error()
+	}
+	s.mu.Unlock()
+	s.tracer.enqueue(s)
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.queue) >= maxQueued {
+		t.dropped++
+		return
+	}
+	t.queue = append(t.queue, s)
+	if len(t.queue) >= batchSize {
+		select {
+		case t.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run exports queued spans every period, or sooner when a batch is full,
+// logging failures with logf. It never returns.
+func (t *Tracer) Run(logf func(format string, args ...interface{})) {
+	ticker := time.NewTicker(t.period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.notify:
+		}
+		if err := t.Flush(); err != nil {
+			logf("Unable to export traces: %v", err)
+		}
+	}
+}
+
+// Flush exports all queued spans. Spans of a failed export are dropped.
+func (t *Tracer) Flush() error {
+	t.mu.Lock()
+	spans, dropped := t.queue, t.dropped
+	t.queue, t.dropped = nil, 0
+	t.mu.Unlock()
+
+	for len(spans) != 0 {
+		n := len(spans)
+		if n > batchSize {
+			n = batchSize
+		}
+		if err := t.export(spans[:n]); err != nil {
+			return fmt.Errorf("%v, %d spans lost", err, len(spans)+dropped)
+		}
+		spans = spans[n:]
+	}
+	if dropped != 0 {
+		return fmt.Errorf("%d spans dropped as the queue was full", dropped)
+	}
+	return nil
+}
+
+// OTLP JSON encoding of ExportTraceServiceRequest
+type (
+	exportRequest struct {
+		ResourceSpans []resourceSpans `json:"resourceSpans"`
+	}
+	resourceSpans struct {
+		Resource   resource     `json:"resource"`
+		ScopeSpans []scopeSpans `json:"scopeSpans"`
+	}
+	resource struct {
+		Attributes []keyValue `json:"attributes"`
+	}
+	scopeSpans struct {
+		Scope scope      `json:"scope"`
+		Spans []spanJSON `json:"spans"`
+	}
+	scope struct {
+		Name string `json:"name"`
+	}
+	spanJSON struct {
+		TraceID           string     `json:"traceId"`
+		SpanID            string     `json:"spanId"`
+		ParentSpanID      string     `json:"parentSpanId,omitempty"`
+		Name              string     `json:"name"`
+		Kind              int        `json:"kind"`
+		StartTimeUnixNano string     `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+		Attributes        []keyValue `json:"attributes,omitempty"`
+		Status            status     `json:"status"`
+	}
+	keyValue struct {
+		Key   string   `json:"key"`
+		Value anyValue `json:"value"`
+	}
+	anyValue struct {
+		StringValue string `json:"stringValue"`
+	}
+	status struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+const (
+	spanKindInternal = 1
+	statusOK         = 1
+	statusError      = 2
+)
+
+func (s *Span) encode() spanJSON {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j := spanJSON{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              spanKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Status:            status{Code: statusOK},
+	}
+	if s.parent != [8]byte{} {
+		j.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	for k, v := range s.attributes {
+		j.Attributes = append(j.Attributes, keyValue{k, anyValue{v}})
+	}
+	if s.err != "" {
+		j.Status = status{Code: statusError, Message: s.err}
+	}
+	return j
+}
+
+func (t *Tracer) export(spans []*Span) error {
+	ss := scopeSpans{Scope: scope{Name: t.service}}
+	for _, s := range spans {
+		ss.Spans = append(ss.Spans, s.encode())
+	}
+	req := exportRequest{ResourceSpans: []resourceSpans{{
+		Resource: resource{Attributes: []keyValue{
+			{"service.name", anyValue{t.service}},
+		}},
+		ScopeSpans: []scopeSpans{ss},
+	}}}
+	data, err := json.Marshal(&req)
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package trace
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestExport(t *testing.T) {
+	var requests []exportRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Unexpected request to %s of %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		var req exportRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Unable to decode request: %v", err)
+		}
+		requests = append(requests, req)
+	}))
+	defer server.Close()
+
+	tracer := NewTracer(server.URL+"/", "vzstorage-pd", time.Hour)
+	root := tracer.Start("Provision")
+	root.SetAttribute("claim", "default/claim1")
+	child := root.Child("ploop.create")
+	child.End(errors.New("no space left"))
+	root.End(nil)
+	if err := tracer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requests) != 1 || len(requests[0].ResourceSpans) != 1 {
+		t.Fatalf("Expected a single export, got %+v", requests)
+	}
+	rs := requests[0].ResourceSpans[0]
+	if rs.Resource.Attributes[0].Value.StringValue != "vzstorage-pd" {
+		t.Errorf("Unexpected resource %+v", rs.Resource)
+	}
+	spans := rs.ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %+v", spans)
+	}
+	c, r := spans[0], spans[1]
+	if c.Name != "ploop.create" || r.Name != "Provision" {
+		t.Fatalf("Unexpected spans %+v", spans)
+	}
+	if c.TraceID != r.TraceID || c.ParentSpanID != r.SpanID || r.ParentSpanID != "" {
+		t.Errorf("Expected ploop.create to be a child of Provision, got %+v", spans)
+	}
+	if len(r.TraceID) != 32 || len(r.SpanID) != 16 {
+		t.Errorf("Unexpected ids %s %s", r.TraceID, r.SpanID)
+	}
+	if c.Status.Code != statusError || c.Status.Message != "no space left" || r.Status.Code != statusOK {
+		t.Errorf("Unexpected statuses %+v %+v", c.Status, r.Status)
+	}
+	if len(r.Attributes) != 1 || r.Attributes[0].Key != "claim" || r.Attributes[0].Value.StringValue != "default/claim1" {
+		t.Errorf("Unexpected attributes %+v", r.Attributes)
+	}
+
+	if err := tracer.Flush(); err != nil || len(requests) != 1 {
+		t.Errorf("Expected nothing to export, got %v and %d requests", err, len(requests))
+	}
+}
+
+func TestExportFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	tracer := NewTracer(server.URL, "vzstorage-pd", time.Hour)
+	tracer.Start("Delete").End(nil)
+	if err := tracer.Flush(); err == nil {
+		t.Errorf("Expected an export error")
+	}
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	span := tracer.Start("Provision")
+	span.SetAttribute("claim", "default/claim1")
+	span.Child("ploop.create").End(nil)
+	span.End(nil)
+}
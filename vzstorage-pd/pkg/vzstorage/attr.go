@@ -0,0 +1,52 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vzstorage
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// GetAttr runs "vstorage get-attr" for a file or directory on a mounted
+// cluster and returns its attributes
+func GetAttr(ctx context.Context, file string) (map[string]string, error) {
+	out, err := exec.CommandContext(ctx, "vstorage", "get-attr", file).Output()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get attributes of %s: %v", file, err)
+	}
+	return ParseAttrs(string(out)), nil
+}
+
+// ParseAttrs parses the output of "vstorage get-attr", which prints an
+// attribute per line as name=value. Other lines are ignored.
+func ParseAttrs(out string) map[string]string {
+	attrs := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.ContainsAny(line, " \t") {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			continue
+		}
+		attrs[line[:i]] = line[i+1:]
+	}
+	return attrs
+}
@@ -0,0 +1,44 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vzstorage
+
+import (
+	"reflect"
+	"testing"
+)
+
+const getAttrOutput = `connected to MDS#1
+File: '/vstorage/stor1/k8s-deltas/kubernetes-dynamic-pvc-1.image'
+Attributes:
+  replicas=3:2
+  failure-domain=host
+  tier=0
+  encoding=5+2/4096
+`
+
+func TestParseAttrs(t *testing.T) {
+	attrs := ParseAttrs(getAttrOutput)
+	expected := map[string]string{
+		"replicas":       "3:2",
+		"failure-domain": "host",
+		"tier":           "0",
+		"encoding":       "5+2/4096",
+	}
+	if !reflect.DeepEqual(attrs, expected) {
+		t.Errorf("Expected %v, got %v", expected, attrs)
+	}
+}
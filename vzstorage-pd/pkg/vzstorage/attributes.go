@@ -0,0 +1,211 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vzstorage
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Names of vstorage attributes
+const (
+	ReplicasAttr      = "replicas"
+	TierAttr          = "tier"
+	EncodingAttr      = "encoding"
+	FailureDomainAttr = "failure-domain"
+)
+
+// Replicas is the replicas attribute, norm[:limit][/max]
+type Replicas struct {
+	// Norm is the normal number of replicas
+	Norm int
+	// Limit is the number of replicas writes succeed with, 0 if not set
+	Limit int
+	// Max is the number of replicas allowed when restoring, 0 if not set
+	Max int
+}
+
+// ParseReplicas parses the replicas attribute
+func ParseReplicas(s string) (Replicas, error) {
+	var r Replicas
+	invalid := fmt.Errorf("invalid replicas %q, expected norm[:limit][/max]", s)
+	rest := s
+	if i := strings.Index(rest, "/"); i >= 0 {
+		max, err := strconv.Atoi(rest[i+1:])
+		if err != nil {
+			return r, invalid
+		}
+		r.Max = max
+		rest = rest[:i]
+	}
+	if i := strings.Index(rest, ":"); i >= 0 {
+		limit, err := strconv.Atoi(rest[i+1:])
+		if err != nil {
+			return r, invalid
+		}
+		r.Limit = limit
+		rest = rest[:i]
+	}
+	norm, err := strconv.Atoi(rest)
+	if err != nil {
+		return r, invalid
+	}
+	r.Norm = norm
+	if r.Norm < 1 || r.Limit < 0 || r.Limit > r.Norm || r.Max != 0 && r.Max < r.Norm {
+		return r, fmt.Errorf("invalid replicas %q, expected 0 < limit <= norm <= max", s)
+	}
+	return r, nil
+}
+
+func (r Replicas) String() string {
+	s := strconv.Itoa(r.Norm)
+	if r.Limit != 0 {
+		s += ":" + strconv.Itoa(r.Limit)
+	}
+	if r.Max != 0 {
+		s += "/" + strconv.Itoa(r.Max)
+	}
+	return s
+}
+
+// Encoding is the erasure coding attribute, M+N[/stripe]
+type Encoding struct {
+	// Data and Parity are the numbers of data and parity chunks
+	Data, Parity int
+	// Stripe is the stripe size in bytes, 0 if not set
+	Stripe int
+}
+
+// ParseEncoding parses the encoding attribute
+func ParseEncoding(s string) (Encoding, error) {
+	var e Encoding
+	invalid := fmt.Errorf("invalid encoding %q, expected M+N[/stripe]", s)
+	rest := s
+	if i := strings.Index(rest, "/"); i >= 0 {
+		stripe, err := strconv.Atoi(rest[i+1:])
+		if err != nil || stripe <= 0 {
+			return e, invalid
+		}
+		e.Stripe = stripe
+		rest = rest[:i]
+	}
+	parts := strings.SplitN(rest, "+", 2)
+	if len(parts) != 2 {
+		return e, invalid
+	}
+	var err1, err2 error
+	e.Data, err1 = strconv.Atoi(parts[0])
+	e.Parity, err2 = strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || e.Data < 1 || e.Parity < 0 {
+		return e, invalid
+	}
+	return e, nil
+}
+
+func (e Encoding) String() string {
+	s := fmt.Sprintf("%d+%d", e.Data, e.Parity)
+	if e.Stripe != 0 {
+		s += "/" + strconv.Itoa(e.Stripe)
+	}
+	return s
+}
+
+var failureDomains = map[string]bool{
+	"disk": true, "host": true, "rack": true, "row": true, "room": true,
+	"0": true, "1": true, "2": true, "3": true, "4": true,
+}
+
+// Attributes are the vstorage attributes managed by the provisioner. Unset
+// attributes are inherited from the parent directory.
+type Attributes struct {
+	Replicas      *Replicas
+	Tier          *int
+	Encoding      *Encoding
+	FailureDomain string
+}
+
+// ParseAttributes parses attributes by their names, e.g. as returned by
+// ParseAttrs. Other attributes are ignored.
+func ParseAttributes(attrs map[string]string) (*Attributes, error) {
+	a := &Attributes{}
+	if s, ok := attrs[ReplicasAttr]; ok {
+		r, err := ParseReplicas(s)
+		if err != nil {
+			return nil, err
+		}
+		a.Replicas = &r
+	}
+	if s, ok := attrs[TierAttr]; ok {
+		tier, err := strconv.Atoi(s)
+		if err != nil || tier < 0 || tier > 3 {
+			return nil, fmt.Errorf("invalid tier %q, expected 0 to 3", s)
+		}
+		a.Tier = &tier
+	}
+	if s, ok := attrs[EncodingAttr]; ok {
+		e, err := ParseEncoding(s)
+		if err != nil {
+			return nil, err
+		}
+		a.Encoding = &e
+	}
+	if s, ok := attrs[FailureDomainAttr]; ok {
+		if !failureDomains[s] {
+			return nil, fmt.Errorf("invalid failure domain %q", s)
+		}
+		a.FailureDomain = s
+	}
+	return a, nil
+}
+
+// Marshal returns the set attributes by their names, as passed to
+// "vstorage set-attr". A nil a has no attributes.
+func (a *Attributes) Marshal() map[string]string {
+	attrs := map[string]string{}
+	if a == nil {
+		return attrs
+	}
+	if a.Replicas != nil {
+		attrs[ReplicasAttr] = a.Replicas.String()
+	}
+	if a.Tier != nil {
+		attrs[TierAttr] = strconv.Itoa(*a.Tier)
+	}
+	if a.Encoding != nil {
+		attrs[EncodingAttr] = a.Encoding.String()
+	}
+	if a.FailureDomain != "" {
+		attrs[FailureDomainAttr] = a.FailureDomain
+	}
+	return attrs
+}
+
+// GetAttributes returns the attributes of a file or directory on a mounted
+// cluster
+func GetAttributes(ctx context.Context, file string) (*Attributes, error) {
+	attrs, err := GetAttr(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+	a, err := ParseAttributes(attrs)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse attributes of %s: %v", file, err)
+	}
+	return a, nil
+}
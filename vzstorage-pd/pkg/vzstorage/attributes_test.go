@@ -0,0 +1,133 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vzstorage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseReplicas(t *testing.T) {
+	tests := []struct {
+		in  string
+		out Replicas
+		err bool
+	}{
+		{"3", Replicas{Norm: 3}, false},
+		{"3:2", Replicas{Norm: 3, Limit: 2}, false},
+		{"3/5", Replicas{Norm: 3, Max: 5}, false},
+		{"3:1/5", Replicas{Norm: 3, Limit: 1, Max: 5}, false},
+		{"0", Replicas{}, true},
+		{"2:3", Replicas{}, true},
+		{"3/2", Replicas{}, true},
+		{"three", Replicas{}, true},
+		{"3:", Replicas{}, true},
+	}
+	for _, test := range tests {
+		r, err := ParseReplicas(test.in)
+		if (err != nil) != test.err {
+			t.Errorf("%s: unexpected error state: %v", test.in, err)
+			continue
+		}
+		if test.err {
+			continue
+		}
+		if r != test.out {
+			t.Errorf("%s: expected %+v, got %+v", test.in, test.out, r)
+		}
+		if s := r.String(); s != test.in {
+			t.Errorf("%s: formatted as %s", test.in, s)
+		}
+	}
+}
+
+func TestParseEncoding(t *testing.T) {
+	tests := []struct {
+		in  string
+		out Encoding
+		err bool
+	}{
+		{"5+2", Encoding{Data: 5, Parity: 2}, false},
+		{"5+2/4096", Encoding{Data: 5, Parity: 2, Stripe: 4096}, false},
+		{"1+0", Encoding{Data: 1}, false},
+		{"0+2", Encoding{}, true},
+		{"5", Encoding{}, true},
+		{"5+2/0", Encoding{}, true},
+		{"a+b", Encoding{}, true},
+	}
+	for _, test := range tests {
+		e, err := ParseEncoding(test.in)
+		if (err != nil) != test.err {
+			t.Errorf("%s: unexpected error state: %v", test.in, err)
+			continue
+		}
+		if test.err {
+			continue
+		}
+		if e != test.out {
+			t.Errorf("%s: expected %+v, got %+v", test.in, test.out, e)
+		}
+		if s := e.String(); s != test.in {
+			t.Errorf("%s: formatted as %s", test.in, s)
+		}
+	}
+}
+
+func TestParseAttributes(t *testing.T) {
+	a, err := ParseAttributes(ParseAttrs(getAttrOutput))
+	if err != nil {
+		t.Fatalf("ParseAttributes failed: %v", err)
+	}
+	if a.Replicas == nil || *a.Replicas != (Replicas{Norm: 3, Limit: 2}) {
+		t.Errorf("Unexpected replicas %v", a.Replicas)
+	}
+	if a.Tier == nil || *a.Tier != 0 {
+		t.Errorf("Unexpected tier %v", a.Tier)
+	}
+	if a.Encoding == nil || *a.Encoding != (Encoding{Data: 5, Parity: 2, Stripe: 4096}) {
+		t.Errorf("Unexpected encoding %v", a.Encoding)
+	}
+	if a.FailureDomain != "host" {
+		t.Errorf("Unexpected failure domain %q", a.FailureDomain)
+	}
+
+	expected := map[string]string{
+		"replicas":       "3:2",
+		"failure-domain": "host",
+		"tier":           "0",
+		"encoding":       "5+2/4096",
+	}
+	if attrs := a.Marshal(); !reflect.DeepEqual(attrs, expected) {
+		t.Errorf("Expected %v, got %v", expected, attrs)
+	}
+
+	for _, attrs := range []map[string]string{
+		{"tier": "4"},
+		{"failure-domain": "planet"},
+		{"encoding": "5"},
+		{"replicas": ""},
+	} {
+		if _, err := ParseAttributes(attrs); err == nil {
+			t.Errorf("%v: expected an error", attrs)
+		}
+	}
+
+	var none *Attributes
+	if attrs := none.Marshal(); len(attrs) != 0 {
+		t.Errorf("Expected no attributes of nil, got %v", attrs)
+	}
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vzstorage
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/virtuozzo/ploop-flexvol/vstorage"
+)
+
+// isVstorage tells if a directory is on a vstorage mount, tests replace it
+var isVstorage = vstorage.IsVstorage
+
+// DeltasBalancer spreads ploop images over the directories listed in the
+// deltasPath StorageClass parameter
+type DeltasBalancer struct {
+	mu sync.Mutex
+	// next index to use, keyed by the deltasPath parameter value
+	next map[string]int
+}
+
+// NewDeltasBalancer returns a balancer starting with the first directory
+// of every deltasPath
+func NewDeltasBalancer() *DeltasBalancer {
+	return &DeltasBalancer{next: make(map[string]int)}
+}
+
+// SplitDeltasPaths returns the entries of a comma separated deltasPath
+func SplitDeltasPaths(s string) []string {
+	var paths []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// Pick validates the deltasPath entries against the cluster mounted at
+// mount and returns the one to place the next image in. Entries are used
+// round-robin.
+func (b *DeltasBalancer) Pick(mount, deltasPath string) (string, error) {
+	paths := SplitDeltasPaths(deltasPath)
+	if len(paths) == 0 {
+		return "", fmt.Errorf("deltasPath %q doesn't contain any path", deltasPath)
+	}
+	for _, p := range paths {
+		if err := CheckDeltasPath(mount, p); err != nil {
+			return "", err
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	i := b.next[deltasPath] % len(paths)
+	b.next[deltasPath] = i + 1
+	return paths[i], nil
+}
+
+// CheckDeltasPath makes sure p is an existing directory on the vstorage
+// cluster mounted at mount
+func CheckDeltasPath(mount, p string) error {
+	dir := path.Join(mount, p)
+	if !strings.HasPrefix(dir, path.Clean(mount)+"/") {
+		return fmt.Errorf("deltasPath %q points outside of the cluster", p)
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("Unable to use deltasPath %q: %v", p, err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("deltasPath %q is not a directory", p)
+	}
+	ok, err := isVstorage(dir)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("deltasPath %q is not on a Virtuozzo Storage mount", p)
+	}
+	return nil
+}
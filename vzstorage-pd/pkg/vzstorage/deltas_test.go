@@ -0,0 +1,134 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vzstorage
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitDeltasPaths(t *testing.T) {
+	for s, expected := range map[string][]string{
+		"":              nil,
+		" , ":           nil,
+		"d1":            {"d1"},
+		"d1, d2,,d3 ":   {"d1", "d2", "d3"},
+		"fast/a,slow/b": {"fast/a", "slow/b"},
+	} {
+		if paths := SplitDeltasPaths(s); !reflect.DeepEqual(paths, expected) {
+			t.Errorf("%q: expected %v, got %v", s, expected, paths)
+		}
+	}
+}
+
+// withDeltasDirs creates directories of the cluster in a temporary mount
+// and makes those under "vz" look like vstorage
+func withDeltasDirs(t *testing.T, dirs ...string) string {
+	mount, err := ioutil.TempDir("", "deltas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range dirs {
+		if err := os.MkdirAll(path.Join(mount, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(path.Join(mount, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	isVstorage = func(dir string) (bool, error) {
+		return strings.HasPrefix(dir, path.Join(mount, "vz")+"/"), nil
+	}
+	return mount
+}
+
+func TestCheckDeltasPath(t *testing.T) {
+	mount := withDeltasDirs(t, "vz/d1", "local")
+	defer os.RemoveAll(mount)
+
+	for _, c := range []struct {
+		path string
+		err  string
+	}{
+		{"vz/d1", ""},
+		{"vz/d1/", ""},
+		{"../vz/d1", "outside of the cluster"},
+		{".", "outside of the cluster"},
+		{"vz/missing", "Unable to use"},
+		{"file", "not a directory"},
+		{"local", "not on a Virtuozzo Storage mount"},
+	} {
+		err := CheckDeltasPath(mount, c.path)
+		if c.err == "" && err != nil || c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("%q: expected error %q, got %v", c.path, c.err, err)
+		}
+	}
+}
+
+func TestDeltasBalancerPick(t *testing.T) {
+	mount := withDeltasDirs(t, "vz/d1", "vz/d2", "vz/d3", "local")
+	defer os.RemoveAll(mount)
+
+	for _, c := range []struct {
+		deltasPath string
+		picks      []string
+		err        string
+	}{
+		{"vz/d1", []string{"vz/d1", "vz/d1"}, ""},
+		{"vz/d1, vz/d2,vz/d3", []string{"vz/d1", "vz/d2", "vz/d3", "vz/d1"}, ""},
+		{"vz/d2,vz/d3", []string{"vz/d2", "vz/d3", "vz/d2"}, ""},
+		{" , ", nil, "doesn't contain any path"},
+		{"vz/d1,local", nil, "not on a Virtuozzo Storage mount"},
+		{"vz/d1,vz/missing", nil, "Unable to use"},
+	} {
+		b := NewDeltasBalancer()
+		if c.err != "" {
+			if _, err := b.Pick(mount, c.deltasPath); err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%q: expected error %q, got %v", c.deltasPath, c.err, err)
+			}
+			continue
+		}
+		var picks []string
+		for range c.picks {
+			p, err := b.Pick(mount, c.deltasPath)
+			if err != nil {
+				t.Fatalf("%q: %v", c.deltasPath, err)
+			}
+			picks = append(picks, p)
+		}
+		if !reflect.DeepEqual(picks, c.picks) {
+			t.Errorf("%q: expected %v, got %v", c.deltasPath, c.picks, picks)
+		}
+	}
+
+	// rotations of different parameters don't affect each other
+	b := NewDeltasBalancer()
+	for _, c := range []struct{ deltasPath, expected string }{
+		{"vz/d1,vz/d2", "vz/d1"},
+		{"vz/d2,vz/d3", "vz/d2"},
+		{"vz/d1,vz/d2", "vz/d2"},
+		{"vz/d2,vz/d3", "vz/d3"},
+	} {
+		if p, err := b.Pick(mount, c.deltasPath); err != nil || p != c.expected {
+			t.Errorf("%q: expected %s, got %s, %v", c.deltasPath, c.expected, p, err)
+		}
+	}
+}
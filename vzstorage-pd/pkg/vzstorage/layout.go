@@ -0,0 +1,155 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vzstorage
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Layout holds templates of the directories of a volume relative to the
+// cluster root. Templates refer to variables like {volumeID}.
+type Layout struct {
+	// Descriptor is the directory of DiskDescriptor.xml. ploop-flexvol
+	// looks for it in volumePath/volumeID, so it has to end with
+	// /{volumeID}.
+	Descriptor string
+	// Image is the directory of deltas of the image
+	Image string
+	// Snapshots is the directory snapshots of the volume are made in
+	Snapshots string
+}
+
+// DefaultLayout keeps deltas in <volumeID>.image next to the descriptor
+// directory, or under deltasPath if it is set
+var DefaultLayout = Layout{
+	Descriptor: "{volumePath}/{volumeID}",
+	Image:      "{deltasPath}/{volumeID}.image",
+	Snapshots:  "{volumePath}",
+}
+
+// LayoutVariables are the variables templates may refer to
+var LayoutVariables = []string{"volumePath", "deltasPath", "volumeID", "namespace", "claim", "storageClass"}
+
+var reLayoutVariable = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// Validate checks that templates refer to known variables only and can't
+// be rendered into paths shared by several volumes
+func (l Layout) Validate() error {
+	for _, t := range []struct{ name, template string }{
+		{"descriptor", l.Descriptor},
+		{"image", l.Image},
+		{"snapshots", l.Snapshots},
+	} {
+		if t.template == "" {
+			return fmt.Errorf("%s directory template is empty", t.name)
+		}
+		if strings.HasPrefix(t.template, "/") {
+			return fmt.Errorf("%s directory template %q has to be relative to the cluster root", t.name, t.template)
+		}
+		for _, e := range strings.Split(t.template, "/") {
+			if e == ".." {
+				return fmt.Errorf("%s directory template %q can't refer to parent directories", t.name, t.template)
+			}
+		}
+		for _, m := range reLayoutVariable.FindAllStringSubmatch(t.template, -1) {
+			if !isLayoutVariable(m[1]) {
+				return fmt.Errorf("%s directory template %q refers to unknown variable %q, known ones are %s",
+					t.name, t.template, m[1], strings.Join(LayoutVariables, ", "))
+			}
+		}
+	}
+	if !strings.HasSuffix(l.Descriptor, "/{volumeID}") {
+		return fmt.Errorf("descriptor directory template %q has to end with /{volumeID}", l.Descriptor)
+	}
+	if !hasVolumeElement(strings.Split(l.Image, "/"), "{volumeID}") {
+		return fmt.Errorf("image directory template %q has to contain {volumeID} as a path element, optionally with an extension like {volumeID}.image", l.Image)
+	}
+	if l.Image == l.Descriptor {
+		return fmt.Errorf("descriptor and image directory templates are the same")
+	}
+	return nil
+}
+
+// hasVolumeElement tells whether one of elements is id, possibly followed
+// by an extension. Such an element can't be shared by several volumes,
+// while {volumeID}/.. or {namespace}{volumeID} may turn into one.
+func hasVolumeElement(elements []string, id string) bool {
+	for _, e := range elements {
+		if e == id {
+			return true
+		}
+		if strings.HasPrefix(e, id+".") && !strings.ContainsAny(e[len(id):], "{}") {
+			return true
+		}
+	}
+	return false
+}
+
+func isLayoutVariable(name string) bool {
+	for _, v := range LayoutVariables {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// LayoutPaths are directories of a volume relative to the cluster root
+type LayoutPaths struct {
+	Descriptor string
+	Image      string
+	Snapshots  string
+}
+
+// Render validates the layout and substitutes variables in its templates
+func (l Layout) Render(vars map[string]string) (*LayoutPaths, error) {
+	if err := l.Validate(); err != nil {
+		return nil, err
+	}
+	if id := vars["volumeID"]; id == "" || strings.ContainsAny(id, "/{}") || id == "." || id == ".." {
+		return nil, fmt.Errorf("invalid volume ID %q", id)
+	}
+	var renderErr error
+	render := func(template string) string {
+		p := reLayoutVariable.ReplaceAllStringFunc(template, func(m string) string {
+			return vars[m[1:len(m)-1]]
+		})
+		p = path.Clean(p)
+		if renderErr == nil && (p == "." || p == ".." || strings.HasPrefix(p, "../") || strings.HasPrefix(p, "/")) {
+			renderErr = fmt.Errorf("template %q is rendered into %q outside of the cluster", template, p)
+		}
+		return p
+	}
+	paths := &LayoutPaths{
+		Descriptor: render(l.Descriptor),
+		Image:      render(l.Image),
+		Snapshots:  render(l.Snapshots),
+	}
+	if renderErr != nil {
+		return nil, renderErr
+	}
+	if id := vars["volumeID"]; !hasVolumeElement(strings.Split(paths.Image, "/"), id) {
+		return nil, fmt.Errorf("image directory %q doesn't have the volume ID %q as a path element", paths.Image, id)
+	}
+	if paths.Descriptor == paths.Image {
+		return nil, fmt.Errorf("descriptor and image directories are both %q", paths.Image)
+	}
+	return paths, nil
+}
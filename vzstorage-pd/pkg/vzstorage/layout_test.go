@@ -0,0 +1,94 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vzstorage
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLayoutRender(t *testing.T) {
+	vars := map[string]string{
+		"volumePath":   "k8s-volumes",
+		"deltasPath":   "k8s-deltas",
+		"volumeID":     "kubernetes-dynamic-pvc-1",
+		"namespace":    "team-a",
+		"claim":        "db",
+		"storageClass": "fast",
+	}
+
+	paths, err := DefaultLayout.Render(vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := LayoutPaths{
+		Descriptor: "k8s-volumes/kubernetes-dynamic-pvc-1",
+		Image:      "k8s-deltas/kubernetes-dynamic-pvc-1.image",
+		Snapshots:  "k8s-volumes",
+	}
+	if *paths != expected {
+		t.Errorf("Expected %+v, got %+v", expected, *paths)
+	}
+
+	l := Layout{
+		Descriptor: "{storageClass}/{namespace}/{volumeID}",
+		Image:      "{storageClass}/{namespace}/{volumeID}/deltas",
+		Snapshots:  "snapshots/{namespace}/{claim}",
+	}
+	if paths, err = l.Render(vars); err != nil {
+		t.Fatal(err)
+	}
+	expected = LayoutPaths{
+		Descriptor: "fast/team-a/kubernetes-dynamic-pvc-1",
+		Image:      "fast/team-a/kubernetes-dynamic-pvc-1/deltas",
+		Snapshots:  "snapshots/team-a/db",
+	}
+	if *paths != expected {
+		t.Errorf("Expected %+v, got %+v", expected, *paths)
+	}
+}
+
+func TestLayoutInvalid(t *testing.T) {
+	tests := []struct {
+		layout Layout
+		err    string
+	}{
+		{Layout{"{volumePath}/{volumeID}", "{deltasPath}/{volumeID}.image", ""}, "is empty"},
+		{Layout{"/vols/{volumeID}", "{volumeID}.image", "snaps"}, "relative"},
+		{Layout{"{pool}/{volumeID}", "{volumeID}.image", "snaps"}, "unknown variable \"pool\""},
+		{Layout{"{volumeID}/root", "{volumeID}.image", "snaps"}, "end with /{volumeID}"},
+		{Layout{"v/{volumeID}", "{namespace}/images", "snaps"}, "contain {volumeID}"},
+		{Layout{"v/{volumeID}", "{namespace}{volumeID}", "snaps"}, "contain {volumeID}"},
+		{Layout{"v/{volumeID}", "{volumeID}.{claim}", "snaps"}, "contain {volumeID}"},
+		{Layout{"v/{volumeID}", "{volumeID}/../shared", "snaps"}, "parent directories"},
+		{Layout{"v/{volumeID}", "{volumePath}/{volumeID}/..", "snaps"}, "parent directories"},
+		{Layout{"v/{volumeID}", "{volumeID}.image", "snaps/.."}, "parent directories"},
+		{Layout{"v/{volumeID}", "v/{volumeID}", "snaps"}, "are the same"},
+		{Layout{"{deltasPath}/{volumeID}", "{volumeID}.image", "snaps"}, "outside of the cluster"},
+		{Layout{"v{namespace}/{volumeID}", "v/{volumeID}", "snaps"}, "are both"},
+	}
+	for _, test := range tests {
+		_, err := test.layout.Render(map[string]string{"volumeID": "v1", "deltasPath": "../.."})
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%+v: expected error with %q, got %v", test.layout, test.err, err)
+		}
+	}
+
+	if _, err := DefaultLayout.Render(map[string]string{"deltasPath": "d"}); err == nil || !strings.Contains(err.Error(), "invalid volume ID") {
+		t.Errorf("Expected an error about the empty volume ID, got %v", err)
+	}
+}
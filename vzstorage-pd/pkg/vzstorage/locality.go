@@ -0,0 +1,91 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vzstorage
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+)
+
+// ReplicaServers runs "vstorage file-info" for a file on a mounted cluster
+// and returns how many chunk replicas of the file each chunk server holds
+func ReplicaServers(ctx context.Context, file string) (map[string]int, error) {
+	out, err := exec.CommandContext(ctx, "vstorage", "file-info", file).Output()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get chunk map of %s: %v", file, err)
+	}
+	return ParseFileInfo(string(out)), nil
+}
+
+var reReplica = regexp.MustCompile(`(?i)\bcs#(\d+)`)
+
+// ParseFileInfo counts chunk replicas per chunk server in the output of
+// "vstorage file-info", where replicas are listed as CS#<id>
+func ParseFileInfo(out string) map[string]int {
+	servers := map[string]int{}
+	for _, m := range reReplica.FindAllStringSubmatch(out, -1) {
+		servers[m[1]]++
+	}
+	return servers
+}
+
+var reChunk = regexp.MustCompile(`(?m)^\s*chunk\s+\d+`)
+
+// ParseChunkReplicas returns the number of replicas of every chunk in the
+// output of "vstorage file-info", in the order chunks are listed
+func ParseChunkReplicas(out string) []int {
+	starts := reChunk.FindAllStringIndex(out, -1)
+	replicas := make([]int, len(starts))
+	for i, start := range starts {
+		end := len(out)
+		if i+1 < len(starts) {
+			end = starts[i+1][0]
+		}
+		replicas[i] = len(reReplica.FindAllString(out[start[1]:end], -1))
+	}
+	return replicas
+}
+
+// MinReplicas runs "vstorage file-info" for a file on a mounted cluster and
+// returns the fewest replicas any of its chunks has, -1 if it has no chunks
+func MinReplicas(ctx context.Context, file string) (int, error) {
+	out, err := exec.CommandContext(ctx, "vstorage", "file-info", file).Output()
+	if err != nil {
+		return 0, fmt.Errorf("Unable to get chunk map of %s: %v", file, err)
+	}
+	min := -1
+	for _, n := range ParseChunkReplicas(string(out)) {
+		if min < 0 || n < min {
+			min = n
+		}
+	}
+	return min, nil
+}
+
+// ReplicaHosts sums up replica counts of chunk servers per host, using the
+// server addresses from Stat. Servers with an unknown host are skipped.
+func ReplicaHosts(servers map[string]int, hosts map[string]string) map[string]int {
+	byHost := map[string]int{}
+	for cs, n := range servers {
+		if h, ok := hosts[cs]; ok {
+			byHost[h] += n
+		}
+	}
+	return byHost
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vzstorage
+
+import (
+	"reflect"
+	"testing"
+)
+
+const fileInfoOutput = `/vstorage/stor1/k8s-deltas/kubernetes-dynamic-pvc-1.image/root.hds:
+  attributes: replicas=2:1 failure-domain=host tier=0
+  chunk 0 [0..268435456) version 3:
+    CS#1025 CS#1026
+  chunk 1 [268435456..536870912) version 1:
+    CS#1026 CS#1027
+`
+
+func TestParseFileInfo(t *testing.T) {
+	servers := ParseFileInfo(fileInfoOutput)
+	expected := map[string]int{"1025": 1, "1026": 2, "1027": 1}
+	if !reflect.DeepEqual(servers, expected) {
+		t.Errorf("Expected %v, got %v", expected, servers)
+	}
+}
+
+func TestParseChunkReplicas(t *testing.T) {
+	degraded := fileInfoOutput + `  chunk 2 [536870912..805306368) version 2:
+    CS#1025
+`
+	tests := []struct {
+		out      string
+		expected []int
+	}{
+		{fileInfoOutput, []int{2, 2}},
+		{degraded, []int{2, 2, 1}},
+		{"/vstorage/stor1/empty.hds:\n  attributes: replicas=3\n", []int{}},
+	}
+	for _, test := range tests {
+		replicas := ParseChunkReplicas(test.out)
+		if !reflect.DeepEqual(replicas, test.expected) {
+			t.Errorf("Expected %v, got %v", test.expected, replicas)
+		}
+	}
+}
+
+func TestReplicaHosts(t *testing.T) {
+	servers := map[string]int{"1025": 1, "1026": 2, "1027": 1, "1030": 5}
+	hosts := map[string]string{
+		"1025": "10.29.1.1",
+		"1026": "10.29.1.2",
+		"1027": "10.29.1.1",
+	}
+	byHost := ReplicaHosts(servers, hosts)
+	expected := map[string]int{"10.29.1.1": 2, "10.29.1.2": 2}
+	if !reflect.DeepEqual(byHost, expected) {
+		t.Errorf("Expected %v, got %v", expected, byHost)
+	}
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vzstorage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// DefaultMDSPort is the port MDS servers listen on by default
+const DefaultMDSPort = 2510
+
+// ClustersDir is where vstorage tools keep per-cluster configuration
+var ClustersDir = "/etc/vstorage/clusters"
+
+// ParseMDSAddresses parses a comma or whitespace separated list of MDS
+// addresses. An address is a host name, an IPv4 address or an IPv6
+// address (bracketed if a port is given), optionally followed by a port.
+// If iface is not empty, it is used as the zone of link-local IPv6
+// addresses which don't have one, so that multi-homed nodes reach MDS
+// servers through the right interface.
+func ParseMDSAddresses(s string, iface string) ([]string, error) {
+	var out []string
+	for _, a := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\t'
+	}) {
+		host, port := a, strconv.Itoa(DefaultMDSPort)
+		if h, p, err := net.SplitHostPort(a); err == nil {
+			host, port = h, p
+		} else if strings.HasPrefix(a, "[") && strings.HasSuffix(a, "]") {
+			host = a[1 : len(a)-1]
+		}
+
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			return nil, fmt.Errorf("Invalid port in MDS address %q", a)
+		}
+
+		addr, zone := host, ""
+		if i := strings.LastIndex(host, "%"); i != -1 {
+			addr, zone = host[:i], host[i+1:]
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			if zone != "" || strings.Contains(host, ":") {
+				return nil, fmt.Errorf("Invalid MDS address %q", a)
+			}
+		} else if ip.To4() == nil && ip.IsLinkLocalUnicast() && zone == "" && iface != "" {
+			host = addr + "%" + iface
+		}
+		out = append(out, net.JoinHostPort(host, port))
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("No MDS addresses in %q", s)
+	}
+	return out, nil
+}
+
+// SelectInterface keeps MDS addresses, as returned by ParseMDSAddresses,
+// which are reached directly through the network interface iface: those in
+// networks of its addresses, and link-local IPv6 ones, which are zoned to
+// it. Host names are resolved first. On multi-homed nodes, connections to
+// the kept addresses go out through the interface by its on-link routes.
+func SelectInterface(addrs []string, iface string) ([]string, error) {
+	i, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to find interface %s: %v", iface, err)
+	}
+	ifAddrs, err := i.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get addresses of interface %s: %v", iface, err)
+	}
+	var nets []*net.IPNet
+	for _, a := range ifAddrs {
+		if n, ok := a.(*net.IPNet); ok {
+			nets = append(nets, n)
+		}
+	}
+	return selectNetworks(addrs, nets, iface, net.LookupIP)
+}
+
+func selectNetworks(addrs []string, nets []*net.IPNet, iface string, lookup func(string) ([]net.IP, error)) ([]string, error) {
+	var out []string
+	for _, a := range addrs {
+		host, port, err := net.SplitHostPort(a)
+		if err != nil {
+			return nil, err
+		}
+		addr := host
+		if i := strings.LastIndex(host, "%"); i != -1 {
+			addr = host[:i]
+		}
+		ips := []net.IP{net.ParseIP(addr)}
+		if ips[0] == nil {
+			if ips, err = lookup(addr); err != nil {
+				return nil, fmt.Errorf("Unable to resolve MDS address %s: %v", addr, err)
+			}
+		}
+		for _, ip := range ips {
+			if ip.To4() == nil && ip.IsLinkLocalUnicast() {
+				// zoned by ParseMDSAddresses unless it has a zone
+				if addr == host {
+					out = append(out, net.JoinHostPort(ip.String()+"%"+iface, port))
+				} else {
+					out = append(out, a)
+				}
+				continue
+			}
+			for _, n := range nets {
+				if n.Contains(ip) {
+					out = append(out, net.JoinHostPort(ip.String(), port))
+					break
+				}
+			}
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("None of MDS addresses %s is in a network of interface %s", strings.Join(addrs, ", "), iface)
+	}
+	return out, nil
+}
+
+// ValidateClusterName checks that name is a plain cluster name, as it is
+// used as a directory name in ClustersDir and in mount points
+func ValidateClusterName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") || strings.HasPrefix(name, "-") {
+		return fmt.Errorf("%q is not a valid cluster name", name)
+	}
+	return nil
+}
+
+// WriteBSList writes the list of MDS addresses of the cluster, which
+// vstorage tools use instead of auto-discovery
+func WriteBSList(cluster string, addrs []string) error {
+	if err := ValidateClusterName(cluster); err != nil {
+		return err
+	}
+	dir := path.Join(ClustersDir, cluster)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	data := strings.Join(addrs, "\n") + "\n"
+	tmp := path.Join(dir, ".bs.list.tmp")
+	if err := ioutil.WriteFile(tmp, []byte(data), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path.Join(dir, "bs.list"))
+}
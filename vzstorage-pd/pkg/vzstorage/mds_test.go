@@ -0,0 +1,132 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vzstorage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestParseMDSAddresses(t *testing.T) {
+	tests := []struct {
+		in    string
+		iface string
+		out   []string
+		err   bool
+	}{
+		{"10.0.0.1", "", []string{"10.0.0.1:2510"}, false},
+		{"10.0.0.1:2511, mds.example.com", "", []string{"10.0.0.1:2511", "mds.example.com:2510"}, false},
+		{"2001:db8::1", "", []string{"[2001:db8::1]:2510"}, false},
+		{"[2001:db8::1]:2600", "", []string{"[2001:db8::1]:2600"}, false},
+		{"[2001:db8::2]", "", []string{"[2001:db8::2]:2510"}, false},
+		{"fe80::1", "eth1", []string{"[fe80::1%eth1]:2510"}, false},
+		{"fe80::1%eth0", "eth1", []string{"[fe80::1%eth0]:2510"}, false},
+		{"2001:db8::1", "eth1", []string{"[2001:db8::1]:2510"}, false},
+		{"10.0.0.1:0", "", nil, true},
+		{"10.0.0.1:http", "", nil, true},
+		{"2001:db8::zz", "", nil, true},
+		{" , ", "", nil, true},
+	}
+	for _, test := range tests {
+		out, err := ParseMDSAddresses(test.in, test.iface)
+		if (err != nil) != test.err {
+			t.Errorf("%q: unexpected error state: %v", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(out, test.out) {
+			t.Errorf("%q: expected %v, got %v", test.in, test.out, out)
+		}
+	}
+}
+
+func TestWriteBSList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vzstorage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ClustersDir = dir
+
+	if err := WriteBSList("stor1", []string{"10.0.0.1:2510", "[2001:db8::1]:2510"}); err != nil {
+		t.Fatalf("WriteBSList failed: %v", err)
+	}
+	data, err := ioutil.ReadFile(path.Join(dir, "stor1", "bs.list"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "10.0.0.1:2510\n[2001:db8::1]:2510\n" {
+		t.Errorf("Unexpected bs.list content: %q", data)
+	}
+}
+
+func TestSelectNetworks(t *testing.T) {
+	_, storage, _ := net.ParseCIDR("10.1.0.0/16")
+	_, storage6, _ := net.ParseCIDR("2001:db8:1::/64")
+	nets := []*net.IPNet{storage, storage6}
+	lookup := func(host string) ([]net.IP, error) {
+		if host == "mds.example.com" {
+			return []net.IP{net.ParseIP("192.168.0.10"), net.ParseIP("10.1.0.10")}, nil
+		}
+		return nil, fmt.Errorf("no such host")
+	}
+
+	tests := []struct {
+		in  []string
+		out []string
+		err bool
+	}{
+		// addresses of MDS servers on the public and storage networks
+		{[]string{"192.168.0.1:2510", "10.1.0.1:2510"}, []string{"10.1.0.1:2510"}, false},
+		{[]string{"[2001:db8:2::1]:2510", "[2001:db8:1::1]:2600"}, []string{"[2001:db8:1::1]:2600"}, false},
+		{[]string{"mds.example.com:2510"}, []string{"10.1.0.10:2510"}, false},
+		{[]string{"[fe80::1%eth1]:2510"}, []string{"[fe80::1%eth1]:2510"}, false},
+		{[]string{"[fe80::1%eth0]:2510"}, []string{"[fe80::1%eth0]:2510"}, false},
+		{[]string{"192.168.0.1:2510"}, nil, true},
+		{[]string{"missing.example.com:2510"}, nil, true},
+	}
+	for _, test := range tests {
+		out, err := selectNetworks(test.in, nets, "eth1", lookup)
+		if (err != nil) != test.err {
+			t.Errorf("%v: unexpected error state: %v", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(out, test.out) {
+			t.Errorf("%v: expected %v, got %v", test.in, test.out, out)
+		}
+	}
+}
+
+func TestValidateClusterName(t *testing.T) {
+	for _, name := range []string{"stor1", "stor-1.example", "cluster_2"} {
+		if err := ValidateClusterName(name); err != nil {
+			t.Errorf("%q: unexpected error: %v", name, err)
+		}
+	}
+	for _, name := range []string{"", ".", "..", "../../etc/x", "a/b", "/stor1", "-stor1", "stor\x001"} {
+		if err := ValidateClusterName(name); err == nil {
+			t.Errorf("%q: expected an error", name)
+		}
+	}
+	if err := WriteBSList("../x", []string{"10.0.0.1:2510"}); err == nil {
+		t.Errorf("expected WriteBSList to reject a path as the cluster name")
+	}
+}
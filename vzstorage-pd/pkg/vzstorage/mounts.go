@@ -0,0 +1,161 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vzstorage
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// MountCache keeps mount points of clusters read from mountinfo. procfs
+// doesn't support inotify, but the kernel reports changes of the mount
+// table by POLLPRI on an open mountinfo file, which invalidates the cache.
+// If the file can't be polled, mountinfo is read on every lookup.
+type MountCache struct {
+	path  string
+	start sync.Once
+
+	mu       sync.Mutex
+	watching bool
+	// generation is bumped on every change of the mount table
+	generation uint64
+	cached     uint64
+	mounts     map[string]string
+}
+
+// NewMountCache returns a cache of mount points in the mount namespace of
+// the process
+func NewMountCache() *MountCache {
+	return newMountCache("/proc/self/mountinfo")
+}
+
+func newMountCache(path string) *MountCache {
+	return &MountCache{path: path}
+}
+
+// Mountpoint returns the mount point of the cluster, or "" if it isn't
+// mounted
+func (c *MountCache) Mountpoint(cluster string) (string, error) {
+	c.start.Do(func() {
+		if f, err := os.Open(c.path); err == nil {
+			c.watching = true
+			go c.watch(f)
+		}
+	})
+
+	c.mu.Lock()
+	if c.watching && c.mounts != nil && c.cached == c.generation {
+		defer c.mu.Unlock()
+		return c.mounts[cluster], nil
+	}
+	generation := c.generation
+	c.mu.Unlock()
+
+	data, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return "", err
+	}
+	mounts := ParseMountInfo(string(data))
+
+	c.mu.Lock()
+	// a change during the read leaves the cache invalid
+	c.mounts, c.cached = mounts, generation
+	c.mu.Unlock()
+	return mounts[cluster], nil
+}
+
+// invalidate makes the next lookup read mountinfo
+func (c *MountCache) invalidate() {
+	c.mu.Lock()
+	c.generation++
+	c.mu.Unlock()
+}
+
+func (c *MountCache) watch(f *os.File) {
+	defer f.Close()
+	fds := []unix.PollFd{{Fd: int32(f.Fd()), Events: unix.POLLPRI}}
+	for {
+		// reading the file acknowledges the change
+		if _, err := f.Seek(0, io.SeekStart); err == nil {
+			io.Copy(ioutil.Discard, f)
+		}
+		_, err := unix.Poll(fds, -1)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			c.mu.Lock()
+			c.watching = false
+			c.mu.Unlock()
+			return
+		}
+		if fds[0].Revents&(unix.POLLPRI|unix.POLLERR) != 0 {
+			c.invalidate()
+		}
+	}
+}
+
+// ParseMountInfo returns mount points of vstorage clusters by cluster
+// name from the content of /proc/<pid>/mountinfo
+func ParseMountInfo(data string) map[string]string {
+	mounts := map[string]string{}
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		// optional fields end with a "-" separator, which is followed by
+		// the filesystem type and the source
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 0 || sep+2 >= len(fields) || fields[sep+1] != "fuse.vstorage" {
+			continue
+		}
+		if !strings.HasPrefix(fields[sep+2], "vstorage://") {
+			continue
+		}
+		cluster := strings.TrimPrefix(fields[sep+2], "vstorage://")
+		if _, ok := mounts[cluster]; !ok {
+			mounts[cluster] = unescapeMountPath(fields[4])
+		}
+	}
+	return mounts
+}
+
+// unescapeMountPath decodes octal escapes like \040 used for spaces
+func unescapeMountPath(s string) string {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b = append(b, byte(n))
+				i += 3
+				continue
+			}
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
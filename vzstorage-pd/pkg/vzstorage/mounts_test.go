@@ -0,0 +1,74 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vzstorage
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+const mountInfo = `22 1 253:0 / / rw,relatime shared:1 - xfs /dev/mapper/root rw
+40 22 0:35 / /vstorage/stor1 rw,nosuid,nodev,relatime shared:20 - fuse.vstorage vstorage://stor1 rw,user_id=0,group_id=0
+41 22 0:36 / /mnt/with\040space rw,relatime shared:21 master:3 - fuse.vstorage vstorage://stor2 rw
+42 22 0:35 / /var/lib/pd/stor1 rw,relatime shared:20 - fuse.vstorage vstorage://stor1 rw
+43 22 0:37 / /mnt/other rw,relatime - fuse.sshfs user@host:/ rw
+`
+
+func TestParseMountInfo(t *testing.T) {
+	mounts := ParseMountInfo(mountInfo)
+	expected := map[string]string{
+		"stor1": "/vstorage/stor1",
+		"stor2": "/mnt/with space",
+	}
+	if len(mounts) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, mounts)
+	}
+	for k, v := range expected {
+		if mounts[k] != v {
+			t.Errorf("Expected %s mounted in %q, got %q", k, v, mounts[k])
+		}
+	}
+}
+
+func TestMountCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "mountinfo")
+	if err := ioutil.WriteFile(file, []byte(mountInfo), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newMountCache(file)
+	if p, err := c.Mountpoint("stor1"); err != nil || p != "/vstorage/stor1" {
+		t.Fatalf("Expected /vstorage/stor1, got %q, %v", p, err)
+	}
+	if err := ioutil.WriteFile(file, []byte(""), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := c.Mountpoint("stor1"); p != "/vstorage/stor1" {
+		t.Errorf("Expected the cached mount point, got %q", p)
+	}
+	c.invalidate()
+	if p, _ := c.Mountpoint("stor1"); p != "" {
+		t.Errorf("Expected stor1 unmounted after invalidation, got %q", p)
+	}
+}
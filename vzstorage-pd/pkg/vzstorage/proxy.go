@@ -0,0 +1,306 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vzstorage
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// proxyDialTimeout limits connecting to a proxy and its handshake
+const proxyDialTimeout = 30 * time.Second
+
+// Proxy is a SOCKS5 or HTTP CONNECT proxy through which MDS servers are
+// reached in segmented networks
+type Proxy struct {
+	// Scheme is either "socks5" or "http"
+	Scheme   string
+	Address  string
+	Username string
+	Password string
+}
+
+// ParseProxy parses a proxy URL, socks5://[user:password@]host:port or
+// http://[user:password@]host:port
+func ParseProxy(s string) (*Proxy, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid proxy %q: %v", s, err)
+	}
+	if u.Scheme != "socks5" && u.Scheme != "http" {
+		return nil, fmt.Errorf("Unsupported scheme of proxy %q, only socks5 and http are", s)
+	}
+	if u.Path != "" && u.Path != "/" || u.RawQuery != "" {
+		return nil, fmt.Errorf("Proxy %q has a path", s)
+	}
+	_, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid address of proxy %q: %v", s, err)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return nil, fmt.Errorf("Invalid port of proxy %q", s)
+	}
+	p := &Proxy{Scheme: u.Scheme, Address: u.Host}
+	if u.User != nil {
+		p.Username = u.User.Username()
+		p.Password, _ = u.User.Password()
+	}
+	return p, nil
+}
+
+// String returns the proxy URL without the password
+func (p *Proxy) String() string {
+	u := url.URL{Scheme: p.Scheme, Host: p.Address}
+	if p.Username != "" {
+		u.User = url.User(p.Username)
+	}
+	return u.String()
+}
+
+// Dial connects to addr through the proxy
+func (p *Proxy) Dial(addr string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", p.Address, proxyDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(proxyDialTimeout))
+	if p.Scheme == "socks5" {
+		err = p.socks5Connect(conn, addr)
+	} else {
+		err = p.httpConnect(conn, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Unable to connect to %s through proxy %s: %v", addr, p, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (p *Proxy) httpConnect(conn net.Conn, addr string) error {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if p.Username != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(p.Username + ":" + p.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	// the reader doesn't buffer past the response, nothing is sent after
+	// it before the client speaks
+	resp, err := http.ReadResponse(bufio.NewReaderSize(conn, 1), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// SOCKS5 as of RFC 1928 and RFC 1929
+const (
+	socks5Version      = 5
+	socks5NoAuth       = 0
+	socks5PasswordAuth = 2
+	socks5NoAcceptable = 0xff
+	socks5Connect      = 1
+	socks5IPv4         = 1
+	socks5Domain       = 3
+	socks5IPv6         = 4
+)
+
+func (p *Proxy) socks5Connect(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+
+	method := byte(socks5NoAuth)
+	if p.Username != "" {
+		method = socks5PasswordAuth
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version || reply[1] == socks5NoAcceptable || reply[1] != method {
+		return errors.New("proxy refused the authentication method")
+	}
+	if method == socks5PasswordAuth {
+		if len(p.Username) > 255 || len(p.Password) > 255 {
+			return errors.New("proxy credentials are too long")
+		}
+		req := []byte{1, byte(len(p.Username))}
+		req = append(req, p.Username...)
+		req = append(req, byte(len(p.Password)))
+		req = append(req, p.Password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("proxy rejected the credentials")
+		}
+	}
+
+	req := []byte{socks5Version, socks5Connect, 0}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		req = append(req, socks5IPv4)
+		req = append(req, ip.To4()...)
+	} else if ip != nil {
+		req = append(req, socks5IPv6)
+		req = append(req, ip...)
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("host name %q is too long", host)
+		}
+		req = append(req, socks5Domain, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	if head[1] != 0 {
+		return fmt.Errorf("proxy failed to connect, code %d", head[1])
+	}
+	// skip the bound address
+	var n int
+	switch head[3] {
+	case socks5IPv4:
+		n = net.IPv4len
+	case socks5IPv6:
+		n = net.IPv6len
+	case socks5Domain:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return err
+		}
+		n = int(l[0])
+	default:
+		return fmt.Errorf("unknown address type %d in proxy reply", head[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, n+2))
+	return err
+}
+
+// Forwarder listens on local ports and forwards their connections to MDS
+// servers through a proxy, as vstorage tools can't use proxies themselves
+type Forwarder struct {
+	proxy     *Proxy
+	onError   func(error)
+	listeners []net.Listener
+	// local addresses, in the order of MDS addresses
+	local []string
+	once  sync.Once
+}
+
+// NewForwarder starts forwarding a port on the loopback interface to each
+// of the MDS addresses. Errors of forwarded connections are passed to
+// onError.
+func NewForwarder(proxy *Proxy, addrs []string, onError func(error)) (*Forwarder, error) {
+	f := &Forwarder{proxy: proxy, onError: onError}
+	for _, addr := range addrs {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		f.listeners = append(f.listeners, l)
+		f.local = append(f.local, l.Addr().String())
+		go f.serve(l, addr)
+	}
+	return f, nil
+}
+
+// Addresses returns local addresses to give vstorage tools instead of the
+// MDS addresses
+func (f *Forwarder) Addresses() []string {
+	return f.local
+}
+
+// Close stops forwarding, connections which are already forwarded are
+// left until either side closes them
+func (f *Forwarder) Close() {
+	f.once.Do(func() {
+		for _, l := range f.listeners {
+			l.Close()
+		}
+	})
+}
+
+func (f *Forwarder) serve(l net.Listener, addr string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go f.forward(conn, addr)
+	}
+}
+
+func (f *Forwarder) forward(conn net.Conn, addr string) {
+	defer conn.Close()
+	remote, err := f.proxy.Dial(addr)
+	if err != nil {
+		f.onError(err)
+		return
+	}
+	defer remote.Close()
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		if c, ok := dst.(*net.TCPConn); ok {
+			c.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go pipe(remote, conn)
+	go pipe(conn, remote)
+	<-done
+	<-done
+}
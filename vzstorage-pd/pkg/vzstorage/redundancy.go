@@ -0,0 +1,86 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vzstorage
+
+import "fmt"
+
+// UsableSpace returns how much data fits into free bytes of chunk servers
+// with the redundancy of vzsReplicas (norm[:min][/max]) or vzsEncoding
+// (M+N) parameters. Without both the default number of replicas is used.
+func UsableSpace(free uint64, replicas, encoding string, defaultReplicas int) (uint64, error) {
+	if encoding != "" {
+		e, err := ParseEncoding(encoding)
+		if err != nil {
+			return 0, err
+		}
+		return free / uint64(e.Data+e.Parity) * uint64(e.Data), nil
+	}
+
+	norm := defaultReplicas
+	if replicas != "" {
+		r, err := ParseReplicas(replicas)
+		if err != nil {
+			return 0, err
+		}
+		norm = r.Norm
+	}
+	if norm <= 0 {
+		norm = 1
+	}
+	return free / uint64(norm), nil
+}
+
+// CheckPlacement checks that the cluster has enough failure domains to
+// place the replicas, or the chunks of the encoding, of attributes in
+// distinct ones. hosts maps chunk servers to their hosts, as in
+// ClusterStat. Only the disk and host failure domains are checked, the
+// default one is host; the cluster statistics don't tell racks, rows and
+// rooms apart. Without known chunk servers nothing is checked.
+func CheckPlacement(a *Attributes, hosts map[string]string) error {
+	if a == nil || len(hosts) == 0 {
+		return nil
+	}
+	var need int
+	var what string
+	switch {
+	case a.Encoding != nil:
+		need, what = a.Encoding.Data+a.Encoding.Parity, "encoding "+a.Encoding.String()
+	case a.Replicas != nil:
+		need, what = a.Replicas.Norm, "replicas "+a.Replicas.String()
+	default:
+		return nil
+	}
+
+	var have int
+	var domain string
+	switch a.FailureDomain {
+	case "disk", "0":
+		have, domain = len(hosts), "chunk servers"
+	case "", "host", "1":
+		distinct := map[string]bool{}
+		for _, h := range hosts {
+			distinct[h] = true
+		}
+		have, domain = len(distinct), "hosts"
+	default:
+		return nil
+	}
+	if need > have {
+		return fmt.Errorf("%s need %d %s, the cluster has %d", what, need, domain, have)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vzstorage
+
+import (
+	"testing"
+)
+
+func TestUsableSpace(t *testing.T) {
+	tests := []struct {
+		replicas, encoding string
+		defaultReplicas    int
+		out                uint64
+		err                bool
+	}{
+		{"", "", 3, 100 << 20, false},
+		{"", "", 0, 300 << 20, false},
+		{"2", "", 3, 150 << 20, false},
+		{"3:2/5", "", 1, 100 << 20, false},
+		{"", "2+1", 3, 200 << 20, false},
+		{"3", "1+0", 3, 300 << 20, false},
+		{"x", "", 3, 0, true},
+		{"", "3", 3, 0, true},
+		{"", "0+2", 3, 0, true},
+	}
+	for _, test := range tests {
+		v, err := UsableSpace(300<<20, test.replicas, test.encoding, test.defaultReplicas)
+		if (err != nil) != test.err {
+			t.Errorf("%q %q: unexpected error state: %v", test.replicas, test.encoding, err)
+			continue
+		}
+		if v != test.out {
+			t.Errorf("%q %q: expected %d, got %d", test.replicas, test.encoding, test.out, v)
+		}
+	}
+}
+
+func TestCheckPlacement(t *testing.T) {
+	hosts := map[string]string{
+		"1025": "10.29.1.1",
+		"1026": "10.29.1.1",
+		"1027": "10.29.1.2",
+		"1028": "10.29.1.3",
+	}
+	tests := []struct {
+		attrs map[string]string
+		err   bool
+	}{
+		{map[string]string{}, false},
+		{map[string]string{ReplicasAttr: "3:2"}, false},
+		{map[string]string{ReplicasAttr: "4"}, true},
+		{map[string]string{ReplicasAttr: "4", FailureDomainAttr: "disk"}, false},
+		{map[string]string{ReplicasAttr: "5", FailureDomainAttr: "0"}, true},
+		{map[string]string{ReplicasAttr: "5", FailureDomainAttr: "rack"}, false},
+		{map[string]string{EncodingAttr: "2+1"}, false},
+		{map[string]string{EncodingAttr: "3+1"}, true},
+		{map[string]string{ReplicasAttr: "1", EncodingAttr: "3+2", FailureDomainAttr: "host"}, true},
+	}
+	for _, test := range tests {
+		a, err := ParseAttributes(test.attrs)
+		if err != nil {
+			t.Fatalf("%v: %v", test.attrs, err)
+		}
+		err = CheckPlacement(a, hosts)
+		if (err != nil) != test.err {
+			t.Errorf("%v: unexpected error state: %v", test.attrs, err)
+		}
+	}
+	a, _ := ParseAttributes(map[string]string{ReplicasAttr: "9"})
+	if err := CheckPlacement(a, nil); err != nil {
+		t.Errorf("unexpected error without chunk servers: %v", err)
+	}
+}
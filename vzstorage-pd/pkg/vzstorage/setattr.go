@@ -0,0 +1,112 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vzstorage
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// AttrQueue runs "vstorage set-attr -R" for a single cluster. Every call
+// goes to the MDS, so calls are made by a fixed number of workers at a
+// limited rate. A request identical to one still queued or running waits
+// for its result instead of being queued again; it is cancelled with the
+// context of the caller which queued it.
+type AttrQueue struct {
+	setAttr func(ctx context.Context, path, attr, value string) error
+	limiter flowcontrol.RateLimiter
+	queue   chan *attrRequest
+
+	mu      sync.Mutex
+	pending map[string]*attrRequest
+}
+
+type attrRequest struct {
+	ctx               context.Context
+	path, attr, value string
+	done              chan struct{}
+	err               error
+}
+
+// NewAttrQueue starts workers of a queue holding up to size requests.
+// SetAttr blocks while the queue is full.
+func NewAttrQueue(qps float32, workers, size int) *AttrQueue {
+	return newAttrQueue(setAttr, qps, workers, size)
+}
+
+func newAttrQueue(setAttr func(ctx context.Context, path, attr, value string) error, qps float32, workers, size int) *AttrQueue {
+	q := &AttrQueue{
+		setAttr: setAttr,
+		limiter: flowcontrol.NewTokenBucketRateLimiter(qps, workers),
+		queue:   make(chan *attrRequest, size),
+		pending: map[string]*attrRequest{},
+	}
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// SetAttr recursively sets the attribute of path and waits for the result
+// or for ctx to be done
+func (q *AttrQueue) SetAttr(ctx context.Context, path, attr, value string) error {
+	key := strings.Join([]string{path, attr, value}, "\x00")
+	q.mu.Lock()
+	r, ok := q.pending[key]
+	if !ok {
+		r = &attrRequest{ctx: ctx, path: path, attr: attr, value: value, done: make(chan struct{})}
+		q.pending[key] = r
+	}
+	q.mu.Unlock()
+
+	if !ok {
+		q.queue <- r
+	}
+	select {
+	case <-r.done:
+		return r.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *AttrQueue) work() {
+	for r := range q.queue {
+		q.limiter.Accept()
+		if r.err = r.ctx.Err(); r.err == nil {
+			r.err = q.setAttr(r.ctx, r.path, r.attr, r.value)
+		}
+
+		q.mu.Lock()
+		delete(q.pending, strings.Join([]string{r.path, r.attr, r.value}, "\x00"))
+		q.mu.Unlock()
+		close(r.done)
+	}
+}
+
+func setAttr(ctx context.Context, path, attr, value string) error {
+	out, err := exec.CommandContext(ctx, "vstorage", "set-attr", "-R", path, attr+"="+value).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Unable to set %s to %s for %s: %v: %s", attr, value, path, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
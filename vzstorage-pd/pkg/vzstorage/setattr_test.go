@@ -0,0 +1,143 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vzstorage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAttrQueueCoalesces(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	calls := map[string]int{}
+	q := newAttrQueue(func(ctx context.Context, path, attr, value string) error {
+		mu.Lock()
+		calls[path+" "+attr+"="+value]++
+		mu.Unlock()
+		<-release
+		if value == "bad" {
+			return errors.New("failed")
+		}
+		return nil
+	}, 1000, 1, 10)
+
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i, value := range []string{"3", "3", "3", "bad"} {
+		wg.Add(1)
+		go func(i int, value string) {
+			defer wg.Done()
+			errs[i] = q.SetAttr(context.Background(), "/vstorage/stor1/dir", "replicas", value)
+		}(i, value)
+	}
+	// let all requests get queued before the first one completes
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls["/vstorage/stor1/dir replicas=3"] != 1 || calls["/vstorage/stor1/dir replicas=bad"] != 1 {
+		t.Errorf("unexpected calls %v", calls)
+	}
+	for i := 0; i < 3; i++ {
+		if errs[i] != nil {
+			t.Errorf("request %d failed: %v", i, errs[i])
+		}
+	}
+	if errs[3] == nil {
+		t.Errorf("expected the failure of request 3")
+	}
+
+	// a completed request is not coalesced with later ones
+	if err := q.SetAttr(context.Background(), "/vstorage/stor1/dir", "replicas", "3"); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if calls["/vstorage/stor1/dir replicas=3"] != 2 {
+		t.Errorf("expected a repeated call, got %v", calls)
+	}
+}
+
+func TestAttrQueueWorkers(t *testing.T) {
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	q := newAttrQueue(func(ctx context.Context, path, attr, value string) error {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	}, 1000, 2, 1)
+
+	var wg sync.WaitGroup
+	for _, path := range []string{"a", "b", "c", "d", "e", "f"} {
+		wg.Add(1)
+		go func(path string) {
+			defer wg.Done()
+			q.SetAttr(context.Background(), path, "tier", "1")
+		}(path)
+	}
+	wg.Wait()
+
+	if maxRunning != 2 {
+		t.Errorf("expected 2 concurrent calls, got %d", maxRunning)
+	}
+}
+
+func TestAttrQueueCancel(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	var mu sync.Mutex
+	calls := 0
+	q := newAttrQueue(func(ctx context.Context, path, attr, value string) error {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		return ctx.Err()
+	}, 1000, 1, 10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := q.SetAttr(ctx, "a", "tier", "1"); err != context.DeadlineExceeded {
+		t.Errorf("expected the deadline to be exceeded, got %v", err)
+	}
+
+	// a request cancelled while queued is not run
+	done, cancelDone := context.WithCancel(context.Background())
+	cancelDone()
+	if err := q.SetAttr(done, "b", "tier", "1"); err != context.Canceled {
+		t.Errorf("expected cancellation, got %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 1 {
+		t.Errorf("expected 1 call, got %d", calls)
+	}
+}
@@ -0,0 +1,264 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package vzstorage contains helpers to query and configure Virtuozzo
+// Storage clusters, complementing the vstorage package of ploop-flexvol.
+package vzstorage
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TierStat is the space of chunk servers of a single tier
+type TierStat struct {
+	Tier  string
+	Total uint64
+	Free  uint64
+}
+
+// Used returns the amount of used space in the tier
+func (t *TierStat) Used() uint64 {
+	if t.Free > t.Total {
+		return 0
+	}
+	return t.Total - t.Free
+}
+
+// ClusterStat is a summary of the cluster space usage
+type ClusterStat struct {
+	// Tiers maps a tier name to its space usage
+	Tiers map[string]*TierStat
+	// LicensedCapacity is 0 if the license has no capacity limit
+	LicensedCapacity uint64
+	// Replicas is the default normal number of replicas, 0 if unknown
+	Replicas int
+	// Hosts maps a chunk server ID to the address of its host
+	Hosts map[string]string
+	// ClientLatency maps the address of a host mounting the cluster to
+	// the highest average IO latency of its clients, in milliseconds
+	ClientLatency map[string]float64
+}
+
+// Stat runs "vstorage stat" for the cluster and parses its output
+func Stat(ctx context.Context, cluster string) (*ClusterStat, error) {
+	out, err := exec.CommandContext(ctx, "vstorage", "-c", cluster, "stat").Output()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get statistics of %s: %v", cluster, err)
+	}
+	return ParseStat(string(out))
+}
+
+// statTimeout limits a vstorage stat run by StatCache
+const statTimeout = 2 * time.Minute
+
+// StatCache shares results of Stat between its callers for a while, and
+// runs a single vstorage stat per cluster at a time, so that pollers of
+// the same clusters don't fork one each. Failures aren't cached. Results
+// are shared and must not be modified.
+type StatCache struct {
+	ttl     time.Duration
+	stat    func(ctx context.Context, cluster string) (*ClusterStat, error)
+	mutex   sync.Mutex
+	entries map[string]*statEntry
+}
+
+type statEntry struct {
+	// done is closed once st and err are set
+	done chan struct{}
+	st   *ClusterStat
+	err  error
+	at   time.Time
+}
+
+// NewStatCache returns a cache keeping results of Stat for ttl
+func NewStatCache(ttl time.Duration) *StatCache {
+	return &StatCache{ttl: ttl, stat: Stat, entries: map[string]*statEntry{}}
+}
+
+// Stat returns the statistics of the cluster, running vstorage stat unless
+// it is running already or ran less than ttl ago
+func (c *StatCache) Stat(ctx context.Context, cluster string) (*ClusterStat, error) {
+	c.mutex.Lock()
+	e, ok := c.entries[cluster]
+	if ok {
+		select {
+		case <-e.done:
+			if time.Since(e.at) >= c.ttl {
+				ok = false
+			}
+		default:
+		}
+	}
+	if !ok {
+		e = &statEntry{done: make(chan struct{})}
+		c.entries[cluster] = e
+		go func() {
+			// the result is shared, so it isn't bound to the caller, and
+			// a hung run is not to hold up callers forever
+			ctx, cancel := context.WithTimeout(context.Background(), statTimeout)
+			e.st, e.err = c.stat(ctx, cluster)
+			cancel()
+			e.at = time.Now()
+			if e.err != nil {
+				c.mutex.Lock()
+				if c.entries[cluster] == e {
+					delete(c.entries, cluster)
+				}
+				c.mutex.Unlock()
+			}
+			close(e.done)
+		}()
+	}
+	c.mutex.Unlock()
+
+	select {
+	case <-e.done:
+		return e.st, e.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+var (
+	reLicenseCapacity = regexp.MustCompile(`(?m)^License:.*capacity:\s*([0-9.]+\s*[KMGTPE]?B)`)
+	reReplication     = regexp.MustCompile(`(?m)^Replication:\s*([0-9]+)\s+norm`)
+)
+
+// ParseStat parses the output of "vstorage stat". Space of chunk servers
+// is summed up per tier; servers are accounted in tier 0 if the output
+// has no TIER column.
+func ParseStat(out string) (*ClusterStat, error) {
+	st := &ClusterStat{
+		Tiers:         map[string]*TierStat{},
+		Hosts:         map[string]string{},
+		ClientLatency: map[string]float64{},
+	}
+
+	if m := reLicenseCapacity.FindStringSubmatch(out); m != nil {
+		c, err := ParseSize(m[1])
+		if err != nil {
+			return nil, err
+		}
+		st.LicensedCapacity = c
+	}
+	if m := reReplication.FindStringSubmatch(out); m != nil {
+		st.Replicas, _ = strconv.Atoi(m[1])
+	}
+
+	var columns map[string]int
+	clients := false
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			columns = nil
+			continue
+		}
+		if fields[0] == "CSID" || fields[0] == "CLID" {
+			columns = map[string]int{}
+			for i, f := range fields {
+				columns[f] = i
+			}
+			clients = fields[0] == "CLID"
+			continue
+		}
+		if columns == nil {
+			continue
+		}
+		if clients {
+			parseClient(st, columns, fields)
+			continue
+		}
+
+		spaceIdx, ok1 := columns["SPACE"]
+		availIdx, ok2 := columns["AVAIL"]
+		if !ok1 || !ok2 || spaceIdx >= len(fields) || availIdx >= len(fields) {
+			return nil, fmt.Errorf("Unable to parse chunk server line %q", line)
+		}
+		total, err := ParseSize(fields[spaceIdx])
+		if err != nil {
+			return nil, err
+		}
+		free, err := ParseSize(fields[availIdx])
+		if err != nil {
+			return nil, err
+		}
+
+		if i, ok := columns["HOST"]; ok && i < len(fields) {
+			st.Hosts[fields[0]] = fields[i]
+		}
+
+		tier := "0"
+		if i, ok := columns["TIER"]; ok && i < len(fields) {
+			tier = fields[i]
+		}
+		t, ok := st.Tiers[tier]
+		if !ok {
+			t = &TierStat{Tier: tier}
+			st.Tiers[tier] = t
+		}
+		t.Total += total
+		t.Free += free
+	}
+
+	return st, nil
+}
+
+// parseClient accounts IO latency of a client line, which is printed as
+// average/maximum. Lines which can't be parsed are skipped, as latency is
+// only advisory.
+func parseClient(st *ClusterStat, columns map[string]int, fields []string) {
+	latIdx, ok1 := columns["IOLAT(ms)"]
+	hostIdx, ok2 := columns["HOST"]
+	if !ok1 || !ok2 || latIdx >= len(fields) || hostIdx >= len(fields) {
+		return
+	}
+	avg := strings.SplitN(fields[latIdx], "/", 2)[0]
+	lat, err := strconv.ParseFloat(avg, 64)
+	if err != nil {
+		return
+	}
+	host := fields[hostIdx]
+	if cur, ok := st.ClientLatency[host]; !ok || lat > cur {
+		st.ClientLatency[host] = lat
+	}
+}
+
+var reSize = regexp.MustCompile(`^([0-9.]+)\s*([KMGTPE]?)B$`)
+
+// ParseSize parses sizes as printed by vstorage tools, like "11.8GB".
+// vstorage uses binary multiples, so 1KB is 1024 bytes.
+func ParseSize(s string) (uint64, error) {
+	m := reSize.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0, fmt.Errorf("Unable to parse size %q", s)
+	}
+	v, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to parse size %q: %v", s, err)
+	}
+	shift := uint(strings.Index("KMGTPE", m[2])+1) * 10
+	if m[2] == "" {
+		shift = 0
+	}
+	return uint64(v * float64(uint64(1)<<shift)), nil
+}
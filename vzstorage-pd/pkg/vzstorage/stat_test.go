@@ -0,0 +1,177 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vzstorage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+const statOutput = `connected to MDS#1
+Cluster 'stor1': healthy
+Space: [OK] allocatable 28GB of 35GB, free 31GB of 35GB
+MDS nodes: 3 of 3, epoch uptime: 10d 19h
+CS nodes:  3 of 3 (3 avail, 0 inactive, 0 offline)
+License: ACTIVE (capacity: 100TB, used: 15GB)
+Replication:  1 norm,  1 limit
+
+CSID STATUS      SPACE   AVAIL REPLICAS   UNIQUE IOWAIT IOLAT(ms) QDEPTH HOST       TIER
+1025 active     10GB    4GB        141        0    0%       0/0    0.0 10.29.1.1  0
+1026 active     10GB    6GB        141        0    0%       0/0    0.0 10.29.1.2  0
+1027 active     15GB    12.5GB     120        0    0%       0/0    0.0 10.29.1.3  2
+
+CLID   LEASES     READ    WRITE     RD_OPS     WR_OPS     FSYNCS IOLAT(ms) HOST
+2090     0/0     0B/s     0B/s     0ops/s     0ops/s    0ops/s       0/0 10.29.1.1
+2091     0/0     0B/s     0B/s     0ops/s     0ops/s    0ops/s     12/80 10.29.1.2
+2092     0/0     0B/s     0B/s     0ops/s     0ops/s    0ops/s     35/90 10.29.1.2
+`
+
+func TestParseStat(t *testing.T) {
+	st, err := ParseStat(statOutput)
+	if err != nil {
+		t.Fatalf("ParseStat failed: %v", err)
+	}
+	if st.LicensedCapacity != 100<<40 {
+		t.Errorf("Expected licensed capacity %d, got %d", uint64(100<<40), st.LicensedCapacity)
+	}
+	if st.Replicas != 1 {
+		t.Errorf("Expected 1 replica by default, got %d", st.Replicas)
+	}
+	if len(st.Tiers) != 2 {
+		t.Fatalf("Expected 2 tiers, got %d", len(st.Tiers))
+	}
+	t0 := st.Tiers["0"]
+	if t0.Total != 20<<30 || t0.Free != 10<<30 || t0.Used() != 10<<30 {
+		t.Errorf("Unexpected tier 0 stats: %+v", t0)
+	}
+	if h := st.Hosts["1026"]; h != "10.29.1.2" || len(st.Hosts) != 3 {
+		t.Errorf("Unexpected chunk server hosts: %v", st.Hosts)
+	}
+	if l, ok := st.ClientLatency["10.29.1.1"]; !ok || l != 0 {
+		t.Errorf("Expected latency 0 of 10.29.1.1, got %v", st.ClientLatency)
+	}
+	if l := st.ClientLatency["10.29.1.2"]; l != 35 || len(st.ClientLatency) != 2 {
+		t.Errorf("Expected latency 35 of 10.29.1.2, got %v", st.ClientLatency)
+	}
+	t2 := st.Tiers["2"]
+	if t2.Total != 15<<30 || t2.Free != 12<<30+512<<20 {
+		t.Errorf("Unexpected tier 2 stats: %+v", t2)
+	}
+}
+
+func TestParseStatNoTier(t *testing.T) {
+	out := "CSID STATUS SPACE AVAIL\n1025 active 1GB 512MB\n"
+	st, err := ParseStat(out)
+	if err != nil {
+		t.Fatalf("ParseStat failed: %v", err)
+	}
+	if t0, ok := st.Tiers["0"]; !ok || t0.Total != 1<<30 || t0.Free != 512<<20 {
+		t.Errorf("Unexpected stats: %+v", st.Tiers)
+	}
+	if st.LicensedCapacity != 0 {
+		t.Errorf("Expected no licensed capacity, got %d", st.LicensedCapacity)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in  string
+		out uint64
+		err bool
+	}{
+		{"0B", 0, false},
+		{"512B", 512, false},
+		{"1KB", 1024, false},
+		{"1.5GB", 3 << 29, false},
+		{"2TB", 2 << 40, false},
+		{"12", 0, true},
+		{"1XB", 0, true},
+	}
+	for _, test := range tests {
+		v, err := ParseSize(test.in)
+		if (err != nil) != test.err {
+			t.Errorf("%s: unexpected error state: %v", test.in, err)
+			continue
+		}
+		if v != test.out {
+			t.Errorf("%s: expected %d, got %d", test.in, test.out, v)
+		}
+	}
+}
+
+func TestStatCache(t *testing.T) {
+	var mutex sync.Mutex
+	runs := 0
+	release := make(chan struct{})
+	fail := false
+	c := NewStatCache(time.Hour)
+	c.stat = func(ctx context.Context, cluster string) (*ClusterStat, error) {
+		<-release
+		mutex.Lock()
+		defer mutex.Unlock()
+		runs++
+		if fail {
+			return nil, errors.New("stat failed")
+		}
+		return &ClusterStat{Replicas: runs}, nil
+	}
+
+	// concurrent callers share a single run
+	results := make(chan *ClusterStat, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			st, err := c.Stat(context.Background(), "stor1")
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			results <- st
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	for i := 0; i < 3; i++ {
+		if st := <-results; st == nil || st.Replicas != 1 {
+			t.Errorf("Expected the result of the first run, got %+v", st)
+		}
+	}
+
+	// results are reused within ttl, other clusters run on their own
+	if st, _ := c.Stat(context.Background(), "stor1"); st.Replicas != 1 {
+		t.Errorf("Expected a cached result, got %+v", st)
+	}
+	if st, _ := c.Stat(context.Background(), "stor2"); st.Replicas != 2 {
+		t.Errorf("Expected a run for another cluster, got %+v", st)
+	}
+
+	// failures aren't cached
+	mutex.Lock()
+	fail = true
+	mutex.Unlock()
+	c.ttl = 0
+	if _, err := c.Stat(context.Background(), "stor1"); err == nil {
+		t.Errorf("Expected an error")
+	}
+	mutex.Lock()
+	fail = false
+	mutex.Unlock()
+	if st, err := c.Stat(context.Background(), "stor1"); err != nil || st.Replicas != 4 {
+		t.Errorf("Expected a new run after a failure, got %+v, %v", st, err)
+	}
+}
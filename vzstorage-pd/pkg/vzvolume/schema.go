@@ -0,0 +1,223 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vzvolume
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzstorage"
+)
+
+// optionSpec describes an option of volumes in their JSON schema
+type optionSpec struct {
+	description string
+	required    bool
+	pattern     string
+	enum        []string
+	// check validates what a pattern can't express
+	check func(v string) error
+}
+
+const relativePath = `^[^/]`
+
+// optionSpecs are the options of volumes understood by the provisioner
+// and ploop-flexvol. Others, like StorageClass parameters unknown to the
+// provisioner, are passed through as they are.
+var optionSpecs = map[string]optionSpec{
+	"volumePath": {
+		description: "Directory of volume directories, relative to the cluster root",
+		required:    true, pattern: relativePath, check: checkRelativePath,
+	},
+	VolumeIDOption: {
+		description: "Name of the volume directory in volumePath",
+		required:    true, pattern: `^[^/]+$`,
+	},
+	SizeOption: {
+		description: "Size of the image, a quantity like 10737418240, 1.5Gi or 10G",
+		required:    true, pattern: `^[0-9]+(\.[0-9]+)?(Ki|Mi|Gi|Ti|Pi|Ei|k|M|G|T|P|E)?$`,
+		check: func(v string) error { _, err := SizeKB(v); return err },
+	},
+	"deltasPath": {
+		description: "Directory of image directories of volumes without imagePath, relative to the cluster root",
+		pattern:     relativePath, check: checkRelativePath,
+	},
+	ImagePathOption: {
+		description: "Image directory, relative to the cluster root",
+		pattern:     relativePath, check: checkRelativePath,
+	},
+	SnapshotsPathOption: {
+		description: "Directory snapshots are made in, relative to the cluster root",
+		pattern:     relativePath, check: checkRelativePath,
+	},
+	BlockSizeOption: {
+		description: "Cluster block size of the image, a power of two from 32K to 16M",
+		pattern:     `^[0-9]+[KkMm]([Ii]?[Bb])?$`,
+		check:       func(v string) error { _, err := ParseBlockSize(v); return err },
+	},
+	AllocationOption: {
+		description: "Whether the image grows as it is written or takes its whole size on creation",
+		enum:        []string{"thin", Preallocated},
+	},
+	SecureDeleteOption: {
+		description: "How to wipe the image before it is removed",
+		enum:        []string{WipeNone, WipeShred, WipeDiscard},
+	},
+	"vzsReplicas": {
+		description: "vstorage replicas attribute, norm[:min][/max]",
+		pattern:     `^[0-9]+(:[0-9]+)?(/[0-9]+)?$`,
+		check:       func(v string) error { _, err := vzstorage.ParseReplicas(v); return err },
+	},
+	"vzsEncoding": {
+		description: "vstorage erasure coding attribute, M+N[/stripe]",
+		pattern:     `^[0-9]+\+[0-9]+(/[0-9]+)?$`,
+		check:       func(v string) error { _, err := vzstorage.ParseEncoding(v); return err },
+	},
+	"vzsFailureDomain": {
+		description: "vstorage failure domain attribute",
+		pattern:     `^(disk|host|rack|row|room|[0-4])$`,
+	},
+	"vzsTier": {
+		description: "vstorage tier attribute",
+		pattern:     `^[0-3]$`,
+	},
+	"clusterName": {
+		description: "Name of the cluster of the volume",
+	},
+	"secretName": {
+		description: "Secret of the cluster in kube-system, with optionsFromSystem",
+	},
+	"optionsFromSystem": {
+		description: "Whether the secret of the cluster is in kube-system",
+		enum:        []string{"true", "false"},
+	},
+	"finalizer": {
+		description: "Finalizer of the volume on the secret of its cluster",
+	},
+	"kubernetes.io/fsType": {
+		description: "Filesystem of the volume, set by kubelet",
+	},
+	"kubernetes.io/readwrite": {
+		description: "Access mode of the mount, set by kubelet",
+		enum:        []string{"ro", "rw"},
+	},
+}
+
+func checkRelativePath(v string) error {
+	for _, c := range strings.Split(v, "/") {
+		if c == ".." {
+			return fmt.Errorf("may not contain ..")
+		}
+	}
+	return nil
+}
+
+// Schema returns the JSON schema of volume options. Options not described
+// by it are allowed and have to be strings, like all options.
+func Schema() ([]byte, error) {
+	properties := map[string]interface{}{}
+	var required []string
+	for name, o := range optionSpecs {
+		p := map[string]interface{}{
+			"type":        "string",
+			"description": o.description,
+		}
+		if o.pattern != "" {
+			p["pattern"] = o.pattern
+		}
+		if o.enum != nil {
+			p["enum"] = o.enum
+		}
+		properties[name] = p
+		if o.required {
+			required = append(required, name)
+		}
+	}
+	sort.Strings(required)
+	return json.MarshalIndent(map[string]interface{}{
+		"$schema":              "http://json-schema.org/draft-07/schema#",
+		"title":                "Options of Virtuozzo ploop volumes",
+		"type":                 "object",
+		"required":             required,
+		"properties":           properties,
+		"additionalProperties": map[string]string{"type": "string"},
+	}, "", "  ")
+}
+
+var optionPatterns = map[string]*regexp.Regexp{}
+
+func init() {
+	for name, o := range optionSpecs {
+		if o.pattern != "" {
+			optionPatterns[name] = regexp.MustCompile(o.pattern)
+		}
+	}
+}
+
+// ValidateOptions checks options against their schema. The error lists
+// every invalid option by its path, e.g. options.vzsTier.
+func ValidateOptions(options map[string]string) error {
+	var errs []string
+	for _, name := range sortedOptions() {
+		o := optionSpecs[name]
+		v, ok := options[name]
+		if !ok {
+			if o.required {
+				errs = append(errs, fmt.Sprintf("options.%s: is required", name))
+			}
+			continue
+		}
+		if err := validateOption(name, o, v); err != nil {
+			errs = append(errs, fmt.Sprintf("options.%s: %v", name, err))
+		}
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("invalid volume options: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func validateOption(name string, o optionSpec, v string) error {
+	if re := optionPatterns[name]; re != nil && !re.MatchString(v) {
+		return fmt.Errorf("%q doesn't match %s", v, o.pattern)
+	}
+	if o.enum != nil {
+		found := false
+		for _, e := range o.enum {
+			found = found || e == v
+		}
+		if !found {
+			return fmt.Errorf("%q is not one of %s", v, strings.Join(o.enum, ", "))
+		}
+	}
+	if o.check != nil {
+		return o.check(v)
+	}
+	return nil
+}
+
+func sortedOptions() []string {
+	names := make([]string, 0, len(optionSpecs))
+	for name := range optionSpecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
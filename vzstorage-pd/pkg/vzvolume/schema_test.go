@@ -0,0 +1,81 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vzvolume
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestValidateOptions(t *testing.T) {
+	valid := map[string]string{
+		"volumePath":       "k8s-volumes",
+		"volumeID":         "kubernetes-dynamic-pvc-1",
+		"size":             "1.5Gi",
+		"vzsReplicas":      "3:2",
+		"vzsTier":          "1",
+		"vzsFailureDomain": "host",
+		"ploopBlockSize":   "256K",
+		"ploopAllocation":  "thin",
+		"someParameter":    "passed through",
+	}
+	if err := ValidateOptions(valid); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	for _, c := range []struct {
+		options map[string]string
+		path    string
+	}{
+		{map[string]string{"volumePath": "v", "volumeID": "pvc-1"}, "options.size: is required"},
+		{map[string]string{"volumePath": "/v", "volumeID": "pvc-1", "size": "1Gi"}, "options.volumePath"},
+		{map[string]string{"volumePath": "v/../w", "volumeID": "pvc-1", "size": "1Gi"}, "options.volumePath"},
+		{map[string]string{"volumePath": "v", "volumeID": "pvc-1", "size": "1Gi", "vzsTier": "5"}, "options.vzsTier"},
+		{map[string]string{"volumePath": "v", "volumeID": "pvc-1", "size": "1Gi", "ploopBlockSize": "3M"}, "options.ploopBlockSize"},
+		{map[string]string{"volumePath": "v", "volumeID": "pvc-1", "size": "-1Gi"}, "options.size"},
+		{map[string]string{"volumePath": "v", "volumeID": "pvc-1", "size": "1Gi", "ploopAllocation": "sparse"}, "options.ploopAllocation"},
+		{map[string]string{"volumePath": "v", "volumeID": "pvc-1", "size": "1Gi", "vzsReplicas": "2:3"}, "options.vzsReplicas"},
+		{map[string]string{"volumePath": "v", "volumeID": "pvc-1", "size": "1Gi", "vzsReplicas": "3/2"}, "options.vzsReplicas"},
+		{map[string]string{"volumePath": "v", "volumeID": "pvc-1", "size": "1Gi", "vzsEncoding": "0+2"}, "options.vzsEncoding"},
+	} {
+		err := ValidateOptions(c.options)
+		if err == nil || !strings.Contains(err.Error(), c.path) {
+			t.Errorf("%v: expected an error at %s, got %v", c.options, c.path, err)
+		}
+	}
+}
+
+func TestSchema(t *testing.T) {
+	data, err := Schema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema struct {
+		Required   []string                          `json:"required"`
+		Properties map[string]map[string]interface{} `json:"properties"`
+	}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		t.Fatalf("invalid schema: %v", err)
+	}
+	if strings.Join(schema.Required, ",") != "size,volumeID,volumePath" {
+		t.Errorf("unexpected required options %v", schema.Required)
+	}
+	if schema.Properties["vzsTier"]["pattern"] != "^[0-3]$" {
+		t.Errorf("unexpected vzsTier %v", schema.Properties["vzsTier"])
+	}
+}
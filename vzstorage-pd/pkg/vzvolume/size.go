@@ -0,0 +1,58 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vzvolume
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/virtuozzo/goploop-cli"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// SizeKB parses the size option of a volume, a quantity like 1073741824,
+// 1.5Gi or 10G, and returns it in the kilobytes ploop takes. Sizes are
+// rounded up, so that an image is never smaller than requested.
+func SizeKB(size string) (uint64, error) {
+	q, err := resource.ParseQuantity(size)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid size %q: %v", size, err)
+	}
+	// Value rounds fractions of a byte up
+	bytes := q.Value()
+	if bytes <= 0 {
+		return 0, fmt.Errorf("Invalid size %q: it has to be positive", size)
+	}
+	return (uint64(bytes) + 1023) / 1024, nil
+}
+
+// ImageSize returns the size of the image of the volume in bytes, which
+// is the requested size rounded up to the cluster block of the image
+func ImageSize(mount string, options map[string]string) (int64, error) {
+	ploopPath, _ := Paths(mount, options)
+	d, err := ploop.Open(path.Join(ploopPath, "DiskDescriptor.xml"))
+	if err != nil {
+		return 0, err
+	}
+	defer d.Close()
+	info, err := d.ImageInfo()
+	if err != nil {
+		return 0, err
+	}
+	// sizes are in 512-byte sectors
+	return int64(info.Blocks) * 512, nil
+}
@@ -0,0 +1,45 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vzvolume
+
+import (
+	"testing"
+)
+
+func TestSizeKB(t *testing.T) {
+	for size, expected := range map[string]uint64{
+		"1073741824": 1048576,
+		"1Gi":        1048576,
+		"1.5Gi":      1572864,
+		"10G":        9765625,
+		// 976562.5 kilobytes
+		"999999999": 976563,
+		"1k":        1,
+		"1":         1,
+		"0.5":       1,
+	} {
+		kb, err := SizeKB(size)
+		if err != nil || kb != expected {
+			t.Errorf("%s: expected %d, got %d, %v", size, expected, kb, err)
+		}
+	}
+	for _, size := range []string{"", "0", "-1Gi", "lots", "1.5GiB"} {
+		if _, err := SizeKB(size); err == nil {
+			t.Errorf("%s: expected an error", size)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vzvolume
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/virtuozzo/goploop-cli"
+)
+
+// ImageUsage tells how much of the space an image takes on the cluster
+// its filesystem actually uses
+type ImageUsage struct {
+	// Allocated is the space taken by all deltas of the image
+	Allocated uint64
+	// Used is the space used by the filesystem in the image, as of the
+	// last time ploop recorded it
+	Used uint64
+	// Deltas is the number of deltas the image consists of, every
+	// snapshot adds one which reads have to go through
+	Deltas int
+}
+
+// Reclaimable returns the space compaction would return to the cluster
+func (u *ImageUsage) Reclaimable() uint64 {
+	if u.Allocated < u.Used {
+		return 0
+	}
+	return u.Allocated - u.Used
+}
+
+// Usage returns usage of the image of the volume. The image doesn't have
+// to be mounted, the filesystem usage is the one ploop recorded when it
+// was last unmounted or resized.
+func Usage(mount string, options map[string]string) (*ImageUsage, error) {
+	ploopPath, imageDir := Paths(mount, options)
+	u, err := deltasUsage(imageDir)
+	if err != nil {
+		return nil, err
+	}
+	info, err := ploop.FSInfo(path.Join(ploopPath, "DiskDescriptor.xml"))
+	if err != nil {
+		return nil, err
+	}
+	u.Used = (info.Blocks - info.BlocksFree) * info.BlockSize
+	return u, nil
+}
+
+// deltasUsage sums space allocated by the deltas in imageDir
+func deltasUsage(imageDir string) (*ImageUsage, error) {
+	files, err := ioutil.ReadDir(imageDir)
+	if err != nil {
+		return nil, err
+	}
+	u := &ImageUsage{}
+	for _, f := range files {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		u.Deltas++
+		if st, ok := f.Sys().(*syscall.Stat_t); ok {
+			u.Allocated += uint64(st.Blocks) * 512
+		}
+	}
+	return u, nil
+}
+
+// Allocated returns the space taken on the cluster by all deltas of the
+// image of the volume
+func Allocated(mount string, options map[string]string) (uint64, error) {
+	_, imageDir := Paths(mount, options)
+	u, err := deltasUsage(imageDir)
+	if err != nil {
+		return 0, err
+	}
+	return u.Allocated, nil
+}
+
+// descriptor is the part of DiskDescriptor.xml telling which delta is the
+// top one
+type descriptor struct {
+	Images []struct {
+		GUID string `xml:"GUID"`
+		File string `xml:"File"`
+	} `xml:"StorageData>Storage>Image"`
+	TopGUID string `xml:"Snapshots>TopGUID"`
+}
+
+// MergeSize returns the space taken by the top delta of the snapshot, which
+// deleting the snapshot merges into the delta above it
+func MergeSize(snapshotPath string) (uint64, error) {
+	data, err := ioutil.ReadFile(path.Join(snapshotPath, "DiskDescriptor.xml"))
+	if err != nil {
+		return 0, err
+	}
+	var dd descriptor
+	if err := xml.Unmarshal(data, &dd); err != nil {
+		return 0, err
+	}
+	for _, image := range dd.Images {
+		if image.GUID != dd.TopGUID {
+			continue
+		}
+		file := image.File
+		if !path.IsAbs(file) {
+			file = path.Join(snapshotPath, file)
+		}
+		fi, err := os.Stat(file)
+		if err != nil {
+			return 0, err
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			return uint64(st.Blocks) * 512, nil
+		}
+		return uint64(fi.Size()), nil
+	}
+	return 0, fmt.Errorf("%s has no top delta", snapshotPath)
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vzvolume
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestDeltasUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(path.Join(dir, "root.hds"), make([]byte, 1<<20), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// a sparse delta takes no space
+	f, err := os.Create(path.Join(dir, "root.hds.{5fbaabe3-6958-40ff-92a7-860e329aab41}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(1 << 30); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := os.Mkdir(path.Join(dir, "subdir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := deltasUsage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Deltas != 2 {
+		t.Errorf("expected 2 deltas, got %d", u.Deltas)
+	}
+	if u.Allocated < 1<<20 || u.Allocated >= 1<<30 {
+		t.Errorf("expected about 1M allocated, got %d", u.Allocated)
+	}
+
+	if _, err := deltasUsage(path.Join(dir, "missing")); err == nil {
+		t.Errorf("expected an error for a missing directory")
+	}
+}
+
+func TestReclaimable(t *testing.T) {
+	for _, test := range []struct {
+		allocated, used, expected uint64
+	}{
+		{10 << 30, 4 << 30, 6 << 30},
+		{4 << 30, 4 << 30, 0},
+		// filesystem usage recorded before the image was compacted
+		{2 << 30, 4 << 30, 0},
+	} {
+		u := &ImageUsage{Allocated: test.allocated, Used: test.used}
+		if got := u.Reclaimable(); got != test.expected {
+			t.Errorf("%d allocated, %d used: expected %d reclaimable, got %d", test.allocated, test.used, test.expected, got)
+		}
+	}
+}
+
+func TestMergeSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "merge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapshot := path.Join(dir, "vol.snap")
+	if err := os.MkdirAll(snapshot, 0700); err != nil {
+		t.Fatal(err)
+	}
+	// the base delta is in the snapshot, the top one next to it
+	if err := ioutil.WriteFile(path.Join(snapshot, "root.hds"), make([]byte, 4<<20), 0600); err != nil {
+		t.Fatal(err)
+	}
+	top := path.Join(dir, "root.hds.{5fbaabe3-6958-40ff-92a7-860e329aab41}")
+	if err := ioutil.WriteFile(top, make([]byte, 1<<20), 0600); err != nil {
+		t.Fatal(err)
+	}
+	dd := `<?xml version="1.0"?>
+<Ploop>
+  <StorageData>
+    <Storage>
+      <Image>
+        <GUID>{00000000-0000-0000-0000-000000000000}</GUID>
+        <File>root.hds</File>
+      </Image>
+      <Image>
+        <GUID>{5fbaabe3-6958-40ff-92a7-860e329aab41}</GUID>
+        <File>` + top + `</File>
+      </Image>
+    </Storage>
+  </StorageData>
+  <Snapshots>
+    <TopGUID>{5fbaabe3-6958-40ff-92a7-860e329aab41}</TopGUID>
+  </Snapshots>
+</Ploop>
+`
+	if err := ioutil.WriteFile(path.Join(snapshot, "DiskDescriptor.xml"), []byte(dd), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := MergeSize(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size < 1<<20 || size >= 4<<20 {
+		t.Errorf("expected about 1M of the top delta, got %d", size)
+	}
+
+	if _, err := MergeSize(path.Join(dir, "missing")); err == nil {
+		t.Errorf("expected an error for a missing snapshot")
+	}
+}
@@ -0,0 +1,346 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package vzvolume manages ploop volumes of the provisioner on a mounted
+// Virtuozzo Storage cluster. Volumes are described by the options of their
+// PVs, so tools can create, delete, resize and snapshot volumes the same
+// way the provisioner does without depending on it or on Kubernetes.
+package vzvolume
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzstorage"
+	"github.com/virtuozzo/goploop-cli"
+)
+
+// Driver is the flexvolume driver attaching volumes on nodes
+const Driver = "virtuozzo/ploop"
+
+// Options of volumes besides the StorageClass parameters they were
+// created with
+const (
+	// VolumeIDOption is the name of the volume directory
+	VolumeIDOption = "volumeID"
+	// SizeOption is the size of the image, a quantity like 10Gi
+	SizeOption = "size"
+	// ImagePathOption is the image directory relative to the cluster root.
+	// Volumes without it keep images in deltasPath/volumeID.image.
+	ImagePathOption = "imagePath"
+	// SnapshotsPathOption is the directory snapshots are made in. Volumes
+	// without it make snapshots in volumePath.
+	SnapshotsPathOption = "snapshotsPath"
+	// AllocationOption is "preallocated" for images taking their whole
+	// size on creation, which are thin otherwise
+	AllocationOption = "ploopAllocation"
+	// BlockSizeOption is the cluster block size of the image, e.g. 256K
+	BlockSizeOption = "ploopBlockSize"
+	// SecureDeleteOption tells how to wipe the image before it is removed,
+	// see WipeImage
+	SecureDeleteOption = "secureDelete"
+)
+
+// Preallocated is the AllocationOption of preallocated images
+const Preallocated = "preallocated"
+
+// vstorage attributes set on volume directories by their options
+var attrOptions = map[string]string{
+	"vzsReplicas":      vzstorage.ReplicasAttr,
+	"vzsTier":          vzstorage.TierAttr,
+	"vzsEncoding":      vzstorage.EncodingAttr,
+	"vzsFailureDomain": vzstorage.FailureDomainAttr,
+}
+
+// Attributes returns the vstorage attributes set on directories of the
+// volume by its options
+func Attributes(options map[string]string) (*vzstorage.Attributes, error) {
+	attrs := map[string]string{}
+	for k, v := range options {
+		if attr, ok := attrOptions[k]; ok {
+			attrs[attr] = v
+		}
+	}
+	return vzstorage.ParseAttributes(attrs)
+}
+
+// AttrSetter sets vstorage attributes of directories, e.g.
+// vzstorage.AttrQueue
+type AttrSetter interface {
+	SetAttr(ctx context.Context, path, attr, value string) error
+}
+
+// Paths returns paths of a ploop volume directory and of its image
+// directory under mount. Volumes provisioned before layouts were recorded
+// have the image directory of the default layout.
+func Paths(mount string, options map[string]string) (string, string) {
+	volumePath := options["volumePath"]
+	volumeID := options[VolumeIDOption]
+	if imagePath := options[ImagePathOption]; imagePath != "" {
+		return path.Join(mount, volumePath, volumeID), path.Join(mount, imagePath)
+	}
+	deltasPath, ok := options["deltasPath"]
+	if !ok {
+		deltasPath = volumePath
+	}
+	return path.Join(mount, volumePath, volumeID), path.Join(mount, deltasPath, volumeID+".image")
+}
+
+// SnapshotsDir returns the directory snapshots of the volume are made in
+func SnapshotsDir(mount string, options map[string]string) string {
+	if p := options[SnapshotsPathOption]; p != "" {
+		return path.Join(mount, p)
+	}
+	return path.Join(mount, options["volumePath"])
+}
+
+// CreateVolume validates options of the volume and creates its directories
+// with their vstorage attributes and an empty image. Nothing is left
+// behind on errors. Subprocesses setting attributes are killed when ctx
+// is done; ploop can't be interrupted, so the image is still created then,
+// and removed again.
+func CreateVolume(ctx context.Context, mount string, options map[string]string, attrs AttrSetter) error {
+	if err := ValidateOptions(options); err != nil {
+		return err
+	}
+	volumeSize, err := SizeKB(options[SizeOption])
+	if err != nil {
+		return err
+	}
+
+	var clog uint
+	if blockSize := options[BlockSizeOption]; blockSize != "" {
+		if clog, err = ParseBlockSize(blockSize); err != nil {
+			return err
+		}
+	}
+	a, err := Attributes(options)
+	if err != nil {
+		return err
+	}
+
+	ploopPath, imageDir := Paths(mount, options)
+	volumeDir, deltaDir := path.Dir(ploopPath), path.Dir(imageDir)
+	imageFile := path.Join(imageDir, "root.hds")
+
+	if err := os.MkdirAll(volumeDir, 0755); err != nil {
+		return fmt.Errorf("Error creating dir %s: %v", volumeDir, err)
+	}
+
+	// create base dirs for ploop metadatas and ploop images, the latter
+	// may be laid out inside of the former
+	if err := os.Mkdir(ploopPath, 0755); err != nil {
+		return fmt.Errorf("Error creating dir %s: %v", ploopPath, err)
+	}
+
+	if err := os.MkdirAll(deltaDir, 0755); err != nil {
+		os.RemoveAll(ploopPath)
+		return fmt.Errorf("Error creating dir %s: %v", deltaDir, err)
+	}
+
+	if err := os.Mkdir(imageDir, 0755); err != nil {
+		os.RemoveAll(ploopPath)
+		return fmt.Errorf("Error creating dir %s: %v", imageDir, err)
+	}
+
+	for _, d := range []string{ploopPath, imageDir} {
+		for attr, v := range a.Marshal() {
+			if err := attrs.SetAttr(ctx, d, attr, v); err != nil {
+				os.Remove(imageDir)
+				os.RemoveAll(ploopPath)
+				return err
+			}
+		}
+	}
+
+	// Create the ploop volume
+	preallocated := options[AllocationOption] == Preallocated
+	if clog != 0 || preallocated {
+		var mode ploop.ImageMode
+		if preallocated {
+			mode = ploop.Preallocated
+		}
+		err = createImage(ploopPath, volumeSize, imageFile, clog, mode)
+	} else {
+		_, err = ploop.PloopVolumeCreate(ploopPath, volumeSize, imageFile)
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		os.RemoveAll(ploopPath)
+		os.RemoveAll(imageDir)
+		return err
+	}
+
+	return nil
+}
+
+// ParseBlockSize converts a ploop cluster block size like "256K" or "1M"
+// to the cluster log expected by ploop.CreateParam, i.e. log2 of the size
+// in 512-byte sectors. The kernel supports logs from 6 to 15. The block
+// size is also the discard granularity of the device on nodes, which
+// isn't a property of the image and can't be set here.
+func ParseBlockSize(s string) (uint, error) {
+	unit := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "IB"), "B")
+	n, err := vzstorage.ParseSize(unit + "B")
+	if err != nil || n < 512 || n%512 != 0 {
+		return 0, fmt.Errorf("Invalid ploopBlockSize %q", s)
+	}
+
+	var clog uint
+	for sectors := n / 512; sectors > 1; sectors >>= 1 {
+		if sectors&1 != 0 {
+			return 0, fmt.Errorf("ploopBlockSize %q is not a power of two", s)
+		}
+		clog++
+	}
+	if clog < 6 || clog > 15 {
+		return 0, fmt.Errorf("ploopBlockSize %q is out of the supported range 32K-16M", s)
+	}
+	return clog, nil
+}
+
+// createImage creates a ploop volume with a non-default cluster block
+// size or image mode. ploop-volume can't do that, so the image is created
+// by "ploop init" and its descriptor is moved to the volume directory,
+// where ploop-volume and ploop-flexvol expect it.
+func createImage(ploopPath string, size uint64, imageFile string, clog uint, mode ploop.ImageMode) error {
+	if err := ploop.Create(&ploop.CreateParam{Size: size, File: imageFile, CLog: clog, Mode: mode}); err != nil {
+		return err
+	}
+
+	dd := path.Join(path.Dir(imageFile), "DiskDescriptor.xml")
+	data, err := ioutil.ReadFile(dd)
+	if err != nil {
+		return err
+	}
+	// the image path has to be relative, as the cluster is mounted in
+	// different places on the provisioner and on nodes
+	rel, err := filepath.Rel(ploopPath, imageFile)
+	if err != nil {
+		return err
+	}
+	data = bytes.Replace(data,
+		[]byte("<File>"+path.Base(imageFile)+"</File>"),
+		[]byte("<File>"+rel+"</File>"), -1)
+	if err := ioutil.WriteFile(path.Join(ploopPath, "DiskDescriptor.xml"), data, 0644); err != nil {
+		return err
+	}
+	return os.Remove(dd)
+}
+
+// DeleteVolume deletes the volume with its image. The volume directory is
+// renamed first, so that a deletion interrupted half way is continued by
+// the next call rather than leaving a broken volume in place. The image is
+// wiped before it is removed if SecureDeleteOption asks for it. The
+// deletion stops between its steps when ctx is done.
+func DeleteVolume(ctx context.Context, mount string, options map[string]string) error {
+	ploopPath, imageDir := Paths(mount, options)
+	ploopPathTmp := ploopPath + ".deleted"
+	// the volume may have been renamed by a previous unfinished attempt
+	if _, err := os.Stat(ploopPathTmp); err != nil {
+		if err := os.Rename(ploopPath, ploopPathTmp); err != nil {
+			return err
+		}
+	}
+
+	// a lease left by a node which lost the volume would keep the image
+	// from being deleted, revoking fails harmlessly if there is none
+	exec.CommandContext(ctx, "vstorage", "revoke", "-R", imageDir).Run()
+
+	if err := WipeImage(ctx, imageDir, options[SecureDeleteOption]); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	vol, err := ploop.PloopVolumeOpen(ploopPathTmp)
+	if err != nil {
+		return err
+	}
+	if err := vol.Delete(); err != nil {
+		return err
+	}
+	os.RemoveAll(imageDir)
+	return nil
+}
+
+// Resize changes the size of the image of a volume which isn't attached
+// to size bytes, rounded up to kilobytes. The filesystem on the image is
+// resized along with it.
+func Resize(mount string, options map[string]string, size uint64) error {
+	ploopPath, _ := Paths(mount, options)
+	d, err := ploop.Open(path.Join(ploopPath, "DiskDescriptor.xml"))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Resize((size+1023)/1024, true); err != nil {
+		return fmt.Errorf("Unable to resize %s: %v", ploopPath, err)
+	}
+	return nil
+}
+
+// Snapshot makes a snapshot called name of the volume in its snapshots
+// directory and returns its path. The snapshot is a ploop volume itself,
+// which can be opened with ploop.PloopVolumeSnapshotOpen and has to be
+// deleted when it is no longer needed.
+func Snapshot(mount string, options map[string]string, name string) (string, error) {
+	ploopPath, _ := Paths(mount, options)
+	snapshotPath := path.Join(SnapshotsDir(mount, options), name)
+	vol, err := ploop.PloopVolumeOpen(ploopPath)
+	if err != nil {
+		return "", err
+	}
+	if _, err := vol.Snapshot(snapshotPath); err != nil {
+		return "", fmt.Errorf("Unable to snapshot %s: %v", ploopPath, err)
+	}
+	return snapshotPath, nil
+}
+
+// AttachInfo is what attaching a volume on a node takes
+type AttachInfo struct {
+	// Driver and Options are the flexvolume source of the PV, along with
+	// a reference to the secret of the cluster
+	Driver  string
+	Options map[string]string
+	// Descriptor is the DiskDescriptor.xml to mount with ploop on nodes
+	// where the cluster is mounted at the same place
+	Descriptor string
+}
+
+// Attachment returns what attaching the volume takes
+func Attachment(mount string, options map[string]string) *AttachInfo {
+	ploopPath, _ := Paths(mount, options)
+	o := make(map[string]string, len(options))
+	for k, v := range options {
+		o[k] = v
+	}
+	return &AttachInfo{
+		Driver:     Driver,
+		Options:    o,
+		Descriptor: path.Join(ploopPath, "DiskDescriptor.xml"),
+	}
+}
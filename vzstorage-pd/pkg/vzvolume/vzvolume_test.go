@@ -0,0 +1,106 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vzvolume
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestPaths(t *testing.T) {
+	for _, c := range []struct {
+		options      map[string]string
+		ploop, image string
+		snapshots    string
+	}{
+		{
+			map[string]string{"volumePath": "v", "volumeID": "pvc-1"},
+			"/mnt/v/pvc-1", "/mnt/v/pvc-1.image", "/mnt/v",
+		},
+		{
+			map[string]string{"volumePath": "v", "deltasPath": "d", "volumeID": "pvc-1"},
+			"/mnt/v/pvc-1", "/mnt/d/pvc-1.image", "/mnt/v",
+		},
+		{
+			map[string]string{"volumePath": "fast/ns", "volumeID": "pvc-1", ImagePathOption: "fast/ns/pvc-1/deltas", SnapshotsPathOption: "snap/ns"},
+			"/mnt/fast/ns/pvc-1", "/mnt/fast/ns/pvc-1/deltas", "/mnt/snap/ns",
+		},
+	} {
+		ploopPath, imageDir := Paths("/mnt", c.options)
+		if ploopPath != c.ploop || imageDir != c.image {
+			t.Errorf("%v: expected %s and %s, got %s and %s", c.options, c.ploop, c.image, ploopPath, imageDir)
+		}
+		if s := SnapshotsDir("/mnt", c.options); s != c.snapshots {
+			t.Errorf("%v: expected snapshots in %s, got %s", c.options, c.snapshots, s)
+		}
+	}
+}
+
+func TestParseBlockSize(t *testing.T) {
+	for s, expected := range map[string]uint{"32K": 6, "256K": 9, "1M": 11, "1MiB": 11, "16m": 15} {
+		clog, err := ParseBlockSize(s)
+		if err != nil || clog != expected {
+			t.Errorf("%s: expected %d, got %d, %v", s, expected, clog, err)
+		}
+	}
+	for _, s := range []string{"", "16K", "32M", "3M", "abc"} {
+		if _, err := ParseBlockSize(s); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
+
+func TestCreateVolumeValidation(t *testing.T) {
+	for _, options := range []map[string]string{
+		{"volumeID": "pvc-1", "size": "1024"},
+		{"volumePath": "v", "size": "1024"},
+		{"volumePath": "v", "volumeID": "pvc-1"},
+		{"volumePath": "v", "volumeID": "pvc-1", "size": "lots"},
+		{"volumePath": "v", "volumeID": "pvc-1", "size": "1024", BlockSizeOption: "3M"},
+	} {
+		if err := CreateVolume(context.Background(), "/nonexistent", options, nil); err == nil {
+			t.Errorf("%v: expected an error", options)
+		}
+	}
+}
+
+func TestAttachment(t *testing.T) {
+	options := map[string]string{"volumePath": "v", "volumeID": "pvc-1"}
+	a := Attachment("/mnt", options)
+	if a.Driver != "virtuozzo/ploop" || a.Descriptor != "/mnt/v/pvc-1/DiskDescriptor.xml" {
+		t.Errorf("unexpected %+v", a)
+	}
+	a.Options["volumeID"] = "changed"
+	if options["volumeID"] != "pvc-1" {
+		t.Errorf("options of the volume were changed")
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	a, err := Attributes(map[string]string{"volumePath": "v", "vzsReplicas": "3:2", "vzsTier": "1"})
+	if err != nil {
+		t.Fatalf("Attributes failed: %v", err)
+	}
+	expected := map[string]string{"replicas": "3:2", "tier": "1"}
+	if attrs := a.Marshal(); !reflect.DeepEqual(attrs, expected) {
+		t.Errorf("expected %v, got %v", expected, attrs)
+	}
+	if _, err := Attributes(map[string]string{"vzsReplicas": "2:3"}); err == nil {
+		t.Errorf("expected a limit above norm to fail")
+	}
+}
@@ -0,0 +1,234 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vzvolume
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"golang.org/x/sys/unix"
+)
+
+// Values of SecureDeleteOption
+const (
+	// WipeNone removes images without wiping them
+	WipeNone = "none"
+	// WipeShred overwrites images with zeros
+	WipeShred = "shred"
+	// WipeDiscard punches holes over whole images, which releases their
+	// chunks; it falls back to WipeShred where holes aren't supported
+	WipeDiscard = "discard"
+)
+
+const (
+	fallocKeepSize  = 0x01
+	fallocPunchHole = 0x02
+	seekData        = 3
+	seekHole        = 4
+	wipeChunk       = 1 << 20
+	// wipeCheckpoint is how often the progress of wiping is saved
+	wipeCheckpoint = 256 << 20
+)
+
+// wipeProgressFile keeps the progress of wiping in the image directory, so
+// an attempt cut short by its deadline is continued by the next one
+// rather than started over
+const wipeProgressFile = ".wipe-progress"
+
+// wipeProgress tells how far File has been wiped and checked. Files of the
+// image are wiped in the order of their names, so files before File are
+// done.
+type wipeProgress struct {
+	File    string `json:"file"`
+	Wiped   int64  `json:"wiped"`
+	Checked int64  `json:"checked"`
+}
+
+// WipeImage wipes data of all images in imageDir as mode tells and then
+// checks that only zeros are left, so tenant data can't be recovered from
+// chunks reused by other volumes. An empty mode is WipeNone. Only data
+// extents are wiped and checked, holes of thin images are skipped. Wiping
+// stops when ctx is done and continues from where it stopped on the next
+// call.
+func WipeImage(ctx context.Context, imageDir, mode string) error {
+	if mode == "" || mode == WipeNone {
+		return nil
+	}
+	if mode != WipeShred && mode != WipeDiscard {
+		return fmt.Errorf("unknown secure delete mode %q", mode)
+	}
+
+	files, err := ioutil.ReadDir(imageDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	progressPath := path.Join(imageDir, wipeProgressFile)
+	var progress wipeProgress
+	if data, err := ioutil.ReadFile(progressPath); err == nil {
+		// a damaged record only makes wiping start over
+		json.Unmarshal(data, &progress)
+	}
+	save := func() error {
+		data, err := json.Marshal(&progress)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(progressPath, data, 0600)
+	}
+
+	for _, f := range files {
+		if !f.Mode().IsRegular() || f.Name() == wipeProgressFile || f.Name() < progress.File {
+			continue
+		}
+		if f.Name() != progress.File {
+			progress = wipeProgress{File: f.Name()}
+		}
+		p := path.Join(imageDir, f.Name())
+		err := wipeFile(ctx, p, f.Size(), mode, &progress, save)
+		if e := save(); err == nil && e != nil {
+			err = fmt.Errorf("Unable to save wiping progress: %v", e)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(progressPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// wipeFile wipes and checks p from where progress tells, calling save at
+// checkpoints. Progress of wiping is only advanced over data which has
+// been synced.
+func wipeFile(ctx context.Context, p string, size int64, mode string, progress *wipeProgress, save func() error) error {
+	f, err := os.OpenFile(p, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if progress.Wiped < size && mode == WipeDiscard {
+		err := unix.Fallocate(int(f.Fd()), fallocKeepSize|fallocPunchHole, 0, size)
+		if err == nil {
+			if err := f.Sync(); err != nil {
+				return err
+			}
+			progress.Wiped = size
+		} else if err != unix.EOPNOTSUPP {
+			return fmt.Errorf("Unable to wipe %s: %v", p, err)
+		}
+	}
+
+	if progress.Wiped < size {
+		zeros := make([]byte, wipeChunk)
+		wiped := progress.Wiped
+		checkpoint := func() error {
+			if err := f.Sync(); err != nil {
+				return err
+			}
+			progress.Wiped = wiped
+			return save()
+		}
+		err := forEachDataChunk(ctx, f, progress.Wiped, size, func(off, n int64) error {
+			if _, err := f.WriteAt(zeros[:n], off); err != nil {
+				return err
+			}
+			wiped = off + n
+			if wiped-progress.Wiped >= wipeCheckpoint {
+				return checkpoint()
+			}
+			return nil
+		})
+		if err == nil {
+			wiped = size
+		}
+		if e := checkpoint(); err == nil {
+			err = e
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to wipe %s: %v", p, err)
+		}
+	}
+
+	buf := make([]byte, wipeChunk)
+	zeros := make([]byte, wipeChunk)
+	saved := progress.Checked
+	err = forEachDataChunk(ctx, f, progress.Checked, size, func(off, n int64) error {
+		if _, err := f.ReadAt(buf[:n], off); err != nil && err != io.EOF {
+			return err
+		}
+		if !bytes.Equal(buf[:n], zeros[:n]) {
+			// the data may have been changed since it was wiped
+			progress.Wiped, progress.Checked = off, off
+			return fmt.Errorf("%s has data left after wiping near offset %d", p, off)
+		}
+		progress.Checked = off + n
+		if progress.Checked-saved >= wipeCheckpoint {
+			saved = progress.Checked
+			return save()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	progress.Checked = size
+	return nil
+}
+
+// forEachDataChunk calls fn for chunks of data extents of f between from
+// and size. Where the filesystem can't tell holes, the whole range is data.
+func forEachDataChunk(ctx context.Context, f *os.File, from, size int64, fn func(off, n int64) error) error {
+	fd := int(f.Fd())
+	for off := from; off < size; {
+		start, err := unix.Seek(fd, off, seekData)
+		if err == unix.ENXIO {
+			// only a hole is left
+			return nil
+		}
+		end := size
+		if err != nil {
+			start = off
+		} else if e, err := unix.Seek(fd, start, seekHole); err == nil && e < end {
+			end = e
+		}
+		for ; start < end; start += wipeChunk {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			n := end - start
+			if n > wipeChunk {
+				n = wipeChunk
+			}
+			if err := fn(start, n); err != nil {
+				return err
+			}
+		}
+		off = end
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vzvolume
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+)
+
+func TestWipeImage(t *testing.T) {
+	for _, mode := range []string{"", WipeNone, WipeShred, WipeDiscard} {
+		dir, err := ioutil.TempDir("", "wipe")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		data := bytes.Repeat([]byte("tenant data "), 300000)
+		image := path.Join(dir, "root.hds")
+		if err := ioutil.WriteFile(image, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := WipeImage(context.Background(), dir, mode); err != nil {
+			t.Errorf("%q: wipe failed: %v", mode, err)
+			continue
+		}
+		got, err := ioutil.ReadFile(image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(data) {
+			t.Errorf("%q: expected size %d, got %d", mode, len(data), len(got))
+		}
+		wiped := bytes.Equal(got, make([]byte, len(data)))
+		if expected := mode == WipeShred || mode == WipeDiscard; wiped != expected {
+			t.Errorf("%q: expected wiped %v, got %v", mode, expected, wiped)
+		}
+	}
+}
+
+func TestWipeImageErrors(t *testing.T) {
+	if err := WipeImage(context.Background(), "/nonexistent", WipeShred); err != nil {
+		t.Errorf("Expected a missing image to be wiped already, got %v", err)
+	}
+	if err := WipeImage(context.Background(), "/nonexistent", "erase"); err == nil {
+		t.Errorf("Expected an unknown mode to fail")
+	}
+}
+
+func TestWipeImageResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wipe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := bytes.Repeat([]byte("tenant data "), 300000)
+	for _, name := range []string{"root.hds", "root.hds.1"} {
+		if err := ioutil.WriteFile(path.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := WipeImage(ctx, dir, WipeShred); err == nil {
+		t.Fatalf("Expected wiping to stop when the context is done")
+	}
+	if _, err := os.Stat(path.Join(dir, wipeProgressFile)); err != nil {
+		t.Fatalf("Expected progress to be saved: %v", err)
+	}
+
+	// root.hds is recorded as done, so it has to be left alone
+	progress := fmt.Sprintf(`{"file":"root.hds","wiped":%d,"checked":%d}`, len(data), len(data))
+	if err := ioutil.WriteFile(path.Join(dir, wipeProgressFile), []byte(progress), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := WipeImage(context.Background(), dir, WipeShred); err != nil {
+		t.Fatal(err)
+	}
+	for name, wiped := range map[string]bool{"root.hds": false, "root.hds.1": true} {
+		got, err := ioutil.ReadFile(path.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(got, make([]byte, len(data))) != wiped {
+			t.Errorf("%s: expected wiped %v", name, wiped)
+		}
+	}
+	if _, err := os.Stat(path.Join(dir, wipeProgressFile)); !os.IsNotExist(err) {
+		t.Errorf("Expected progress to be removed once done, got %v", err)
+	}
+}
+
+func TestWipeImageThin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wipe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	image := path.Join(dir, "root.hds")
+	f, err := os.Create(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const size = 1 << 30
+	data := bytes.Repeat([]byte("tenant data "), 1000)
+	if _, err := f.WriteAt(data, size/2); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if err := WipeImage(context.Background(), dir, WipeShred); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(data))
+	if f, err = os.Open(image); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.ReadAt(got, size/2); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, make([]byte, len(data))) {
+		t.Errorf("Expected data to be wiped")
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(image, &st); err != nil {
+		t.Fatal(err)
+	}
+	// holes stay holes rather than being filled with zeros
+	if allocated := st.Blocks * 512; allocated >= size/2 {
+		t.Errorf("Expected holes to be skipped, %d bytes are allocated", allocated)
+	}
+}
@@ -0,0 +1,50 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/policy"
+	"k8s.io/client-go/kubernetes"
+)
+
+// namespacePolicy restricts StorageClasses, tiers and replication which
+// namespaces may provision volumes of. RBAC can't restrict usage of
+// StorageClasses, so the policy is kept in a config map and checked on
+// every provisioning.
+type namespacePolicy struct {
+	configMapStore
+}
+
+func newNamespacePolicy(client kubernetes.Interface, namespace, name string) *namespacePolicy {
+	return &namespacePolicy{
+		configMapStore: configMapStore{
+			client:    client,
+			namespace: namespace,
+			name:      name,
+		},
+	}
+}
+
+// load returns the current policy, which is empty if the config map
+// doesn't exist
+func (n *namespacePolicy) load() (policy.Policy, error) {
+	data, err := n.get()
+	if err != nil {
+		return nil, err
+	}
+	return policy.Parse(data)
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzvolume"
+	"github.com/virtuozzo/goploop-cli"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// populateAnn on a claim names the image config map its volume is
+	// populated from
+	populateAnn = "virtuozzo.com/populate-from"
+	// imageLabel marks config maps in the provisioner namespace which
+	// describe golden images
+	imageLabel = "virtuozzo.com/image"
+)
+
+// imageSource is a golden image, a ploop image on the cluster which new
+// volumes are copies of
+type imageSource struct {
+	name string
+	// path of the directory with DiskDescriptor.xml relative to the
+	// cluster root
+	path string
+	// sha256 of deltas of the image in the order of the descriptor,
+	// not verified if empty
+	sha256 string
+}
+
+// imageSourceOf returns the image the claim asks to be populated from, or
+// nil if it doesn't
+func (p *vzFSProvisioner) imageSourceOf(claim *v1.PersistentVolumeClaim) (*imageSource, error) {
+	name, ok := claim.Annotations[populateAnn]
+	if !ok {
+		return nil, nil
+	}
+	cm, err := p.client.Core().ConfigMaps(*namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get image %s: %v", name, err)
+	}
+	if _, ok := cm.Labels[imageLabel]; !ok {
+		return nil, fmt.Errorf("config map %s/%s is not labeled %s", *namespace, name, imageLabel)
+	}
+	if cm.Data["path"] == "" {
+		return nil, fmt.Errorf("image %s has no path", name)
+	}
+	return &imageSource{name: name, path: cm.Data["path"], sha256: cm.Data["sha256"]}, nil
+}
+
+// populate replaces the empty image of a new volume with a copy of the
+// golden image and grows it to size bytes
+func populate(mount string, options map[string]string, image *imageSource, size uint64) error {
+	srcDir := path.Join(mount, image.path)
+	dd, err := ioutil.ReadFile(path.Join(srcDir, "DiskDescriptor.xml"))
+	if err != nil {
+		return err
+	}
+
+	ploopPath, imageDir := vzvolume.Paths(mount, options)
+	for _, f := range []string{path.Join(ploopPath, "DiskDescriptor.xml"), path.Join(imageDir, "root.hds")} {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	h := sha256.New()
+	var copyErr error
+	n := 0
+	newDD := reDeltaFile.ReplaceAllStringFunc(string(dd), func(m string) string {
+		if copyErr != nil {
+			return m
+		}
+		file := reDeltaFile.FindStringSubmatch(m)[1]
+		if !path.IsAbs(file) {
+			file = path.Join(srcDir, file)
+		}
+		dst := path.Join(imageDir, fmt.Sprintf("%d-%s", n, path.Base(file)))
+		n++
+		if copyErr = copyHashed(file, dst, h); copyErr != nil {
+			return m
+		}
+		rel, _ := filepath.Rel(ploopPath, dst)
+		return "<File>" + rel + "</File>"
+	})
+	if copyErr != nil {
+		return copyErr
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); image.sha256 != "" && sum != image.sha256 {
+		return fmt.Errorf("image %s is corrupted: sha256 of its deltas is %s, expected %s", image.name, sum, image.sha256)
+	}
+	ddPath := path.Join(ploopPath, "DiskDescriptor.xml")
+	if err := ioutil.WriteFile(ddPath, []byte(newDD), 0644); err != nil {
+		return err
+	}
+
+	d, err := ploop.Open(ddPath)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	info, err := d.ImageInfo()
+	if err != nil {
+		return err
+	}
+	// sizes are in 512-byte sectors
+	current := info.Blocks * 512
+	if current > size {
+		return fmt.Errorf("image %s of %d bytes doesn't fit into the claimed %d bytes", image.name, current, size)
+	}
+	if current < size {
+		if err := d.Resize((size+1023)/1024, true); err != nil {
+			return fmt.Errorf("Unable to grow the copy of image %s: %v", image.name, err)
+		}
+	}
+	glog.Infof("Populated %s from image %s", options["volumeID"], image.name)
+	return nil
+}
+
+// copyHashed copies src to dst, adding the content to h
+func copyHashed(src, dst string, h hash.Hash) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(io.MultiWriter(out, h), in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	return err
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzvolume"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// StorageClass parameter naming the storage profile of the class
+	profileParam = "profile"
+	// StorageClass parameter routing volumes to profiles by their size
+	sizeProfilesParam = "sizeProfiles"
+	// profileLabel marks config maps which are storage profiles
+	profileLabel = "virtuozzo.com/storage-profile"
+	// profileAnn on PVs names the profile they were provisioned with
+	profileAnn = "virtuozzo.com/storage-profile"
+)
+
+// profileExcluded are parameters a profile can't set: those choosing the
+// cluster are read from classes directly, and profiles don't nest
+var profileExcluded = map[string]bool{
+	profileParam:         true,
+	sizeProfilesParam:    true,
+	"secretName":         true,
+	"optionsFromSystem":  true,
+	secondarySecretParam: true,
+}
+
+// storageProfiles keeps parameters shared by several StorageClasses in
+// config maps labeled profileLabel, so that they are changed in one place.
+// Classes name their profile with the profile parameter.
+type storageProfiles struct {
+	client    kubernetes.Interface
+	namespace string
+}
+
+func newStorageProfiles(client kubernetes.Interface, namespace string) *storageProfiles {
+	return &storageProfiles{client: client, namespace: namespace}
+}
+
+// resolve returns parameters of a class merged with its profile, which
+// the parameters of the class override. Parameters of classes without a
+// profile are returned as they are.
+func (s *storageProfiles) resolve(parameters map[string]string) (map[string]string, error) {
+	name, ok := parameters[profileParam]
+	if !ok {
+		return parameters, nil
+	}
+	profile, err := s.get(name)
+	if err != nil {
+		return nil, err
+	}
+	resolved := map[string]string{}
+	for k, v := range profile {
+		resolved[k] = v
+	}
+	for k, v := range parameters {
+		if k != profileParam {
+			resolved[k] = v
+		}
+	}
+	return resolved, nil
+}
+
+// sizeRule routes volumes whose size compares to size by op to a profile
+type sizeRule struct {
+	op      string
+	size    resource.Quantity
+	profile string
+}
+
+func (r sizeRule) matches(size resource.Quantity) bool {
+	c := size.Cmp(r.size)
+	switch r.op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0
+}
+
+// parseSizeProfiles parses a comma separated list of rules like
+// "<10Gi=small, >=1Ti=large"
+func parseSizeProfiles(s string) ([]sizeRule, error) {
+	var rules []sizeRule
+	for _, r := range strings.Split(s, ",") {
+		r = strings.TrimSpace(r)
+		op := ""
+		for _, o := range []string{"<=", ">=", "<", ">"} {
+			if strings.HasPrefix(r, o) {
+				op = o
+				break
+			}
+		}
+		if op == "" {
+			return nil, fmt.Errorf("rule %q of %s has no comparison, like <10Gi=profile", r, sizeProfilesParam)
+		}
+		rest := r[len(op):]
+		i := strings.Index(rest, "=")
+		if i == -1 || strings.TrimSpace(rest[i+1:]) == "" {
+			return nil, fmt.Errorf("rule %q of %s names no profile", r, sizeProfilesParam)
+		}
+		size, err := resource.ParseQuantity(strings.TrimSpace(rest[:i]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid size in rule %q of %s: %v", r, sizeProfilesParam, err)
+		}
+		rules = append(rules, sizeRule{op: op, size: size, profile: strings.TrimSpace(rest[i+1:])})
+	}
+	return rules, nil
+}
+
+// route returns parameters of a class with the profile picked for a volume
+// of the given size by the first matching rule of its sizeProfiles. If no
+// rule matches, the profile parameter of the class is kept.
+func route(parameters map[string]string, size resource.Quantity) (map[string]string, error) {
+	s, ok := parameters[sizeProfilesParam]
+	if !ok {
+		return parameters, nil
+	}
+	rules, err := parseSizeProfiles(s)
+	if err != nil {
+		return nil, err
+	}
+	routed := map[string]string{}
+	for k, v := range parameters {
+		if k != sizeProfilesParam {
+			routed[k] = v
+		}
+	}
+	for _, r := range rules {
+		if r.matches(size) {
+			routed[profileParam] = r.profile
+			break
+		}
+	}
+	return routed, nil
+}
+
+// get returns validated parameters of the profile
+func (s *storageProfiles) get(name string) (map[string]string, error) {
+	cm, err := s.client.Core().ConfigMaps(s.namespace).Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("storage profile %q not found", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get storage profile %q: %v", name, err)
+	}
+	if _, ok := cm.Labels[profileLabel]; !ok {
+		return nil, fmt.Errorf("config map %s/%s is not a storage profile, it lacks the %s label", s.namespace, name, profileLabel)
+	}
+	if err := validateProfile(cm.Data); err != nil {
+		return nil, fmt.Errorf("invalid storage profile %q: %v", name, err)
+	}
+	return cm.Data, nil
+}
+
+// validateProfile checks that the profile has only known parameters which
+// it may set, and that its vstorage attributes parse
+func validateProfile(data map[string]string) error {
+	for k := range data {
+		if profileExcluded[k] {
+			return fmt.Errorf("parameter %q can't be set by a profile", k)
+		}
+		if !knownParameters[k] {
+			return fmt.Errorf("unknown parameter %q", k)
+		}
+	}
+	_, err := vzvolume.Attributes(data)
+	return err
+}
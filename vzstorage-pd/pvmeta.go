@@ -0,0 +1,90 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// StorageClass parameters with JSON objects of labels and annotations of
+// created PVs, e.g. for backup selectors and cost allocation
+const (
+	pvLabelsParam      = "pvLabels"
+	pvAnnotationsParam = "pvAnnotations"
+)
+
+// pvMetadata is what a StorageClass stamps on its PVs
+type pvMetadata struct {
+	labels      map[string]string
+	annotations map[string]string
+}
+
+// parsePVMetadata parses and validates pvLabels and pvAnnotations of the
+// StorageClass parameters
+func parsePVMetadata(parameters map[string]string) (*pvMetadata, error) {
+	m := &pvMetadata{}
+	for _, p := range []struct {
+		param  string
+		target *map[string]string
+		label  bool
+	}{
+		{pvLabelsParam, &m.labels, true},
+		{pvAnnotationsParam, &m.annotations, false},
+	} {
+		data, ok := parameters[p.param]
+		if !ok {
+			continue
+		}
+		if err := json.Unmarshal([]byte(data), p.target); err != nil {
+			return nil, fmt.Errorf("Invalid %s: %v", p.param, err)
+		}
+		for k, v := range *p.target {
+			errs := validation.IsQualifiedName(k)
+			if p.label {
+				errs = append(errs, validation.IsValidLabelValue(v)...)
+			}
+			if len(errs) != 0 {
+				return nil, fmt.Errorf("Invalid %s %q: %s", p.param, k, strings.Join(errs, ", "))
+			}
+		}
+	}
+	return m, nil
+}
+
+// apply stamps the labels and annotations on pv. Annotations set by the
+// provisioner itself can't be overridden.
+func (m *pvMetadata) apply(pv *v1.PersistentVolume) {
+	if len(m.labels) != 0 && pv.Labels == nil {
+		pv.Labels = map[string]string{}
+	}
+	for k, v := range m.labels {
+		pv.Labels[k] = v
+	}
+	if len(m.annotations) != 0 && pv.Annotations == nil {
+		pv.Annotations = map[string]string{}
+	}
+	for k, v := range m.annotations {
+		if _, ok := pv.Annotations[k]; !ok {
+			pv.Annotations[k] = v
+		}
+	}
+}
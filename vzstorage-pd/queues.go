@@ -0,0 +1,45 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"time"
+
+	"github.com/kubernetes-incubator/external-storage/lib/controller"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/metrics"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// how often to sample depths of the provisioning and deletion queues
+const queuePollPeriod = 5 * time.Second
+
+var operationQueue = metrics.NewGauge("vzstorage_operation_queue",
+	"Number of Provision and Delete operations waiting for a worker and running.",
+	"operation", "state")
+
+// runQueuePoller exports depths of the work queues of pc
+func runQueuePoller(pc *controller.ProvisionController) {
+	go wait.Forever(func() {
+		setQueueDepth("Provision", pc.ProvisionQueue())
+		setQueueDepth("Delete", pc.DeleteQueue())
+	}, queuePollPeriod)
+}
+
+func setQueueDepth(operation string, depth controller.QueueDepth) {
+	operationQueue.Set(float64(depth.Waiting), operation, "waiting")
+	operationQueue.Set(float64(depth.Running), operation, "running")
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"path"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/metrics"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzvolume"
+	"github.com/virtuozzo/goploop-cli"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// imageSizeAnn on a PV is the size of its ploop image
+	imageSizeAnn = "virtuozzo.com/image-size"
+	// requestedSizeAnn on a PV is the size its claim requested
+	requestedSizeAnn = "virtuozzo.com/requested-size"
+)
+
+var capacityMismatchBytes = metrics.NewGauge("vzstorage_volume_capacity_mismatch_bytes",
+	"Difference between the ploop image size and the capacity declared in the PV.", "pv")
+
+// runCapacityReconciler periodically compares capacity of PVs against
+// sizes of their ploop images
+func (p *vzFSProvisioner) runCapacityReconciler(period time.Duration, fix bool) {
+	wait.Forever(func() { p.reconcileCapacity(fix) }, period)
+}
+
+func (p *vzFSProvisioner) reconcileCapacity(fix bool) {
+	volumes, err := p.client.Core().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		glog.Errorf("Unable to list persistent volumes: %v", err)
+		return
+	}
+
+	capacityMismatchBytes.Reset()
+	for i := range volumes.Items {
+		volume := &volumes.Items[i]
+		if volume.Annotations[parentProvisionerAnn] != *provisionerID ||
+			volume.Spec.FlexVolume == nil || volume.Spec.ClaimRef == nil {
+			continue
+		}
+		if err := p.reconcileVolumeCapacity(volume, fix); err != nil {
+			glog.Warningf("Unable to reconcile capacity of %s: %v", volume.Name, err)
+		}
+	}
+}
+
+func (p *vzFSProvisioner) reconcileVolumeCapacity(volume *v1.PersistentVolume, fix bool) error {
+	secretNamespace, secretName := volumeSecret(volume)
+	secret, err := tenantSecrets.get(secretNamespace, secretName)
+	if err != nil {
+		return err
+	}
+	cluster, err := clusterFromSecret(secret)
+	if err != nil {
+		return err
+	}
+	options := volume.Spec.FlexVolume.Options
+	if err := p.prepareVstorage(options, cluster, secret); err != nil {
+		return err
+	}
+
+	ploopPath, _ := vzvolume.Paths(mountDir+cluster.name, options)
+	d, err := ploop.Open(path.Join(ploopPath, "DiskDescriptor.xml"))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	info, err := d.ImageInfo()
+	if err != nil {
+		return err
+	}
+
+	// sizes are in 512-byte sectors, an image is rounded up to its block
+	actual := int64(info.Blocks) * 512
+	tolerance := int64(info.BlockSize) * 512
+	capacity := volume.Spec.Capacity[v1.ResourceName(v1.ResourceStorage)]
+	declared := capacity.Value()
+	actualQuantity := resource.NewQuantity(actual, resource.BinarySI)
+
+	// the image size is published for users who can't query the cluster
+	update, fixed := false, false
+	if volume.Annotations[imageSizeAnn] != actualQuantity.String() {
+		volume.Annotations[imageSizeAnn] = actualQuantity.String()
+		update = true
+	}
+
+	diff := actual - declared
+	if diff > tolerance || diff < -tolerance {
+		capacityMismatchBytes.Set(float64(diff), volume.Name)
+		glog.Warningf("Capacity of %s is %s, but its image size is %s", volume.Name, capacity.String(), actualQuantity.String())
+		p.recorder.Eventf(volume, v1.EventTypeWarning, "CapacityMismatch",
+			"Declared capacity %s differs from the image size %s, the image was probably resized out of band",
+			capacity.String(), actualQuantity.String())
+		if fix {
+			volume.Spec.Capacity[v1.ResourceName(v1.ResourceStorage)] = *actualQuantity
+			update, fixed = true, true
+		}
+	}
+
+	if !update {
+		return nil
+	}
+	if _, err := p.client.Core().PersistentVolumes().Update(volume); err != nil {
+		return err
+	}
+	if fixed {
+		glog.Infof("Capacity of %s is corrected to %s", volume.Name, actualQuantity.String())
+		p.history.add(volume.Spec.ClaimRef, volume.Name, "CorrectCapacity", nil, false)
+	}
+	return nil
+}
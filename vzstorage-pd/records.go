@@ -0,0 +1,138 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"path"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzvolume"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// volumeRecordLabel marks volume records, its value is the name of the PV
+const volumeRecordLabel = "virtuozzo.com/volume-record"
+
+// lifecycle states of volumes in their records
+const (
+	volumeProvisioned   = "Provisioned"
+	volumeDeletePending = "DeletePending"
+	volumeDeleteFailed  = "DeleteFailed"
+)
+
+// volumeRecords keeps a config map per provisioned volume in -namespace,
+// describing where and how its image was created and what happens to it.
+// Flexvolume options of PVs are the interface of the driver and mix its
+// parameters with those of the provisioner, so the records are what tools
+// and people inspect. A record is removed with
+// the image of its volume.
+type volumeRecords struct {
+	client    kubernetes.Interface
+	namespace string
+}
+
+func newVolumeRecords(client kubernetes.Interface, namespace string) *volumeRecords {
+	return &volumeRecords{client: client, namespace: namespace}
+}
+
+func (r *volumeRecords) store(pv string) *configMapStore {
+	return &configMapStore{
+		client:    r.client,
+		namespace: r.namespace,
+		name:      *provisionerID + "-volume-" + pv,
+		labels:    map[string]string{volumeRecordLabel: pv},
+	}
+}
+
+// describeVolume returns the record data of the PV, besides its state
+func describeVolume(volume *v1.PersistentVolume) map[string]string {
+	options := volume.Spec.FlexVolume.Options
+	ploopPath, imageDir := vzvolume.Paths("", options)
+	a, _ := vzvolume.Attributes(options)
+	attrs, _ := json.Marshal(a.Marshal())
+	capacity := volume.Spec.Capacity[v1.ResourceName(v1.ResourceStorage)]
+	blockSize := options[vzvolume.BlockSizeOption]
+	if blockSize == "" {
+		blockSize = "1M"
+	}
+	allocation := options[vzvolume.AllocationOption]
+	if allocation == "" {
+		allocation = allocationThin
+	}
+	data := map[string]string{
+		"pv":             volume.Name,
+		"cluster":        options["clusterName"],
+		"descriptorPath": ploopPath,
+		"imagePath":      imageDir,
+		"snapshotsPath":  vzvolume.SnapshotsDir("", options),
+		"deltasPath":     path.Dir(imageDir),
+		"attributes":     string(attrs),
+		"format":         "ploop",
+		"blockSize":      blockSize,
+		"allocation":     allocation,
+		"capacity":       capacity.String(),
+	}
+	if ref := volume.Spec.ClaimRef; ref != nil {
+		data["claim"] = ref.Namespace + "/" + ref.Name
+	}
+	return data
+}
+
+// update records the volume in the given state. Failures are only logged,
+// records never hold up operations on volumes.
+func (r *volumeRecords) update(volume *v1.PersistentVolume, state string, err error) {
+	if r == nil {
+		return
+	}
+	message := ""
+	if err != nil {
+		message = err.Error()
+	}
+	_, e := r.store(volume.Name).modify(func(d map[string]string) {
+		// the inventory is written once, later updates may come with
+		// mutated PVs
+		inventory := inventoryOf(volume)
+		for k, v := range describeVolume(volume) {
+			if _, ok := inventory[k]; !ok {
+				d[k] = v
+			}
+		}
+		recordInventory(d, volume)
+		d["state"] = state
+		d["message"] = message
+		d["updated"] = time.Now().UTC().Format(time.RFC3339)
+	})
+	if e != nil {
+		glog.Warningf("Unable to record %s of %s: %v", state, volume.Name, e)
+	}
+}
+
+// remove removes the record of a deleted volume
+func (r *volumeRecords) remove(pv string) {
+	if r == nil {
+		return
+	}
+	s := r.store(pv)
+	err := r.client.Core().ConfigMaps(s.namespace).Delete(s.name, nil)
+	if err != nil && !apierrors.IsNotFound(err) {
+		glog.Warningf("Unable to remove the record of %s: %v", pv, err)
+	}
+}
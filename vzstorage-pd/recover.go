@@ -0,0 +1,220 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// recoveryMarker is the copy of the PV of a volume kept next to its
+	// disk descriptor, from which the PV is recreated if it is lost
+	recoveryMarker = "virtuozzo-pv.json"
+	// recoveredAnn is set on recreated PVs to the time of the recovery
+	recoveredAnn = "virtuozzo.com/recovered-at"
+)
+
+// recoverVolumes scans the cluster of the secret, given as namespace/name,
+// for volumes of the provisioner whose PVs are gone, e.g. after an etcd
+// restore, and writes their PVs as YAML to w. With apply the PVs are also
+// created. roots are directories to scan relative to the cluster root, the
+// volumePath of classes of the provisioner using the secret by default.
+func (p *vzFSProvisioner) recoverVolumes(secretRef string, roots []string, apply bool, w io.Writer) error {
+	parts := strings.SplitN(secretRef, "/", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("the secret %q has to be namespace/name", secretRef)
+	}
+	secret, err := tenantSecrets.get(parts[0], parts[1])
+	if err != nil {
+		return err
+	}
+	cluster, err := clusterFromSecret(secret)
+	if err != nil {
+		return err
+	}
+	if err := p.prepareVstorage(map[string]string{}, cluster, secret); err != nil {
+		return err
+	}
+	mount := mountDir + cluster.name
+
+	if len(roots) == 0 {
+		if roots, err = p.recoveryRoots(parts[1]); err != nil {
+			return err
+		}
+	}
+	var markers []string
+	for _, root := range roots {
+		dir, err := importSource(mount, root)
+		if err != nil {
+			return err
+		}
+		err = filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				glog.Warningf("Unable to scan %s: %v", file, err)
+				return nil
+			}
+			if !info.IsDir() && info.Name() == recoveryMarker {
+				markers = append(markers, file)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// volumes whose deletion is deferred have no PV either, they are
+	// restored by undeleting them
+	pending, err := p.pendingDeletes()
+	if err != nil {
+		return fmt.Errorf("Unable to list deferred deletes: %v", err)
+	}
+
+	recovered, skipped := 0, 0
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, marker := range markers {
+		pv, reason := p.recoverableVolume(marker, pending)
+		if pv == nil {
+			glog.Infof("Skipping %s: %s", marker, reason)
+			skipped++
+			continue
+		}
+		pv.Annotations[recoveredAnn] = now
+		data, err := yaml.Marshal(pv)
+		if err != nil {
+			return err
+		}
+		if recovered != 0 {
+			io.WriteString(w, "---\n")
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		recovered++
+		if !apply {
+			continue
+		}
+		if err := p.recoverVolume(pv); err != nil {
+			return fmt.Errorf("Unable to recover %s: %v", pv.Name, err)
+		}
+		glog.Infof("Recovered %s from %s", pv.Name, marker)
+	}
+	action := "can be recovered, run with -recover-apply to create their PVs"
+	if apply {
+		action = "were recovered"
+	}
+	glog.Infof("%d volumes of %s %s, %d skipped", recovered, cluster.name, action, skipped)
+	return nil
+}
+
+// recoveryRoots returns volumePath of classes of the provisioner using the
+// secret
+func (p *vzFSProvisioner) recoveryRoots(secretName string) ([]string, error) {
+	classes, err := p.client.Storage().StorageClasses().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	var roots []string
+	for i := range classes.Items {
+		class := &classes.Items[i]
+		if !servesClass(class) || class.Parameters["secretName"] != secretName {
+			continue
+		}
+		parameters, err := p.profiles.resolve(class.Parameters)
+		if err != nil {
+			glog.Warningf("Skipping class %s: %v", class.Name, err)
+			continue
+		}
+		if root := parameters["volumePath"]; root != "" && !seen[root] {
+			seen[root] = true
+			roots = append(roots, root)
+		}
+	}
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("no storage classes of the provisioner use secret %s, give directories to scan with -recover-paths", secretName)
+	}
+	return roots, nil
+}
+
+// recoverableVolume returns the PV of the marker prepared to be created,
+// or nil and why it is not to be recovered. Recovered PVs are retained on
+// release and only pre-bound to their claims by name, so that a claim
+// which is gone too doesn't get their volumes deleted.
+func (p *vzFSProvisioner) recoverableVolume(marker string, pending map[string]bool) (*v1.PersistentVolume, string) {
+	data, err := ioutil.ReadFile(marker)
+	if err != nil {
+		return nil, err.Error()
+	}
+	pv := &v1.PersistentVolume{}
+	if err := json.Unmarshal(data, pv); err != nil {
+		return nil, fmt.Sprintf("invalid marker: %v", err)
+	}
+	if pv.Annotations[parentProvisionerAnn] != *provisionerID || pv.Spec.FlexVolume == nil {
+		return nil, fmt.Sprintf("provisioned by %q", pv.Annotations[parentProvisionerAnn])
+	}
+	if pending[pv.Name] {
+		return nil, fmt.Sprintf("deletion of %s is deferred, undelete it instead", pv.Name)
+	}
+	if _, err := os.Stat(path.Join(path.Dir(marker), "DiskDescriptor.xml")); err != nil {
+		return nil, fmt.Sprintf("no disk descriptor: %v", err)
+	}
+	_, err = p.client.Core().PersistentVolumes().Get(pv.Name, metav1.GetOptions{})
+	if err == nil {
+		return nil, fmt.Sprintf("PV %s exists", pv.Name)
+	}
+	if !apierrors.IsNotFound(err) {
+		return nil, fmt.Sprintf("unable to get PV %s: %v", pv.Name, err)
+	}
+
+	pv.Spec.PersistentVolumeReclaimPolicy = v1.PersistentVolumeReclaimRetain
+	if ref := pv.Spec.ClaimRef; ref != nil {
+		pv.Spec.ClaimRef = &v1.ObjectReference{Kind: ref.Kind, APIVersion: ref.APIVersion, Namespace: ref.Namespace, Name: ref.Name}
+	}
+	return pv, ""
+}
+
+// recoverVolume creates the PV and restores the finalizer of the volume on
+// its secret and its record
+func (p *vzFSProvisioner) recoverVolume(pv *v1.PersistentVolume) error {
+	created, err := p.client.Core().PersistentVolumes().Create(pv)
+	if err != nil {
+		return err
+	}
+	if finalizer := pv.Spec.FlexVolume.Options["finalizer"]; finalizer != "" {
+		secretNamespace, secretName := volumeSecret(pv)
+		if err := p.finalizers.add(secretNamespace, secretName, finalizer); err != nil {
+			glog.Warningf("Unable to add finalizer of %s to secret %s/%s: %v", pv.Name, secretNamespace, secretName, err)
+		}
+	}
+	p.records.update(created, volumeProvisioned, nil)
+	return nil
+}
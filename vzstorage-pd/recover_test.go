@@ -0,0 +1,169 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/deferred"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// writeMarker writes the recovery marker of pv with a disk descriptor
+// next to it and returns the path of the marker
+func writeMarker(t *testing.T, dir string, pv *v1.PersistentVolume) string {
+	volumeDir := path.Join(dir, pv.Name)
+	if err := os.MkdirAll(volumeDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(volumeDir, "DiskDescriptor.xml"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(pv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	marker := path.Join(volumeDir, recoveryMarker)
+	if err := ioutil.WriteFile(marker, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return marker
+}
+
+func testVolume(name string) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Annotations: map[string]string{parentProvisionerAnn: *provisionerID, vzShareAnn: name},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+			ClaimRef:                      &v1.ObjectReference{Kind: "PersistentVolumeClaim", Namespace: "team-a", Name: "db", UID: "1234"},
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				FlexVolume: &v1.FlexVolumeSource{Driver: "virtuozzo/ploop", Options: map[string]string{"volumeID": name}},
+			},
+		},
+	}
+}
+
+func TestRecoverableVolume(t *testing.T) {
+	*provisionerID = "vz"
+	dir, err := ioutil.TempDir("", "recover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	existing := testVolume("pv-existing")
+	foreign := testVolume("pv-foreign")
+	foreign.Annotations[parentProvisionerAnn] = "other"
+	client := fake.NewSimpleClientset(existing)
+	p := &vzFSProvisioner{client: client}
+	// the volume is waiting out its grace period, its PV is already gone
+	if err := deferred.New(client, *namespace, deferredDeletesName(), time.Hour).Add(testVolume("pv-deferred")); err != nil {
+		t.Fatal(err)
+	}
+	pending, err := p.pendingDeletes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		pv     *v1.PersistentVolume
+		reason string
+	}{
+		{testVolume("pv-deferred"), "is deferred"},
+		{existing, "exists"},
+		{foreign, "provisioned by \"other\""},
+		{testVolume("pv-lost"), ""},
+	} {
+		pv, reason := p.recoverableVolume(writeMarker(t, dir, c.pv), pending)
+		if c.reason != "" {
+			if pv != nil || !strings.Contains(reason, c.reason) {
+				t.Errorf("%s: expected to be skipped as %q, got %v", c.pv.Name, c.reason, reason)
+			}
+			continue
+		}
+		if pv == nil {
+			t.Fatalf("%s: expected to be recoverable, got %s", c.pv.Name, reason)
+		}
+		if pv.Spec.PersistentVolumeReclaimPolicy != v1.PersistentVolumeReclaimRetain {
+			t.Errorf("%s: expected the recovered PV to be retained", pv.Name)
+		}
+		if ref := pv.Spec.ClaimRef; ref == nil || ref.Name != "db" || ref.UID != "" {
+			t.Errorf("%s: expected a claim reference by name, got %+v", pv.Name, ref)
+		}
+	}
+
+	// a marker without its image isn't recovered either
+	marker := writeMarker(t, dir, testVolume("pv-broken"))
+	os.Remove(path.Join(path.Dir(marker), "DiskDescriptor.xml"))
+	if pv, reason := p.recoverableVolume(marker, pending); pv != nil || !strings.Contains(reason, "no disk descriptor") {
+		t.Errorf("Expected a volume without descriptor to be skipped, got %v", reason)
+	}
+}
+
+func TestRecoverVolume(t *testing.T) {
+	*provisionerID = "vz"
+	client := fake.NewSimpleClientset(&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "vz-secret", Namespace: "kube-system"}})
+	tenantSecrets = newSecretAccess(client, nil, *namespace, "")
+	p := &vzFSProvisioner{
+		client:     client,
+		finalizers: newSecretFinalizers(),
+		records:    newVolumeRecords(client, *namespace),
+	}
+	lost := testVolume("pv-lost")
+	options := lost.Spec.FlexVolume.Options
+	options["optionsFromSystem"] = "true"
+	options["secretName"] = "vz-secret"
+	options["finalizer"] = "virtuozzo.com/lost-pv"
+	options["clusterName"] = "cl1"
+
+	if err := p.recoverVolume(lost); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Core().PersistentVolumes().Get("pv-lost", metav1.GetOptions{}); err != nil {
+		t.Errorf("Expected the PV to be created, got %v", err)
+	}
+	secret, err := client.Core().Secrets("kube-system").Get("vz-secret", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasFinalizer(secret, "virtuozzo.com/lost-pv") {
+		t.Errorf("Expected the finalizer of the volume restored on its secret, got %v", secret.Finalizers)
+	}
+	data, err := p.records.store("pv-lost").get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data["share"] != "pv-lost" || data["state"] != volumeProvisioned {
+		t.Errorf("Expected the record of the volume restored, got %v", data)
+	}
+
+	// a PV recreated meanwhile isn't overwritten
+	if err := p.recoverVolume(testVolume("pv-lost")); err == nil {
+		t.Errorf("Expected recovering an existing PV to fail")
+	}
+}
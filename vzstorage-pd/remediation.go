@@ -0,0 +1,88 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// hintContext describes where a failed operation took its settings from,
+// so a remediation hint can point to the exact object to fix
+type hintContext struct {
+	secretNamespace string
+	secretName      string
+	parameters      map[string]string
+}
+
+// remediations maps common backend failures to a text telling the user
+// what to check. The first matching entry wins.
+var remediations = []struct {
+	pattern *regexp.Regexp
+	hint    func(h *hintContext) string
+}{
+	{
+		regexp.MustCompile(`secrets? "[^"]*" not found`),
+		func(h *hintContext) string {
+			return fmt.Sprintf("create secret %s in namespace %s with clusterName and clusterPassword keys", h.secretName, h.secretNamespace)
+		},
+	},
+	{
+		regexp.MustCompile(`Unable to authenticate the node`),
+		func(h *hintContext) string {
+			return fmt.Sprintf("check secret key clusterPassword in secret %s in namespace %s", h.secretName, h.secretNamespace)
+		},
+	},
+	{
+		regexp.MustCompile(`Unable to mount .* in `),
+		func(h *hintContext) string {
+			return fmt.Sprintf("check that MDS servers of the cluster named by secret key clusterName in secret %s in namespace %s are reachable from the provisioner node", h.secretName, h.secretNamespace)
+		},
+	},
+	{
+		regexp.MustCompile(`Unable to set tier to `),
+		func(h *hintContext) string {
+			return fmt.Sprintf("check that tier %q set by StorageClass parameter vzsTier exists in the cluster", h.parameters["vzsTier"])
+		},
+	},
+	{
+		regexp.MustCompile(`Unable to set (replicas|encoding|failure-domain) to `),
+		func(h *hintContext) string {
+			return "check the vzsReplicas, vzsEncoding and vzsFailureDomain StorageClass parameters against the cluster configuration"
+		},
+	},
+	{
+		regexp.MustCompile(`(?i)permission denied|read-only file system`),
+		func(h *hintContext) string {
+			return fmt.Sprintf("check that volumePath %q and deltasPath %q are writable on the cluster", h.parameters["volumePath"], h.parameters["deltasPath"])
+		},
+	},
+}
+
+// explain adds a remediation hint to err if it matches a known failure.
+// The error text ends up in the PVC/PV events emitted by the controller.
+func (h *hintContext) explain(err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, r := range remediations {
+		if r.pattern.MatchString(err.Error()) {
+			return fmt.Errorf("%v (hint: %s)", err, r.hint(h))
+		}
+	}
+	return err
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/metrics"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzstorage"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzvolume"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// replicaCheckTimeout bounds the check of a single volume
+const replicaCheckTimeout = time.Minute
+
+var (
+	volumeReplicas = metrics.NewGauge("vzstorage_volume_replicas",
+		"Fewest replicas of any chunk of the image of a volume with vzsReplicas.", "pv")
+	volumeDegradedSeconds = metrics.NewGauge("vzstorage_volume_degraded_seconds",
+		"Time the image of a volume has had chunks with fewer replicas than its vzsReplicas norm.", "pv")
+)
+
+// replicaHealth periodically counts chunk replicas of images of volumes
+// with vzsReplicas and reports those which have been degraded, i.e. have
+// chunks with fewer replicas than the norm, for longer than a threshold.
+// Short degradations while the cluster replicates chunks of a lost chunk
+// server aren't reported. It's only run by the leader, a new leader starts
+// measuring degradations anew.
+type replicaHealth struct {
+	p         *vzFSProvisioner
+	threshold time.Duration
+	// time volumes were found degraded at, by PV name
+	degradedSince map[string]time.Time
+	// degraded volumes an event was emitted for
+	reported map[string]bool
+}
+
+func newReplicaHealth(p *vzFSProvisioner, threshold time.Duration) *replicaHealth {
+	return &replicaHealth{
+		p:             p,
+		threshold:     threshold,
+		degradedSince: map[string]time.Time{},
+		reported:      map[string]bool{},
+	}
+}
+
+func (h *replicaHealth) run(period time.Duration) {
+	wait.Forever(h.check, period)
+}
+
+func (h *replicaHealth) check() {
+	volumes, err := h.p.client.Core().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		glog.Errorf("Unable to list persistent volumes: %v", err)
+		return
+	}
+
+	checked := map[string]bool{}
+	for i := range volumes.Items {
+		volume := &volumes.Items[i]
+		if volume.Annotations[parentProvisionerAnn] != *provisionerID ||
+			volume.Spec.FlexVolume == nil || volume.Spec.FlexVolume.Options["vzsReplicas"] == "" {
+			continue
+		}
+		replicas, err := vzstorage.ParseReplicas(volume.Spec.FlexVolume.Options["vzsReplicas"])
+		if err != nil {
+			continue
+		}
+		checked[volume.Name] = true
+		min, err := h.minReplicas(volume)
+		if err != nil {
+			// the volume is considered as it was until it's checked again
+			glog.Warningf("Unable to check replicas of %s: %v", volume.Name, err)
+			continue
+		}
+		if min < 0 {
+			// nothing is written to the image yet
+			min = replicas.Norm
+		}
+		volumeReplicas.Set(float64(min), volume.Name)
+		h.update(volume, min, replicas.Norm)
+	}
+
+	for name := range h.degradedSince {
+		if !checked[name] {
+			h.forget(name)
+		}
+	}
+	for name := range h.reported {
+		if !checked[name] {
+			h.forget(name)
+		}
+	}
+}
+
+// update tracks the degradation of the volume and reports its changes
+func (h *replicaHealth) update(volume *v1.PersistentVolume, min, norm int) {
+	name := volume.Name
+	if min >= norm {
+		if h.reported[name] {
+			glog.Infof("Redundancy of %s is restored", name)
+			h.p.recorder.Eventf(volume, v1.EventTypeNormal, "ReplicasRestored",
+				"All chunks of the image have %d replicas again", norm)
+		}
+		delete(h.degradedSince, name)
+		delete(h.reported, name)
+		volumeDegradedSeconds.Delete(name)
+		return
+	}
+
+	since, ok := h.degradedSince[name]
+	if !ok {
+		since = time.Now()
+		h.degradedSince[name] = since
+	}
+	degraded := time.Since(since)
+	volumeDegradedSeconds.Set(degraded.Seconds(), name)
+	if degraded >= h.threshold && !h.reported[name] {
+		glog.Warningf("Chunks of %s have %d of %d replicas for %v", name, min, norm, degraded)
+		h.p.recorder.Eventf(volume, v1.EventTypeWarning, "ReplicasDegraded",
+			"Chunks of the image have %d of %d replicas for %v, the volume is a failure away from an outage",
+			min, norm, degraded-degraded%time.Second)
+		h.reported[name] = true
+	}
+}
+
+func (h *replicaHealth) forget(name string) {
+	delete(h.degradedSince, name)
+	delete(h.reported, name)
+	volumeReplicas.Delete(name)
+	volumeDegradedSeconds.Delete(name)
+}
+
+// minReplicas returns the fewest replicas of any chunk of any delta of
+// the image of the volume, -1 if the image has no chunks
+func (h *replicaHealth) minReplicas(volume *v1.PersistentVolume) (int, error) {
+	secretNamespace, secretName := volumeSecret(volume)
+	secret, err := tenantSecrets.get(secretNamespace, secretName)
+	if err != nil {
+		return 0, err
+	}
+	cluster, err := clusterFromSecret(secret)
+	if err != nil {
+		return 0, err
+	}
+	options := volume.Spec.FlexVolume.Options
+	if err := h.p.prepareVstorage(options, cluster, secret); err != nil {
+		return 0, err
+	}
+
+	_, imageDir := vzvolume.Paths(mountDir+cluster.name, options)
+	files, err := ioutil.ReadDir(imageDir)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), replicaCheckTimeout)
+	defer cancel()
+	min := -1
+	for _, f := range files {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		n, err := vzstorage.MinReplicas(ctx, path.Join(imageDir, f.Name()))
+		if err != nil {
+			return 0, err
+		}
+		if n >= 0 && (min < 0 || n < min) {
+			min = n
+		}
+	}
+	return min, nil
+}
@@ -0,0 +1,278 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/metrics"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzvolume"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// drPeerLabel on a StorageClass names the secret in the provisioner
+// namespace with credentials of the cluster its volumes are replicated to
+const drPeerLabel = "virtuozzo.com/dr-peer"
+
+var replicationLag = metrics.NewGauge("vzstorage_replication_lag_seconds",
+	"Time since the last successful replication of a volume to its DR peer cluster.", "pv")
+
+// replicationStatus is the state of replication of a single volume
+type replicationStatus struct {
+	Peer           string    `json:"peer"`
+	LastReplicated time.Time `json:"lastReplicated,omitempty"`
+	LastAttempt    time.Time `json:"lastAttempt"`
+	LastError      string    `json:"lastError,omitempty"`
+}
+
+// replicator periodically ships snapshots of volumes of StorageClasses
+// labeled with drPeerLabel to the peer cluster. Replication status of
+// each volume is kept in a config map.
+type replicator struct {
+	p      *vzFSProvisioner
+	status configMapStore
+}
+
+func newReplicator(p *vzFSProvisioner, client kubernetes.Interface, namespace, name string) *replicator {
+	return &replicator{
+		p: p,
+		status: configMapStore{
+			client:    client,
+			namespace: namespace,
+			name:      name,
+		},
+	}
+}
+
+func (r *replicator) run(period time.Duration) {
+	wait.Forever(r.replicate, period)
+}
+
+func (r *replicator) replicate() {
+	client := r.p.client
+	classes, err := client.Storage().StorageClasses().List(metav1.ListOptions{LabelSelector: drPeerLabel})
+	if err != nil {
+		glog.Errorf("Unable to list storage classes: %v", err)
+		return
+	}
+	peers := map[string]string{}
+	for _, c := range classes.Items {
+		peers[c.Name] = c.Labels[drPeerLabel]
+	}
+	if len(peers) == 0 {
+		return
+	}
+
+	volumes, err := client.Core().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		glog.Errorf("Unable to list persistent volumes: %v", err)
+		return
+	}
+	status, err := r.status.get()
+	if err != nil {
+		glog.Errorf("Unable to get replication status: %v", err)
+		return
+	}
+
+	for i := range volumes.Items {
+		volume := &volumes.Items[i]
+		peer, ok := peers[volume.Spec.StorageClassName]
+		if !ok || volume.Annotations[parentProvisionerAnn] != *provisionerID ||
+			volume.Status.Phase != v1.VolumeBound {
+			continue
+		}
+
+		var st replicationStatus
+		if data, ok := status[volume.Name]; ok {
+			json.Unmarshal([]byte(data), &st)
+		}
+		st.Peer = peer
+		st.LastAttempt = time.Now()
+		err := r.replicateVolume(volume, peer)
+		if e, ok := err.(*volumeInUseError); ok {
+			st.LastError, _ = r.p.postponeInUse(volume, "ReplicationPostponed", "replication", volume.Name, st.LastError, e)
+		} else if err != nil {
+			glog.Errorf("Unable to replicate %s to %s: %v", volume.Name, peer, err)
+			st.LastError = err.Error()
+		} else {
+			st.LastReplicated = st.LastAttempt
+			st.LastError = ""
+		}
+		if !st.LastReplicated.IsZero() {
+			replicationLag.Set(time.Since(st.LastReplicated).Seconds(), volume.Name)
+		}
+
+		data, err := json.Marshal(&st)
+		if err != nil {
+			continue
+		}
+		name := volume.Name
+		if _, err := r.status.modify(func(d map[string]string) { d[name] = string(data) }); err != nil {
+			glog.Errorf("Unable to update replication status of %s: %v", name, err)
+		}
+	}
+}
+
+// replicateVolume snapshots the volume and copies deltas of the snapshot
+// missing on the peer cluster. Deltas of a snapshot never change, so only
+// those made since the previous replication are copied. The snapshot is
+// taken offline, so a volume used by a pod is skipped until it's released.
+func (r *replicator) replicateVolume(volume *v1.PersistentVolume, peer string) error {
+	if err := r.p.checkNotInUse(volume); err != nil {
+		return err
+	}
+	options := volume.Spec.FlexVolume.Options
+	secretNamespace, secretName := volumeSecret(volume)
+	secret, err := tenantSecrets.get(secretNamespace, secretName)
+	if err != nil {
+		return err
+	}
+	cluster, err := clusterFromSecret(secret)
+	if err != nil {
+		return err
+	}
+	if err := r.p.prepareVstorage(options, cluster, secret); err != nil {
+		return err
+	}
+
+	peerSecret, err := tenantSecrets.get(*namespace, peer)
+	if err != nil {
+		return err
+	}
+	peerCluster, err := clusterFromSecret(peerSecret)
+	if err != nil {
+		return err
+	}
+	if err := r.p.prepareVstorage(options, peerCluster, peerSecret); err != nil {
+		return err
+	}
+
+	mount := mountDir + cluster.name
+	dir := vzvolume.SnapshotsDir(mount, options)
+	// snapshots left by interrupted runs are already stale
+	if err := r.p.merges.queueLeftovers(volume.Name, dir, options["volumeID"]+"-dr"); err != nil {
+		return err
+	}
+	snapshotPath, err := vzvolume.Snapshot(mount, options, tempSnapshotName(options, "-dr-"))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := r.p.merges.queue(volume.Name, snapshotPath); err != nil {
+			glog.Errorf("Unable to queue deletion of snapshot %s, the next run queues it: %v", snapshotPath, err)
+		}
+	}()
+
+	replicaPath, _ := vzvolume.Paths(mountDir+peerCluster.name, options)
+	return shipSnapshot(snapshotPath, mount, replicaPath, mountDir+peerCluster.name)
+}
+
+var reDeltaFile = regexp.MustCompile(`<File>([^<]+)</File>`)
+
+// shipSnapshot copies the descriptor and the deltas of the snapshot in
+// mount to replicaPath in peerMount. Deltas keep their paths relative to
+// the cluster root.
+func shipSnapshot(snapshotPath, mount, replicaPath, peerMount string) error {
+	dd, err := ioutil.ReadFile(path.Join(snapshotPath, "DiskDescriptor.xml"))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(replicaPath, 0755); err != nil {
+		return err
+	}
+
+	var shipErr error
+	replicaDD := reDeltaFile.ReplaceAllStringFunc(string(dd), func(m string) string {
+		file := reDeltaFile.FindStringSubmatch(m)[1]
+		if !path.IsAbs(file) {
+			file = path.Join(snapshotPath, file)
+		}
+		rel, err := filepath.Rel(mount, file)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			shipErr = fmt.Errorf("Delta %s is outside of %s", file, mount)
+			return m
+		}
+		peerFile := path.Join(peerMount, rel)
+		if err := copyDelta(file, peerFile); err != nil && shipErr == nil {
+			shipErr = err
+		}
+		relPeer, _ := filepath.Rel(replicaPath, peerFile)
+		return "<File>" + relPeer + "</File>"
+	})
+	if shipErr != nil {
+		return shipErr
+	}
+
+	tmp := path.Join(replicaPath, ".DiskDescriptor.xml")
+	if err := ioutil.WriteFile(tmp, []byte(replicaDD), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path.Join(replicaPath, "DiskDescriptor.xml"))
+}
+
+// copyDelta copies src to dst unless dst of the same size exists
+func copyDelta(src, dst string) error {
+	si, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if di, err := os.Stat(dst); err == nil && di.Size() == si.Size() {
+		return nil
+	}
+	if err := os.MkdirAll(path.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	glog.V(4).Infof("Copied delta %s to %s", src, dst)
+	return os.Rename(tmp, dst)
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	secretAccessDirect      = "direct"
+	secretAccessImpersonate = "impersonate"
+)
+
+// secretAccess reads and updates cluster secrets. Directly, the provisioner
+// needs access to secrets in all namespaces. With impersonation secrets of
+// other namespaces are accessed as the service account reader of their
+// namespace, so the provisioner only needs to impersonate that account and
+// every namespace grants access to its own secrets.
+type secretAccess struct {
+	client kubernetes.Interface
+	// config of the provisioner's client, nil to access secrets directly
+	config *rest.Config
+	// own namespace, whose secrets are always accessed directly
+	namespace string
+	reader    string
+
+	mu      sync.Mutex
+	clients map[string]kubernetes.Interface
+	// last successfully read version of every secret, to delete volumes
+	// while the API server is unavailable
+	cache map[string]*v1.Secret
+}
+
+// tenantSecrets accesses secrets of StorageClasses and volumes
+var tenantSecrets *secretAccess
+
+func newSecretAccess(client kubernetes.Interface, config *rest.Config, namespace, reader string) *secretAccess {
+	return &secretAccess{
+		client:    client,
+		config:    config,
+		namespace: namespace,
+		reader:    reader,
+		clients:   map[string]kubernetes.Interface{},
+		cache:     map[string]*v1.Secret{},
+	}
+}
+
+// clientFor returns the client to access secrets of namespace with
+func (s *secretAccess) clientFor(namespace string) (kubernetes.Interface, error) {
+	if s.config == nil || namespace == s.namespace {
+		return s.client, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.clients[namespace]; ok {
+		return c, nil
+	}
+	config := *s.config
+	config.Impersonate = rest.ImpersonationConfig{
+		UserName: fmt.Sprintf("system:serviceaccount:%s:%s", namespace, s.reader),
+	}
+	c, err := kubernetes.NewForConfig(&config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create client impersonating %s/%s: %v", namespace, s.reader, err)
+	}
+	s.clients[namespace] = c
+	return c, nil
+}
+
+func (s *secretAccess) get(namespace, name string) (*v1.Secret, error) {
+	c, err := s.clientFor(namespace)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := c.Core().Secrets(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// callers may change the secret they got, e.g. its finalizers
+	cached := *secret
+	s.mu.Lock()
+	s.cache[namespace+"/"+name] = &cached
+	s.mu.Unlock()
+	return secret, nil
+}
+
+// cached returns the secret as it was last read by get, if ever
+func (s *secretAccess) cached(namespace, name string) (*v1.Secret, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	secret, ok := s.cache[namespace+"/"+name]
+	return secret, ok
+}
+
+func (s *secretAccess) update(secret *v1.Secret) (*v1.Secret, error) {
+	c, err := s.clientFor(secret.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	return c.Core().Secrets(secret.Namespace).Update(secret)
+}
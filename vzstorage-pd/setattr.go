@@ -0,0 +1,49 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzstorage"
+)
+
+// attrAnnPrefix prefixes annotations of PVs with the vstorage attributes
+// set on their directories, normalized, e.g. virtuozzo.com/vstorage-replicas
+const attrAnnPrefix = "virtuozzo.com/vstorage-"
+
+// attrQueues keeps a set-attr queue per cluster, so that bulk provisioning
+// on one cluster doesn't delay others
+type attrQueues struct {
+	mu     sync.Mutex
+	queues map[string]*vzstorage.AttrQueue
+}
+
+func newAttrQueues() *attrQueues {
+	return &attrQueues{queues: map[string]*vzstorage.AttrQueue{}}
+}
+
+func (a *attrQueues) get(cluster string) *vzstorage.AttrQueue {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	q, ok := a.queues[cluster]
+	if !ok {
+		q = vzstorage.NewAttrQueue(float32(*setAttrQPS), *setAttrWorkers, *setAttrQueueSize)
+		a.queues[cluster] = q
+	}
+	return q
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// shardAnn on a StorageClass is the id of the provisioner serving it
+	shardAnn    = "virtuozzo.com/provisioner-id"
+	shardPeriod = 30 * time.Second
+)
+
+// shard is the set of StorageClasses served by this provisioner when
+// several provisioners with the same name split classes between them.
+// A class matching the selector is claimed by setting shardAnn on it, and
+// is served only by the provisioner which claimed it first.
+type shard struct {
+	client   kubernetes.Interface
+	selector labels.Selector
+}
+
+// serves returns true for classes claimed by this provisioner
+func (s *shard) serves(class metav1.Object) bool {
+	return s.selector.Matches(labels.Set(class.GetLabels())) &&
+		class.GetAnnotations()[shardAnn] == *provisionerID
+}
+
+func (s *shard) run(period time.Duration) {
+	wait.Forever(s.claim, period)
+}
+
+// claim sets shardAnn on matching classes which aren't claimed yet
+func (s *shard) claim() {
+	classes, err := s.client.Storage().StorageClasses().List(metav1.ListOptions{LabelSelector: s.selector.String()})
+	if err != nil {
+		glog.Errorf("Unable to list storage classes: %v", err)
+		return
+	}
+	for i := range classes.Items {
+		class := &classes.Items[i]
+		owner, ok := class.Annotations[shardAnn]
+		if ok {
+			if owner != *provisionerID {
+				glog.V(4).Infof("StorageClass %s is served by %s", class.Name, owner)
+			}
+			continue
+		}
+
+		if class.Annotations == nil {
+			class.Annotations = map[string]string{}
+		}
+		class.Annotations[shardAnn] = *provisionerID
+		// another provisioner updating the class at the same time makes
+		// this update conflict, the class is rechecked on the next run
+		if _, err := s.client.Storage().StorageClasses().Update(class); err != nil {
+			if !apierrors.IsConflict(err) {
+				glog.Errorf("Unable to claim StorageClass %s: %v", class.Name, err)
+			}
+			continue
+		}
+		glog.Infof("Claimed StorageClass %s", class.Name)
+	}
+}
@@ -0,0 +1,285 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/cron"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzvolume"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// scheduledSnapshotKind names postponed scheduled snapshots
+	scheduledSnapshotKind = "scheduled snapshot"
+	// StorageClass parameters of scheduled snapshots: a cron schedule and
+	// how many snapshots to keep or for how long
+	snapshotScheduleParam  = "snapshotSchedule"
+	snapshotRetentionParam = "snapshotRetention"
+	// scheduledSnapshotsAnn set to "false" on a PV or its claim excludes
+	// the volume from scheduled snapshots of its class
+	scheduledSnapshotsAnn = "virtuozzo.com/scheduled-snapshots"
+
+	scheduledSnapshotsPeriod  = time.Minute
+	defaultSnapshotRetention  = "7"
+	scheduledSnapshotInfix    = "-scheduled-"
+	scheduledSnapshotTimeForm = "20060102T150405Z"
+)
+
+// snapshotPolicy is when volumes of a class are snapshotted and which of
+// their snapshots are kept: the last keep ones, or those younger than
+// maxAge and the last one
+type snapshotPolicy struct {
+	schedule *cron.Schedule
+	keep     int
+	maxAge   time.Duration
+}
+
+// parseSnapshotPolicy returns the snapshot policy of class parameters, nil
+// if volumes of the class aren't snapshotted
+func parseSnapshotPolicy(parameters map[string]string) (*snapshotPolicy, error) {
+	spec, ok := parameters[snapshotScheduleParam]
+	if !ok {
+		return nil, nil
+	}
+	schedule, err := cron.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", snapshotScheduleParam, err)
+	}
+	policy := &snapshotPolicy{schedule: schedule}
+	retention := parameters[snapshotRetentionParam]
+	if retention == "" {
+		retention = defaultSnapshotRetention
+	}
+	if n, err := strconv.Atoi(retention); err == nil {
+		policy.keep = n
+	} else if policy.maxAge, err = time.ParseDuration(retention); err != nil {
+		return nil, fmt.Errorf("invalid %s %q, it is a number of snapshots or a duration", snapshotRetentionParam, retention)
+	}
+	if policy.keep <= 0 && policy.maxAge <= 0 {
+		return nil, fmt.Errorf("%s has to be positive", snapshotRetentionParam)
+	}
+	return policy, nil
+}
+
+// prune returns the snapshots, taken at the given sorted times, which are
+// to be removed at now
+func (s *snapshotPolicy) prune(taken []time.Time, now time.Time) []time.Time {
+	var removed []time.Time
+	for i, t := range taken {
+		last := i == len(taken)-1
+		if s.keep > 0 && i < len(taken)-s.keep || s.maxAge > 0 && !last && now.Sub(t) > s.maxAge {
+			removed = append(removed, t)
+		}
+	}
+	return removed
+}
+
+func (p *vzFSProvisioner) runScheduledSnapshots(period time.Duration) {
+	wait.Forever(p.takeScheduledSnapshots, period)
+}
+
+// takeScheduledSnapshots snapshots volumes of classes with a snapshot
+// schedule whose next snapshot is due, and prunes their old snapshots.
+// Snapshots are recorded only by their names, which carry the time they
+// were taken at, so a schedule missed while the provisioner was down
+// results in a single snapshot.
+func (p *vzFSProvisioner) takeScheduledSnapshots() {
+	classes, err := p.client.Storage().StorageClasses().List(metav1.ListOptions{})
+	if err != nil {
+		glog.Errorf("Unable to list storage classes: %v", err)
+		return
+	}
+	policies := map[string]*snapshotPolicy{}
+	for i := range classes.Items {
+		class := &classes.Items[i]
+		if !servesClass(class) {
+			continue
+		}
+		parameters, err := p.profiles.resolve(class.Parameters)
+		if err != nil {
+			continue
+		}
+		policy, err := parseSnapshotPolicy(parameters)
+		if err != nil {
+			glog.Warningf("Not snapshotting volumes of class %s: %v", class.Name, err)
+			continue
+		}
+		if policy != nil {
+			policies[class.Name] = policy
+		}
+	}
+	if len(policies) == 0 {
+		return
+	}
+
+	volumes, err := p.client.Core().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		glog.Errorf("Unable to list volumes: %v", err)
+		return
+	}
+	for i := range volumes.Items {
+		volume := &volumes.Items[i]
+		if volume.Annotations[parentProvisionerAnn] != *provisionerID || volume.Spec.FlexVolume == nil {
+			continue
+		}
+		class := volume.Spec.StorageClassName
+		if class == "" {
+			class = volume.Annotations[v1.BetaStorageClassAnnotation]
+		}
+		policy, ok := policies[class]
+		if !ok || p.scheduledSnapshotsExcluded(volume) {
+			continue
+		}
+		pending := volume.Annotations[maintenancePendingAnn]
+		err := p.scheduledSnapshot(volume, policy, time.Now().UTC())
+		if e, ok := err.(*volumeInUseError); ok {
+			if message, changed := p.postponeInUse(volume, "ScheduledSnapshotPostponed", scheduledSnapshotKind, volume.Name, pending, e); changed {
+				p.updateVolumeAnnotations(volume, func(ann map[string]string) { ann[maintenancePendingAnn] = message })
+			}
+		} else if err != nil {
+			glog.Warningf("Scheduled snapshot of %s failed: %v", volume.Name, err)
+			p.recorder.Event(volume, v1.EventTypeWarning, "ScheduledSnapshotFailed", err.Error())
+		} else if strings.HasPrefix(pending, scheduledSnapshotKind+" ") {
+			p.updateVolumeAnnotations(volume, func(ann map[string]string) { delete(ann, maintenancePendingAnn) })
+		}
+	}
+}
+
+// scheduledSnapshotsExcluded returns whether the PV or its claim opt out of
+// scheduled snapshots
+func (p *vzFSProvisioner) scheduledSnapshotsExcluded(volume *v1.PersistentVolume) bool {
+	if volume.Annotations[scheduledSnapshotsAnn] == "false" {
+		return true
+	}
+	ref := volume.Spec.ClaimRef
+	if ref == nil {
+		return false
+	}
+	claim, err := p.client.Core().PersistentVolumeClaims(ref.Namespace).Get(ref.Name, metav1.GetOptions{})
+	return err == nil && claim.Annotations[scheduledSnapshotsAnn] == "false"
+}
+
+func (p *vzFSProvisioner) scheduledSnapshot(volume *v1.PersistentVolume, policy *snapshotPolicy, now time.Time) error {
+	options := volume.Spec.FlexVolume.Options
+	secretNamespace, secretName := volumeSecret(volume)
+	secret, err := tenantSecrets.get(secretNamespace, secretName)
+	if err != nil {
+		return err
+	}
+	cluster, err := clusterFromSecret(secret)
+	if err != nil {
+		return err
+	}
+	if err := p.prepareVstorage(options, cluster, secret); err != nil {
+		return err
+	}
+	mount := mountDir + cluster.name
+	dir := vzvolume.SnapshotsDir(mount, options)
+	taken, err := scheduledSnapshots(dir, options)
+	if err != nil {
+		return err
+	}
+
+	last := volume.CreationTimestamp.Time
+	if len(taken) != 0 {
+		last = taken[len(taken)-1]
+	}
+	if next := policy.schedule.Next(last); !next.IsZero() && !now.Before(next) {
+		// snapshots are taken offline, see checkNotInUse
+		if err := p.checkNotInUse(volume); err != nil {
+			return err
+		}
+		now = now.Truncate(time.Second)
+		if _, err := vzvolume.Snapshot(mount, options, scheduledSnapshotName(options, now)); err != nil {
+			return err
+		}
+		glog.Infof("Took scheduled snapshot of %s", volume.Name)
+		taken = append(taken, now)
+	}
+
+	// pruned snapshots are kept until they are merged
+	for _, t := range policy.prune(taken, now) {
+		snapshot := path.Join(dir, scheduledSnapshotName(options, t))
+		if err := p.merges.queue(volume.Name, snapshot); err != nil {
+			return fmt.Errorf("Unable to prune snapshot %s: %v", snapshot, err)
+		}
+	}
+	return nil
+}
+
+func scheduledSnapshotName(options map[string]string, t time.Time) string {
+	return options["volumeID"] + scheduledSnapshotInfix + t.UTC().Format(scheduledSnapshotTimeForm) + ".snap"
+}
+
+type byTime []time.Time
+
+func (t byTime) Len() int           { return len(t) }
+func (t byTime) Less(i, j int) bool { return t[i].Before(t[j]) }
+func (t byTime) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+
+// scheduledSnapshots returns the sorted times scheduled snapshots of the
+// volume in dir were taken at
+func scheduledSnapshots(dir string, options map[string]string) ([]time.Time, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	prefix := options["volumeID"] + scheduledSnapshotInfix
+	var taken []time.Time
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".snap") {
+			continue
+		}
+		t, err := time.Parse(scheduledSnapshotTimeForm, strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".snap"))
+		if err == nil {
+			taken = append(taken, t)
+		}
+	}
+	sort.Sort(byTime(taken))
+	return taken, nil
+}
+
+// removeScheduledSnapshots removes scheduled snapshots of a deleted volume
+func removeScheduledSnapshots(mount string, options map[string]string) error {
+	dir := vzvolume.SnapshotsDir(mount, options)
+	taken, err := scheduledSnapshots(dir, options)
+	if err != nil {
+		return err
+	}
+	for _, t := range taken {
+		if err := deleteSnapshot(path.Join(dir, scheduledSnapshotName(options, t))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
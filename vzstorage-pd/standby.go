@@ -0,0 +1,156 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/lib/leaderelection"
+	rl "github.com/kubernetes-incubator/external-storage/lib/leaderelection/resourcelock"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/hostlock"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/metrics"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	standbyLeaseDuration = 15 * time.Second
+	standbyRenewDeadline = 10 * time.Second
+	standbyRetryPeriod   = 2 * time.Second
+	// how often to check whether operations of a leader handing off are
+	// done
+	handoffPollPeriod = time.Second
+	// mountDirLock is locked by the replica using mountDir, which may be
+	// shared by replicas on the same node through the host
+	mountDirLock = provisionerDir + "mnt.lock"
+)
+
+var leaderGauge = metrics.NewGauge("vzstorage_leader",
+	"1 if this replica of the provisioner is active, 0 if it is a standby.")
+
+// standby runs a replica of the provisioner as a warm standby: it mounts
+// clusters of existing volumes, which also caches their secrets, and waits
+// to be elected the active replica. The active replica hands off on
+// SIGTERM: it stops taking new operations, waits for running ones up to
+// the handoff timeout and releases the lease, so that a standby takes over
+// without waiting for the lease to expire.
+type standby struct {
+	client   kubernetes.Interface
+	recorder record.EventRecorder
+	identity string
+	// warmUp mounts clusters, it is run by a standby once the mount
+	// directory is its own
+	warmUp func()
+	// lead starts the provisioner, which runs until stop is closed
+	lead func(stop <-chan struct{})
+	// drained returns true once no operation is running
+	drained func() bool
+	handoff time.Duration
+
+	mountLock *hostlock.Lock
+}
+
+// run blocks until the replica loses or hands off leadership, when it
+// exits
+func (s *standby) run() {
+	leaderGauge.Set(0)
+	// a leader has to use the mount directory, so of replicas sharing it
+	// only the one holding its lock campaigns; the others wait for it to
+	// exit
+	if s.mountLock == nil {
+		s.mountLock = hostlock.New(mountDirLock)
+	}
+	err := s.mountLock.Acquire(func() {
+		glog.Infof("%s is used by another replica on this node, waiting for it to exit", mountDir)
+	})
+	if err != nil {
+		glog.Fatalf("Unable to lock %s: %v", mountDirLock, err)
+	}
+	s.warmUp()
+
+	stop := make(chan struct{})
+	task := make(chan bool, 1)
+	handingOff := make(chan struct{})
+	leading := make(chan struct{})
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-sigs
+		select {
+		case <-leading:
+		default:
+			glog.Infof("Standby stopped")
+			os.Exit(0)
+		}
+		glog.Infof("Handing off, waiting up to %v for running operations", s.handoff)
+		close(handingOff)
+		close(stop)
+		wait.PollImmediate(handoffPollPeriod, s.handoff, func() (bool, error) { return s.drained(), nil })
+		task <- true
+	}()
+
+	var le *leaderelection.LeaderElector
+	le, err = leaderelection.NewLeaderElector(leaderelection.Config{
+		Lock: &rl.ConfigMapLock{
+			ConfigMapMeta: metav1.ObjectMeta{Namespace: *namespace, Name: *provisionerID + "-leader"},
+			Client:        s.client,
+			LockConfig:    rl.Config{Identity: s.identity, EventRecorder: s.recorder},
+		},
+		LeaseDuration: standbyLeaseDuration,
+		RenewDeadline: standbyRenewDeadline,
+		RetryPeriod:   standbyRetryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(<-chan struct{}) {
+				glog.Infof("%s became the active replica", s.identity)
+				close(leading)
+				leaderGauge.Set(1)
+				s.lead(stop)
+			},
+			OnStoppedLeading: func() {
+				leaderGauge.Set(0)
+				select {
+				case <-handingOff:
+				default:
+					// operations of the lost term can't be stopped,
+					// restart as a standby
+					glog.Fatalf("%s lost leadership", s.identity)
+				}
+				if err := le.Release(); err != nil {
+					glog.Errorf("Unable to release leadership, standbys take over once it expires: %v", err)
+				}
+				glog.Infof("%s handed off", s.identity)
+				os.Exit(0)
+			},
+			OnNewLeader: func(identity string) {
+				if identity != "" && identity != s.identity {
+					glog.Infof("Standing by for %s", identity)
+				}
+			},
+		},
+	})
+	if err != nil {
+		glog.Fatalf("Unable to create leader elector: %v", err)
+	}
+	le.Run(task)
+}
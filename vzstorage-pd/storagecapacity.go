@@ -0,0 +1,211 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzstorage"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	storage "k8s.io/client-go/pkg/apis/storage/v1"
+)
+
+// storageCapacity is the space available to new volumes of a StorageClass,
+// similar to CSIStorageCapacity. The cluster is reachable from every node,
+// so the capacity has no topology.
+type storageCapacity struct {
+	StorageClass string `json:"storageClass"`
+	// Namespace is set for classes with secrets in claim namespaces, whose
+	// cluster depends on the namespace
+	Namespace string            `json:"namespace,omitempty"`
+	Cluster   string            `json:"cluster"`
+	Tier      string            `json:"tier"`
+	Capacity  resource.Quantity `json:"capacity"`
+	Time      time.Time         `json:"time"`
+}
+
+// storageCapacities publishes capacity of StorageClasses in a config map
+// for a scheduler extender, keyed by class name for classes with secrets
+// in kube-system and by <class>.<namespace> for others
+type storageCapacities struct {
+	configMapStore
+	profiles *storageProfiles
+}
+
+func newStorageCapacities(client kubernetes.Interface, namespace, name string, profiles *storageProfiles) *storageCapacities {
+	return &storageCapacities{
+		configMapStore: configMapStore{
+			client:    client,
+			namespace: namespace,
+			name:      name,
+		},
+		profiles: profiles,
+	}
+}
+
+// run publishes capacities every period
+func (c *storageCapacities) run(period time.Duration) {
+	wait.Forever(c.publish, period)
+}
+
+func (c *storageCapacities) publish() {
+	classes, err := c.client.Storage().StorageClasses().List(metav1.ListOptions{})
+	if err != nil {
+		glog.Errorf("Unable to list storage classes to publish capacity: %v", err)
+		return
+	}
+	volumes, err := c.client.Core().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		glog.Errorf("Unable to list PVs to publish capacity: %v", err)
+		return
+	}
+	// namespaces of claims which use a class, whose secrets tell clusters
+	// of classes without optionsFromSystem
+	namespaces := map[string]map[string]bool{}
+	for _, volume := range volumes.Items {
+		if volume.Annotations[parentProvisionerAnn] != *provisionerID || volume.Spec.ClaimRef == nil {
+			continue
+		}
+		class := volume.Spec.StorageClassName
+		if namespaces[class] == nil {
+			namespaces[class] = map[string]bool{}
+		}
+		namespaces[class][volume.Spec.ClaimRef.Namespace] = true
+	}
+
+	s := &capacitySnapshot{
+		mounted:    map[string]bool{},
+		stats:      map[string]*vzstorage.ClusterStat{},
+		capacities: map[string]string{},
+	}
+	for _, cluster := range mountedClusters() {
+		s.mounted[cluster] = true
+	}
+	for i := range classes.Items {
+		class := &classes.Items[i]
+		if class.Provisioner != *provisionerName {
+			continue
+		}
+		// tier and replication may come from the profile of the class
+		parameters, err := c.profiles.resolve(class.Parameters)
+		if err != nil {
+			glog.Warningf("Unable to compute capacity of %s: %v", class.Name, err)
+			continue
+		}
+		resolved := *class
+		resolved.Parameters = parameters
+		class = &resolved
+		if class.Parameters["optionsFromSystem"] == "true" {
+			s.add(class.Name, class, "kube-system", "")
+			continue
+		}
+		for ns := range namespaces[class.Name] {
+			s.add(class.Name+"."+ns, class, ns, ns)
+		}
+	}
+
+	_, err = c.modify(func(data map[string]string) {
+		for key := range data {
+			delete(data, key)
+		}
+		for key, value := range s.capacities {
+			data[key] = value
+		}
+	})
+	if err != nil {
+		glog.Errorf("Unable to publish storage capacity: %v", err)
+	}
+}
+
+// capacitySnapshot collects capacities of classes during a single publish,
+// querying every cluster once
+type capacitySnapshot struct {
+	mounted    map[string]bool
+	stats      map[string]*vzstorage.ClusterStat
+	capacities map[string]string
+}
+
+// add computes capacity of the class with its secret in secretNamespace.
+// Only mounted clusters are queried, the capacity of others is unknown.
+func (s *capacitySnapshot) add(key string, class *storage.StorageClass, secretNamespace, namespace string) {
+	secret, err := tenantSecrets.get(secretNamespace, class.Parameters["secretName"])
+	if err != nil {
+		glog.V(4).Infof("Unable to get secret of %s: %v", key, err)
+		return
+	}
+	cluster := string(secret.Data["clusterName"])
+	if !s.mounted[cluster] {
+		return
+	}
+	st, ok := s.stats[cluster]
+	if !ok {
+		if st, err = clusterStats.Stat(context.Background(), cluster); err != nil {
+			glog.Warningf("Unable to get capacity of cluster %s: %v", cluster, err)
+		}
+		s.stats[cluster] = st
+	}
+	if st == nil {
+		return
+	}
+
+	tier := class.Parameters["vzsTier"]
+	if tier == "" {
+		tier = "0"
+	}
+	var free uint64
+	if t, ok := st.Tiers[tier]; ok {
+		free = t.Free
+	}
+	if st.LicensedCapacity != 0 {
+		var used uint64
+		for _, t := range st.Tiers {
+			used += t.Used()
+		}
+		licensed := uint64(0)
+		if st.LicensedCapacity > used {
+			licensed = st.LicensedCapacity - used
+		}
+		if licensed < free {
+			free = licensed
+		}
+	}
+	usable, err := vzstorage.UsableSpace(free, class.Parameters["vzsReplicas"], class.Parameters["vzsEncoding"], st.Replicas)
+	if err != nil {
+		glog.Warningf("Unable to compute capacity of %s: %v", key, err)
+		return
+	}
+
+	data, err := json.Marshal(&storageCapacity{
+		StorageClass: class.Name,
+		Namespace:    namespace,
+		Cluster:      cluster,
+		Tier:         tier,
+		Capacity:     *resource.NewQuantity(int64(usable), resource.BinarySI),
+		Time:         time.Now(),
+	})
+	if err != nil {
+		glog.Errorf("Unable to marshal capacity of %s: %v", key, err)
+		return
+	}
+	s.capacities[key] = string(data)
+}
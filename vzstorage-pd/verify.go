@@ -0,0 +1,144 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzvolume"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// verifyAnn on a claim or its PV requests a check of the image chain
+	// of the volume, "check" or "now" only reports problems and "repair"
+	// fixes them
+	verifyAnn = "virtuozzo.com/verify"
+	// verifyResultAnn on the annotated claim or PV is the time and outcome
+	// of its last check
+	verifyResultAnn = "virtuozzo.com/verify-result"
+	verifyPeriod    = 30 * time.Second
+
+	verifyCheck  = "check"
+	verifyRepair = "repair"
+)
+
+// runVerifier periodically looks for claims and PVs annotated for
+// verification
+func (p *vzFSProvisioner) runVerifier(period time.Duration) {
+	wait.Forever(p.processVerifications, period)
+}
+
+func (p *vzFSProvisioner) processVerifications() {
+	var nodes map[string]string
+	for _, r := range p.maintenanceRequests(verifyAnn) {
+		if nodes == nil {
+			nodes = p.maintenance.claimNodes()
+		}
+		if node := nodes[r.claim.Namespace+"/"+r.claim.Name]; node != "" && r.value == verifyRepair {
+			p.postponeMaintenance(r, "repair", node)
+			continue
+		}
+		r := r
+		p.maintenance.start("verification", r.claim, r.volume, nodes, func() { p.verifyClaim(r) })
+	}
+}
+
+func (p *vzFSProvisioner) verifyClaim(r *maintenanceRequest) {
+	volume, mode := r.volume, r.value
+	if mode == maintenanceNow {
+		mode = verifyCheck
+	}
+	var err error
+	if mode != verifyCheck && mode != verifyRepair {
+		err = fmt.Errorf("unknown mode %q, use %q or %q", mode, verifyCheck, verifyRepair)
+	} else {
+		err = p.verify(volume, mode == verifyRepair)
+	}
+	operation := "Verify"
+	if mode == verifyRepair {
+		operation = "Repair"
+	}
+	p.history.add(volume.Spec.ClaimRef, volume.Name, operation, err, false)
+
+	var result string
+	switch {
+	case err != nil:
+		glog.Errorf("Verification of %s failed: %v", volume.Name, err)
+		p.recorder.Eventf(r.object(), v1.EventTypeWarning, "VerificationFailed", "The image didn't pass %s: %v", mode, err)
+		result = "Failed: " + err.Error()
+	case mode == verifyRepair:
+		glog.Infof("Repaired %s", volume.Name)
+		p.recorder.Event(r.object(), v1.EventTypeNormal, "Repaired", "The image is checked and repaired")
+		result = "Repaired"
+	default:
+		glog.Infof("Verified %s", volume.Name)
+		p.recorder.Event(r.object(), v1.EventTypeNormal, "Verified", "The image is consistent")
+		result = "OK"
+	}
+
+	// like compaction, verification is done once per request
+	p.updateAnnotations(r, func(ann map[string]string) {
+		delete(ann, verifyAnn)
+		delete(ann, maintenancePendingAnn)
+		ann[verifyResultAnn] = time.Now().UTC().Format(time.RFC3339) + " " + result
+	})
+}
+
+// verify runs ploop check on all deltas of the image. Without repair the
+// image isn't modified, so it can be checked while it is in use, though a
+// busy image may be reported inconsistent. Repair needs the image not to
+// be used by a pod.
+func (p *vzFSProvisioner) verify(volume *v1.PersistentVolume, repair bool) error {
+	if volume.Spec.FlexVolume == nil {
+		return fmt.Errorf("volume is not a flexvolume")
+	}
+	secretNamespace, secretName := volumeSecret(volume)
+	secret, err := tenantSecrets.get(secretNamespace, secretName)
+	if err != nil {
+		return err
+	}
+	cluster, err := clusterFromSecret(secret)
+	if err != nil {
+		return err
+	}
+	options := volume.Spec.FlexVolume.Options
+	if err := p.prepareVstorage(options, cluster, secret); err != nil {
+		return err
+	}
+
+	ploopPath, _ := vzvolume.Paths(mountDir+cluster.name, options)
+	// -f checks images marked clean too, -c looks for duplicated blocks
+	args := []string{"check", "-f", "-c"}
+	if repair {
+		args = append(args, "-F")
+	} else {
+		args = append(args, "-r")
+	}
+	args = append(args, path.Join(ploopPath, "DiskDescriptor.xml"))
+	out, err := exec.Command("ploop", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
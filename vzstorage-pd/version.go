@@ -0,0 +1,53 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/metrics"
+)
+
+// Build information, set by the Makefile with -ldflags "-X main.version=..."
+var (
+	version   = "unknown"
+	gitCommit = "unknown"
+	buildDate = "unknown"
+)
+
+var buildInfo = metrics.NewGauge("vzstorage_build_info",
+	"Build information of the provisioner, always 1.", "version", "commit", "date")
+
+func init() {
+	buildInfo.Set(1, version, gitCommit, buildDate)
+}
+
+func versionString() string {
+	return fmt.Sprintf("vzstorage-pd %s (commit %s, built %s)", version, gitCommit, buildDate)
+}
+
+// serveVersion writes the build information as JSON
+func serveVersion(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"version":   version,
+		"gitCommit": gitCommit,
+		"buildDate": buildDate,
+	})
+}
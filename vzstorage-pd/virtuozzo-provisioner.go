@@ -17,265 +17,313 @@ limitations under the License.
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
-	"os/exec"
 	"path"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/kubernetes-incubator/external-storage/lib/controller"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/cron"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/journal"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/metrics"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/trace"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzstorage"
+	"github.com/kubernetes-incubator/external-storage/vzstorage-pd/pkg/vzvolume"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/uuid"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/pkg/api"
 	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/api/v1/helper"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 
-	"github.com/dustin/go-humanize"
-	"github.com/virtuozzo/goploop-cli"
 	"github.com/virtuozzo/ploop-flexvol/vstorage"
 )
 
 const (
 	parentProvisionerAnn = "vzFSParentProvisioner"
 	vzShareAnn           = "vzShare"
+	// set by the controller on dynamically provisioned PVs
+	provisionedByAnn = "pv.kubernetes.io/provisioned-by"
+	// StorageClass parameter telling how images are wiped on deletion
+	secureDeleteParam = vzvolume.SecureDeleteOption
 )
 
 type vzFSProvisioner struct {
 	// Kubernetes Client. Use to retrieve secrets with Virtuozzo Storage credentials
 	client kubernetes.Interface
+	// Audit trail of Provision and Delete calls
+	audit *auditLog
+	// Leftovers of failed provisioning to be removed in background
+	cleanup *cleanupQueue
+	// Clusters which can't be reached at the moment
+	health *clusterHealth
+	// Emits events on objects related to volumes
+	recorder record.EventRecorder
+	// When this replica took over, journal entries written before are left
+	// over by a crash
+	journalSince time.Time
+	// Chooses a directory for ploop images if deltasPath lists several
+	deltas *vzstorage.DeltasBalancer
+	// Keeps finalizers of volumes on secrets with cluster credentials
+	finalizers *secretFinalizers
+	// Volumes released within the grace period, nil if it is disabled
+	deferred *deferredDeletes
+	// Rate limits vstorage set-attr calls per cluster
+	attrs *attrQueues
+	// Ploop volumes attached to nodes, nil if not tracked
+	attach *attachLimits
+	// Namespaces allowed to use StorageClasses, nil if not restricted
+	policy *namespacePolicy
+	// Limits concurrency of compaction and verification
+	maintenance *maintenance
+	// Deletes snapshots which are no longer needed
+	merges *merger
+	// Records of provisioned volumes, nil if they aren't kept
+	records *volumeRecords
+	// Histories of operations on volumes, nil if they aren't kept
+	history *volumeHistories
+	// Timeouts of Provision and Delete
+	operations *operations
+	// Parameters shared by StorageClasses
+	profiles *storageProfiles
+	// Limits capacity of volumes relative to space of clusters
+	overcommit *overcommitGuard
+	// Pace compactions, nil if they run at full speed
+	compactBudgets *compactBudgets
+	// Serialize mounting of each cluster
+	mountMu    sync.Mutex
+	mountLocks map[string]*sync.Mutex
 }
 
-func newVzFSProvisioner(client kubernetes.Interface) controller.Provisioner {
+func newVzFSProvisioner(client kubernetes.Interface, audit *auditLog, cleanup *cleanupQueue, recorder record.EventRecorder) *vzFSProvisioner {
 	return &vzFSProvisioner{
-		client: client,
+		client:     client,
+		audit:      audit,
+		cleanup:    cleanup,
+		health:     newClusterHealth(recorder),
+		recorder:   recorder,
+		deltas:     vzstorage.NewDeltasBalancer(),
+		finalizers: newSecretFinalizers(),
+		attrs:      newAttrQueues(),
+		operations: newOperations(*operationTimeout),
+		profiles:   newStorageProfiles(client, *namespace),
+		overcommit: newOvercommitGuard(client),
+		mountLocks: map[string]*sync.Mutex{},
 	}
 }
 
 var _ controller.Provisioner = &vzFSProvisioner{}
 
+// tracer traces volume operations, nil if tracing is disabled
+var tracer *trace.Tracer
+
 const provisionerDir = "/export/virtuozzo-provisioner/"
 const mountDir = provisionerDir + "mnt/"
 
-func prepareVstorage(options map[string]string, clusterName string, clusterPassword string) error {
-	mount := mountDir + clusterName
+// prepareVstorage mounts the cluster unless it is mounted, tracing the
+// steps taken under span
+func prepareVstorage(ctx context.Context, span *trace.Span, options map[string]string, cluster *vstorageCluster) error {
+	mount := mountDir + cluster.name
 	mounted, _ := vstorage.IsVstorage(mount)
 	if mounted {
 		return nil
 	}
 
-	if err := os.MkdirAll(mount, 0755); err != nil {
+	// a mount left from the previous boot or cluster client instance
+	// has to be detached before it can be rebuilt
+	if err := cleanupStaleMount(mount); err != nil {
 		return err
 	}
 
-	v := vstorage.Vstorage{clusterName}
-	p, _ := v.Mountpoint()
-	if p != "" {
-		return syscall.Mount(p, mount, "", syscall.MS_BIND, "")
-	}
-
-	if err := v.Auth(clusterPassword); err != nil {
+	if err := os.MkdirAll(mount, 0755); err != nil {
 		return err
 	}
-	if err := v.Mount(mount); err != nil {
+
+	p, _ := hostMounts.Mountpoint(cluster.name)
+	if p != "" {
+		s := span.Child("vstorage.bind-mount")
+		err := syscall.Mount(p, mount, "", syscall.MS_BIND, "")
+		s.End(err)
 		return err
 	}
 
-	return nil
-}
-
-func createPloop(mount string, options map[string]string) error {
-	var (
-		volumePath, deltasPath, volumeID, size string
-	)
-
-	for k, v := range options {
-		switch k {
-		case "volumePath":
-			volumePath = v
-		case "deltasPath":
-			deltasPath = v
-		case "volumeID":
-			volumeID = v
-		case "size":
-			size = v
-		case "vzsReplicas":
-		case "vzsFailureDomain":
-		case "vzsEncoding":
-		case "vzsTier":
-		case "kubernetes.io/readwrite":
-		case "kubernetes.io/fsType":
-		default:
+	if len(cluster.mdsAddresses) != 0 {
+		addrs, err := mdsAddresses(cluster)
+		if err != nil {
+			return err
+		}
+		if err := vzstorage.WriteBSList(cluster.name, addrs); err != nil {
+			return fmt.Errorf("Unable to configure MDS addresses of %s: %v", cluster.name, err)
 		}
 	}
 
-	if volumePath == "" {
-		return fmt.Errorf("volumePath isn't specified")
-	}
-
-	if deltasPath == "" {
-		deltasPath = volumePath
-	}
-
-	if volumeID == "" {
-		return fmt.Errorf("volumeID isn't specified")
+	if !clusterAuth.authenticated(cluster) {
+		v := vstorage.Vstorage{Name: cluster.name}
+		s := span.Child("vstorage.auth")
+		err := v.Auth(cluster.password)
+		s.End(err)
+		if err != nil {
+			return err
+		}
+		clusterAuth.add(cluster)
 	}
+	s := span.Child("vstorage.mount")
+	err := mountCluster(ctx, cluster, mount)
+	s.End(err)
+	clusterAuth.invalidate(cluster.name, err)
+	return err
+}
 
-	if size == "" {
-		return fmt.Errorf("size isn't specified")
+// mountLock returns the lock serializing changes of the mount of cluster
+func (p *vzFSProvisioner) mountLock(cluster string) *sync.Mutex {
+	p.mountMu.Lock()
+	defer p.mountMu.Unlock()
+	lock, ok := p.mountLocks[cluster]
+	if !ok {
+		lock = &sync.Mutex{}
+		p.mountLocks[cluster] = lock
 	}
+	return lock
+}
 
-	// get a human readable size from the map
-	bytes, _ := humanize.ParseBytes(size)
-
-	// ploop driver takes kilobytes, so convert it
-	volumeSize := bytes / 1024
-
-	volumeDir := path.Join(mount, volumePath)
-	ploopPath := path.Join(volumeDir, volumeID)
-
-	deltaDir := path.Join(mount, deltasPath)
-	// add .image suffix to handle case when deltasPath == volumePath
-	imageDir := path.Join(deltaDir, volumeID+".image")
-	imageFile := path.Join(imageDir, "root.hds")
-
-	if err := os.MkdirAll(volumeDir, 0755); err != nil {
-		return fmt.Errorf("Error creating dir %s: %v", volumeDir, err)
-	}
+// prepareVstorage mounts the cluster unless it is known to be unavailable,
+// and starts tracking its outage if it can't be mounted
+func (p *vzFSProvisioner) prepareVstorage(options map[string]string, cluster *vstorageCluster, secret *v1.Secret) error {
+	return p.prepareVstorageTraced(context.Background(), nil, options, cluster, secret)
+}
 
-	if err := os.MkdirAll(deltaDir, 0755); err != nil {
-		return fmt.Errorf("Error creating dir %s: %v", deltaDir, err)
+func (p *vzFSProvisioner) prepareVstorageTraced(ctx context.Context, span *trace.Span, options map[string]string, cluster *vstorageCluster, secret *v1.Secret) error {
+	if err := p.health.check(cluster.name); err != nil {
+		return err
 	}
 
-	// create base dirs for ploop metadatas and ploop images
-	if err := os.Mkdir(ploopPath, 0755); err != nil {
-		return fmt.Errorf("Error creating dir %s: %v", ploopPath, err)
-	}
+	lock := p.mountLock(cluster.name)
+	wait := span.Child("vstorage.mount-lock")
+	lock.Lock()
+	wait.End(nil)
+	err := prepareVstorage(ctx, span, options, cluster)
+	lock.Unlock()
 
-	if err := os.Mkdir(imageDir, 0755); err != nil {
-		os.Remove(ploopPath)
-		return fmt.Errorf("Error creating dir %s: %v", imageDir, err)
+	if isClusterUnavailable(err) {
+		p.health.markUnavailable(cluster, secret, err)
 	}
+	return err
+}
 
-	for _, d := range []string{ploopPath, imageDir} {
-		for k, v := range options {
-			attr := ""
-			switch k {
-			case "vzsReplicas":
-				attr = "replicas"
-			case "vzsTier":
-				attr = "tier"
-			case "vzsEncoding":
-				attr = "encoding"
-			case "vzsFailureDomain":
-				attr = "failure-domain"
-			}
-			if attr == "" {
-				continue
-			}
+// shareName returns the name of the ploop volume backing the claim
+func shareName(claim *v1.PersistentVolumeClaim) string {
+	return fmt.Sprintf("kubernetes-dynamic-pvc-%s", claim.UID)
+}
 
-			cmd := "vstorage"
-			args := []string{"set-attr", "-R", d,
-				fmt.Sprintf("%s=%s", attr, v)}
-			if err := exec.Command(cmd, args...).Run(); err != nil {
-				os.Remove(ploopPath)
-				os.Remove(imageDir)
-				return fmt.Errorf("Unable to set %s to %s for %s: %v", attr, v, d, err)
+// removePloop deletes the volume, see vzvolume.DeleteVolume
+func removePloop(ctx context.Context, mount string, options map[string]string) error {
+	ploopPath, _ := vzvolume.Paths(mount, options)
+	glog.Infof("Delete: %s", ploopPath)
+	// ploop only knows files of its own, and a volume being deleted is
+	// not to be recovered
+	for _, d := range []string{ploopPath, ploopPath + ".deleted"} {
+		for _, f := range []string{recoveryMarker, bundleMetadataFile} {
+			if err := os.Remove(path.Join(d, f)); err != nil && !os.IsNotExist(err) {
+				return err
 			}
 		}
 	}
-
-	// Create the ploop volume
-	_, err := ploop.PloopVolumeCreate(ploopPath, volumeSize, imageFile)
-	if err != nil {
-		os.RemoveAll(ploopPath)
-		os.RemoveAll(imageDir)
-		return err
-	}
-
-	return nil
+	return vzvolume.DeleteVolume(ctx, mount, options)
 }
 
-func copySecret(secret *v1.Secret) (*v1.Secret, error) {
-	clone, err := api.Scheme.DeepCopy(secret)
-	if err != nil {
-		return nil, fmt.Errorf("Error cloning secret: %v", err)
+// volumeGone returns true if the volume was removed from a mounted cluster
+// out of band. A cluster without volumePath isn't trusted to be the right
+// one, so it is reported as an error.
+func volumeGone(mount string, options map[string]string) (bool, error) {
+	if mounted, _ := vstorage.IsVstorage(mount); !mounted {
+		return false, fmt.Errorf("%s is not a mounted cluster", mount)
 	}
-	newSecret, ok := clone.(*v1.Secret)
-	if !ok {
-		return nil, fmt.Errorf("Unexpected secret cast error: %v", newSecret)
-	}
-	return newSecret, nil
-}
-
-func (p *vzFSProvisioner) patchSecret(oldSecret, newSecret *v1.Secret) error {
-	oldData, err := json.Marshal(oldSecret)
-	if err != nil {
-		glog.Errorf("failed to marshal secret %s: %v", newSecret.Name, err)
-		return err
+	volumeDir := path.Join(mount, options["volumePath"])
+	if _, err := os.Stat(volumeDir); err != nil {
+		return false, fmt.Errorf("Unable to verify that the volume is gone: %v", err)
 	}
-	newData, err := json.Marshal(newSecret)
-	if err != nil {
-		glog.Errorf("failed to marshal secret patch %s: %v", newSecret.Name, err)
-		return err
+	ploopPath, _ := vzvolume.Paths(mount, options)
+	for _, d := range []string{ploopPath, ploopPath + ".deleted"} {
+		if _, err := os.Stat(path.Join(d, "DiskDescriptor.xml")); !os.IsNotExist(err) {
+			return false, nil
+		}
 	}
+	return true, nil
+}
 
-	patchBytes, err := strategicpatch.CreateTwoWayMergePatch(oldData, newData, v1.Secret{})
-	if err != nil {
-		glog.Errorf("failed to create patch for secret %s: %v", newSecret.Name, err)
+// Provision creates a storage asset and returns a PV object representing it.
+func (p *vzFSProvisioner) Provision(options controller.VolumeOptions) (*v1.PersistentVolume, error) {
+	var pv *v1.PersistentVolume
+	err := p.operations.run("Provision "+options.PVName, func(ctx context.Context) (err error) {
+		pv, err = p.provision(ctx, options)
 		return err
+	})
+	claim := fmt.Sprintf("%s/%s", options.PVC.Namespace, options.PVC.Name)
+	p.audit.record("Provision", options.PVName, claim, shareName(options.PVC), err)
+	if err == nil {
+		p.records.update(pv, volumeProvisioned, nil)
 	}
-	glog.Infof("Secret %s patch: %s", newSecret.Name, string(patchBytes))
-
-	_, err = p.client.Core().Secrets(newSecret.ObjectMeta.Namespace).Patch(newSecret.Name, types.StrategicMergePatchType, patchBytes)
-	return err
+	// a failed attempt leaves no volume, its history expires unless a
+	// retry succeeds
+	ref := &v1.ObjectReference{Namespace: options.PVC.Namespace, Name: options.PVC.Name}
+	p.history.add(ref, options.PVName, "Provision", err, err != nil)
+	return pv, err
 }
 
-func removePloop(mount string, options map[string]string) error {
-	volumePath := options["volumePath"]
-	volumeID := options["volumeID"]
-	deltasPath, ok := options["deltasPath"]
-	if !ok {
-		deltasPath = volumePath
+func (p *vzFSProvisioner) provision(ctx context.Context, options controller.VolumeOptions) (_ *v1.PersistentVolume, err error) {
+	span := tracer.Start("Provision")
+	span.SetAttribute("claim", options.PVC.Namespace+"/"+options.PVC.Name)
+	span.SetAttribute("pv", options.PVName)
+	defer func() { span.End(err) }()
+
+	requested := options.PVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
+	if options.Parameters, err = route(options.Parameters, requested); err != nil {
+		p.recorder.Event(options.PVC, v1.EventTypeWarning, "ProfileInvalid", err.Error())
+		return nil, err
 	}
-	imageDir := path.Join(mount, deltasPath, volumeID+".image")
-	ploopPath := path.Join(mount, options["volumePath"], options["volumeID"])
-	ploopPathTmp := path.Join(mount, options["volumePath"], options["volumeID"]+".deleted")
-	err := os.Rename(ploopPath, ploopPathTmp)
-	if err != nil {
-		return err
+	profile := options.Parameters[profileParam]
+	if options.Parameters, err = p.profiles.resolve(options.Parameters); err != nil {
+		p.recorder.Event(options.PVC, v1.EventTypeWarning, "ProfileInvalid", err.Error())
+		return nil, err
 	}
-
-	cmd := "vstorage"
-	args := []string{"revoke", "-R", imageDir}
-	err = exec.Command(cmd, args...).Run()
-	if err != nil {
-		glog.Errorf("Unable to revoke a lease for %s", imageDir)
+	if err := checkParameters(options.Parameters, *strictParameters); err != nil {
+		return nil, err
 	}
-
-	vol, err := ploop.PloopVolumeOpen(ploopPathTmp)
-	if err != nil {
-		return err
+	if _, err := parseSnapshotPolicy(options.Parameters); err != nil {
+		return nil, err
 	}
-	glog.Infof("Delete: %s", ploopPathTmp)
-	err = vol.Delete()
+	attrs, err := vzvolume.Attributes(options.Parameters)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if p.policy != nil {
+		rules, err := p.policy.load()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read namespace policy: %v", err)
+		}
+		class := helper.GetPersistentVolumeClaimClass(options.PVC)
+		if err := rules.Check(options.PVC.Namespace, class, options.Parameters); err != nil {
+			p.recorder.Event(options.PVC, v1.EventTypeWarning, "PolicyViolation", err.Error())
+			return nil, err
+		}
 	}
-	os.RemoveAll(imageDir)
-	return nil
-}
 
-// Provision creates a storage asset and returns a PV object representing it.
-func (p *vzFSProvisioner) Provision(options controller.VolumeOptions) (*v1.PersistentVolume, error) {
 	modes := options.PVC.Spec.AccessModes
 	if len(modes) == 0 {
 		// if AccessModes field is absent, ReadWriteOnce is used by default
@@ -291,17 +339,30 @@ func (p *vzFSProvisioner) Provision(options controller.VolumeOptions) (*v1.Persi
 	if options.PVC.Spec.Selector != nil {
 		return nil, fmt.Errorf("claim Selector is not supported")
 	}
-	share := fmt.Sprintf("kubernetes-dynamic-pvc-%s", options.PVC.UID)
+	share := shareName(options.PVC)
 
-	glog.Infof("Add %s %s", share, humanize.Bytes(uint64(bytes)))
+	glog.Infof("Add %s %s", share, capacity.String())
 
 	storageClassOptions := map[string]string{}
 	for k, v := range options.Parameters {
 		storageClassOptions[k] = v
 	}
 
+	allocation, err := allocationOf(options.PVC, options.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := parsePVMetadata(options.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	delete(storageClassOptions, pvLabelsParam)
+	delete(storageClassOptions, pvAnnotationsParam)
+	delete(storageClassOptions, snapshotScheduleParam)
+	delete(storageClassOptions, snapshotRetentionParam)
 	storageClassOptions["volumeID"] = share
 	storageClassOptions["size"] = fmt.Sprintf("%d", bytes)
+	storageClassOptions[allocationParam] = allocation
 	secretName := storageClassOptions["secretName"]
 	optionsFromSystem := storageClassOptions["optionsFromSystem"]
 
@@ -315,30 +376,130 @@ func (p *vzFSProvisioner) Provision(options controller.VolumeOptions) (*v1.Persi
 		delete(storageClassOptions, "secretName")
 	}
 
-	secret, err := p.client.Core().Secrets(secretNamespace).Get(secretName, metav1.GetOptions{})
+	hints := &hintContext{secretNamespace, secretName, options.Parameters}
+	defer func() { err = hints.explain(err) }()
+
+	image, err := p.imageSourceOf(options.PVC)
+	if err != nil {
+		return nil, err
+	}
+	secret, cluster, err := p.connectCluster(ctx, span, storageClassOptions, secretNamespace, secretName)
+	failedOver := ""
+	if secondary := storageClassOptions[secondarySecretParam]; secondary != "" && isClusterUnavailable(err) {
+		glog.Warningf("Provisioning %s on the cluster of secret %s, the cluster of secret %s is unavailable: %v", share, secondary, secretName, err)
+		p.recorder.Eventf(options.PVC, v1.EventTypeWarning, "FailedOver",
+			"The cluster of secret %s is unavailable, the volume is provisioned on the cluster of secret %s", secretName, secondary)
+		failedOver = secretName
+		secretName = secondary
+		hints.secretName = secondary
+		if secretRef != nil {
+			secretRef = &v1.LocalObjectReference{Name: secretName}
+		} else {
+			storageClassOptions["secretName"] = secretName
+		}
+		secret, cluster, err = p.connectCluster(ctx, span, storageClassOptions, secretNamespace, secretName)
+	}
+	delete(storageClassOptions, secondarySecretParam)
 	if err != nil {
 		return nil, err
 	}
+	name := cluster.name
+	span.SetAttribute("cluster", name)
 
-	name := string(secret.Data["clusterName"][:len(secret.Data["clusterName"])])
-	password := string(secret.Data["clusterPassword"][:len(secret.Data["clusterPassword"])])
-	if err := prepareVstorage(storageClassOptions, name, password); err != nil {
+	if st, statErr := clusterStats.Stat(ctx, name); statErr != nil {
+		glog.Warningf("Unable to check placement of %s on %s: %v", share, name, statErr)
+	} else if err = vzstorage.CheckPlacement(attrs, st.Hosts); err != nil {
+		p.recorder.Event(options.PVC, v1.EventTypeWarning, "PlacementImpossible", err.Error())
 		return nil, err
 	}
 
-	if err := createPloop(mountDir+name, storageClassOptions); err != nil {
+	release, err := p.overcommit.reserve(ctx, cluster, options.PVName, bytes)
+	if err != nil {
+		p.recorder.Event(options.PVC, v1.EventTypeWarning, "OvercommitLimit", err.Error())
+		return nil, err
+	}
+	defer func() { release(err == nil) }()
+
+	if deltasPath := storageClassOptions["deltasPath"]; deltasPath != "" {
+		// only the chosen directory is kept in the PV, so that Delete and
+		// ploop-flexvol find the image
+		chosen, err := p.deltas.Pick(mountDir+name, deltasPath)
+		if err != nil {
+			return nil, err
+		}
+		storageClassOptions["deltasPath"] = chosen
+	}
+	if err := applyLayout(storageClassOptions, options.PVC); err != nil {
 		return nil, err
 	}
 
 	finalizer := fmt.Sprintf("virtuozzo.com/%s-pv", uuid.NewUUID())
 	storageClassOptions["clusterName"] = name
 	storageClassOptions["finalizer"] = finalizer
+
+	// the journal entry is marked provisioned when the volume is returned
+	// and removed by runJournal once its PV is created
+	entry := &journal.Entry{
+		PV:              options.PVName,
+		SecretNamespace: secretNamespace,
+		SecretName:      secretName,
+		Options:         storageClassOptions,
+		Time:            time.Now(),
+	}
+	s := span.Child("journal.write")
+	err = p.startJournal(mountDir+name, share, entry)
+	s.End(err)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			journal.Remove(journalPath(mountDir+name), share)
+			return
+		}
+		entry.Provisioned = true
+		if e := journal.Write(journalPath(mountDir+name), share, entry); e != nil {
+			glog.Warningf("Unable to mark %s provisioned in the journal: %v", share, e)
+		}
+	}()
+
+	s = span.Child("ploop.create")
+	err = vzvolume.CreateVolume(ctx, mountDir+name, storageClassOptions, p.attrs.get(name))
+	s.End(err)
+	if err != nil {
+		// pause the cluster, so that the retry fails over right away
+		if isClusterUnavailable(err) {
+			p.health.markUnavailable(cluster, secret, err)
+		}
+		return nil, err
+	}
+	if image != nil {
+		s = span.Child("ploop.populate")
+		err = populate(mountDir+name, storageClassOptions, image, uint64(bytes))
+		s.End(err)
+		if err != nil {
+			if e := removePloop(ctx, mountDir+name, storageClassOptions); e != nil {
+				p.cleanup.add(share, cleanupEntry{
+					SecretNamespace: secretNamespace,
+					SecretName:      secretName,
+					Options:         storageClassOptions,
+					LastError:       e.Error(),
+				})
+			}
+			return nil, err
+		}
+		p.recorder.Eventf(options.PVC, v1.EventTypeNormal, "Populated", "The volume is populated from image %s", image.name)
+	}
+
 	pv := &v1.PersistentVolume{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: options.PVName,
 			Annotations: map[string]string{
 				parentProvisionerAnn: *provisionerID,
 				vzShareAnn:           share,
+				allocationAnn:        allocation,
+				clusterAnn:           name,
+				requestedSizeAnn:     capacity.String(),
 			},
 		},
 		Spec: v1.PersistentVolumeSpec{
@@ -357,120 +518,355 @@ func (p *vzFSProvisioner) Provision(options controller.VolumeOptions) (*v1.Persi
 		},
 	}
 
-	newSecret, err := copySecret(secret)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to copy secret %s: %v", secret.Name, err)
+	if failedOver != "" {
+		pv.Annotations[failedOverAnn] = failedOver
+	}
+	if profile != "" {
+		pv.Annotations[profileAnn] = profile
+	}
+	for attr, v := range attrs.Marshal() {
+		pv.Annotations[attrAnnPrefix+attr] = v
+	}
+	if err := writeBundle(mountDir+name, boundVolume(pv, options.PVC)); err != nil {
+		glog.Warningf("Unable to write files describing %s: %v", share, err)
 	}
-	idx := -1
-	for i, f := range newSecret.Finalizers {
-		if f == finalizer {
-			idx = i
-			break
+	metadata.apply(pv)
+	if size, err := vzvolume.ImageSize(mountDir+name, storageClassOptions); err == nil {
+		pv.Annotations[imageSizeAnn] = resource.NewQuantity(size, resource.BinarySI).String()
+	} else {
+		glog.Warningf("Unable to get the image size of %s: %v", share, err)
+	}
+
+	s = span.Child("api.add-finalizer")
+	err = p.finalizers.add(secretNamespace, secretName, finalizer)
+	s.End(err)
+	if err != nil {
+		glog.Errorf("Failed to update finalizers in secret: %s", secretName)
+		if e := removePloop(ctx, mountDir+name, storageClassOptions); e != nil {
+			err = fmt.Errorf("Add finalizer error: %v; cleanup ploop-volume error: %v", err, e)
+			p.cleanup.add(share, cleanupEntry{
+				SecretNamespace: secretNamespace,
+				SecretName:      secretName,
+				Options:         storageClassOptions,
+				LastError:       e.Error(),
+			})
 		}
+		return nil, err
 	}
-	if idx == -1 {
-		newSecret.Finalizers = append(newSecret.Finalizers, finalizer)
-		if err = p.patchSecret(secret, newSecret); err != nil {
-			glog.Errorf("Failed to update finalizers in secret: %s", secretName)
-			if e := removePloop(mountDir+name, storageClassOptions); e != nil {
-				err = fmt.Errorf("Add finalizer error: %v; cleanup ploop-volume error: %v", err, e)
-			}
-			return nil, err
+	if *localityLabel != "" {
+		s = span.Child("vstorage.locality")
+		l, err := p.locality(ctx, name, mountDir+name, storageClassOptions, *localityLabel)
+		if err == nil && l != nil {
+			err = setLocality(pv, l)
+		}
+		s.End(err)
+		if err != nil {
+			glog.Warningf("Unable to publish locality of %s: %v", share, err)
 		}
 	}
 	glog.Infof("successfully created virtuozzo storage share: %s", share)
 	return pv, nil
 }
 
+// volumeSecret returns namespace and name of the secret with credentials
+// of the cluster the volume is located in
+func volumeSecret(volume *v1.PersistentVolume) (string, string) {
+	options := volume.Spec.PersistentVolumeSource.FlexVolume.Options
+	if options["optionsFromSystem"] == "true" {
+		return "kube-system", options["secretName"]
+	}
+	return volume.Spec.ClaimRef.Namespace, volume.Spec.PersistentVolumeSource.FlexVolume.SecretRef.Name
+}
+
 // Delete removes the storage asset that was created by Provision represented
 // by the given PV.
 func (p *vzFSProvisioner) Delete(volume *v1.PersistentVolume) error {
+	volume, changed := p.records.restore(volume)
+	if len(changed) != 0 {
+		glog.Warningf("Inventory of %s was changed on the PV (%s), using the recorded one", volume.Name, strings.Join(changed, ", "))
+		p.recorder.Eventf(volume, v1.EventTypeWarning, "InventoryRestored", "Changed %s on the PV, deleting the recorded volume", strings.Join(changed, ", "))
+	}
+	if p.deferred != nil && volume.Annotations[parentProvisionerAnn] == *provisionerID {
+		err := p.deferred.add(volume)
+		p.recordDelete("DeferDelete", volume, err)
+		return err
+	}
+	err := p.operations.run("Delete "+volume.Name, func(ctx context.Context) error {
+		return p.delete(ctx, volume)
+	})
+	if _, ok := err.(*controller.IgnoredError); !ok {
+		p.recordDelete("Delete", volume, err)
+	}
+	return err
+}
+
+func (p *vzFSProvisioner) recordDelete(op string, volume *v1.PersistentVolume, err error) {
+	claim := ""
+	if ref := volume.Spec.ClaimRef; ref != nil {
+		claim = fmt.Sprintf("%s/%s", ref.Namespace, ref.Name)
+	}
+	p.audit.record(op, volume.Name, claim, volume.Annotations[vzShareAnn], err)
+	p.history.add(volume.Spec.ClaimRef, volume.Name, op, err, op == "Delete" && err == nil)
+
+	switch {
+	case err != nil:
+		p.records.update(volume, volumeDeleteFailed, err)
+	case op == "DeferDelete":
+		p.records.update(volume, volumeDeletePending, nil)
+	case op == "Undelete":
+		p.records.update(volume, volumeProvisioned, nil)
+	default:
+		p.records.remove(volume.Name)
+	}
+}
+
+// deleteCluster mounts the cluster of a volume being deleted. If its secret
+// can't be read, e.g. while the API server is unavailable, the last read
+// version of the secret is used, or the cluster named in the options if it
+// is already mounted.
+func (p *vzFSProvisioner) deleteCluster(ctx context.Context, span *trace.Span, options map[string]string, namespace, name string) (*vstorageCluster, error) {
+	s := span.Child("api.get-secret")
+	secret, err := tenantSecrets.get(namespace, name)
+	s.End(err)
+	if err != nil {
+		cached, ok := tenantSecrets.cached(namespace, name)
+		if !ok {
+			clusterName := options["clusterName"]
+			if mounted, _ := vstorage.IsVstorage(mountDir + clusterName); clusterName == "" || !mounted {
+				return nil, err
+			}
+			glog.Warningf("Unable to get secret %s/%s, deleting from mounted cluster %s: %v", namespace, name, clusterName, err)
+			if err := p.health.check(clusterName); err != nil {
+				return nil, err
+			}
+			return &vstorageCluster{name: clusterName}, nil
+		}
+		glog.Warningf("Unable to get secret %s/%s, using its cached version: %v", namespace, name, err)
+		secret = cached
+	}
+
+	cluster, err := clusterFromSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.prepareVstorageTraced(ctx, span, options, cluster, secret); err != nil {
+		return nil, err
+	}
+	return cluster, nil
+}
+
+func (p *vzFSProvisioner) delete(ctx context.Context, volume *v1.PersistentVolume) (err error) {
 	ann, ok := volume.Annotations[parentProvisionerAnn]
 	if !ok {
 		return errors.New("Parent provisioner name annotation not found on PV")
 	}
 	if ann != *provisionerID {
-		return &controller.IgnoredError{"parent provisioner name annotation on PV does not match ours"}
+		return &controller.IgnoredError{Reason: "parent provisioner name annotation on PV does not match ours"}
 	}
 	share, ok := volume.Annotations[vzShareAnn]
 	if !ok {
 		return errors.New("vz share annotation not found on PV")
 	}
 
-	var secretName string
+	span := tracer.Start("Delete")
+	span.SetAttribute("pv", volume.Name)
+	defer func() { span.End(err) }()
+
 	options := volume.Spec.PersistentVolumeSource.FlexVolume.Options
+	secretNamespace, secretName := volumeSecret(volume)
 
-	optionsFromSystem := options["optionsFromSystem"]
-	secretNamespace := volume.Spec.ClaimRef.Namespace
+	hints := &hintContext{secretNamespace, secretName, options}
+	defer func() { err = hints.explain(err) }()
 
-	if optionsFromSystem == "true" {
-		secretNamespace = "kube-system"
-		secretName = options["secretName"]
-	} else {
-		secretName = volume.Spec.PersistentVolumeSource.FlexVolume.SecretRef.Name
-	}
-
-	secret, err := p.client.Core().Secrets(secretNamespace).Get(secretName, metav1.GetOptions{})
+	cluster, err := p.deleteCluster(ctx, span, options, secretNamespace, secretName)
 	if err != nil {
 		return err
 	}
+	span.SetAttribute("cluster", cluster.name)
+	mount := mountDir + cluster.name
 
-	name := string(secret.Data["clusterName"][:len(secret.Data["clusterName"])])
-	password := string(secret.Data["clusterPassword"][:len(secret.Data["clusterPassword"])])
-	mount := mountDir + name
-	if err := prepareVstorage(options, name, password); err != nil {
-		return err
+	gone := false
+	if !*strictDelete {
+		if gone, err = volumeGone(mount, options); err != nil {
+			return err
+		}
 	}
-
-	if err = removePloop(mount, options); err != nil {
+	if gone {
+		glog.Warningf("Image of %s is already gone, removing leftovers", volume.Name)
+		p.recorder.Event(volume, v1.EventTypeWarning, "VolumeMissing", "The image was removed out of band, the volume is deleted anyway")
+		ploopPath, imageDir := vzvolume.Paths(mount, options)
+		if err = vzvolume.WipeImage(ctx, imageDir, options[secureDeleteParam]); err != nil {
+			return err
+		}
+		for _, d := range []string{ploopPath, ploopPath + ".deleted", imageDir} {
+			if err = os.RemoveAll(d); err != nil {
+				return err
+			}
+		}
+	} else {
+		s := span.Child("ploop.delete")
+		err = removePloop(ctx, mount, options)
+		s.End(err)
+		if err != nil {
+			return err
+		}
+	}
+	if err = removeScheduledSnapshots(mount, options); err != nil {
 		return err
 	}
 
 	defer glog.Infof("successfully delete virtuozzo storage share: %s", share)
 
-	newSecret, err := copySecret(secret)
-	if err != nil {
-		glog.Warningf("Failed to copy secret %s: %v", secret.Name, err)
-		return nil
-	}
 	finalizer, ok := options["finalizer"]
 	if !ok {
 		glog.Warningf("Unable to find finalizer in flexvolume %s options", volume.Name)
 		return nil
 	}
-	idx := -1
-	for i, f := range newSecret.Finalizers {
-		if f == finalizer {
-			idx = i
-			break
-		}
-	}
-	if idx == -1 {
-		glog.Warningf("Cannot find finalizer %s in secret %s: %v", finalizer, secretName)
-		return nil
-	}
-
-	newSecret.Finalizers = append(newSecret.Finalizers[:idx], newSecret.Finalizers[idx+1:]...)
-	if err = p.patchSecret(secret, newSecret); err != nil {
-		glog.Warningf("Failed to update finalizers in secret %s: %v", secretName, err)
+	// the volume is gone, so the finalizer is removed in background if
+	// the secret can't be updated now
+	s := span.Child("api.remove-finalizer")
+	err = p.finalizers.remove(secretNamespace, secretName, finalizer)
+	s.End(err)
+	if err != nil && !apierrors.IsNotFound(err) {
+		glog.Warningf("Failed to update finalizers in secret %s, will retry: %v", secretName, err)
+		p.finalizers.removeLater(secretNamespace, secretName, finalizer)
 	}
 
 	return nil
 }
 
 var (
-	master          = flag.String("master", "", "Master URL")
-	kubeconfig      = flag.String("kubeconfig", "", "Absolute path to the kubeconfig")
-	provisionerID   = flag.String("id", "", "Unique provisioner id")
-	provisionerName = flag.String("name", "virtuozzo.com/virtuozzo-storage", "Unique provisioner name")
+	master                = flag.String("master", "", "Master URL")
+	kubeconfig            = flag.String("kubeconfig", "", "Absolute path to the kubeconfig")
+	provisionerID         = flag.String("id", "", "Unique provisioner id")
+	provisionerName       = flag.String("name", "virtuozzo.com/virtuozzo-storage", "Unique provisioner name")
+	auditLogPath          = flag.String("audit-log", "", "Path to a file to append the audit trail of volume operations to. Disabled if empty")
+	metricsAddress        = flag.String("metrics-address", "", "The address to expose Prometheus metrics on, e.g. :9100. Disabled if empty")
+	capacityPoll          = flag.Duration("capacity-poll-interval", time.Minute, "How often to query capacity of mounted clusters for metrics")
+	namespace             = flag.String("namespace", "kube-system", "Namespace to keep provisioner state in")
+	publishCapacity       = flag.Duration("storage-capacity-interval", 0, "How often to publish available capacity of StorageClasses for a scheduler extender. Disabled if 0")
+	reconcilePeriod       = flag.Duration("capacity-reconcile-interval", 10*time.Minute, "How often to compare PV capacity against image sizes. Disabled if 0")
+	replicaCheckPeriod    = flag.Duration("replica-check-interval", 10*time.Minute, "How often to count chunk replicas of images of volumes with vzsReplicas. Disabled if 0")
+	replicaDegradedAfter  = flag.Duration("replica-degraded-threshold", 30*time.Minute, "How long chunks of an image may have fewer replicas than vzsReplicas before a ReplicasDegraded event is emitted")
+	strictParameters      = flag.Bool("strict-parameters", false, "Fail provisioning if a StorageClass has unknown parameters")
+	advicePeriod          = flag.Duration("maintenance-advice-interval", 0, "How often to measure images of all volumes and publish those which would benefit from compaction most. Disabled if 0")
+	adviceTop             = flag.Int("maintenance-advice-top", 50, "Number of volumes published by -maintenance-advice-interval")
+	fixCapacity           = flag.Bool("fix-capacity", false, "Update capacity of PVs to sizes of their images if they differ")
+	exportPV              = flag.String("export-recipe", "", "Print a YAML recipe to recreate the given PV with and exit")
+	copyPV                = flag.String("copy-volume", "", "Copy the image of the given PV to the cluster of -copy-to, print a manifest of a PV of the copy and exit")
+	recoverSecret         = flag.String("recover-volumes", "", "Print PVs of volumes on the cluster of the given secret, as namespace/name, whose PVs are gone and exit")
+	recoverPaths          = flag.String("recover-paths", "", "Comma separated directories to scan with -recover-volumes, relative to the cluster root, volumePath of the storage classes using the secret by default")
+	recoverApply          = flag.Bool("recover-apply", false, "Create the PVs printed by -recover-volumes")
+	copyTo                = flag.String("copy-to", "", "Secret of the cluster to copy a volume to with -copy-volume, as namespace/name")
+	replicationPeriod     = flag.Duration("replication-interval", 0, "How often to replicate volumes of StorageClasses with a DR peer. Disabled if 0")
+	deleteGracePeriod     = flag.Duration("delete-grace-period", 0, "How long to keep images of released volumes, so that they can be undeleted. Disabled if 0")
+	watchNamespaces       = flag.String("watch-namespaces", "", "Comma separated namespaces to serve claims of, for a provisioner dedicated to them. Claims of all namespaces are served if empty")
+	classSelector         = flag.String("storageclass-selector", "", "Label selector of StorageClasses to serve, for several provisioners with the same name. All classes are served if empty")
+	operationTimeout      = flag.Duration("operation-timeout", 10*time.Minute, "How long Provision and Delete may take before their vstorage and ploop subprocesses are killed and the operation fails. Disabled if 0")
+	overcommitLimit       = flag.Float64("overcommit-ratio", 0, "Maximum capacity of volumes on a cluster relative to its total space, unless set by overcommitRatio in the cluster secret. Unlimited if 0")
+	standbyMode           = flag.Bool("standby", false, "Run replicas of the provisioner as warm standbys of the one elected active, for fast failover")
+	handoffTimeout        = flag.Duration("handoff-timeout", 30*time.Second, "How long the active replica waits for running operations when it hands off to a standby on SIGTERM")
+	provisionWorkers      = flag.Int("provision-workers", 0, "Maximum number of volumes provisioned at a time. Unlimited if 0")
+	deleteWorkers         = flag.Int("delete-workers", 4, "Maximum number of volumes deleted at a time, independently of -provision-workers. Unlimited if 0")
+	setAttrQPS            = flag.Float64("set-attr-qps", 10, "Maximum rate of vstorage set-attr calls per cluster")
+	setAttrWorkers        = flag.Int("set-attr-workers", 4, "Maximum number of concurrent vstorage set-attr calls per cluster")
+	setAttrQueueSize      = flag.Int("set-attr-queue-size", 100, "Number of vstorage set-attr calls per cluster queued before provisioning blocks")
+	attachPeriod          = flag.Duration("attach-limits-interval", 0, "How often to count ploop volumes attached to nodes, to avoid nodes which reached their limit. Disabled if 0")
+	maxNodeVolumes        = flag.Int("max-volumes-per-node", 32, "Number of ploop volumes a node can attach, unless set by the node annotation virtuozzo.com/max-ploop-volumes")
+	maintenancePerCluster = flag.Int("maintenance-per-cluster", 2, "Maximum number of compactions and verifications running at a time on a cluster")
+	maintenancePerNode    = flag.Int("maintenance-per-node", 1, "Maximum number of compactions and verifications running at a time on volumes used by pods on the same node")
+	maintenanceLatency    = flag.Duration("maintenance-max-io-latency", 0, "Postpone compactions and verifications of volumes used on nodes whose cluster client IO latency is higher, e.g. 50ms. Disabled if 0")
+	mdsProxy              = flag.String("mds-proxy", "", "Proxy through which MDS servers of clusters with mdsAddresses but no mdsProxy in their secret are reached, socks5://[user:password@]host:port or http://[user:password@]host:port")
+	mountOptions          = flag.String("vstorage-mount-options", "", "Extra vstorage-mount arguments of clusters whose secret has no mountOptions, e.g. cache and readahead settings")
+	traceEndpoint         = flag.String("trace-endpoint", "", "OTLP HTTP endpoint of an OpenTelemetry collector to export traces of volume operations to, e.g. http://otel-collector:4318. Disabled if empty")
+	tracePeriod           = flag.Duration("trace-export-interval", 5*time.Second, "How often to export traces")
+	policyConfigMap       = flag.String("namespace-policy", "", "Name of a config map in -namespace with StorageClasses, tiers and replicas allowed per namespace. Disabled if empty")
+	strictDelete          = flag.Bool("strict-delete", false, "Fail deletion of volumes whose images are already gone instead of deleting them with a warning")
+	compactRate           = flag.String("compact-rate", "", "How fast a single compaction may reclaim space, in bytes per second like 50Mi. Unlimited if empty")
+	compactClusterRate    = flag.String("compact-cluster-rate", "", "How fast all compactions on a cluster whose secret has no compactClusterRate may reclaim space together, in bytes per second like 200Mi. Unlimited if empty")
+	mergeWindow           = flag.String("merge-window", "", "Daily UTC window in which deleted snapshots are merged, like 01:00-05:00. Any time if empty")
+	authCacheTTL          = flag.Duration("auth-cache-ttl", 10*time.Minute, "How long a successful vstorage authentication in a cluster is reused for its mounts, 0 to authenticate before every mount")
+	mountWorkers          = flag.Int("mount-workers", 4, "Number of clusters mounted in parallel at startup")
+	mountQPS              = flag.Float64("mount-qps", 2, "Maximum rate of cluster mounts at startup")
+	showVersion           = flag.Bool("version", false, "Print version and exit")
+	secretAccessMode      = flag.String("secret-access", secretAccessDirect, "How to access cluster secrets outside of -namespace: direct, or impersonate to read them as the -secret-reader service account of their namespace")
+	secretReader          = flag.String("secret-reader", "vz-secret-reader", "Service account impersonated in every namespace to access its secrets with -secret-access=impersonate")
+	legacyVolumes         = flag.String("legacy-volumes", legacyWarn, "What to do at startup with volumes provisioned by older versions without the annotations and finalizers of the current ones: ignore, warn or adopt them")
+	keepVolumeRecords     = flag.Bool("volume-records", true, "Keep a config map in -namespace describing every provisioned volume")
+	volumeHistorySize     = flag.Int("volume-history", 50, "Number of operations kept in the history of every volume, in a config map in the namespace of its claim. Disabled if 0")
+	volumeHistoryKeep     = flag.Duration("volume-history-retention", 30*24*time.Hour, "How long to keep histories of deleted volumes")
+	localityLabel         = flag.String("locality-label", "", "Node label to prefer nodes holding volume replicas by, e.g. kubernetes.io/hostname. Disabled if empty")
 )
 
 func main() {
 	flag.Parse()
 	flag.Set("logtostderr", "true")
+	if *showVersion {
+		fmt.Println(versionString())
+		return
+	}
+	glog.Infof("Starting %s", versionString())
 	if *provisionerID == "" {
 		glog.Fatalf("You should provide unique provisioner name!")
 	}
+	if *setAttrQPS <= 0 || *setAttrWorkers <= 0 || *setAttrQueueSize < 0 {
+		glog.Fatalf("set-attr-qps and set-attr-workers must be positive, set-attr-queue-size can't be negative")
+	}
+	if *mountQPS <= 0 || *mountWorkers <= 0 {
+		glog.Fatalf("mount-qps and mount-workers must be positive")
+	}
+	if *operationTimeout < 0 {
+		glog.Fatalf("operation-timeout can't be negative")
+	}
+	if *provisionWorkers < 0 || *deleteWorkers < 0 {
+		glog.Fatalf("provision-workers and delete-workers can't be negative")
+	}
+	if *overcommitLimit < 0 {
+		glog.Fatalf("overcommit-ratio can't be negative")
+	}
+	compactVolumeLimit, rateErr := parseRate(*compactRate)
+	if rateErr != nil {
+		glog.Fatalf("Invalid compact-rate: %v", rateErr)
+	}
+	if compactClusterLimit, rateErr = parseRate(*compactClusterRate); rateErr != nil {
+		glog.Fatalf("Invalid compact-cluster-rate: %v", rateErr)
+	}
+	var window *cron.Window
+	if *mergeWindow != "" {
+		var windowErr error
+		if window, windowErr = cron.ParseWindow(*mergeWindow); windowErr != nil {
+			glog.Fatalf("Invalid merge-window: %v", windowErr)
+		}
+	}
+	if *authCacheTTL < 0 {
+		glog.Fatalf("auth-cache-ttl can't be negative")
+	}
+	if *authCacheTTL != 0 {
+		clusterAuth = newAuthCache(*authCacheTTL)
+	}
+	if *mdsProxy != "" {
+		if _, err := vzstorage.ParseProxy(*mdsProxy); err != nil {
+			glog.Fatalf("Invalid mds-proxy: %v", err)
+		}
+	}
+	if *adviceTop <= 0 {
+		glog.Fatalf("maintenance-advice-top must be positive")
+	}
+	if *volumeHistorySize < 0 {
+		glog.Fatalf("volume-history can't be negative")
+	}
+	switch *legacyVolumes {
+	case legacyIgnore, legacyWarn, legacyAdopt:
+	default:
+		glog.Fatalf("Unknown legacy-volumes %q, expected %s, %s or %s", *legacyVolumes, legacyIgnore, legacyWarn, legacyAdopt)
+	}
+	if *maintenancePerCluster <= 0 || *maintenancePerNode <= 0 {
+		glog.Fatalf("maintenance-per-cluster and maintenance-per-node must be positive")
+	}
+	if *traceEndpoint != "" {
+		tracer = trace.NewTracer(*traceEndpoint, "vzstorage-pd", *tracePeriod)
+		go tracer.Run(glog.Warningf)
+	}
 
 	var config *rest.Config
 	var err error
@@ -487,6 +883,14 @@ func main() {
 	if err != nil {
 		glog.Fatalf("Failed to create client: %v", err)
 	}
+	switch *secretAccessMode {
+	case secretAccessDirect:
+		tenantSecrets = newSecretAccess(clientset, nil, *namespace, "")
+	case secretAccessImpersonate:
+		tenantSecrets = newSecretAccess(clientset, config, *namespace, *secretReader)
+	default:
+		glog.Fatalf("Unknown secret-access %q, expected %s or %s", *secretAccessMode, secretAccessDirect, secretAccessImpersonate)
+	}
 
 	// The controller needs to know what the server version is because out-of-tree
 	// provisioners aren't officially supported until 1.5
@@ -497,14 +901,183 @@ func main() {
 
 	// Create the provisioner: it implements the Provisioner interface expected by
 	// the controller
-	vzFSProvisioner := newVzFSProvisioner(clientset)
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&corev1.EventSinkImpl{Interface: clientset.Core().Events(v1.NamespaceAll)})
+	recorder := broadcaster.NewRecorder(api.Scheme, v1.EventSource{Component: *provisionerName})
+
+	cleanup := newCleanupQueue(clientset, *namespace, *provisionerID+"-cleanup")
+	vzFSProvisioner := newVzFSProvisioner(clientset, newAuditLog(*auditLogPath), cleanup, recorder)
+	vzFSProvisioner.maintenance = newMaintenance(clientset, *maintenancePerCluster, *maintenancePerNode, *maintenanceLatency)
+	vzFSProvisioner.merges = newMerger(vzFSProvisioner, clientset, *namespace, *provisionerID+"-snapshot-merges", window)
+	if *deleteGracePeriod != 0 {
+		vzFSProvisioner.deferred = newDeferredDeletes(vzFSProvisioner, clientset, *namespace, deferredDeletesName(), *deleteGracePeriod)
+	}
+	if *attachPeriod != 0 {
+		vzFSProvisioner.attach = newAttachLimits(clientset, *namespace, *provisionerID+"-attach-limits", *maxNodeVolumes)
+	}
+	vzFSProvisioner.compactBudgets = newCompactBudgets(compactVolumeLimit)
+	if *keepVolumeRecords {
+		vzFSProvisioner.records = newVolumeRecords(clientset, *namespace)
+	}
+	if *volumeHistorySize != 0 {
+		vzFSProvisioner.history = newVolumeHistories(clientset, *volumeHistorySize, *volumeHistoryKeep)
+	}
+	if *policyConfigMap != "" {
+		vzFSProvisioner.policy = newNamespacePolicy(clientset, *namespace, *policyConfigMap)
+	}
+	if *copyPV != "" {
+		if *copyTo == "" {
+			glog.Fatalf("copy-volume needs copy-to")
+		}
+		if err := vzFSProvisioner.copyVolume(*copyPV, *copyTo, os.Stdout); err != nil {
+			glog.Fatalf("Unable to copy %s: %v", *copyPV, err)
+		}
+		return
+	}
+	if *recoverSecret != "" {
+		var roots []string
+		if *recoverPaths != "" {
+			roots = strings.Split(*recoverPaths, ",")
+		}
+		if err := vzFSProvisioner.recoverVolumes(*recoverSecret, roots, *recoverApply, os.Stdout); err != nil {
+			glog.Fatalf("Unable to recover volumes: %v", err)
+		}
+		return
+	}
+	if *exportPV != "" {
+		if err := vzFSProvisioner.exportRecipe(*exportPV, os.Stdout); err != nil {
+			glog.Fatalf("Unable to export %s: %v", *exportPV, err)
+		}
+		return
+	}
+	if *metricsAddress != "" {
+		http.Handle("/metrics", metrics.Handler())
+		http.HandleFunc("/version", serveVersion)
+		if vzFSProvisioner.attach != nil {
+			http.HandleFunc("/scheduler/filter", vzFSProvisioner.attach.serveFilter)
+		}
+		if *localityLabel != "" {
+			http.HandleFunc("/scheduler/prioritize", vzFSProvisioner.serveLocality)
+		}
+		go func() {
+			glog.Fatalf("Metrics server failed: %v", http.ListenAndServe(*metricsAddress, nil))
+		}()
+		runCapacityPoller(*capacityPoll)
+		go vzFSProvisioner.overcommit.run(*capacityPoll)
+	}
 
 	// Start the provision controller which will dynamically provision Virtuozzo Storage PVs
+	options := []func(*controller.ProvisionController) error{
+		controller.ProvisionWorkers(*provisionWorkers),
+		controller.DeleteWorkers(*deleteWorkers),
+	}
+	if *watchNamespaces != "" {
+		namespaces, nsErr := parseNamespaces(*watchNamespaces)
+		if nsErr != nil {
+			glog.Fatalf("Invalid -watch-namespaces: %v", nsErr)
+		}
+		watchedNamespaces = namespaces
+		options = append(options, controller.Namespaces(namespaces))
+	}
+	var sh *shard
+	if *classSelector != "" {
+		selector, err := labels.Parse(*classSelector)
+		if err != nil {
+			glog.Fatalf("Invalid storage class selector %q: %v", *classSelector, err)
+		}
+		sh = &shard{client: clientset, selector: selector}
+		options = append(options, controller.StorageClassFilter(sh.serves))
+	}
+
 	pc := controller.NewProvisionController(clientset,
 		*provisionerName,
 		vzFSProvisioner,
 		serverVersion.GitVersion,
+		options...,
 	)
+	if *metricsAddress != "" {
+		runQueuePoller(pc)
+	}
+
+	// lead starts everything which changes volumes, which only the active
+	// replica does
+	lead := func(stop <-chan struct{}) {
+		vzFSProvisioner.journalSince = time.Now()
+		go cleanup.run(cleanupPeriod)
+		go vzFSProvisioner.finalizers.runRetries(finalizerRetryPeriod)
+		go vzFSProvisioner.runJournal(journalPeriod)
+		go vzFSProvisioner.runCompactor(compactPeriod)
+		go vzFSProvisioner.runVerifier(verifyPeriod)
+		go vzFSProvisioner.runBackups(backupPeriod)
+		go vzFSProvisioner.runScheduledSnapshots(scheduledSnapshotsPeriod)
+		go vzFSProvisioner.merges.run(mergePeriod)
+		go vzFSProvisioner.runBundleRefresh(bundleRefreshPeriod)
+		go vzFSProvisioner.records.migrate()
+		if *advicePeriod != 0 {
+			go vzFSProvisioner.runMaintenanceAdvisor(*advicePeriod, *adviceTop)
+		}
+		if *reconcilePeriod != 0 {
+			go vzFSProvisioner.runCapacityReconciler(*reconcilePeriod, *fixCapacity)
+		}
+		if *replicaCheckPeriod != 0 {
+			go newReplicaHealth(vzFSProvisioner, *replicaDegradedAfter).run(*replicaCheckPeriod)
+		}
+		if *publishCapacity != 0 {
+			go newStorageCapacities(clientset, *namespace, *provisionerID+"-storage-capacity", vzFSProvisioner.profiles).run(*publishCapacity)
+		}
+		if vzFSProvisioner.deferred != nil {
+			go vzFSProvisioner.deferred.run(deferredDeletePeriod)
+		}
+		if vzFSProvisioner.history != nil {
+			go vzFSProvisioner.history.run(volumeHistoryPeriod)
+		}
+		if vzFSProvisioner.attach != nil {
+			go vzFSProvisioner.attach.run(*attachPeriod)
+		}
+		if *replicationPeriod != 0 {
+			r := newReplicator(vzFSProvisioner, clientset, *namespace, *provisionerID+"-replication")
+			go r.run(*replicationPeriod)
+		}
+		if sh != nil {
+			go sh.run(shardPeriod)
+		}
+		pc.Run(stop)
+	}
+	bringUp := func() {
+		vzFSProvisioner.bringUpClusters(*mountWorkers, float32(*mountQPS))
+	}
 
-	pc.Run(wait.NeverStop)
+	if !*standbyMode {
+		// Upgrade volumes of older versions, rebuild cluster mounts which
+		// were torn while we were not running and mount known clusters
+		// without blocking startup on them
+		go func() {
+			vzFSProvisioner.adoptLegacyVolumes(*legacyVolumes)
+			bringUp()
+		}()
+		lead(wait.NeverStop)
+		return
+	}
+
+	identity, err := os.Hostname()
+	if err != nil {
+		glog.Fatalf("Unable to get hostname: %v", err)
+	}
+	sb := &standby{
+		client:   clientset,
+		recorder: recorder,
+		identity: identity,
+		warmUp:   bringUp,
+		lead: func(stop <-chan struct{}) {
+			go vzFSProvisioner.adoptLegacyVolumes(*legacyVolumes)
+			lead(stop)
+		},
+		drained: func() bool {
+			return pc.ProvisionQueue() == controller.QueueDepth{} &&
+				pc.DeleteQueue() == controller.QueueDepth{} &&
+				vzFSProvisioner.operations.idle()
+		},
+		handoff: *handoffTimeout,
+	}
+	sb.run()
 }
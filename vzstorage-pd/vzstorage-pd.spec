@@ -112,7 +112,7 @@ mkdir -p $(dirname $DIR)
 ln -s ../../../ $DIR
 GOPATH=`pwd`
 cd $GOPATH/$DIR/%{name}
-make
+make VERSION=%{version}-%{release} GITID=%{commit}
 
 
 %install